@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// bundleSuffixes maps the suffixes a -bundle file may have to the
+// -compress method that suffix means.
+var bundleSuffixes = []struct{ suffix, method string }{
+	{".tar", "none"},
+	{".tar.gz", "gzip"},
+	{".tgz", "gzip"},
+	{".tar.lz4", "lz4"},
+	{".tar.zst", "zstd"},
+	{".tzst", "zstd"},
+}
+
+// bundleCompression returns the compression method the name of a bundle
+// file asks for, and its name without the suffix.
+func bundleCompression(name string) (method, base string, err error) {
+	for _, s := range bundleSuffixes {
+		if strings.HasSuffix(name, s.suffix) {
+			return s.method, strings.TrimSuffix(filepath.Base(name), s.suffix), nil
+		}
+	}
+	return "", "", fmt.Errorf("bundle name %q should end in .tar, .tar.gz, .tar.lz4, or .tar.zst", name)
+}
+
+// debugFileDir is where distributions install separate debug files, by
+// build ID under .build-id.
+const debugFileDir = "/usr/lib/debug"
+
+// writeBundle writes a tar file to name holding the core at corePath and
+// what gdb needs to debug it on another machine: the ELF files the core's
+// NT_FILE note lists, under root/ at their paths, read as pid mapped them
+// if it's still running; their separate debug files, if installed under
+// /usr/lib/debug; the core's manifest, if -checksum wrote one; and a
+// gdbinit that points gdb at them. Everything is in a directory named
+// after the bundle.
+func writeBundle(name, corePath string, pid int) (err error) {
+	method, dir, err := bundleCompression(name)
+	if err != nil {
+		return err
+	}
+	cr, err := elfcore.OpenCore(corePath)
+	if err != nil {
+		// A compressed core can't be read, so nothing but the core
+		// itself can be found to bundle.
+		return fmt.Errorf("failed to read core to find the files to bundle: %w", err)
+	}
+	info := cr.Info()
+	cr.Close()
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed to close bundle: %w", cerr)
+		}
+		if err != nil {
+			os.Remove(name)
+		}
+	}()
+	var w io.Writer = f
+	if method != "none" {
+		cw, err := compressWriter(method, f)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := cw.Close(); err == nil && cerr != nil {
+				err = fmt.Errorf("failed to finish compressing bundle: %w", cerr)
+			}
+		}()
+		w = cw
+	}
+	tw := tar.NewWriter(w)
+
+	coreName := filepath.Base(corePath)
+	if err := addBundleFile(tw, path.Join(dir, coreName), corePath); err != nil {
+		return err
+	}
+	if _, err := os.Stat(corePath + manifestSuffix); err == nil {
+		if err := addBundleFile(tw, path.Join(dir, coreName+manifestSuffix), corePath+manifestSuffix); err != nil {
+			return err
+		}
+	}
+
+	buildIDs := make(map[string]string)
+	for _, b := range info.BuildIDs {
+		buildIDs[b.Path] = hex.EncodeToString(b.ID)
+	}
+	exe := bundleExecutable(info)
+	seen := make(map[string]bool)
+	var files, debugFiles int
+	for _, fe := range info.FileTable {
+		p := strings.TrimSuffix(fe.Path, " (deleted)")
+		if seen[p] || !filepath.IsAbs(p) {
+			continue
+		}
+		seen[p] = true
+		// The file as mapped, even if it's since been replaced, or
+		// else whatever is at its path now, as the target sees it:
+		// through its root, should it be in a container, or where
+		// the dump found it outside.
+		src := fmt.Sprintf("/proc/%d/map_files/%x-%x", pid, fe.Start, fe.End)
+		for _, alt := range []string{fmt.Sprintf("/proc/%d/root%s", pid, p), info.HostPaths[p], p} {
+			if _, err := os.Stat(src); err == nil {
+				break
+			}
+			src = alt
+		}
+		id, ok := buildIDs[fe.Path]
+		if !ok {
+			id, ok = fileBuildID(src)
+			if !ok {
+				continue // not ELF, or unreadable
+			}
+		}
+		if err := addBundleFile(tw, path.Join(dir, "root", p), src); err != nil {
+			log.Printf("Warning: not bundling %s: %v", p, err)
+			continue
+		}
+		files++
+		if len(id) > 2 {
+			debug := path.Join(".build-id", id[:2], id[2:]+".debug")
+			if _, err := os.Stat(filepath.Join(debugFileDir, debug)); err == nil {
+				if err := addBundleFile(tw, path.Join(dir, "root", debugFileDir, debug), filepath.Join(debugFileDir, debug)); err != nil {
+					return err
+				}
+				debugFiles++
+			}
+		}
+	}
+
+	var gdbinit strings.Builder
+	fmt.Fprintf(&gdbinit, "# Run gdb -x gdbinit from this directory.\n")
+	fmt.Fprintf(&gdbinit, "set sysroot root\n")
+	fmt.Fprintf(&gdbinit, "set debug-file-directory root%s\n", debugFileDir)
+	if exe != "" && seen[exe] {
+		fmt.Fprintf(&gdbinit, "file root%s\n", exe)
+	}
+	fmt.Fprintf(&gdbinit, "core-file %s\n", coreName)
+	if err := addBundleData(tw, path.Join(dir, "gdbinit"), []byte(gdbinit.String())); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish bundle: %w", err)
+	}
+	log.Printf("Bundled the core with %d files and %d debug files in %s", files, debugFiles, name)
+	return nil
+}
+
+// bundleExecutable returns the path of the executable of the process info
+// describes: the file mapped at its entry point, or else the first file
+// mapped, which usually it is.
+func bundleExecutable(info *elfcore.CoreInfo) string {
+	if len(info.FileTable) == 0 {
+		return ""
+	}
+	if entry, ok := proc.ParseAuxv(info.Auxv)[proc.AT_ENTRY]; ok {
+		for _, fe := range info.FileTable {
+			if uint64(fe.Start) <= entry && entry < uint64(fe.End) {
+				return strings.TrimSuffix(fe.Path, " (deleted)")
+			}
+		}
+	}
+	return strings.TrimSuffix(info.FileTable[0].Path, " (deleted)")
+}
+
+// fileBuildID returns the build ID of the ELF file at name, or "" if it
+// has none, and whether it's a readable ELF file at all.
+func fileBuildID(name string) (string, bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	var magic [4]byte
+	if _, err := f.ReadAt(magic[:], 0); err != nil || string(magic[:]) != "\x7fELF" {
+		return "", false
+	}
+	id, _ := proc.ReadBuildID(f)
+	return id, true
+}
+
+// addBundleFile adds the contents of the file src to tw as name.
+func addBundleFile(tw *tar.Writer, name, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(fi.Mode().Perm()),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("failed to bundle %s: %w", src, err)
+	}
+	return nil
+}
+
+// addBundleData adds data to tw as name.
+func addBundleData(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	_, err := tw.Write(data)
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/bradfitz/livecore"
+)
+
+// checkMain implements "livecore check": it runs the dumper's preflight
+// checks against a process without dumping it, saying how to fix each
+// that fails.
+func checkMain(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check <pid>\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Checks, without stopping the process, that livecore can dump it: its\n")
+		fmt.Fprintf(fs.Output(), "ptrace access, Yama, the target's dumpable flag, memory and pagemap\n")
+		fmt.Fprintf(fs.Output(), "reads, clear_refs, soft-dirty tracking, and seccomp, and says how to\n")
+		fmt.Fprintf(fs.Output(), "fix what's missing.\n")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	pid, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid PID: %w", err)
+	}
+
+	failed := 0
+	for _, r := range livecore.Preflight(pid) {
+		switch {
+		case r.Err == nil:
+			fmt.Printf("ok    %s\n", r.Name)
+			continue
+		case r.Warning:
+			fmt.Printf("warn  %s: %v\n", r.Name, r.Err)
+		default:
+			fmt.Printf("FAIL  %s: %v\n", r.Name, r.Err)
+			failed++
+		}
+		fmt.Printf("      fix: %s\n", r.Fix)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of the checks failed; process %d can't be dumped", failed, pid)
+	}
+	return nil
+}
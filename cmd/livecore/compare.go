@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// compareMain implements "livecore compare": it checks a livecore dump
+// against one from gcore (or the kernel) of the same process, reporting
+// differences in segment coverage, notes, registers, and memory.
+func compareMain(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	gcore := fs.String("gcore", "gcore", "gcore command to take the reference dump with")
+	dir := fs.String("dir", os.TempDir(), "directory to write the dumps to")
+	keep := fs.Bool("keep", false, "keep the dumps rather than deleting them after comparing")
+	maxList := fs.Int("max-list", 10, "maximum differing pages to list per segment")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare [flags] <pid> [-- livecore flags]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s compare [flags] <livecore.core> <reference.core>\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Given a pid, stops the process, dumps it with both livecore and gcore,\n")
+		fmt.Fprintf(fs.Output(), "resumes it, and compares the dumps. Given two cores, compares them.\n")
+		fmt.Fprintf(fs.Output(), "Exits non-zero if they differ.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var lcPath, refPath string
+	switch {
+	case fs.NArg() == 2 && !isPid(fs.Arg(0)):
+		lcPath, refPath = fs.Arg(0), fs.Arg(1)
+	case fs.NArg() >= 1 && isPid(fs.Arg(0)):
+		pid, _ := strconv.Atoi(fs.Arg(0))
+		lcArgs := fs.Args()[1:]
+		if len(lcArgs) > 0 && lcArgs[0] == "--" {
+			lcArgs = lcArgs[1:]
+		}
+		var err error
+		lcPath, refPath, err = dumpForCompare(pid, *dir, *gcore, lcArgs)
+		if !*keep {
+			defer os.Remove(lcPath)
+			defer os.Remove(refPath)
+		}
+		if err != nil {
+			return err
+		}
+		if *keep {
+			fmt.Printf("livecore dump: %s\nreference dump: %s\n", lcPath, refPath)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	diffs, err := compareCores(os.Stdout, lcPath, refPath, *maxList)
+	if err != nil {
+		return err
+	}
+	if diffs > 0 {
+		return fmt.Errorf("dumps differ in %d ways", diffs)
+	}
+	fmt.Println("dumps match")
+	return nil
+}
+
+// isPid reports whether s looks like a process ID.
+func isPid(s string) bool {
+	pid, err := strconv.Atoi(s)
+	return err == nil && pid > 0
+}
+
+// dumpForCompare stops pid, dumps it with livecore (this executable, with
+// lcArgs) and then gcore, and lets it continue. Stopping it first means
+// both dumps see the same state.
+func dumpForCompare(pid int, dir, gcore string, lcArgs []string) (lcPath, refPath string, err error) {
+	lcPath = filepath.Join(dir, fmt.Sprintf("livecore-compare.%d.core", pid))
+	refPath = filepath.Join(dir, fmt.Sprintf("gcore-compare.%d", pid)) // gcore appends the pid
+
+	if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil {
+		return "", "", fmt.Errorf("failed to stop process %d: %w", pid, err)
+	}
+	defer syscall.Kill(pid, syscall.SIGCONT)
+	if err := waitStopped(pid, 5*time.Second); err != nil {
+		return "", "", err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find livecore executable: %w", err)
+	}
+	cmd := exec.Command(exe, append(lcArgs, strconv.Itoa(pid), lcPath)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return lcPath, "", fmt.Errorf("livecore dump failed: %w", err)
+	}
+
+	cmd = exec.Command(gcore, "-o", refPath, strconv.Itoa(pid))
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	refPath += "." + strconv.Itoa(pid)
+	if err := cmd.Run(); err != nil {
+		return lcPath, refPath, fmt.Errorf("gcore dump failed: %w", err)
+	}
+	return lcPath, refPath, nil
+}
+
+// waitStopped waits for pid's main thread to enter group-stop.
+func waitStopped(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := proc.ThreadState(pid, pid)
+		if err != nil {
+			return fmt.Errorf("failed to read state of process %d: %w", pid, err)
+		}
+		if state == 'T' {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("process %d didn't stop within %v (state %c)", pid, timeout, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// compareCores writes a report comparing the livecore dump at lcPath with
+// the reference dump at refPath to w, and returns how many differences it
+// found. Things livecore stores that the reference doesn't aren't
+// differences; it's allowed to store more.
+func compareCores(w io.Writer, lcPath, refPath string, maxList int) (diffs int, err error) {
+	lc, err := elfcore.OpenCore(lcPath)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", lcPath, err)
+	}
+	defer lc.Close()
+	ref, err := elfcore.OpenCore(refPath)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", refPath, err)
+	}
+	defer ref.Close()
+
+	diffs += compareNotes(w, lc.Info(), ref.Info())
+	diffs += compareRegisters(w, lc.Info(), ref.Info())
+	d, err := compareMemory(w, lc, ref, maxList)
+	if err != nil {
+		return 0, err
+	}
+	diffs += d
+	return diffs, nil
+}
+
+// compareNotes reports the standard notes the reference has more of than
+// livecore's dump.
+func compareNotes(w io.Writer, lc, ref *elfcore.CoreInfo) (diffs int) {
+	type key struct {
+		name string
+		typ  elfcore.NoteType
+	}
+	count := func(info *elfcore.CoreInfo) map[key]int {
+		m := make(map[key]int)
+		for _, n := range info.Notes {
+			m[key{n.Name, n.Type}]++
+		}
+		return m
+	}
+	lcNotes, refNotes := count(lc), count(ref)
+
+	fmt.Fprintf(w, "== Notes\n")
+	fmt.Fprintf(w, "%-8s %-26s %8s %9s\n", "OWNER", "TYPE", "LIVECORE", "REFERENCE")
+	var names []elfcore.Note
+	for _, n := range append(slices.Clone(ref.Notes), lc.Notes...) {
+		if !slices.ContainsFunc(names, func(m elfcore.Note) bool { return m.Name == n.Name && m.Type == n.Type }) {
+			names = append(names, n)
+		}
+	}
+	for _, n := range names {
+		k := key{n.Name, n.Type}
+		mark := ""
+		if lcNotes[k] < refNotes[k] {
+			mark = "  <- missing"
+			diffs++
+		}
+		fmt.Fprintf(w, "%-8s %-26s %8d %9d%s\n", n.Name, n.TypeName(), lcNotes[k], refNotes[k], mark)
+	}
+	return diffs
+}
+
+// x86RegNames names the registers in user_regs_struct, in order.
+var x86RegNames = []string{
+	"r15", "r14", "r13", "r12", "rbp", "rbx", "r11", "r10", "r9", "r8",
+	"rax", "rcx", "rdx", "rsi", "rdi", "orig_rax", "rip", "cs", "eflags",
+	"rsp", "ss", "fs_base", "gs_base", "ds", "es", "fs", "gs",
+}
+
+// i386RegNames names the registers in i386's user_regs_struct, which a
+// 32-bit process's core has.
+var i386RegNames = []string{
+	"ebx", "ecx", "edx", "esi", "edi", "ebp", "eax", "ds", "es", "fs", "gs",
+	"orig_eax", "eip", "cs", "eflags", "esp", "ss",
+}
+
+// riscvRegNames names the registers in RISC-V's user_regs_struct.
+var riscvRegNames = []string{
+	"pc", "ra", "sp", "gp", "tp", "t0", "t1", "t2", "s0", "s1",
+	"a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7",
+	"s2", "s3", "s4", "s5", "s6", "s7", "s8", "s9", "s10", "s11",
+	"t3", "t4", "t5", "t6",
+}
+
+// compareRegisters reports threads missing from livecore's dump, and
+// registers that differ between the dumps.
+func compareRegisters(w io.Writer, lc, ref *elfcore.CoreInfo) (diffs int) {
+	fmt.Fprintf(w, "\n== Registers\n")
+	names, size := x86RegNames, 8
+	switch {
+	case ref.Class == elf.ELFCLASS32:
+		names, size = i386RegNames, 4
+	case ref.Machine == elf.EM_RISCV:
+		names = riscvRegNames
+	}
+	reg := func(regs []byte, i int) uint64 {
+		if size == 4 {
+			return uint64(binary.LittleEndian.Uint32(regs[i*4:]))
+		}
+		return binary.LittleEndian.Uint64(regs[i*8:])
+	}
+	lcThreads := make(map[int]elfcore.Thread)
+	for _, t := range lc.Threads {
+		lcThreads[t.Tid] = t
+	}
+	for _, rt := range ref.Threads {
+		lt, ok := lcThreads[rt.Tid]
+		if !ok {
+			fmt.Fprintf(w, "thread %d: missing\n", rt.Tid)
+			diffs++
+			continue
+		}
+		var differ []string
+		for i, name := range names {
+			if (i+1)*size > len(lt.Registers) || (i+1)*size > len(rt.Registers) {
+				break
+			}
+			lv, rv := reg(lt.Registers, i), reg(rt.Registers, i)
+			if lv != rv {
+				differ = append(differ, fmt.Sprintf("%s=%#x (reference %#x)", name, lv, rv))
+			}
+		}
+		if len(differ) == 0 {
+			fmt.Fprintf(w, "thread %d: ok\n", rt.Tid)
+			continue
+		}
+		diffs++
+		fmt.Fprintf(w, "thread %d: %d registers differ\n", rt.Tid, len(differ))
+		for _, d := range differ {
+			fmt.Fprintf(w, "    %s\n", d)
+		}
+	}
+	return diffs
+}
+
+// compareMemory reports memory the reference stores but livecore's dump
+// doesn't, and pages both store that differ. Each segment with either
+// counts as one difference.
+func compareMemory(w io.Writer, lc, ref *elfcore.CoreReader, maxList int) (diffs int, err error) {
+	fmt.Fprintf(w, "\n== Memory\n")
+	lcSegs := lc.Segments()
+	const pageSize = 4096
+	lcBuf, refBuf := make([]byte, pageSize), make([]byte, pageSize)
+
+	for _, rs := range ref.Segments() {
+		if rs.FileSize == 0 {
+			continue // the reference left it out too
+		}
+		stored := rs.Start + uintptr(rs.FileSize)
+		var missing uint64
+		var differ []uintptr
+		for addr := rs.Start; addr < stored; addr += pageSize {
+			i, ok := slices.BinarySearchFunc(lcSegs, addr, func(s elfcore.Segment, a uintptr) int {
+				switch {
+				case s.End <= a:
+					return -1
+				case s.Start > a:
+					return 1
+				}
+				return 0
+			})
+			if !ok || addr+pageSize > lcSegs[i].Start+uintptr(lcSegs[i].FileSize) {
+				missing += pageSize
+				continue
+			}
+			if _, err := ref.ReadAt(refBuf, addr); err != nil {
+				return 0, fmt.Errorf("reference: %w", err)
+			}
+			if _, err := lc.ReadAt(lcBuf, addr); err != nil {
+				return 0, fmt.Errorf("livecore: %w", err)
+			}
+			if !bytes.Equal(lcBuf, refBuf) {
+				differ = append(differ, addr)
+			}
+		}
+
+		status := "ok"
+		if missing > 0 || len(differ) > 0 {
+			diffs++
+			status = fmt.Sprintf("%d bytes not stored, %d pages differ", missing, len(differ))
+		}
+		fmt.Fprintf(w, "%016x-%016x %s %s\n", rs.Start, rs.End, permString(rs.Perms), status)
+		for i, addr := range differ {
+			if i == maxList {
+				fmt.Fprintf(w, "    ... and %d more\n", len(differ)-maxList)
+				break
+			}
+			fmt.Fprintf(w, "    page %x differs\n", addr)
+		}
+	}
+	return diffs, nil
+}
+
+// permString formats perms like /proc/<pid>/maps does.
+func permString(p elfcore.Perm) string {
+	b := []byte("---")
+	if p&elfcore.PermRead != 0 {
+		b[0] = 'r'
+	}
+	if p&elfcore.PermWrite != 0 {
+		b[1] = 'w'
+	}
+	if p&elfcore.PermExec != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// compressions are the -compress methods, other than none.
+var compressions = map[string]func(w io.Writer) (io.WriteCloser, error){
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		// Cores are big and mostly compress well at any level; favor speed.
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	},
+	"lz4": func(w io.Writer) (io.WriteCloser, error) {
+		return lz4.NewWriter(w), nil
+	},
+	"zstd": newZstdWriter,
+}
+
+// compressWriter returns a writer that compresses what's written to it
+// with method into w. Closing it finishes the compressed stream but
+// doesn't close w.
+func compressWriter(method string, w io.Writer) (io.WriteCloser, error) {
+	newWriter, ok := compressions[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q (want none, gzip, lz4, or zstd)", method)
+	}
+	return newWriter(w)
+}
+
+// newZstdWriter compresses by piping through the zstd command, there
+// being no zstd encoder in the standard library.
+func newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return newCmdWriter(w, "zstd", "-q", "-c", "-T0")
+}
+
+// cmdWriter pipes what's written to it through a command, such as zstd or
+// age, whose output goes to the underlying writer.
+type cmdWriter struct {
+	io.WriteCloser // the command's stdin
+	cmd            *exec.Cmd
+}
+
+func newCmdWriter(w io.Writer, name string, args ...string) (io.WriteCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s (is it installed?): %w", name, err)
+	}
+	return &cmdWriter{stdin, cmd}, nil
+}
+
+func (c *cmdWriter) Close() error {
+	c.WriteCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %w", c.cmd.Path, err)
+	}
+	return nil
+}
+
+// outputWriter returns a writer that compresses and then encrypts what's
+// written to it into w, as config asks, or nil if it asks for neither.
+// Closing it finishes both streams but doesn't close w.
+func outputWriter(config *Config, w io.Writer) (io.WriteCloser, error) {
+	var stack stackedWriter
+	ew, err := encryptWriter(config, w)
+	if err != nil {
+		return nil, err
+	}
+	if ew != nil {
+		stack.Writer, stack.closers = ew, []io.Closer{ew}
+		w = ew
+	}
+	if config.Compress != "none" {
+		cw, err := compressWriter(config.Compress, w)
+		if err != nil {
+			stack.Close()
+			return nil, err
+		}
+		stack.Writer, stack.closers = cw, append([]io.Closer{cw}, stack.closers...)
+	}
+	if stack.Writer == nil {
+		return nil, nil
+	}
+	return &stack, nil
+}
+
+// stackedWriter writes to the first of a stack of writers, each writing
+// to the next, and closes them in order.
+type stackedWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (s *stackedWriter) Close() error {
+	var err error
+	for _, c := range s.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
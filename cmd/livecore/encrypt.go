@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A core encrypted with -encrypt-key starts with encryptMagic, then the
+// length (big-endian uint16) and contents of a random AES-256 key wrapped
+// with RSA-OAEP (SHA-256, label encryptLabel) for the key file's public
+// key. Then come the core's bytes in chunks of encryptChunkSize, each
+// sealed with AES-GCM under a nonce of the chunk's number (big-endian, in
+// the last 8 bytes) with the first byte 1 for the last chunk, which may
+// be empty, so a truncated core fails to decrypt rather than looking
+// shorter.
+const (
+	encryptMagic     = "livecore-enc-v1\n"
+	encryptLabel     = "livecore core key"
+	encryptChunkSize = 64 << 10
+)
+
+// checkEncrypt checks the -encrypt flag's value, age:<recipient>.
+func checkEncrypt(s string) error {
+	recipient, ok := strings.CutPrefix(s, "age:")
+	if !ok || recipient == "" {
+		return fmt.Errorf("-encrypt must be age:<recipient>")
+	}
+	return nil
+}
+
+// encryptWriter returns a writer that encrypts what's written to it into
+// w, as config's -encrypt or -encrypt-key asks, or nil if neither does.
+// Closing it finishes the encrypted stream but doesn't close w.
+func encryptWriter(config *Config, w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case config.Encrypt != "":
+		recipient, _ := strings.CutPrefix(config.Encrypt, "age:")
+		return newCmdWriter(w, "age", "-r", recipient)
+	case config.EncryptKey != "":
+		pub, err := readPublicKey(config.EncryptKey)
+		if err != nil {
+			return nil, err
+		}
+		return newKeyWriter(w, pub)
+	}
+	return nil, nil
+}
+
+// readPublicKey reads the RSA public key in the PEM file at path.
+func readPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key any
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("%s: want an RSA public key, not %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: want an RSA public key, not %T", path, key)
+	}
+	return pub, nil
+}
+
+// readPrivateKey reads the RSA private key in the PEM file at path.
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: want an RSA private key, not %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: want an RSA private key, not %T", path, key)
+	}
+	return priv, nil
+}
+
+// keyWriter encrypts for -encrypt-key, a chunk at a time.
+type keyWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte // plaintext of the chunk being filled
+	out   []byte // sealed chunk
+	chunk uint64 // number of the chunk being filled
+	err   error
+}
+
+func newKeyWriter(w io.Writer, pub *rsa.PublicKey) (*keyWriter, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, []byte(encryptLabel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptMagic), 0, 0)
+	binary.BigEndian.PutUint16(header[len(encryptMagic):], uint16(len(wrapped)))
+	if _, err := w.Write(append(header, wrapped...)); err != nil {
+		return nil, err
+	}
+	return &keyWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, encryptChunkSize),
+		out:  make([]byte, 0, encryptChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func newChunkAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce for chunk number n.
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	if last {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+func (kw *keyWriter) Write(p []byte) (int, error) {
+	if kw.err != nil {
+		return 0, kw.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is sealed only once more follows it, so that
+		// Close can seal whatever is buffered as the last.
+		if len(kw.buf) == encryptChunkSize {
+			if kw.err = kw.seal(false); kw.err != nil {
+				return 0, kw.err
+			}
+		}
+		k := copy(kw.buf[len(kw.buf):encryptChunkSize], p)
+		kw.buf = kw.buf[:len(kw.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (kw *keyWriter) seal(last bool) error {
+	kw.out = kw.aead.Seal(kw.out[:0], chunkNonce(kw.chunk, last), kw.buf, nil)
+	kw.buf = kw.buf[:0]
+	kw.chunk++
+	_, err := kw.w.Write(kw.out)
+	return err
+}
+
+// Close seals the last chunk.
+func (kw *keyWriter) Close() error {
+	if kw.err != nil {
+		return kw.err
+	}
+	kw.err = kw.seal(true)
+	if kw.err != nil {
+		return kw.err
+	}
+	kw.err = errors.New("write to closed encrypted core")
+	return nil
+}
+
+// decryptCore writes what newKeyWriter encrypted in r to w, with the
+// private key priv.
+func decryptCore(w io.Writer, r io.Reader, priv *rsa.PrivateKey) error {
+	br := bufio.NewReaderSize(r, encryptChunkSize+64)
+	header := make([]byte, len(encryptMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(encryptMagic)]) != encryptMagic {
+		return fmt.Errorf("not a core encrypted with -encrypt-key")
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(header[len(encryptMagic):]))
+	if _, err := io.ReadFull(br, wrapped); err != nil {
+		return fmt.Errorf("failed to read wrapped key: %w", err)
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, wrapped, []byte(encryptLabel))
+	if err != nil {
+		return fmt.Errorf("failed to unwrap key (is it the right private key?): %w", err)
+	}
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	in := make([]byte, encryptChunkSize+aead.Overhead())
+	var out []byte
+	for n := uint64(0); ; n++ {
+		k, err := io.ReadFull(br, in)
+		switch err {
+		case nil, io.ErrUnexpectedEOF:
+		case io.EOF:
+			return fmt.Errorf("encrypted core is truncated")
+		default:
+			return err
+		}
+		last := k < len(in)
+		if !last {
+			_, err := br.Peek(1)
+			last = err == io.EOF
+		}
+		out, err = aead.Open(out[:0], chunkNonce(n, last), in[:k], nil)
+		if err != nil {
+			return fmt.Errorf("chunk %d doesn't decrypt; the core is corrupt or truncated", n)
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptMain implements "livecore decrypt": it decrypts a core written
+// with -encrypt-key.
+func decryptMain(args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyPath := fs.String("key", "", "the RSA private key, in a PEM `file`, matching the public key the core was encrypted for")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s decrypt -key <private.pem> <core|-> <output.core|->\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Decrypts a core written with -encrypt-key. Cores written with\n")
+		fmt.Fprintf(fs.Output(), "-encrypt age:<recipient> are decrypted with age -d instead.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || *keyPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	input, output := fs.Arg(0), fs.Arg(1)
+	priv, err := readPrivateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	r := io.Reader(os.Stdin)
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if output == "-" {
+		return decryptCore(os.Stdout, r, priv)
+	}
+	if input != "-" && sameFile(input, output) {
+		return fmt.Errorf("the output can't be the core being decrypted")
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(f, 1<<20)
+	err = decryptCore(bw, r, priv)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
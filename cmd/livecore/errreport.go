@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/bradfitz/livecore"
+	"github.com/bradfitz/livecore/proc"
+	"golang.org/x/sys/unix"
+)
+
+// errorReport is the JSON object written by -error-json, for automation
+// that wraps livecore to act on without parsing log text.
+type errorReport struct {
+	Error     string `json:"error"`
+	Phase     string `json:"phase"`               // see livecore.PhaseError
+	Errno     int    `json:"errno,omitempty"`     // underlying errno, if any
+	ErrnoName string `json:"errnoName,omitempty"` // e.g. "ESRCH"
+	Pid       int    `json:"pid"`
+
+	// The target's state (from /proc/<pid>/stat) as livecore exits, or
+	// "" if it's gone. Frozen is set if it's stopped, as it would be if a
+	// failure kept livecore from resuming it.
+	TargetState  string `json:"targetState,omitempty"`
+	TargetFrozen bool   `json:"targetFrozen"`
+}
+
+// fail reports err and exits.
+func fail(config *Config, err error) {
+	if jsonLog != nil {
+		jsonLog.Error(err.Error())
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	writeErrorReport(config, err)
+	summary.write(err)
+	os.Exit(1)
+}
+
+// writeErrorReport writes err as JSON where -error-json says to, if
+// anywhere.
+func writeErrorReport(config *Config, err error) {
+	if config.ErrorJSON == "" {
+		return
+	}
+	data, _ := json.Marshal(newErrorReport(config, err))
+	data = append(data, '\n')
+	if config.ErrorJSON == "-" {
+		os.Stderr.Write(data)
+		return
+	}
+	if err := os.WriteFile(config.ErrorJSON, data, 0644); err != nil {
+		log.Printf("Warning: failed to write error report: %v", err)
+	}
+}
+
+// newErrorReport describes err, which the dump of config.Pid failed with.
+func newErrorReport(config *Config, err error) errorReport {
+	r := errorReport{
+		Error: err.Error(),
+		Phase: "setup",
+		Pid:   config.Pid,
+	}
+	var pe *livecore.PhaseError
+	if errors.As(err, &pe) {
+		r.Phase = pe.Phase
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		r.Errno = int(errno)
+		r.ErrnoName = unix.ErrnoName(errno)
+	}
+	if state, err := proc.ThreadState(config.Pid, config.Pid); err == nil {
+		r.TargetState = string(state)
+		r.TargetFrozen = state == 'T' || state == 't'
+	}
+	return r
+}
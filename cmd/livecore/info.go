@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"golang.org/x/sys/unix"
+)
+
+// infoMain implements "livecore info": it summarizes what a core file
+// holds.
+func infoMain(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	showVMAs := fs.Bool("vmas", true, "list the core's segments")
+	showThreads := fs.Bool("threads", true, "list the core's threads with their names and scheduling state, if recorded")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s info [flags] <core>\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Prints a summary of a core file: its process and threads, the notes\n")
+		fmt.Fprintf(fs.Output(), "it has, and its segments, with how much of each is stored and how\n")
+		fmt.Fprintf(fs.Output(), "much of that takes disk space rather than being holes.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	cr, err := elfcore.OpenCore(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer cr.Close()
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	info := cr.Info()
+	segs := cr.Segments()
+
+	onDisk := make([]uint64, len(segs))
+	var mapped, stored, allocated uint64
+	for i, s := range segs {
+		if onDisk[i], err = dataBytes(f, int64(s.FileOffset), int64(s.FileSize)); err != nil {
+			return err
+		}
+		mapped += uint64(s.End - s.Start)
+		stored += s.FileSize
+		allocated += onDisk[i]
+	}
+
+	fmt.Printf("Core:     %s, %d MB\n", path, st.Size()>>20)
+	process := fmt.Sprint(info.Pid)
+	if ps := info.PSInfo; ps != nil {
+		process += " " + ps.Fname
+		if args := strings.TrimSpace(strings.ReplaceAll(string(ps.Args), "\x00", " ")); args != "" {
+			process += " (" + args + ")"
+		}
+	}
+	fmt.Printf("Process:  %s\n", process)
+	if c := info.Container; c != nil {
+		fmt.Printf("Container: %s", c.ID)
+		if c.Runtime != "" {
+			fmt.Printf(" (%s)", c.Runtime)
+		}
+		if c.Name != "" {
+			fmt.Printf(" %s", c.Name)
+		}
+		if c.Image != "" {
+			fmt.Printf(", image %s", c.Image)
+		}
+		if c.Pod != "" {
+			fmt.Printf(", pod %s/%s", c.Namespace, c.Pod)
+		}
+		fmt.Println()
+	}
+	if t := info.FreezeStart; t != (elfcore.ClockSample{}) {
+		fmt.Printf("Dumped:   %s\n", time.Unix(0, t.Realtime).Format(time.RFC3339))
+	}
+	if inc := info.Incremental; inc != nil {
+		fmt.Printf("Base:     incremental, on the dump taken at %s\n", time.Unix(0, inc.Base.Realtime).Format(time.RFC3339))
+	}
+	if o := info.Overrun; o != nil {
+		how := "left as copied before the stop"
+		if o.Fuzzy {
+			how = "copied after the process resumed"
+		}
+		fmt.Printf("Overrun:  the %v stop-time budget ran out; %d ranges were %s\n", o.Budget, len(o.Uncopied), how)
+	}
+	tids := make([]string, len(info.Threads))
+	for i, t := range info.Threads {
+		tids[i] = fmt.Sprint(t.Tid)
+		if t.Name != "" {
+			tids[i] += fmt.Sprintf(" (%s)", t.Name)
+		}
+	}
+	fmt.Printf("Threads:  %d: %s\n", len(info.Threads), strings.Join(tids, " "))
+	if len(info.Unstopped) > 0 {
+		fmt.Printf("          %d never stopped: %v\n", len(info.Unstopped), info.Unstopped)
+	}
+	if len(info.OmittedThreads) > 0 {
+		fmt.Printf("          %d left out: %v\n", len(info.OmittedThreads), info.OmittedThreads)
+	}
+	fmt.Printf("Notes:    %s\n", noteSummary(info.Notes))
+	fmt.Printf("Memory:   %d segments, %d MB mapped, %d MB stored, %d MB on disk",
+		len(segs), mapped>>20, stored>>20, allocated>>20)
+	if stored > 0 {
+		fmt.Printf(" (%.1f%% of stored bytes are holes)", 100*float64(stored-allocated)/float64(stored))
+	}
+	fmt.Println()
+	if len(info.Omitted) > 0 {
+		fmt.Printf("Omitted:  %d ranges\n", len(info.Omitted))
+	}
+	if len(info.Redacted) > 0 {
+		fmt.Printf("Redacted: %d ranges\n", len(info.Redacted))
+	}
+	for i, b := range info.BuildIDs {
+		label := ""
+		if i == 0 {
+			label = "BuildIDs:"
+		}
+		fmt.Printf("%-10s%x %s\n", label, b.ID, b.Path)
+	}
+	for i, p := range slices.Sorted(maps.Keys(info.HostPaths)) {
+		label := ""
+		if i == 0 {
+			label = "HostPath:"
+		}
+		fmt.Printf("%-10s%s -> %s\n", label, p, info.HostPaths[p])
+	}
+	if *showThreads && slices.ContainsFunc(info.Threads, func(t elfcore.Thread) bool { return t.Sched != nil }) {
+		fmt.Println()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "TID\tNAME\tPOLICY\tPRIO\tNICE\tCPU\tAFFINITY\n")
+		for _, t := range info.Threads {
+			if s := t.Sched; s != nil {
+				prio := fmt.Sprint(s.Priority)
+				if s.RTPriority != 0 {
+					prio = fmt.Sprintf("rt %d", s.RTPriority)
+				}
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", t.Tid, t.Name, s.PolicyName(), prio, s.Nice, s.CPU, s.AffinityList())
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if !*showVMAs {
+		return nil
+	}
+
+	paths := make(map[uintptr]string)
+	for _, vma := range info.VMAs {
+		paths[vma.Start] = vma.Path
+	}
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "START\tEND\tPERMS\tSIZE KB\tSTORED KB\tON DISK KB\t  PATH\n")
+	for i, s := range segs {
+		fmt.Fprintf(tw, "%x\t%x\t%s\t%d\t%d\t%d\t  %s\n",
+			s.Start, s.End, permString(s.Perms), (s.End-s.Start)>>10, s.FileSize>>10, onDisk[i]>>10, paths[s.Start])
+	}
+	return tw.Flush()
+}
+
+// noteSummary lists the types of notes, with how many there are of each
+// type, in the order each type first appears.
+func noteSummary(notes []elfcore.Note) string {
+	var names []string
+	counts := make(map[string]int)
+	for _, n := range notes {
+		name := n.TypeName()
+		if n.Name != "CORE" && n.Name != "LINUX" && n.Name != elfcore.LivecoreNoteName {
+			name = n.Name + "/" + name
+		}
+		if counts[name] == 0 {
+			names = append(names, name)
+		}
+		counts[name]++
+	}
+	for i, name := range names {
+		if c := counts[name]; c > 1 {
+			names[i] = fmt.Sprintf("%s (%d)", name, c)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// dataBytes returns how many of the size bytes at off in f take up disk
+// space, according to SEEK_DATA and SEEK_HOLE. If the filesystem can't say,
+// that's all of them.
+func dataBytes(f *os.File, off, size int64) (uint64, error) {
+	fd := int(f.Fd())
+	end := off + size
+	var n uint64
+	for pos := off; pos < end; {
+		data, err := unix.Seek(fd, pos, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // no more data in the file
+		}
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return uint64(size), nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to seek to data at offset %d: %w", pos, err)
+		}
+		if data >= end {
+			break
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return 0, fmt.Errorf("failed to seek to hole at offset %d: %w", data, err)
+		}
+		hole = min(hole, end)
+		n += uint64(hole - data)
+		pos = hole
+	}
+	return n, nil
+}
@@ -0,0 +1,831 @@
+// Command livecore writes a core file of a running process while stopping
+// it only briefly; see package livecore for how. It also has subcommands
+// to list processes it could dump (ps), to say whether it can dump one
+// (check), to check its dumps against gcore's (compare), to dump a
+// process on a schedule (watch), to rebuild full cores from incremental
+// ones (merge), to turn the records of a -records dump into its core
+// (replay), to summarize a core (info), to check that a core is
+// well-formed (verify), and to decrypt a core written with -encrypt-key
+// (decrypt).
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/livecore"
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/internal/upload"
+	"github.com/bradfitz/livecore/proc"
+	"golang.org/x/sys/unix"
+)
+
+// Config holds the configuration for livecore
+type Config struct {
+	Pid            int
+	OutputFile     string
+	MaxPasses      int
+	MaxPreCopyTime time.Duration // 0 means no limit
+	NoPreCopy      bool
+	Direct         bool
+	Records        bool // write page records for "livecore replay", not a core
+	DirtyThreshold float64
+	Concurrency    int
+	ReadBatch      sizeFlag // most bytes one process_vm_readv reads
+	Verbose        bool
+	Progress       bool
+	FixYama        bool
+	StopTimeout    time.Duration
+	OnStopTimeout  string        // "proceed" or "abort"
+	MaxSTW         time.Duration // 0 means no limit
+	OnSTWOverrun   livecore.StopOverrun
+	FreezeWorkers  int
+	Notes          elfcore.NoteSelection
+	PidView        livecore.PidView
+	Cmdline        elfcore.Redaction // command line in notes and memory
+	OmitEnviron    bool              // zero the environment strings in memory
+	RedactRanges   []proc.AddrRange  // to zero in memory
+	RedactPatterns []*regexp.Regexp  // whose matches to mask in memory
+	OmitAuxv       bool
+	Annotations    []elfcore.Annotation
+	Container      *proc.Container // if the target was given by container
+	QuiesceTimeout time.Duration   // 0 means don't ask the target to quiesce
+	Sample         float64         // percentage of pages to copy
+	ResidentOnly   bool
+	SwapIn         bool
+	CompressBuffer bool
+	BufferWindow   sizeFlag // 0 means the default
+	TempDir        string   // for the scratch buffer; "" means $TMPDIR, or next to the core
+	Buffer         livecore.BufferMode
+	MemoryMax      sizeFlag // most page data -buffer=auto buffers in memory; 0 means the default
+	SkipSpaceCheck bool
+	VerifyWrite    livecore.VerifyMode
+	Sparse         elfcore.Sparse
+	WriteCache     elfcore.CacheMode
+	MaxReadBW      sizeFlag // bytes a second; 0 means no limit
+	MaxWriteBW     sizeFlag
+	WriteWorkers   int // segments written at once
+	WriteNice      int
+	WriteIONice    livecore.IOPriority
+	Freeze         livecore.FreezeMethod
+	Compress       string // "none", or a key of compressions
+	Encrypt        string // "age:<recipient>", or "" for none
+	EncryptKey     string // RSA public key file to encrypt for; "" means don't
+	Filter         proc.DumpFilter
+	Pidfd          int  // -1 if the target was given by pid or name
+	FollowChildren bool // also dump descendants, to OutputFile.<pid>
+	Goroutines     bool
+	Checksum       bool   // write a manifest next to the core
+	Bundle         string // where to write a tar of the core and its binaries; "" means don't
+	Upload         string // where to upload the core to; "" means don't
+	Base           string // for -incremental or -reflink, the base core
+	Reflink        bool   // write a full core, cloning what's unchanged from Base
+	Resume         string // journal of a resumable dump; "" means it isn't
+	Tids           []int
+	MaxThreads     int
+	MetricsAddr    string        // where to serve metrics; "" means don't
+	MetricsLinger  time.Duration // how long to wait for a final scrape
+	ErrorJSON      string        // where to write a JSON error report; "-" is stderr
+	LogFormat      string        // "text" or "json"
+	Report         string        // where to write the JSON summary; "-" is stderr, "" means only with -log-format=json
+	SampleSeed     uint64
+}
+
+// parseFlags parses command line flags
+func parseFlags() (*Config, error) {
+	config := &Config{}
+
+	flag.IntVar(&config.MaxPasses, "passes", 2, "maximum pre-copy passes; fewer run if the dirty set stops shrinking")
+	flag.DurationVar(&config.MaxPreCopyTime, "max-precopy-time", 0, "don't start a pre-copy pass that would likely end after this long, going on to the freeze instead (0 means no limit; the first pass always runs)")
+	flag.BoolVar(&config.NoPreCopy, "no-precopy", false, "skip pre-copy and copy everything with the target stopped, for a longer stop; the default, with a warning, when the kernel can't track soft-dirty pages")
+	flag.BoolVar(&config.Direct, "direct", false, "copy memory straight into the core file, with no scratch buffer and no pre-copy, for half the disk I/O and space at the cost of a longer stop")
+	flag.BoolVar(&config.Records, "records", false, "write each pre-copy pass's pages to the output as they're copied, as records, with no scratch buffer; \"livecore replay\" turns them into the core")
+	flag.Float64Var(&config.DirtyThreshold, "dirty-thresh", 5.0, "stop when dirty < threshold (percentage)")
+	flag.IntVar(&config.Concurrency, "concurrency", runtime.GOMAXPROCS(0), "concurrent read workers")
+	config.ReadBatch = 4 << 20
+	flag.Var(&config.ReadBatch, "iov-bytes", "read the target's memory at most `size` bytes per process_vm_readv, with an optional K, M, or G suffix; pre-copy's workers each read one such batch at a time")
+	flag.BoolVar(&config.Verbose, "verbose", false, "show progress and statistics")
+	flag.BoolVar(&config.Progress, "progress", false, "draw a progress bar on stderr for each phase, with how much memory it has copied or written and an ETA")
+	flag.BoolVar(&config.FixYama, "fix-yama", false, "automatically fix yama.ptrace_scope sysctl and restore on exit")
+	flag.DurationVar(&config.StopTimeout, "stop-timeout", 5*time.Second, "how long to wait for threads to stop when freezing (0 waits forever)")
+	flag.IntVar(&config.FreezeWorkers, "freeze-workers", 0, "OS threads to seize a target's threads from in parallel when it has hundreds (0 means one per CPU, up to 16)")
+	flag.StringVar(&config.OnStopTimeout, "on-stop-timeout", "proceed", "what to do about threads that don't stop in time: proceed (dump without them) or abort")
+	flag.DurationVar(&config.MaxSTW, "max-stw", 0, "resume the target after it's been stopped this long, even if dirty pages are left to copy (0 means no limit)")
+	onSTWOverrun := flag.String("on-stw-overrun", "fuzzy", "what to do with the dirty pages -max-stw leaves uncopied: fuzzy (copy them with the target running) or abort (leave them as pre-copy read them)")
+	flag.BoolVar(&config.CompressBuffer, "compress-buffer", false, "keep buffered pages lz4-compressed, for when the scratch disk is smaller than the target's memory")
+	flag.StringVar(&config.TempDir, "tmpdir", "", "put the scratch buffer in this `dir`, such as on a fast local disk when the core goes to network storage (default: $TMPDIR if set, or else the core's directory)")
+	buffer := flag.String("buffer", "disk", "where to keep the scratch buffer: disk, memory (in a memfd, for no disk I/O until the core is written), or auto (memory if the dump looks like it will copy at most -buffer-memory-max, and half the available memory)")
+	flag.Var(&config.MemoryMax, "buffer-memory-max", "with -buffer=auto, the most page data, as `size` bytes with an optional K, M, G, or T suffix, to buffer in memory (0 means 4G)")
+	flag.Var(&config.BufferWindow, "buffer-window", "the most the scratch buffer may hold, holes and all, as `size` bytes with an optional K, M, G, or T suffix: at least the size of the target's mappings; it reserves this much address space, but its file grows only as needed (0 means 512G)")
+	flag.StringVar(&config.MetricsAddr, "metrics-addr", "", "serve Prometheus metrics about the dump at http://`addr`/metrics")
+	flag.DurationVar(&config.MetricsLinger, "metrics-linger", time.Minute, "with -metrics-addr, how long to keep serving after the dump until the final metrics are scraped")
+	flag.StringVar(&config.ErrorJSON, "error-json", "", "on failure, write a JSON error report to this file (- for stderr)")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "how to log: text, or json (a JSON object a line, ending with a summary of the dump)")
+	flag.StringVar(&config.Report, "report", "", "write a JSON summary of the dump (phases, durations, bytes, dirty ratios, warnings, outputs, exit status) to this file (- for stderr); with -log-format=json, it goes to stderr by default")
+	name := flag.String("name", "", "dump the one process with this command name, instead of giving a pid")
+	container := flag.String("container", "", "dump the init process of the Docker, containerd, or CRI-O container with this `id` (or unique prefix, or Docker name), instead of giving a pid, recording the container in the core")
+	flag.IntVar(&config.Pidfd, "pidfd", -1, "dump the process this inherited pidfd refers to, instead of giving a pid")
+	flag.BoolVar(&config.FollowChildren, "follow-children", false, "also dump the target's child processes, theirs, and so on, freezing them all together; each core goes to <output.core>.<pid>")
+	flag.BoolVar(&config.Filter.OnlyAnon, "only-anon", false, "dump only the heap, stacks, and anonymous mappings")
+	flag.BoolVar(&config.Filter.IncludeFileMaps, "include-file-maps", true, "dump file-backed mappings (-include-file-maps=false leaves them out)")
+	flag.BoolVar(&config.Filter.RespectDontdump, "respect-dontdump", true, "leave out mappings marked MADV_DONTDUMP, as the kernel does")
+	flag.BoolVar(&config.Filter.ELFHeaders, "elf-headers", true, "dump the first page of each mapped ELF file, for its build ID, even where its mapping is left out (-elf-headers=false leaves it out too), as bit 4 of /proc/<pid>/coredump_filter does for the kernel")
+	flag.Func("shared", "which shared (MAP_SHARED) mappings to dump: include (all, the default), exclude (none), or anon-only (shared memory, such as shm, memfd, and tmpfs files in /dev/shm, but not shared mappings of other files), as /proc/<pid>/coredump_filter does for the kernel", func(s string) error {
+		var err error
+		config.Filter.Shared, err = proc.ParseSharedPolicy(s)
+		return err
+	})
+	flag.Func("range", "dump only the memory in `start-end` (hex addresses, as in /proc/<pid>/maps); may be repeated", func(s string) error {
+		r, err := proc.ParseAddrRange(s)
+		if err != nil {
+			return err
+		}
+		config.Filter.Ranges = append(config.Filter.Ranges, r)
+		return nil
+	})
+	flag.Func("vma-filter", "dump only mappings matching this `expr`, such as kind=heap or path=*libc*,perms=rw; may be repeated to dump mappings matching any", func(s string) error {
+		e, err := proc.ParseVMAExpr(s)
+		if err != nil {
+			return err
+		}
+		config.Filter.Match = append(config.Filter.Match, e)
+		return nil
+	})
+	exclude := func(name, usage, term string) {
+		flag.Func(name, usage, func(s string) error {
+			if strings.Contains(s, ",") {
+				return fmt.Errorf("%q can't contain a comma", s)
+			}
+			e, err := proc.ParseVMAExpr(term + s)
+			if err != nil {
+				return err
+			}
+			config.Filter.Exclude = append(config.Filter.Exclude, e)
+			return nil
+		})
+	}
+	exclude("exclude-path", "leave out mappings whose path, or for a `glob` without a /, file name, matches glob, such as /data/*.db; may be repeated", "path=")
+	exclude("exclude-larger-than", "leave out mappings bigger than `size` bytes (which may end in K, M, G, or T)", "size>")
+	exclude("exclude-perm", "leave out mappings with at least these `perms` (any of r, w, and x), such as x for code; may be repeated", "perms=")
+	flag.StringVar(&config.Compress, "compress", "none", "compress the core as it's written: none, gzip, lz4, or zstd (with the zstd command)")
+	flag.StringVar(&config.Encrypt, "encrypt", "", "encrypt the core as it's written, for `age:recipient` (an age public key), with the age command")
+	flag.StringVar(&config.EncryptKey, "encrypt-key", "", "encrypt the core as it's written, with AES-256-GCM under a random key wrapped for the RSA public key in this PEM `file`; \"livecore decrypt\" decrypts it")
+	freeze := flag.String("freeze", "ptrace", "how to freeze the target: ptrace (seize each thread), or cgroup (freeze its cgroup, and everything in it, while seizing)")
+	sparse := flag.String("sparse", "auto", "which zeros to leave as holes in the core: auto (memory never touched, and zero pages livecore reads), always (also check every copied page for zeros), or never (write them all)")
+	flag.Var(&config.MaxReadBW, "max-read-bw", "limit pre-copy reads of the target's memory to `size` bytes a second, with an optional K, M, or G suffix (0 means no limit; the final copy is never limited)")
+	flag.Var(&config.MaxWriteBW, "max-write-bw", "limit writing the core to `size` bytes a second, with an optional K, M, or G suffix (0 means no limit)")
+	flag.IntVar(&config.WriteWorkers, "write-concurrency", 1, "how many segments of the core to write at once; a few keep NVMe busy")
+	flag.IntVar(&config.WriteNice, "write-nice", 0, "nice value for the thread writing the core, after the target is thawed (0 leaves it alone)")
+	flag.Func("write-ionice", "I/O priority for the thread writing the core: idle, be, or be:N for best-effort level N (0-7)", func(s string) error {
+		var err error
+		config.WriteIONice, err = livecore.ParseIOPriority(s)
+		return err
+	})
+	writeCache := flag.String("write-cache", "keep", "how writing the core file treats the page cache: keep (as usual), drop (preallocate memory's blocks, and drop what's written from the cache as it goes), or direct (like drop, but write memory with O_DIRECT where the filesystem supports it)")
+	verifyWrite := flag.String("verify-write", "off", "after writing the core, read it back and compare it with the scratch buffer: off, sample (a page in 64), or all")
+	flag.BoolVar(&config.SkipSpaceCheck, "skip-space-check", false, "don't refuse to start when the output filesystem looks too small for the dump")
+	flag.BoolVar(&config.ResidentOnly, "resident-only", false, "copy only pages resident in RAM, skipping swapped-out pages and file pages not in the page cache")
+	flag.BoolVar(&config.SwapIn, "swap-in", true, "fault in swapped-out pages to copy them; -swap-in=false leaves them out, so the target never waits on swap")
+	flag.Float64Var(&config.Sample, "sample", 100, "copy only a pseudo-random sample of this percentage of pages, plus thread stacks")
+	flag.Uint64Var(&config.SampleSeed, "sample-seed", 0, "seed for choosing sampled pages (0 picks one at random)")
+	incremental := flag.Bool("incremental", false, "write only the pages changed since the -base core, which \"livecore merge\" can fill in the rest of")
+	flag.BoolVar(&config.Reflink, "reflink", false, "write a full core, but copy only the pages changed since the -base core, sharing the rest's blocks with it on a filesystem with reflinks (XFS, btrfs)")
+	flag.StringVar(&config.Base, "base", "", "with -incremental or -reflink, the last core livecore wrote of the target")
+	flag.StringVar(&config.Resume, "resume", "", "journal the dump in this `file`, keeping the scratch buffer in file.buf, so that if it's interrupted, running it again with the same -resume picks up where it left off")
+	flag.DurationVar(&config.QuiesceTimeout, "quiesce-timeout", 0, "if non-zero, ask a target using the quiesce package to reach a clean point before freezing, and wait this long for it (0 doesn't ask)")
+
+	flag.Func("tids", "write register notes only for these comma-separated `tids`, still freezing every thread", func(s string) error {
+		for _, f := range strings.Split(s, ",") {
+			tid, err := strconv.Atoi(strings.TrimSpace(f))
+			if err != nil || tid <= 0 {
+				return fmt.Errorf("invalid tid %q", f)
+			}
+			config.Tids = append(config.Tids, tid)
+		}
+		return nil
+	})
+	flag.IntVar(&config.MaxThreads, "max-threads", 0, "write register notes for at most this many threads, still freezing every thread (0 means all)")
+	flag.BoolVar(&config.Checksum, "checksum", false, "also write <output>.manifest.json, with the SHA-256 of each segment, the core, and the target's executable, and the build IDs of its mapped files")
+	flag.StringVar(&config.Bundle, "bundle", "", "also write a tar `file` (.tar, .tar.gz, .tar.lz4, or .tar.zst) of the core, the executable and libraries it maps, their debug files from /usr/lib/debug, and a gdbinit, to debug it on another machine")
+	flag.StringVar(&config.Upload, "upload", "", "upload the finished core, and its manifest, to `dest` and then delete them: s3://bucket/key, gs://bucket/key, or an https:// URL to PUT to; a dest ending in / is a prefix for the core's name")
+	flag.BoolVar(&config.Goroutines, "goroutines", false, "for a Go target, record its goroutines' IDs, states, and stack bounds in a note (needs its symbol table and DWARF)")
+	notes := flag.String("notes", "all", "which notes to write: all, or minimal (registers, auxv, and file mappings only)")
+	pids := flag.String("pids", "namespace", "for a target in another PID namespace, such as a container's, which pids and tids the notes give: namespace (as it sees them, as the kernel's cores do) or host")
+	cmdline := flag.String("cmdline", "keep", "command line capture: keep, hash (SHA-256 in notes), or omit; hash and omit also zero the argument strings in memory")
+	environ := flag.String("environ", "keep", "environment capture: keep, or omit to zero the environment strings in memory")
+	flag.Func("redact-range", "zero the memory in `start-end` (hex addresses, as in /proc/<pid>/maps) before the core is written; may be repeated", func(s string) error {
+		r, err := proc.ParseAddrRange(s)
+		if err != nil {
+			return err
+		}
+		config.RedactRanges = append(config.RedactRanges, r)
+		return nil
+	})
+	flag.Func("redact-pattern", "overwrite every match of this `regexp` in the copied memory with asterisks before the core is written, or secrets for common credentials (AWS keys, private keys, GitHub and Slack tokens); may be repeated", func(s string) error {
+		if s == "secrets" {
+			config.RedactPatterns = append(config.RedactPatterns, livecore.SecretPatterns...)
+			return nil
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		config.RedactPatterns = append(config.RedactPatterns, re)
+		return nil
+	})
+	auxv := flag.String("auxv", "keep", "auxiliary vector capture: keep, or omit the NT_AUXV note")
+	flag.Func("annotate", "record `key=value` in the core's annotations note; may be repeated", func(s string) error {
+		a, err := elfcore.ParseAnnotation(s)
+		if err != nil {
+			return err
+		}
+		config.Annotations = append(config.Annotations, a)
+		return nil
+	})
+
+	flag.Parse()
+
+	// Parse positional arguments: the target, unless -name, -pidfd, or
+	// -container named it, and the output.
+	args := flag.Args()
+	selectors := 0
+	for _, set := range []bool{*name != "", config.Pidfd >= 0, *container != ""} {
+		if set {
+			selectors++
+		}
+	}
+	byPid := selectors == 0
+	switch {
+	case selectors > 1:
+		return nil, fmt.Errorf("-name, -pidfd, and -container are mutually exclusive")
+	case byPid && len(args) != 2, !byPid && len(args) != 1:
+		return nil, fmt.Errorf("usage: livecore [flags] <pid> <output.core|->\n       livecore [flags] -name <name> | -pidfd <fd> | -container <id> <output.core|->")
+	}
+
+	var err error
+	switch {
+	case *name != "":
+		config.Pid, err = proc.FindByName(*name)
+	case config.Pidfd >= 0:
+		config.Pid, err = proc.PidfdPid(config.Pidfd)
+	case *container != "":
+		if config.Container, err = proc.FindContainer(*container); err == nil {
+			config.Pid = config.Container.InitPid
+		}
+	default:
+		config.Pid, err = strconv.Atoi(args[0])
+		if err != nil {
+			err = fmt.Errorf("invalid PID: %w", err)
+		}
+		args = args[1:]
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.OutputFile = args[0]
+
+	// Validate configuration
+	if config.MaxPasses < 1 {
+		return nil, fmt.Errorf("max passes must be >= 1")
+	}
+
+	if config.DirtyThreshold < 0 || config.DirtyThreshold > 100 {
+		return nil, fmt.Errorf("dirty threshold must be between 0 and 100")
+	}
+
+	if config.Concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be >= 1")
+	}
+	if config.WriteWorkers < 1 {
+		return nil, fmt.Errorf("write-concurrency must be >= 1")
+	}
+
+	if config.Sample <= 0 || config.Sample > 100 {
+		return nil, fmt.Errorf("sample must be above 0 and at most 100")
+	}
+
+	if config.MaxThreads < 0 {
+		return nil, fmt.Errorf("max-threads must be >= 0")
+	}
+
+	if config.OnStopTimeout != "proceed" && config.OnStopTimeout != "abort" {
+		return nil, fmt.Errorf("on-stop-timeout must be proceed or abort")
+	}
+
+	if _, ok := compressions[config.Compress]; !ok && config.Compress != "none" {
+		return nil, fmt.Errorf("compress must be none, gzip, lz4, or zstd")
+	}
+	if config.Encrypt != "" {
+		if config.EncryptKey != "" {
+			return nil, fmt.Errorf("-encrypt and -encrypt-key are mutually exclusive")
+		}
+		if err := checkEncrypt(config.Encrypt); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.MaxSTW < 0 {
+		return nil, fmt.Errorf("max-stw must be >= 0")
+	}
+	config.OnSTWOverrun, err = livecore.ParseStopOverrun(*onSTWOverrun)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -on-stw-overrun: %w", err)
+	}
+
+	switch config.LogFormat {
+	case "text":
+	case "json":
+		if config.Progress {
+			return nil, fmt.Errorf("-progress draws on stderr, which -log-format=json keeps for JSON")
+		}
+		if config.Report == "" {
+			config.Report = "-"
+		}
+	default:
+		return nil, fmt.Errorf("-log-format must be text or json")
+	}
+
+	config.Freeze, err = livecore.ParseFreezeMethod(*freeze)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -freeze: %w", err)
+	}
+	if config.FollowChildren {
+		switch {
+		case config.OutputFile == "-":
+			return nil, fmt.Errorf("-follow-children writes a core per process and can't write to stdout")
+		case config.Freeze == livecore.FreezeCgroup:
+			// Each dump would try to freeze the cgroup they likely share.
+			return nil, fmt.Errorf("-follow-children doesn't work with -freeze=cgroup")
+		case config.Progress:
+			// The dumps' bars would draw over each other.
+			return nil, fmt.Errorf("-follow-children doesn't work with -progress")
+		}
+	}
+	if config.Checksum && config.OutputFile == "-" {
+		return nil, fmt.Errorf("-checksum writes a manifest next to the core and can't be used with stdout")
+	}
+	if config.Bundle != "" {
+		if _, _, err := bundleCompression(config.Bundle); err != nil {
+			return nil, err
+		}
+		switch {
+		case config.OutputFile == "-":
+			return nil, fmt.Errorf("-bundle reads the core back and can't be used with stdout")
+		case config.Compress != "none":
+			return nil, fmt.Errorf("-bundle reads the core back and can't be used with -compress; name the bundle .tar.gz, .tar.lz4, or .tar.zst instead")
+		case config.Encrypt != "" || config.EncryptKey != "":
+			return nil, fmt.Errorf("-bundle reads the core back and would write it out unencrypted, so it can't be used with -encrypt or -encrypt-key")
+		case config.FollowChildren:
+			return nil, fmt.Errorf("-bundle doesn't work with -follow-children")
+		}
+	}
+	if config.Upload != "" {
+		if config.OutputFile == "-" {
+			return nil, fmt.Errorf("-upload uploads the core file and can't be used with stdout")
+		}
+		if config.FollowChildren && !strings.HasSuffix(config.Upload, "/") {
+			return nil, fmt.Errorf("-follow-children uploads a core per process, so -upload must be a prefix ending in /")
+		}
+		if err := upload.Check(config.Upload); err != nil {
+			return nil, fmt.Errorf("invalid -upload: %w", err)
+		}
+	}
+	based := *incremental || config.Reflink
+	switch {
+	case *incremental && config.Reflink:
+		return nil, fmt.Errorf("-incremental and -reflink don't go together")
+	case based && config.Base == "":
+		return nil, fmt.Errorf("-incremental and -reflink need -base")
+	case !based && config.Base != "":
+		return nil, fmt.Errorf("-base is only for -incremental or -reflink")
+	case based && config.FollowChildren:
+		return nil, fmt.Errorf("-incremental and -reflink don't work with -follow-children")
+	case based && sameFile(config.Base, config.OutputFile):
+		return nil, fmt.Errorf("-base can't be the output")
+	case config.Resume != "" && (based || config.FollowChildren):
+		return nil, fmt.Errorf("-resume doesn't work with -incremental, -reflink, or -follow-children")
+	case config.Resume != "" && config.TempDir != "":
+		return nil, fmt.Errorf("-resume keeps the scratch buffer next to its journal, so it can't be used with -tmpdir")
+	}
+	config.Sparse, err = elfcore.ParseSparse(*sparse)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -sparse: %w", err)
+	}
+	config.WriteCache, err = elfcore.ParseCacheMode(*writeCache)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -write-cache: %w", err)
+	}
+	config.VerifyWrite, err = livecore.ParseVerifyMode(*verifyWrite)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -verify-write: %w", err)
+	}
+	config.Buffer, err = livecore.ParseBufferMode(*buffer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -buffer: %w", err)
+	}
+	switch {
+	case config.Buffer != livecore.BufferMemory:
+	case config.Direct, config.Resume != "":
+		return nil, fmt.Errorf("-direct and -resume keep the scratch buffer in files, so they can't be used with -buffer=memory")
+	case config.TempDir != "":
+		return nil, fmt.Errorf("-tmpdir is for a scratch buffer on disk, not -buffer=memory")
+	}
+	if config.Direct {
+		switch {
+		case config.OutputFile == "-", config.Compress != "none", config.Encrypt != "", config.EncryptKey != "":
+			return nil, fmt.Errorf("-direct copies into the core file, so it can't be used with stdout, -compress, -encrypt, or -encrypt-key")
+		case config.CompressBuffer, config.VerifyWrite != livecore.VerifyOff, config.TempDir != "":
+			return nil, fmt.Errorf("-direct has no scratch buffer, so it can't be used with -compress-buffer, -verify-write, or -tmpdir")
+		case based:
+			return nil, fmt.Errorf("-incremental and -reflink need pre-copy, which -direct skips")
+		}
+	}
+	if config.Records {
+		switch {
+		case config.Direct, config.Resume != "", based:
+			return nil, fmt.Errorf("-records can't be used with -direct, -resume, -incremental, or -reflink")
+		case config.CompressBuffer, config.Buffer == livecore.BufferMemory, config.TempDir != "":
+			return nil, fmt.Errorf("-records has no scratch buffer, so it can't be used with -compress-buffer, -buffer=memory, or -tmpdir")
+		case config.VerifyWrite != livecore.VerifyOff, config.Checksum, config.Bundle != "", config.Goroutines:
+			return nil, fmt.Errorf("-records can't read back what it copied, so it can't be used with -verify-write, -checksum, -bundle, or -goroutines")
+		}
+	}
+
+	if config.FreezeWorkers < 0 {
+		return nil, fmt.Errorf("freeze-workers must be >= 0")
+	}
+
+	config.Notes, err = elfcore.ParseNoteSelection(*notes)
+	if err != nil {
+		return nil, err
+	}
+	config.PidView, err = livecore.ParsePidView(*pids)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -pids: %w", err)
+	}
+
+	config.Cmdline, err = elfcore.ParseRedaction(*cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -cmdline: %w", err)
+	}
+	switch *environ {
+	case "keep", "omit":
+		config.OmitEnviron = *environ == "omit"
+	default:
+		return nil, fmt.Errorf("environ must be keep or omit")
+	}
+	switch *auxv {
+	case "keep", "omit":
+		config.OmitAuxv = *auxv == "omit"
+	default:
+		return nil, fmt.Errorf("auxv must be keep or omit")
+	}
+
+	return config, nil
+}
+
+// options returns the livecore options config asks for.
+func (config *Config) options() []livecore.Option {
+	opts := []livecore.Option{
+		livecore.WithPasses(config.MaxPasses),
+		livecore.WithMaxPreCopyTime(config.MaxPreCopyTime),
+		livecore.WithNoPreCopy(config.NoPreCopy),
+		livecore.WithDirect(config.Direct),
+		livecore.WithRecords(config.Records),
+		livecore.WithDirtyThreshold(config.DirtyThreshold),
+		livecore.WithConcurrency(config.Concurrency),
+		livecore.WithReadBatch(uint64(config.ReadBatch)),
+		livecore.WithVerbose(config.Verbose),
+		livecore.WithStopTimeout(config.StopTimeout),
+		livecore.WithAbortOnStopTimeout(config.OnStopTimeout == "abort"),
+		livecore.WithMaxStopTime(config.MaxSTW),
+		livecore.WithStopOverrun(config.OnSTWOverrun),
+		livecore.WithFreezeWorkers(config.FreezeWorkers),
+		livecore.WithNotes(config.Notes),
+		livecore.WithPidView(config.PidView),
+		livecore.WithCmdline(config.Cmdline),
+		livecore.WithOmitEnviron(config.OmitEnviron),
+		livecore.WithRedactRanges(config.RedactRanges...),
+		livecore.WithRedactPatterns(config.RedactPatterns...),
+		livecore.WithOmitAuxv(config.OmitAuxv),
+		livecore.WithAnnotations(config.Annotations...),
+		livecore.WithContainer(config.Container),
+		livecore.WithQuiesceTimeout(config.QuiesceTimeout),
+		livecore.WithSample(config.Sample, config.SampleSeed),
+		livecore.WithResidentOnly(config.ResidentOnly),
+		livecore.WithSwapIn(config.SwapIn),
+		livecore.WithCompressBuffer(config.CompressBuffer),
+		livecore.WithBufferWindow(int64(config.BufferWindow)),
+		livecore.WithTempDir(config.TempDir),
+		livecore.WithBuffer(config.Buffer, int64(config.MemoryMax)),
+		livecore.WithSpaceCheck(!config.SkipSpaceCheck),
+		livecore.WithVerifyWrite(config.VerifyWrite),
+		livecore.WithSparse(config.Sparse),
+		livecore.WithWriteCache(config.WriteCache),
+		livecore.WithReadRate(int64(config.MaxReadBW)),
+		livecore.WithWriteRate(int64(config.MaxWriteBW)),
+		livecore.WithWriteConcurrency(config.WriteWorkers),
+		livecore.WithWritePriority(config.WriteNice, config.WriteIONice),
+		livecore.WithFreezeMethod(config.Freeze),
+		livecore.WithDumpFilter(config.Filter),
+		livecore.WithPidfd(config.Pidfd),
+		livecore.WithGoroutines(config.Goroutines),
+		livecore.WithChecksums(config.Checksum),
+		livecore.WithThreads(config.Tids),
+		livecore.WithMaxThreads(config.MaxThreads),
+	}
+	switch {
+	case config.Reflink:
+		opts = append(opts, livecore.WithReflinkBase(config.Base))
+	case config.Base != "":
+		opts = append(opts, livecore.WithIncremental(config.Base))
+	}
+	if config.Resume != "" {
+		opts = append(opts, livecore.WithJournal(config.Resume))
+	}
+	if bar != nil {
+		opts = append(opts, livecore.WithProgress(bar.update))
+	}
+	return opts
+}
+
+// sameFile reports whether the files at a and b exist and are the same.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// dumpToFile dumps the target to config.OutputFile, removing it if the
+// dump fails, or streams it to stdout if that's "-". With -compress and
+// -encrypt or -encrypt-key, the core is compressed and encrypted on its
+// way out. With -follow-children, it dumps the
+// process tree instead; see dumpTree. With -upload, the finished core is
+// uploaded and then removed.
+func dumpToFile(config *Config) error {
+	if config.FollowChildren {
+		return dumpTree(config)
+	}
+	if config.OutputFile == "-" {
+		if _, err := unix.IoctlGetTermios(int(os.Stdout.Fd()), unix.TCGETS); err == nil {
+			return &livecore.PhaseError{Phase: "setup", Err: fmt.Errorf("refusing to write a core to a terminal; redirect or pipe stdout")}
+		}
+		_, err := dumpTo(config, os.Stdout, "")
+		return err
+	}
+	f, err := os.Create(config.OutputFile)
+	if err != nil {
+		return &livecore.PhaseError{Phase: "setup", Err: fmt.Errorf("failed to create core file: %w", err)}
+	}
+	d, err := dumpTo(config, f, filepath.Dir(config.OutputFile))
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = &livecore.PhaseError{Phase: "write", Err: fmt.Errorf("failed to close core file: %w", cerr)}
+	}
+	if err == nil && config.Checksum {
+		err = writeManifest(config.OutputFile, d.Manifest())
+	}
+	if err != nil {
+		os.Remove(config.OutputFile)
+		return err
+	}
+	if config.Bundle != "" {
+		if err := writeBundle(config.Bundle, config.OutputFile, config.Pid); err != nil {
+			return &livecore.PhaseError{Phase: "write", Err: fmt.Errorf("wrote %s, but failed to bundle it: %w", config.OutputFile, err)}
+		}
+	}
+	if config.Upload != "" {
+		if err := uploadCore(config.Upload, config.OutputFile); err != nil {
+			return &livecore.PhaseError{Phase: "write", Err: fmt.Errorf("wrote %s, but failed to upload it: %w", config.OutputFile, err)}
+		}
+	}
+	return nil
+}
+
+// scratchDir returns where the scratch buffer goes for a core written to a
+// file in dir through a compressor or encryptor, which the Dumper can't
+// see past: as it would for the file itself, in -tmpdir, or $TMPDIR, or
+// dir.
+func (config *Config) scratchDir(dir string) string {
+	switch {
+	case config.TempDir != "":
+		return config.TempDir
+	case os.Getenv("TMPDIR") != "":
+		return os.Getenv("TMPDIR")
+	}
+	return dir
+}
+
+// dumpTo dumps the target to w, compressing and encrypting it as
+// configured, and returns the Dumper it used. When compressing or
+// encrypting, the scratch buffer goes in scratchDir, if set, as it would
+// for an uncompressed file.
+func dumpTo(config *Config, w io.Writer, scratchDir string) (*livecore.Dumper, error) {
+	ow, err := outputWriter(config, w)
+	if err != nil {
+		return nil, &livecore.PhaseError{Phase: "setup", Err: err}
+	}
+	if ow == nil {
+		d := livecore.New(config.Pid, config.options()...)
+		metrics.track(config.Pid, d)
+		summary.track(config.Pid, d, config.OutputFile)
+		return d, d.Dump(context.Background(), w)
+	}
+	opts := config.options()
+	if dir := config.scratchDir(scratchDir); dir != "" {
+		opts = append(opts, livecore.WithTempDir(dir))
+	}
+	d := livecore.New(config.Pid, opts...)
+	metrics.track(config.Pid, d)
+	summary.track(config.Pid, d, config.OutputFile)
+	err = d.Dump(context.Background(), ow)
+	if cerr := ow.Close(); err == nil && cerr != nil {
+		err = &livecore.PhaseError{Phase: "write", Err: fmt.Errorf("failed to finish core: %w", cerr)}
+	}
+	return d, err
+}
+
+// checkYamaSysctl returns the value of yama.ptrace_scope, or 0 if Yama
+// isn't enabled.
+func checkYamaSysctl() (int, error) {
+	data, err := os.ReadFile("/proc/sys/kernel/yama/ptrace_scope")
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read yama.ptrace_scope: %w", err)
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse yama.ptrace_scope value: %w", err)
+	}
+
+	return value, nil
+}
+
+// setYamaSysctl sets the yama.ptrace_scope sysctl value
+func setYamaSysctl(value int) error {
+	return os.WriteFile("/proc/sys/kernel/yama/ptrace_scope", []byte(fmt.Sprintf("%d\n", value)), 0644)
+}
+
+// fixYamaSysctl temporarily sets yama.ptrace_scope to 0 and returns a cleanup function
+func fixYamaSysctl() (func(), error) {
+	originalValue, err := checkYamaSysctl()
+	if err != nil {
+		return nil, err
+	}
+
+	if originalValue == 0 {
+		// Already set to 0, no need to change
+		return func() {}, nil
+	}
+
+	// Set to 0
+	if err := setYamaSysctl(0); err != nil {
+		return nil, fmt.Errorf("failed to set yama.ptrace_scope to 0: %w", err)
+	}
+
+	// Return cleanup function
+	return func() {
+		if err := setYamaSysctl(originalValue); err != nil {
+			log.Printf("Warning: failed to restore yama.ptrace_scope to %d: %v", originalValue, err)
+		}
+	}, nil
+}
+
+// subcommands maps the name of each subcommand to its implementation,
+// which is passed the arguments after the name. Without one, livecore
+// dumps a process.
+var subcommands = map[string]func(args []string) error{
+	"check":   checkMain,
+	"compare": compareMain,
+	"decrypt": decryptMain,
+	"info":    infoMain,
+	"merge":   mergeMain,
+	"ps":      psMain,
+	"replay":  replayMain,
+	"verify":  verifyMain,
+	"watch":   watchMain,
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	config, err := parseFlags()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	setUpLogging(config)
+
+	// Check yama sysctl and handle it
+	yamaValue, err := checkYamaSysctl()
+	if err != nil {
+		fail(config, err)
+	}
+
+	// Scopes 1 and 2 let a process with CAP_SYS_PTRACE attach anyway.
+	if self, err := proc.ReadStatus(os.Getpid()); err == nil && self.HasPtraceCap() && yamaValue < 3 {
+		yamaValue = 0
+	}
+
+	var cleanupYama func()
+	if yamaValue != 0 {
+		if config.FixYama {
+			// Automatically fix yama sysctl
+			cleanupYama, err = fixYamaSysctl()
+			if err != nil {
+				fail(config, fmt.Errorf("failed to fix yama sysctl: %w", err))
+			}
+			log.Printf("Temporarily set yama.ptrace_scope to 0 (was %d)", yamaValue)
+		} else if jsonLog != nil {
+			fail(config, fmt.Errorf("yama.ptrace_scope is set to %d (non-zero), which prevents ptrace; run sudo sysctl kernel.yama.ptrace_scope=0, or use -fix-yama", yamaValue))
+		} else {
+			// Fail with instructions
+			fmt.Fprintf(os.Stderr, "Error: yama.ptrace_scope is set to %d (non-zero), which prevents ptrace\n", yamaValue)
+			fmt.Fprintf(os.Stderr, "To fix this, run: sudo sysctl kernel.yama.ptrace_scope=0\n")
+			fmt.Fprintf(os.Stderr, "Or use the -fix-yama flag to automatically fix and restore it\n")
+			err := fmt.Errorf("yama.ptrace_scope is %d", yamaValue)
+			writeErrorReport(config, err)
+			summary.write(err)
+			os.Exit(1)
+		}
+	}
+
+	// Set up signal handling to ensure cleanup on exit
+	if cleanupYama != nil {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigChan
+			log.Println("Received signal, cleaning up...")
+			cleanupYama()
+			os.Exit(1)
+		}()
+	}
+
+	if config.MetricsAddr != "" {
+		metrics, err = startMetrics(config.MetricsAddr)
+		if err != nil {
+			fail(config, err)
+		}
+	}
+
+	// Run livecore
+	err = dumpToFile(config)
+	bar.finish()
+	metrics.finish(config.MetricsLinger)
+
+	// Clean up yama sysctl if we modified it
+	if cleanupYama != nil {
+		cleanupYama()
+	}
+
+	if err != nil {
+		fail(config, err)
+	}
+	summary.write(nil)
+}
+
+// setUpLogging sets up the log for config's -log-format, -report, and
+// -progress.
+func setUpLogging(config *Config) {
+	var w io.Writer = os.Stderr
+	if config.Progress {
+		bar = newProgressBar(os.Stderr)
+		w = bar
+	}
+	if config.LogFormat == "json" {
+		jsonLog = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+	if config.Report != "" {
+		summary = newSummary(config, config.Report)
+	}
+	log.SetFlags(0)
+	log.SetOutput(logWriter{w})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bradfitz/livecore"
+)
+
+// manifestSuffix is appended to a core's name to name its manifest.
+const manifestSuffix = ".manifest.json"
+
+// writeManifest writes m, with the checksum of the core file at path
+// filled in, to path's manifest file.
+func writeManifest(path string, m *livecore.Manifest) error {
+	if m == nil {
+		return fmt.Errorf("no manifest for %s", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %s: %w", path, err)
+	}
+	m.Core = &livecore.FileChecksum{SHA256: hex.EncodeToString(h.Sum(nil)), Size: n}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+manifestSuffix, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// readManifest reads a manifest written by writeManifest.
+func readManifest(path string) (*livecore.Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := new(livecore.Manifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bradfitz/livecore/elfcore"
+)
+
+// mergeMain implements "livecore merge": it rebuilds a full core from a
+// full core and the incremental cores taken after it.
+func mergeMain(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s merge <base.core> <incremental.core>... <output.core|->\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Writes the full core that a full core and the incremental cores taken\n")
+		fmt.Fprintf(fs.Output(), "after it, oldest first, add up to: that of the last incremental core.\n")
+	}
+	fs.Parse(args)
+	if fs.NArg() < 3 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	paths, output := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+
+	var cores []*elfcore.CoreReader
+	defer func() {
+		for _, cr := range cores {
+			cr.Close()
+		}
+	}()
+	for i, path := range paths {
+		cr, err := elfcore.OpenCore(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		cores = append(cores, cr)
+		if i == 0 {
+			if cr.Info().Incremental != nil {
+				return fmt.Errorf("%s is incremental; start from the full core it builds on", path)
+			}
+			continue
+		}
+		if err := elfcore.CheckBase(cr.Info(), cores[i-1].Info()); err != nil {
+			return fmt.Errorf("%s doesn't follow %s: %w", path, paths[i-1], err)
+		}
+	}
+	info, mem, err := elfcore.MergeCores(cores)
+	if err != nil {
+		return err
+	}
+
+	var w *elfcore.ELFWriter
+	if output == "-" {
+		w = elfcore.NewStreamWriter(os.Stdout, info, mem)
+	} else {
+		for _, path := range paths {
+			if sameFile(path, output) {
+				return fmt.Errorf("the output can't be one of the cores being merged")
+			}
+		}
+		if w, err = elfcore.NewELFWriter(output, info, mem); err != nil {
+			return err
+		}
+	}
+	defer w.Close()
+	if err := w.WriteCore(); err != nil {
+		if output != "-" {
+			os.Remove(output)
+		}
+		return fmt.Errorf("failed to write merged core: %w", err)
+	}
+	return w.Close()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/livecore"
+)
+
+// metrics serves the dumps' statistics with -metrics-addr, or is nil.
+var metrics *metricsServer
+
+// metricsServer serves the statistics of the dumps it tracks at /metrics,
+// in the Prometheus text format.
+type metricsServer struct {
+	mu      sync.Mutex
+	dumpers []trackedDumper
+	done    bool // the dumps have finished
+
+	scraped     chan struct{} // closed by the first scrape once done
+	scrapedOnce sync.Once
+}
+
+// trackedDumper is a dump whose statistics are served.
+type trackedDumper struct {
+	pid int
+	d   *livecore.Dumper
+}
+
+// startMetrics starts serving metrics on addr.
+func startMetrics(addr string) (*metricsServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	m := &metricsServer{scraped: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.serveHTTP)
+	go http.Serve(ln, mux)
+	log.Printf("Serving metrics at http://%s/metrics", ln.Addr())
+	return m, nil
+}
+
+// track adds the statistics of d, dumping pid, to those served. It's a
+// no-op on a nil server.
+func (m *metricsServer) track(pid int, d *livecore.Dumper) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dumpers = append(m.dumpers, trackedDumper{pid, d})
+}
+
+// finish waits, once the dumps are done, for the final statistics to be
+// scraped, or for linger to pass, so a one-off dump's results aren't lost
+// when livecore exits. It's a no-op on a nil server.
+func (m *metricsServer) finish(linger time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.done = true
+	m.mu.Unlock()
+	select {
+	case <-m.scraped:
+	case <-time.After(linger):
+		log.Printf("Warning: final metrics weren't scraped within %v", linger)
+	}
+}
+
+func (m *metricsServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	dumpers, done := m.dumpers, m.done
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, dumpers)
+	if done {
+		m.scrapedOnce.Do(func() { close(m.scraped) })
+	}
+}
+
+// writeMetrics writes the dumpers' statistics, labeled by pid.
+func writeMetrics(w io.Writer, dumpers []trackedDumper) {
+	type dump struct {
+		pid   string
+		stats livecore.Stats
+	}
+	dumps := make([]dump, len(dumpers))
+	for i, t := range dumpers {
+		dumps[i] = dump{strconv.Itoa(t.pid), t.d.Stats()}
+	}
+	family := func(name, typ, help string, samples func(d dump, emit func(labels string, v float64))) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, d := range dumps {
+			samples(d, func(labels string, v float64) {
+				fmt.Fprintf(w, "%s{pid=%q%s} %s\n", name, d.pid, labels, strconv.FormatFloat(v, 'g', -1, 64))
+			})
+		}
+	}
+	gauge := func(name, help string, v func(s livecore.Stats) float64) {
+		family(name, "gauge", help, func(d dump, emit func(string, float64)) { emit("", v(d.stats)) })
+	}
+	boolean := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	gauge("livecore_dump_done", "Whether the dump has finished successfully.", func(s livecore.Stats) float64 { return boolean(s.Phase == "done") })
+	gauge("livecore_dump_failed", "Whether the dump has failed.", func(s livecore.Stats) float64 { return boolean(s.Failed) })
+	family("livecore_phase_seconds", "gauge", "How long each dump phase took, or has taken so far.", func(d dump, emit func(string, float64)) {
+		for _, p := range d.stats.Phases {
+			emit(fmt.Sprintf(",phase=%q", p.Phase), p.Duration.Seconds())
+		}
+	})
+	passes := func(name, help string, v func(p livecore.PassStats) float64) {
+		family(name, "gauge", help, func(d dump, emit func(string, float64)) {
+			for i, p := range d.stats.PreCopyPasses {
+				emit(fmt.Sprintf(",pass=\"%d\"", i+1), v(p))
+			}
+		})
+	}
+	passes("livecore_precopy_pass_seconds", "How long each pre-copy pass took.", func(p livecore.PassStats) float64 { return p.Duration.Seconds() })
+	passes("livecore_precopy_pass_dirty_ratio", "Fraction of pages dirtied during each pre-copy pass.", func(p livecore.PassStats) float64 { return p.DirtyRatio })
+	passes("livecore_precopy_pass_dirty_pages", "Pages dirtied during each pre-copy pass.", func(p livecore.PassStats) float64 { return float64(p.DirtyPages) })
+	passes("livecore_precopy_pass_dirty_pages_per_second", "Rate at which the target dirtied pages during each pre-copy pass.", func(p livecore.PassStats) float64 { return p.DirtyRate })
+	passes("livecore_precopy_pass_bytes", "Bytes copied by each pre-copy pass.", func(p livecore.PassStats) float64 { return float64(p.BytesCopied) })
+	passes("livecore_precopy_pass_zero_page_bytes", "Bytes of memory mapping the shared zero page that each pre-copy pass skipped.", func(p livecore.PassStats) float64 { return float64(p.ZeroPageBytes) })
+	gauge("livecore_threads", "Threads in the target.", func(s livecore.Stats) float64 { return float64(s.Threads) })
+	gauge("livecore_unstopped_threads", "Threads that didn't stop within the stop timeout.", func(s livecore.Stats) float64 { return float64(s.UnstoppedThreads) })
+	gauge("livecore_freeze_seconds", "How long seizing and stopping the target's threads took.", func(s livecore.Stats) float64 { return s.FreezeTime.Seconds() })
+	gauge("livecore_stop_seconds", "How long the target was stopped.", func(s livecore.Stats) float64 { return s.StopTime.Seconds() })
+	gauge("livecore_final_dirty_pages", "Pages copied while the target was stopped.", func(s livecore.Stats) float64 { return float64(s.FinalDirtyPages) })
+	gauge("livecore_copied_bytes", "Bytes of memory read from the target.", func(s livecore.Stats) float64 { return float64(s.BytesCopied) })
+	gauge("livecore_swapped_in_bytes", "Bytes of swapped-out, dirty memory faulted in before the freeze.", func(s livecore.Stats) float64 { return float64(s.SwappedInBytes) })
+	gauge("livecore_changed_bytes", "For an incremental dump, bytes of memory changed since the base.", func(s livecore.Stats) float64 { return float64(s.ChangedBytes) })
+	gauge("livecore_read_failures", "Ranges the final copy couldn't read with process_vm_readv.", func(s livecore.Stats) float64 { return float64(s.ReadFailures) })
+	gauge("livecore_read_failure_bytes", "Bytes the final copy couldn't read with process_vm_readv.", func(s livecore.Stats) float64 { return float64(s.ReadFailureBytes) })
+	gauge("livecore_uncopied_bytes", "Bytes of dirty memory -max-stw left uncopied while the target was stopped.", func(s livecore.Stats) float64 { return float64(s.UncopiedBytes) })
+	gauge("livecore_scratch_bytes", "Disk space the scratch buffer took up once everything was copied.", func(s livecore.Stats) float64 { return float64(s.ScratchBytes) })
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/livecore"
+	"golang.org/x/sys/unix"
+)
+
+// bar draws the dump's progress with -progress, or is nil.
+var bar *progressBar
+
+// progressBarWidth is how many characters wide the bar itself is.
+const progressBarWidth = 25
+
+// progressBar draws a dump's progress: on a terminal, a line per phase,
+// or pre-copy pass, redrawn as it goes, with a bar for those that move
+// memory; elsewhere, just a line as each starts.
+type progressBar struct {
+	w        io.Writer
+	terminal bool
+	last     livecore.Progress
+	drawn    bool // the current phase's line is unfinished
+}
+
+// newProgressBar returns a progressBar drawing on f.
+func newProgressBar(f *os.File) *progressBar {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return &progressBar{w: f, terminal: err == nil}
+}
+
+// update draws p, for livecore.WithProgress.
+func (b *progressBar) update(p livecore.Progress) {
+	started := p.Phase != b.last.Phase || p.Pass != b.last.Pass
+	b.last = p
+	if started {
+		b.finish()
+	}
+	switch {
+	case p.Phase == "done":
+	case !b.terminal:
+		if started {
+			fmt.Fprintln(b.w, progressLabel(p))
+		}
+	default:
+		fmt.Fprintf(b.w, "\r\033[K%s", progressLine(p))
+		b.drawn = true
+	}
+}
+
+// Write writes p, a log message, above the current phase's line, which
+// it then redraws, so that logging doesn't garble the bar.
+func (b *progressBar) Write(p []byte) (int, error) {
+	if !b.drawn {
+		return b.w.Write(p)
+	}
+	fmt.Fprint(b.w, "\r\033[K")
+	n, err := b.w.Write(p)
+	fmt.Fprint(b.w, progressLine(b.last))
+	return n, err
+}
+
+// finish ends the current phase's line, leaving it as last drawn. It's a
+// no-op on a nil progressBar.
+func (b *progressBar) finish() {
+	if b == nil || !b.drawn {
+		return
+	}
+	fmt.Fprintln(b.w)
+	b.drawn = false
+}
+
+// progressLabel names p's phase, and its pre-copy pass.
+func progressLabel(p livecore.Progress) string {
+	if p.Pass > 0 {
+		return fmt.Sprintf("%s pass %d", p.Phase, p.Pass)
+	}
+	return p.Phase
+}
+
+// progressLine describes p in a line: its phase, and for one that moves
+// memory, a bar, how much it has moved, and how long it has left.
+func progressLine(p livecore.Progress) string {
+	label := fmt.Sprintf("%-15s", progressLabel(p))
+	if p.Total == 0 {
+		if p.Done == 0 {
+			return label
+		}
+		return fmt.Sprintf("%s %d MB", label, p.Done>>20)
+	}
+	frac := min(float64(p.Done)/float64(p.Total), 1)
+	filled := int(frac * progressBarWidth)
+	line := fmt.Sprintf("%s [%s%s] %3.0f%% %d/%d MB", label,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		frac*100, p.Done>>20, p.Total>>20)
+	if eta := p.ETA(); eta > 0 {
+		line += fmt.Sprintf(", ETA %v", eta.Round(100*time.Millisecond))
+	}
+	return line
+}
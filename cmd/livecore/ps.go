@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/bradfitz/livecore"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// psEntry is a row of "livecore ps" output.
+type psEntry struct {
+	pid     int
+	comm    string
+	threads int
+	vmas    int
+	rss     uint64
+	core    uint64 // estimated
+	why     string // why it can't be dumped, or ""
+}
+
+// psMain implements "livecore ps": it lists the processes livecore could
+// dump, with enough about each to predict what dumping it would cost.
+func psMain(args []string) error {
+	fs := flag.NewFlagSet("ps", flag.ExitOnError)
+	all := fs.Bool("all", false, "also list processes that can't be dumped, and why")
+	sortBy := fs.String("sort", "pid", "sort by pid, rss, or core")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ps [flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Lists the processes you can dump, with their thread and VMA counts,\n")
+		fmt.Fprintf(fs.Output(), "resident memory, and the estimated size of the page data in a core.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var less func(a, b psEntry) int
+	switch *sortBy {
+	case "pid":
+		less = func(a, b psEntry) int { return cmp.Compare(a.pid, b.pid) }
+	case "rss":
+		less = func(a, b psEntry) int { return cmp.Compare(b.rss, a.rss) }
+	case "core":
+		less = func(a, b psEntry) int { return cmp.Compare(b.core, a.core) }
+	default:
+		return fmt.Errorf("invalid -sort value %q (must be pid, rss, or core)", *sortBy)
+	}
+
+	self, err := proc.ReadStatus(os.Getpid())
+	if err != nil {
+		return err
+	}
+	if scope, err := checkYamaSysctl(); err == nil && scope != 0 {
+		fmt.Fprintf(os.Stderr, "Note: yama.ptrace_scope is %d; dumping needs it to be 0 (see -fix-yama)\n", scope)
+	}
+
+	pids, err := proc.ListPids()
+	if err != nil {
+		return err
+	}
+	var entries []psEntry
+	for _, pid := range pids {
+		if pid == os.Getpid() {
+			continue
+		}
+		e, ok := psLookup(pid, &self)
+		if !ok || (e.why != "" && !*all) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	slices.SortStableFunc(entries, less)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "PID\tTHREADS\tVMAS\tRSS MB\tCORE MB\t  COMMAND\n")
+	for _, e := range entries {
+		if e.why != "" {
+			fmt.Fprintf(tw, "%d\t-\t-\t-\t-\t  %s (%s)\n", e.pid, e.comm, e.why)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t  %s\n", e.pid, e.threads, e.vmas, e.rss>>20, e.core>>20, e.comm)
+	}
+	return tw.Flush()
+}
+
+// psLookup gathers pid's row of "livecore ps" output, as seen by a
+// process with status self. It returns false for processes that went away
+// or have no memory to dump.
+func psLookup(pid int, self *proc.Status) (e psEntry, ok bool) {
+	st, err := proc.ReadStatus(pid)
+	if err != nil {
+		return e, false
+	}
+	if st.NoMemory {
+		return e, false
+	}
+	e = psEntry{pid: pid, comm: st.Name, threads: st.Threads, rss: st.VmRSS}
+	if e.why = ptraceDenied(self, &st); e.why != "" {
+		return e, true
+	}
+
+	vmas, err := proc.ParseMaps(pid)
+	if err != nil {
+		e.why = err.Error()
+		return e, true
+	}
+	e.vmas = len(vmas)
+	e.core, _ = livecore.New(pid).EstimateSize()
+	return e, true
+}
+
+// ptraceDenied returns why a process with status self can't ptrace one with
+// status target, or "" if it can, following the kernel's ptrace access
+// check without Yama, which livecore needs out of the way regardless.
+func ptraceDenied(self, target *proc.Status) string {
+	if self.HasPtraceCap() {
+		return ""
+	}
+	uid, gid := self.Uids[0], self.Gids[0]
+	for i := range 3 {
+		if target.Uids[i] != uid || target.Gids[i] != gid {
+			return fmt.Sprintf("uid %d, gid %d", target.Uids[1], target.Gids[1])
+		}
+	}
+	if !target.Dumpable() {
+		return "not dumpable"
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bradfitz/livecore"
+)
+
+// replayMain implements "livecore replay": it turns the record stream of
+// a dump made with -records into the core.
+func replayMain(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	tempDir := fs.String("tmpdir", "", "put the scratch buffer the pages are replayed into in this `dir` (default: $TMPDIR if set, or else /tmp)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [-tmpdir dir] <records|-> <output.core|->\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Writes the core that a dump made with -records describes. Records\n")
+		fmt.Fprintf(fs.Output(), "written with -compress or -encrypt must be decompressed or decrypted\n")
+		fmt.Fprintf(fs.Output(), "first, such as with zstd -dc records.zst | %s replay - out.core.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	input, output := fs.Arg(0), fs.Arg(1)
+
+	r := io.Reader(os.Stdin)
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if output == "-" {
+		return livecore.Replay(r, os.Stdout, *tempDir)
+	}
+	if input != "-" && sameFile(input, output) {
+		return fmt.Errorf("the output can't be the records being replayed")
+	}
+	f, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = livecore.Replay(r, f, *tempDir)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
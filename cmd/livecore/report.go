@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/livecore"
+)
+
+// jsonLog writes the log as JSON objects with -log-format=json, or is nil.
+var jsonLog *slog.Logger
+
+// summary collects the final JSON summary of the run, for -report or
+// -log-format=json, or is nil.
+var summary *summaryReport
+
+// summaryReport is the final summary of a run, as it's collected.
+type summaryReport struct {
+	config *Config
+	dest   string // where to write it; "-" is stderr
+	start  time.Time
+
+	mu       sync.Mutex
+	dumps    []summaryDump
+	warnings []string
+}
+
+// summaryDump is a dump whose results are summarized.
+type summaryDump struct {
+	pid    int
+	d      *livecore.Dumper
+	output string
+}
+
+// newSummary returns a summaryReport of the run config describes, to be
+// written to dest.
+func newSummary(config *Config, dest string) *summaryReport {
+	return &summaryReport{config: config, dest: dest, start: time.Now()}
+}
+
+// track adds d, dumping pid to output, to the dumps summarized. It's a
+// no-op on a nil summary.
+func (s *summaryReport) track(pid int, d *livecore.Dumper, output string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dumps = append(s.dumps, summaryDump{pid, d, output})
+}
+
+// logged records msg, a line of the log, if it's a warning. It's a no-op
+// on a nil summary.
+func (s *summaryReport) logged(msg string) {
+	if s == nil {
+		return
+	}
+	if _, w, ok := cutWarning(msg); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.warnings = append(s.warnings, w)
+	}
+}
+
+// The JSON form of the summary. Durations are in seconds.
+type (
+	summaryJSON struct {
+		Status   string       `json:"status"` // "ok" or "failed"
+		ExitCode int          `json:"exitCode"`
+		Error    *errorReport `json:"error,omitempty"`
+		Seconds  float64      `json:"seconds"`
+		Dumps    []dumpJSON   `json:"dumps"`
+		Warnings []string     `json:"warnings"`
+	}
+	dumpJSON struct {
+		Pid               int         `json:"pid"`
+		Output            string      `json:"output"`         // "-" for stdout
+		Size              int64       `json:"size,omitempty"` // of the core file, if it was kept
+		Phase             string      `json:"phase"`          // "done", or the one that failed
+		Failed            bool        `json:"failed"`
+		Phases            []phaseJSON `json:"phases"`
+		PreCopyPasses     []passJSON  `json:"preCopyPasses,omitempty"`
+		PreCopyStopReason string      `json:"preCopyStopReason,omitempty"`
+		Threads           int         `json:"threads"`
+		UnstoppedThreads  int         `json:"unstoppedThreads"`
+		FreezeSeconds     float64     `json:"freezeSeconds"`
+		StopSeconds       float64     `json:"stopSeconds"`
+		FinalDirtyPages   int         `json:"finalDirtyPages"`
+		BytesCopied       uint64      `json:"bytesCopied"`
+		SwappedInBytes    uint64      `json:"swappedInBytes,omitempty"`
+		ChangedBytes      uint64      `json:"changedBytes,omitempty"`
+		ReadFailures      int         `json:"readFailures"`
+		ReadFailureBytes  uint64      `json:"readFailureBytes"`
+		UncopiedBytes     uint64      `json:"uncopiedBytes,omitempty"`
+		ScratchBytes      uint64      `json:"scratchBytes"`
+		ScratchDir        string      `json:"scratchDir,omitempty"`
+		ScratchInMemory   bool        `json:"scratchInMemory,omitempty"`
+	}
+	phaseJSON struct {
+		Phase   string  `json:"phase"`
+		Seconds float64 `json:"seconds"`
+	}
+	passJSON struct {
+		Seconds       float64 `json:"seconds"`
+		DirtyRatio    float64 `json:"dirtyRatio"`
+		DirtyPages    int     `json:"dirtyPages"`
+		DirtyRate     float64 `json:"dirtyPagesPerSecond"`
+		BytesCopied   uint64  `json:"bytesCopied"`
+		ZeroPageBytes uint64  `json:"zeroPageBytes"`
+	}
+)
+
+// write writes the summary of the run, which failed with err if it's not
+// nil. It's a no-op on a nil summary.
+func (s *summaryReport) write(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	dumps, warnings := s.dumps, append([]string{}, s.warnings...)
+	s.mu.Unlock()
+
+	r := summaryJSON{
+		Status:   "ok",
+		Seconds:  time.Since(s.start).Seconds(),
+		Dumps:    []dumpJSON{},
+		Warnings: warnings,
+	}
+	if err != nil {
+		e := newErrorReport(s.config, err)
+		r.Status, r.ExitCode, r.Error = "failed", 1, &e
+	}
+	for _, t := range dumps {
+		st := t.d.Stats()
+		d := dumpJSON{
+			Pid:               t.pid,
+			Output:            t.output,
+			Phase:             st.Phase,
+			Failed:            st.Failed || err != nil && st.Phase != "done",
+			Phases:            []phaseJSON{},
+			PreCopyStopReason: st.PreCopyStopReason,
+			Threads:           st.Threads,
+			UnstoppedThreads:  st.UnstoppedThreads,
+			FreezeSeconds:     st.FreezeTime.Seconds(),
+			StopSeconds:       st.StopTime.Seconds(),
+			FinalDirtyPages:   st.FinalDirtyPages,
+			BytesCopied:       st.BytesCopied,
+			SwappedInBytes:    st.SwappedInBytes,
+			ChangedBytes:      st.ChangedBytes,
+			ReadFailures:      st.ReadFailures,
+			ReadFailureBytes:  st.ReadFailureBytes,
+			UncopiedBytes:     st.UncopiedBytes,
+			ScratchBytes:      st.ScratchBytes,
+			ScratchDir:        st.ScratchDir,
+			ScratchInMemory:   st.ScratchInMemory,
+		}
+		if d.Phase == "" {
+			d.Phase = "setup" // it failed before starting
+		}
+		if fi, err := os.Stat(t.output); err == nil && t.output != "-" && fi.Mode().IsRegular() {
+			d.Size = fi.Size()
+		}
+		for _, p := range st.Phases {
+			d.Phases = append(d.Phases, phaseJSON{p.Phase, p.Duration.Seconds()})
+		}
+		for _, p := range st.PreCopyPasses {
+			d.PreCopyPasses = append(d.PreCopyPasses, passJSON{p.Duration.Seconds(), p.DirtyRatio, p.DirtyPages, p.DirtyRate, p.BytesCopied, p.ZeroPageBytes})
+		}
+		r.Dumps = append(r.Dumps, d)
+	}
+
+	data, _ := json.Marshal(r)
+	data = append(data, '\n')
+	if s.dest == "-" {
+		os.Stderr.Write(data)
+		return
+	}
+	if err := os.WriteFile(s.dest, data, 0644); err != nil {
+		log.Printf("Warning: failed to write report: %v", err)
+	}
+}
+
+// logTimeFormat is how logWriter timestamps text lines, as the log
+// package does with LstdFlags and Lmicroseconds.
+const logTimeFormat = "2006/01/02 15:04:05.000000"
+
+// logWriter is where the log package writes, with no flags. It records
+// warnings in the summary, if there is one, and passes each line on to w,
+// timestamped, or, with -log-format=json, to jsonLog, with a level.
+type logWriter struct {
+	w io.Writer
+}
+
+func (lw logWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	summary.logged(msg)
+	if jsonLog == nil {
+		_, err := fmt.Fprintf(lw.w, "%s %s", time.Now().Format(logTimeFormat), p)
+		return len(p), err
+	}
+	level := slog.LevelInfo
+	if prefix, w, ok := cutWarning(msg); ok {
+		level, msg = slog.LevelWarn, prefix+w
+	}
+	jsonLog.Log(context.Background(), level, msg)
+	return len(p), nil
+}
+
+// cutWarning splits a log line that's a warning, "Warning: w", or, from
+// a -follow-children dump, "[pid] Warning: w", around "Warning: ".
+func cutWarning(msg string) (prefix, w string, ok bool) {
+	prefix, w, ok = strings.Cut(msg, "Warning: ")
+	if ok && prefix != "" && !(strings.HasPrefix(prefix, "[") && strings.HasSuffix(prefix, "] ")) {
+		return "", "", false
+	}
+	return prefix, w, ok
+}
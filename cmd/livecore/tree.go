@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bradfitz/livecore"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// treeCoreName returns the name of pid's core in a -follow-children dump
+// to output: output.<pid>, as the kernel names cores with core_uses_pid.
+func treeCoreName(output string, pid int) string {
+	return output + "." + strconv.Itoa(pid)
+}
+
+// dumpTree dumps the target and all its descendants, each to its own core
+// named by treeCoreName, freezing them together. Cores that fail are
+// removed; the others are kept even if some fail.
+func dumpTree(config *Config) error {
+	kids, err := proc.Descendants(config.Pid)
+	if err != nil {
+		return &livecore.PhaseError{Phase: "setup", Err: fmt.Errorf("failed to find child processes: %w", err)}
+	}
+	pids := append([]int{config.Pid}, kids...)
+	log.Printf("Dumping process %d and %d descendants", config.Pid, len(kids))
+
+	names := make([]string, len(pids))
+	files := make([]*os.File, len(pids))
+	ds := make([]*livecore.Dumper, len(pids))
+	ws := make([]io.Writer, len(pids))
+	cws := make([]io.WriteCloser, len(pids))
+	defer func() {
+		// Clean up after a failure to set up the dumps.
+		for i, f := range files {
+			if f == nil {
+				continue
+			}
+			if cws[i] != nil {
+				cws[i].Close()
+			}
+			f.Close()
+			os.Remove(names[i])
+		}
+	}()
+	for i, pid := range pids {
+		names[i] = treeCoreName(config.OutputFile, pid)
+		files[i], err = os.Create(names[i])
+		if err != nil {
+			return &livecore.PhaseError{Phase: "setup", Err: fmt.Errorf("failed to create core file: %w", err)}
+		}
+		opts := append(config.options(),
+			livecore.WithLogf(func(format string, args ...any) {
+				log.Printf("[%d] "+format, append([]any{pid}, args...)...)
+			}))
+		if i > 0 {
+			opts = append(opts, livecore.WithPidfd(-1)) // the pidfd is the root's
+		}
+		ws[i] = files[i]
+		cws[i], err = outputWriter(config, files[i])
+		if err != nil {
+			return &livecore.PhaseError{Phase: "setup", Err: err}
+		}
+		if cws[i] != nil {
+			opts = append(opts, livecore.WithTempDir(config.scratchDir(filepath.Dir(names[i]))))
+			ws[i] = cws[i]
+		}
+		ds[i] = livecore.New(pid, opts...)
+		metrics.track(pid, ds[i])
+		summary.track(pid, ds[i], names[i])
+	}
+
+	errs := livecore.DumpAll(context.Background(), ds, ws)
+	for i, pid := range pids {
+		if cws[i] != nil {
+			if err := cws[i].Close(); errs[i] == nil && err != nil {
+				errs[i] = &livecore.PhaseError{Phase: "write", Err: fmt.Errorf("failed to finish core: %w", err)}
+			}
+		}
+		if err := files[i].Close(); errs[i] == nil && err != nil {
+			errs[i] = &livecore.PhaseError{Phase: "write", Err: fmt.Errorf("failed to close core file: %w", err)}
+		}
+		files[i] = nil
+		if errs[i] != nil {
+			os.Remove(names[i])
+			errs[i] = fmt.Errorf("process %d: %w", pid, errs[i])
+			continue
+		}
+		if config.Checksum {
+			if err := writeManifest(names[i], ds[i].Manifest()); err != nil {
+				os.Remove(names[i])
+				errs[i] = fmt.Errorf("process %d: %w", pid, err)
+				continue
+			}
+		}
+		log.Printf("Wrote %s", names[i])
+		if config.Upload != "" {
+			if err := uploadCore(config.Upload, names[i]); err != nil {
+				errs[i] = fmt.Errorf("process %d: %w", pid, &livecore.PhaseError{Phase: "write", Err: fmt.Errorf("wrote %s, but failed to upload it: %w", names[i], err)})
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/livecore/proc"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day
+// of month, month, and day of week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bitmasks of allowed values
+	domAny, dowAny                bool   // the field was *
+}
+
+// parseCron parses a cron expression such as "*/15 * * * *" or
+// "0 9-17 * * 1-5". Each field is *, a number, a range a-b, any of those
+// with a /step, or a comma-separated list of them. As in cron, when both
+// the day of month and day of week are restricted, a day matching either
+// will do.
+func parseCron(s string) (*cronSchedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: want 5 fields, got %d", s, len(fields))
+	}
+	c := new(cronSchedule)
+	for i, f := range []struct {
+		mask     *uint64
+		lo, hi   int
+		anyField *bool
+	}{
+		{&c.minute, 0, 59, nil},
+		{&c.hour, 0, 23, nil},
+		{&c.dom, 1, 31, &c.domAny},
+		{&c.month, 1, 12, nil},
+		{&c.dow, 0, 7, &c.dowAny},
+	} {
+		mask, err := parseCronField(fields[i], f.lo, f.hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", s, err)
+		}
+		*f.mask = mask
+		if f.anyField != nil {
+			*f.anyField = fields[i] == "*"
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	return c, nil
+}
+
+// parseCronField parses one field of a cron expression, whose values
+// range from lo to hi, into a bitmask.
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+		}
+		start, end := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value in %q", part)
+				}
+			} else if hasStep {
+				end = hi
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// next returns the first minute after t that c matches, or the zero time
+// if there's none within five years, as for February 30th.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches reports whether t's day matches c's day of month and day of
+// week fields.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// A trigger decides, each time it's polled, whether the target should be
+// dumped now.
+type trigger interface {
+	// check returns why the target should be dumped, or "" if it
+	// shouldn't.
+	check(pid int) (string, error)
+}
+
+// rssTrigger fires while the target's resident memory is above limit
+// bytes.
+type rssTrigger struct {
+	limit uint64
+}
+
+func (t *rssTrigger) check(pid int) (string, error) {
+	st, err := proc.ReadStatus(pid)
+	if err != nil {
+		return "", err
+	}
+	if st.VmRSS > t.limit {
+		return fmt.Sprintf("rss %d above %d", st.VmRSS, t.limit), nil
+	}
+	return "", nil
+}
+
+// clockTicks is the kernel's USER_HZ, the unit of the CPU times in
+// /proc/<pid>/stat. It's 100 on every Linux architecture Go supports.
+const clockTicks = 100
+
+// cpuTrigger fires when the target used more than pct percent of a CPU
+// (which can be over 100, for several) since the previous poll.
+type cpuTrigger struct {
+	pct float64
+
+	lastTicks uint64
+	lastTime  time.Time
+}
+
+func (t *cpuTrigger) check(pid int) (string, error) {
+	info, err := proc.GetProcessInfo(pid)
+	if err != nil {
+		return "", err
+	}
+	fields := proc.StatFields([]byte(info.Stat))
+	if len(fields) < 13 {
+		return "", fmt.Errorf("stat has %d fields, want at least 15", len(fields)+2)
+	}
+	var ticks uint64
+	for _, f := range fields[11:13] { // utime and stime
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid CPU time in stat: %w", err)
+		}
+		ticks += v
+	}
+	now := time.Now()
+	lastTicks, lastTime := t.lastTicks, t.lastTime
+	t.lastTicks, t.lastTime = ticks, now
+	if lastTime.IsZero() {
+		return "", nil
+	}
+	used := float64(ticks-lastTicks) / clockTicks / now.Sub(lastTime).Seconds() * 100
+	if used > t.pct {
+		return fmt.Sprintf("cpu %.0f%% above %.0f%%", used, t.pct), nil
+	}
+	return "", nil
+}
+
+// stateTrigger fires when the target's main thread enters one of the
+// scheduler states in states, such as "D" or "T", from another.
+type stateTrigger struct {
+	states string
+
+	last byte
+}
+
+func (t *stateTrigger) check(pid int) (string, error) {
+	state, err := proc.ThreadState(pid, pid)
+	if err != nil {
+		return "", err
+	}
+	last := t.last
+	t.last = state
+	if state != last && strings.IndexByte(t.states, state) >= 0 {
+		return fmt.Sprintf("state %c", state), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/livecore/internal/upload"
+)
+
+// uploadCore uploads the core at path, and its manifest if -checksum
+// wrote one, to dst, then removes them. If either upload fails, both stay
+// where they are. A dst with a query string is taken to be a presigned
+// URL, which the manifest can't go to, so it's kept.
+func uploadCore(dst, path string) error {
+	opts := upload.Options{Logf: log.Printf}
+	coreDst, err := upload.File(context.Background(), dst, path, opts)
+	if err != nil {
+		return err
+	}
+	manifest := path + manifestSuffix
+	if _, err := os.Stat(manifest); err == nil && strings.Contains(coreDst, "?") {
+		// A presigned URL is good for one object only.
+		log.Printf("Not uploading the manifest to a presigned URL; keeping %s", manifest)
+	} else if err == nil {
+		if _, err := upload.File(context.Background(), coreDst+manifestSuffix, manifest, opts); err != nil {
+			return err
+		}
+		if err := os.Remove(manifest); err != nil {
+			return fmt.Errorf("uploaded %s, but failed to remove it: %w", manifest, err)
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("uploaded %s, but failed to remove it: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bradfitz/livecore"
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// verifyMain implements "livecore verify": it checks that a core file is
+// well-formed, and optionally that it matches the process it's of.
+func verifyMain(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	pid := fs.Int("pid", 0, "also check the core's segments against this running process's mappings")
+	manifest := fs.String("manifest", "", "also check the core against this manifest from -checksum")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [-pid <pid>] [-manifest <file>] <core>\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Checks that a core file's ELF headers, segments, and notes are\n")
+		fmt.Fprintf(fs.Output(), "consistent, and exits non-zero if they aren't. With -pid, also\n")
+		fmt.Fprintf(fs.Output(), "reports differences between its segments and the process's mappings,\n")
+		fmt.Fprintf(fs.Output(), "as warnings, since the process may have changed them since. With\n")
+		fmt.Fprintf(fs.Output(), "-manifest, also checks its segments' contents against the checksums\n")
+		fmt.Fprintf(fs.Output(), "that -checksum recorded.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	problems, err := elfcore.Validate(f, st.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if *pid != 0 {
+		pp, err := checkAgainstProcess(path, *pid)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, pp...)
+	}
+	if *manifest != "" {
+		mp, err := checkAgainstManifest(path, f, *manifest)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, mp...)
+	}
+
+	var errs, warnings int
+	for _, p := range problems {
+		fmt.Printf("%s: %v\n", path, p)
+		if p.Warning {
+			warnings++
+		} else {
+			errs++
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("%s: %d errors, %d warnings", path, errs, warnings)
+	}
+	fmt.Printf("%s: ok (%d warnings)\n", path, warnings)
+	return nil
+}
+
+// checkAgainstManifest checks the core at path, open as f, against the
+// manifest at manifestPath. The whole file's checksum is only compared if
+// its size matches, since a compressed core is checked once it's been
+// decompressed; its segments' checksums always should match.
+func checkAgainstManifest(path string, f *os.File, manifestPath string) ([]elfcore.Problem, error) {
+	m, err := readManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var problems []elfcore.Problem
+	errorf := func(format string, args ...any) {
+		problems = append(problems, elfcore.Problem{Msg: fmt.Sprintf(format, args...)})
+	}
+	if m.Core != nil {
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if st.Size() == m.Core.Size {
+			h := sha256.New()
+			if _, err := io.Copy(h, io.NewSectionReader(f, 0, st.Size())); err != nil {
+				return nil, fmt.Errorf("failed to checksum %s: %w", path, err)
+			}
+			if sum := hex.EncodeToString(h.Sum(nil)); sum != m.Core.SHA256 {
+				errorf("core's SHA-256 is %s; manifest says %s", sum, m.Core.SHA256)
+			}
+		}
+	}
+
+	cr, err := elfcore.OpenCore(path)
+	if err != nil {
+		// Validate has said what's wrong with it.
+		return append(problems, elfcore.Problem{Msg: fmt.Sprintf("can't check the core's segments against the manifest: %v", err)}), nil
+	}
+	defer cr.Close()
+	if info := cr.Info(); info.Pid != m.Pid {
+		errorf("core is of process %d; manifest is of %d", info.Pid, m.Pid)
+	}
+	sums, err := elfcore.HashCoreSegments(cr)
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]livecore.ManifestSegment)
+	for _, s := range m.Segments {
+		want[s.Start] = s
+	}
+	for _, s := range sums {
+		start, end := fmt.Sprintf("%x", s.Start), fmt.Sprintf("%x", s.End)
+		w, ok := want[start]
+		switch {
+		case !ok || w.End != end:
+			errorf("segment %s-%s isn't in the manifest", start, end)
+		case w.SHA256 != hex.EncodeToString(s.SHA256[:]):
+			errorf("segment %s-%s doesn't match the manifest's checksum", start, end)
+		}
+		delete(want, start)
+	}
+	for _, s := range m.Segments {
+		if _, ok := want[s.Start]; ok {
+			errorf("manifest's segment %s-%s isn't in the core", s.Start, s.End)
+		}
+	}
+	return problems, nil
+}
+
+// checkAgainstProcess compares the segments of the core at path with the
+// current mappings of process pid. Every difference is a warning: a running
+// process maps and unmaps memory all the time.
+func checkAgainstProcess(path string, pid int) ([]elfcore.Problem, error) {
+	cr, err := elfcore.OpenCore(path)
+	if err != nil {
+		// Validate has said what's wrong with it.
+		return []elfcore.Problem{{Warning: true, Msg: fmt.Sprintf("can't compare the core with process %d: %v", pid, err)}}, nil
+	}
+	defer cr.Close()
+	vmas, err := proc.ParseMaps(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []elfcore.Problem
+	warnf := func(format string, args ...any) {
+		problems = append(problems, elfcore.Problem{Warning: true, Msg: fmt.Sprintf(format, args...)})
+	}
+	if info := cr.Info(); info.Pid != pid {
+		warnf("core is of process %d, not %d", info.Pid, pid)
+	}
+	segs := cr.Segments()
+	for _, s := range segs {
+		mapped := false
+		for _, vma := range vmas {
+			if s.Start >= vma.Start && s.End <= vma.End {
+				mapped = true
+				break
+			}
+		}
+		if !mapped {
+			warnf("segment %#x-%#x isn't within a mapping of process %d", s.Start, s.End, pid)
+		}
+	}
+	omitted := cr.Info().Omitted
+	for _, vma := range vmas {
+		// Cores leave out inaccessible mappings and [vsyscall], which
+		// is at the top of the address space.
+		if !vma.IsDumpable(proc.DefaultDumpFilter) || vma.Perms&(proc.PermRead|proc.PermWrite) == 0 || vma.Start >= 0xffffffffff600000 {
+			continue
+		}
+		covered := false
+		for _, s := range segs {
+			if s.Start < vma.End && vma.Start < s.End {
+				covered = true
+				break
+			}
+		}
+		for _, o := range omitted {
+			if o.Start < vma.End && vma.Start < o.End {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			warnf("process %d's mapping %#x-%#x %s isn't in the core", pid, vma.Start, vma.End, vma.Path)
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/livecore/proc"
+)
+
+// watchMain implements "livecore watch": it dumps a process on a schedule,
+// or when a trigger fires, until the process exits.
+func watchMain(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	every := fs.Duration("every", 0, "dump at this interval (0 means not on an interval)")
+	cron := fs.String("cron", "", "dump on this five-field cron `schedule`, such as \"0 * * * *\", in local time")
+	var rss sizeFlag
+	fs.Var(&rss, "rss-above", "dump when resident memory is above this `size`, such as 8G")
+	cpu := fs.Float64("cpu-above", 0, "dump when CPU use since the last poll is above this percentage of one CPU (0 means don't)")
+	states := fs.String("state", "", "dump when the main thread enters any of these scheduler `states`, such as D or T")
+	poll := fs.Duration("poll", time.Second, "how often to check the triggers")
+	cooldown := fs.Duration("cooldown", 10*time.Minute, "minimum time from one triggered dump to the next")
+	keep := fs.Int("keep", 0, "keep only this many of the newest cores, deleting older ones (0 keeps all)")
+	count := fs.Int("count", 0, "stop after this many dumps (0 means when the process exits)")
+	reflink := fs.Bool("reflink", false, "write each core after the first with -reflink, based on the one before, so on XFS or btrfs it shares the unchanged memory's blocks")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s watch [flags] <pid> <output.core> [-- livecore flags]\n\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Dumps the process on a schedule, or when a trigger fires, to\n")
+		fmt.Fprintf(fs.Output(), "<output.core>.<timestamp>, until it exits. Each core's annotations\n")
+		fmt.Fprintf(fs.Output(), "record why it was taken. The livecore flags apply to every dump.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	pid, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid PID: %w", err)
+	}
+	lcArgs := fs.Args()[2:]
+	if len(lcArgs) > 0 && lcArgs[0] == "--" {
+		lcArgs = lcArgs[1:]
+	}
+
+	w := &watcher{
+		pid:      pid,
+		output:   fs.Arg(1),
+		lcArgs:   lcArgs,
+		poll:     *poll,
+		cooldown: *cooldown,
+		every:    *every,
+		keep:     *keep,
+		count:    *count,
+		reflink:  *reflink,
+	}
+	if *cron != "" {
+		if w.cron, err = parseCron(*cron); err != nil {
+			return err
+		}
+	}
+	if rss > 0 {
+		w.triggers = append(w.triggers, &rssTrigger{limit: uint64(rss)})
+	}
+	if *cpu > 0 {
+		w.triggers = append(w.triggers, &cpuTrigger{pct: *cpu})
+	}
+	if *states != "" {
+		w.triggers = append(w.triggers, &stateTrigger{states: *states})
+	}
+	switch {
+	case w.every < 0, w.poll <= 0, w.cooldown < 0, w.keep < 0, w.count < 0:
+		return fmt.Errorf("-every, -poll, -cooldown, -keep, and -count can't be negative, and -poll must be positive")
+	case w.every == 0 && w.cron == nil && len(w.triggers) == 0:
+		return fmt.Errorf("nothing to watch for; give -every, -cron, or a trigger such as -rss-above")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return w.run(ctx)
+}
+
+// watcher dumps a process when its schedule or triggers say to.
+type watcher struct {
+	pid      int
+	output   string   // cores go to output.<timestamp>
+	lcArgs   []string // livecore flags for each dump
+	every    time.Duration
+	cron     *cronSchedule
+	triggers []trigger
+	poll     time.Duration
+	cooldown time.Duration
+	keep     int
+	count    int
+	reflink  bool
+
+	written []string // cores written so far, oldest first
+	base    string   // the core to base the next on, with reflink; "" for none
+}
+
+// run watches until the target exits, count dumps are done, or ctx is
+// canceled.
+func (w *watcher) run(ctx context.Context) error {
+	var nextScheduled time.Time
+	schedule := func(now time.Time) {
+		nextScheduled = time.Time{}
+		if w.every > 0 {
+			nextScheduled = now.Add(w.every)
+		}
+		if w.cron != nil {
+			if t := w.cron.next(now); !t.IsZero() && (nextScheduled.IsZero() || t.Before(nextScheduled)) {
+				nextScheduled = t
+			}
+		}
+	}
+	schedule(time.Now())
+
+	var lastTriggered time.Time
+	for dumps := 0; w.count == 0 || dumps < w.count; {
+		wait := w.poll
+		if !nextScheduled.IsZero() {
+			wait = min(wait, time.Until(nextScheduled))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		if err := syscall.Kill(w.pid, 0); errors.Is(err, syscall.ESRCH) {
+			log.Printf("Process %d exited; stopping after %d dumps", w.pid, dumps)
+			return nil
+		}
+
+		// Triggers are checked every poll, even when cooling down, so
+		// ones that compare with the previous poll stay current.
+		now := time.Now()
+		reason := w.checkTriggers()
+		switch {
+		case !nextScheduled.IsZero() && !now.Before(nextScheduled):
+			reason = "schedule"
+			schedule(now)
+		case reason != "" && now.Sub(lastTriggered) >= w.cooldown:
+			lastTriggered = now
+		default:
+			continue
+		}
+		// A failed dump is logged, and watching goes on: the target may
+		// be fine by the next attempt.
+		if err := w.dump(now, reason); err != nil {
+			log.Printf("Dump failed: %v", err)
+			continue
+		}
+		dumps++
+	}
+	return nil
+}
+
+// checkTriggers returns why the first trigger that fires says to dump, or
+// "" if none does. Triggers that fail to check are logged and skipped.
+func (w *watcher) checkTriggers() string {
+	reason := ""
+	for _, t := range w.triggers {
+		// Check every trigger, even after one fires, for the same reason.
+		why, err := t.check(w.pid)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		if reason == "" {
+			reason = why
+		}
+	}
+	return reason
+}
+
+// dump dumps the target, for reason, to a core named for now, and then
+// deletes the oldest cores beyond w.keep.
+func (w *watcher) dump(now time.Time, reason string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find livecore executable: %w", err)
+	}
+	path := watchCoreName(w.output, now)
+	log.Printf("Dumping process %d to %s (%s)", w.pid, path, reason)
+	args := append([]string{"-annotate", "watch.reason=" + reason}, w.lcArgs...)
+	if w.base != "" {
+		args = append(args, "-reflink", "-base", w.base)
+	}
+	cmd := exec.Command(exe, append(args, strconv.Itoa(w.pid), path)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		// The failed dump may have cleared the soft-dirty bits, so
+		// the last core no longer says what changed.
+		w.base = ""
+		return fmt.Errorf("livecore dump failed: %w", err)
+	}
+	if w.reflink {
+		w.base = path
+	}
+	w.written = append(w.written, path)
+	for w.keep > 0 && len(w.written) > w.keep {
+		old := w.written[0]
+		w.written = w.written[1:]
+		if err := os.Remove(old); err != nil {
+			log.Printf("Warning: failed to remove old core: %v", err)
+		}
+	}
+	return nil
+}
+
+// watchCoreName returns the name of the core watch writes at t, given
+// the output named on the command line.
+func watchCoreName(output string, t time.Time) string {
+	return output + "." + t.Format("20060102-150405")
+}
+
+// sizeFlag is a flag.Value for a byte count with an optional K, M, G, or
+// T suffix.
+type sizeFlag uint64
+
+func (s *sizeFlag) String() string { return strconv.FormatUint(uint64(*s), 10) }
+
+func (s *sizeFlag) Set(v string) error {
+	n, err := proc.ParseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(n)
+	return nil
+}
@@ -0,0 +1,1540 @@
+package livecore
+
+import (
+	"cmp"
+	"context"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/internal/buffer"
+	"github.com/bradfitz/livecore/internal/copy"
+	"github.com/bradfitz/livecore/internal/throttle"
+	"github.com/bradfitz/livecore/internal/vmaindex"
+	"github.com/bradfitz/livecore/proc"
+	"github.com/bradfitz/livecore/quiesce"
+	"golang.org/x/sys/unix"
+)
+
+// dump dumps the process into out: into it directly, if it's a regular
+// file, or as a stream otherwise.
+func (d *Dumper) dump(ctx context.Context, out io.Writer) (err error) {
+	d.stats = Stats{}
+	d.enterPhase("setup")
+	defer func() {
+		if err != nil {
+			d.failed()
+			err = &PhaseError{Phase: d.phase(), Err: err}
+			return
+		}
+		d.enterPhase("done")
+	}()
+
+	outFile := regularFile(out)
+	direct := d.direct && outFile != nil
+	if d.direct && !direct {
+		d.logf("Warning: can't copy directly into a stream; buffering instead")
+	}
+	outName := "stream"
+	if f, ok := out.(*os.File); ok {
+		outName = f.Name()
+	}
+	if d.verbose {
+		d.logf("livecore: dumping process %d to %s\n", d.pid, outName)
+	}
+
+	// The scratch buffer goes where it's told, or in $TMPDIR, or next to
+	// the core, or is the core, for a direct dump.
+	scratchDir := d.tempDir
+	switch {
+	case direct:
+		scratchDir = filepath.Dir(outFile.Name())
+	case scratchDir != "":
+	case os.Getenv("TMPDIR") != "":
+		scratchDir = os.Getenv("TMPDIR")
+	case outFile != nil:
+		scratchDir = filepath.Dir(outFile.Name())
+	default:
+		scratchDir = os.TempDir()
+	}
+
+	// Create BufferManager for efficient memory buffering, which, for a
+	// direct dump, is the core file itself, for a resumable one, is kept
+	// next to its journal, and for one to records, is the output stream
+	newBufferManager := buffer.NewBufferManager
+	if d.compressBuffer {
+		newBufferManager = buffer.NewCompressedBufferManager
+	}
+	var bufferManager *buffer.Manager
+	var jour *journal
+	var resuming bool
+	inMemory := false
+	switch {
+	case direct:
+		bufferManager, err = buffer.NewFileBufferManager(outFile, d.bufferWindow)
+	case d.journal != "":
+		bufferManager, jour, resuming, err = d.openJournal()
+		scratchDir = filepath.Dir(d.journal)
+	case d.records:
+		bufferManager = buffer.NewRecordManager(out, d.bufferWindow)
+		scratchDir = ""
+	case d.bufferInMemory():
+		bufferManager, err = buffer.NewMemoryBufferManager(d.bufferWindow, d.compressBuffer)
+		scratchDir, inMemory = "", true
+	default:
+		bufferManager, err = newBufferManager(scratchDir, d.bufferWindow)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create buffer manager: %w", err)
+	}
+	defer bufferManager.Close()
+	d.updateStats(func(s *Stats) { s.ScratchDir, s.ScratchInMemory = scratchDir, inMemory })
+	if d.verbose {
+		if d.records {
+			d.logf("No scratch buffer; writing page records as they're copied")
+		} else if inMemory {
+			d.logf("Scratch buffer is in memory")
+		} else {
+			d.logf("Scratch buffer is in %s", scratchDir)
+		}
+	}
+	if jour != nil {
+		defer func() {
+			if _, serr := os.Stat(d.journal); err != nil && serr == nil {
+				d.logf("The dump can be resumed with journal %s", d.journal)
+				return
+			}
+			removeJournal(d.journal) // done, or nothing to resume
+		}()
+		if resuming {
+			d.logf("Resuming the dump journaled in %s", d.journal)
+		}
+	}
+	if !inMemory && !d.records {
+		bufferManager.SetMinFree(minFreeSpace)
+	}
+
+	sampler := copy.NewSampler(d.sample/100, d.sampleSeed)
+
+	// An incremental dump copies only what changed since its base, as
+	// does a reflinked one, which takes the rest from the base's file.
+	var base *elfcore.CoreReader
+	var changed *copy.RangeSet
+	var unread []copy.PageRange // pages pre-copy couldn't read
+	if d.base != "" {
+		if base, err = d.openBase(); err != nil {
+			return err
+		}
+		defer base.Close()
+		changed = new(copy.RangeSet)
+	}
+	// A resumed dump copies only what the interrupted one's buffer lacks.
+	if resuming {
+		changed = new(copy.RangeSet)
+	}
+
+	// Phase 1: Discovery
+	d.enterPhase("discovery")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.verbose {
+		d.logf("Phase 1: Discovery")
+	}
+
+	// Parse VMAs
+	allVMAs, err := proc.ParseMaps(d.pid)
+	if err != nil {
+		return fmt.Errorf("failed to parse maps: %w", err)
+	}
+	if allVMAs, err = d.splitVMAs(allVMAs); err != nil {
+		return err
+	}
+	vmas := d.filterVMAs(allVMAs)
+
+	if d.verbose {
+		d.logf("Found %d VMAs, dumping %d", len(allVMAs), len(vmas))
+	}
+	if resuming {
+		if err := resume(jour, bufferManager, vmas, changed); err != nil {
+			return err
+		}
+	}
+	if changed != nil {
+		addSharedWritable(vmas, changed)
+	}
+
+	if err := d.checkWindow(vmas); err != nil {
+		return err
+	}
+	// A resumed dump's buffer already takes up what it needs, and how
+	// much room records take can't be told until pre-copy is done.
+	switch {
+	case !d.spaceCheck || resuming || d.records:
+	case inMemory:
+		if err := d.checkFreeMemory(vmas); err != nil {
+			return err
+		}
+		// The core still needs room on disk.
+		if outFile != nil {
+			if err := d.checkFreeSpace(filepath.Dir(outFile.Name()), vmas, false, false); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := d.checkFreeSpace(scratchDir, vmas, outFile != nil, direct); err != nil {
+			return err
+		}
+	}
+	if d.onProgress != nil {
+		d.estimate, _ = d.estimateDumpSize(vmas)
+	}
+
+	// Parse threads
+	threads, err := proc.ParseThreads(d.pid)
+	if err != nil {
+		return fmt.Errorf("failed to parse threads: %w", err)
+	}
+
+	d.updateStats(func(s *Stats) { s.Threads = len(threads) })
+	if d.verbose {
+		d.logf("Found %d threads", len(threads))
+	}
+
+	// Parse auxiliary vector
+	_, err = proc.GetAuxv(d.pid)
+	if err != nil {
+		return fmt.Errorf("failed to get auxv: %w", err)
+	}
+
+	// A 32-bit process gets a 32-bit core. Its dynamic linker's and Go
+	// runtime's structures, which livecore reads as 64-bit ones, aren't
+	// recorded.
+	class, err := proc.ELFClass(d.pid)
+	if err != nil {
+		return fmt.Errorf("failed to tell the target's ELF class: %w", err)
+	}
+	is32 := class == elf.ELFCLASS32
+	if is32 && d.verbose {
+		d.logf("Target is a 32-bit process; writing a 32-bit core, without its link map or goroutines")
+	}
+
+	// Find the Go runtime now; its goroutines are read from the copy.
+	var goRuntime *proc.GoRuntime
+	if d.goroutines && !is32 {
+		goRuntime, err = proc.FindGoRuntime(d.pid)
+		if err != nil {
+			d.logf("Warning: not recording goroutines: %v", err)
+		}
+	}
+
+	// Pre-copy, and an incremental dump, need the kernel to say which pages
+	// the target wrote since they were last copied. Without that, all of
+	// them are copied once it's stopped.
+	preCopy := d.maxPasses > 0 && !d.noPreCopy && !direct
+	if preCopy || changed != nil {
+		if err := whyNoPreCopy(d.pid); err != nil {
+			if base != nil {
+				return fmt.Errorf("a dump with a base can't find what changed: %w", err)
+			}
+			if jour != nil {
+				return fmt.Errorf("a resumable dump can't track what it copied: %w", err)
+			}
+			d.logf("Warning: can't pre-copy, so copying everything with the target stopped: %v", err)
+			preCopy = false
+		}
+	}
+	copyAll := !preCopy && changed == nil
+
+	// Phase 2: Pre-copy (if enabled)
+	if d.verbose {
+		d.logf("MaxPasses: %d, DirtyThreshold: %.2f", d.maxPasses, d.dirtyThreshold)
+	}
+	if preCopy {
+		d.enterPhase("precopy")
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.verbose {
+			d.logf("Phase 2: Pre-copy")
+		}
+
+		readLimit := throttle.New(d.readRate)
+		preCopyEngine := copy.NewPreCopyEngine(
+			d.pid,
+			d.maxPasses,
+			d.dirtyThreshold,
+			d.concurrency,
+			bufferManager,
+			d.verbose,
+		)
+		preCopyEngine.SetSampler(sampler)
+		preCopyEngine.SetResidentOnly(d.residentOnly)
+		preCopyEngine.SetSkipSwapped(!d.swapIn)
+		preCopyEngine.SetChanged(changed)
+		preCopyEngine.SetReadLimiter(readLimit)
+		preCopyEngine.SetReadBatch(d.readBatch)
+		preCopyEngine.SetTimeBudget(d.maxPreCopyTime)
+		preCopyEngine.SetProgressHook(func(pass int, copied uint64) {
+			if copied == 0 {
+				d.startProgress("precopy", pass, d.estimate)
+				return
+			}
+			d.progressTo(copied)
+		})
+		preCopyEngine.SetPassHook(func(r copy.PassResult) {
+			d.updateStats(func(s *Stats) {
+				s.PreCopyPasses = append(s.PreCopyPasses, PassStats(r))
+				s.BytesCopied += r.BytesCopied
+			})
+		})
+
+		if jour != nil {
+			preCopyEngine.SetClearHook(func(stale []copy.PageRange) error {
+				jour.VMAs = jour.VMAs[:0]
+				for _, vma := range vmas {
+					jour.VMAs = append(jour.VMAs, toJournalVMA(vma))
+				}
+				jour.Buffer = bufferManager.Allocations()
+				jour.Stale = stale
+				return jour.write(d.journal)
+			})
+		}
+
+		// Convert proc.VMA to copy.VMA
+		copyVMAs := convertVMAsToCopy(vmas)
+		result, err := preCopyEngine.RunPreCopy(copyVMAs)
+		if err != nil {
+			return fmt.Errorf("pre-copy failed: %w", err)
+		}
+
+		unread = result.Unread
+		d.updateStats(func(s *Stats) { s.PreCopyStopReason = string(result.StopReason) })
+		if d.verbose {
+			d.logf("Pre-copy completed in %v", result.TotalTime)
+		}
+
+		if d.swapIn && !d.residentOnly {
+			if err := d.swapInDirtyPages(copyVMAs, sampler, readLimit, bufferManager); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Phase 3: Final stop and delta copy
+	d.enterPhase("freeze")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.verbose {
+		d.logf("Phase 3: Final stop and delta copy")
+	}
+
+	// Give a cooperating target the chance to reach a clean point first.
+	var qs *quiesce.Session
+	resumeTarget := func() {
+		if qs == nil {
+			return
+		}
+		if err := qs.Resume(); err != nil {
+			d.logf("Warning: failed to tell target to resume: %v", err)
+		}
+	}
+	defer resumeTarget() // on error paths; a no-op once resumed
+	if d.quiesceTimeout > 0 {
+		qs, err = quiesce.Request(d.pid, d.quiesceTimeout)
+		switch {
+		case err == nil:
+			if d.verbose {
+				d.logf("Target quiesced")
+			}
+		case errors.Is(err, quiesce.ErrNotSupported):
+			if err != quiesce.ErrNotSupported {
+				d.logf("Warning: %v; freezing anyway", err)
+			} else if d.verbose {
+				d.logf("Target does not support quiesce; freezing anyway")
+			}
+		default:
+			d.logf("Warning: %v; freezing anyway", err)
+		}
+	}
+
+	var cgroup *proc.CgroupFreezer
+	if d.freezeMethod == FreezeCgroup {
+		cgroup, err = proc.FindCgroupFreezer(d.pid)
+		if err != nil {
+			return fmt.Errorf("failed to find cgroup to freeze: %w", err)
+		}
+		pids, err := cgroup.Procs()
+		if err != nil {
+			return err
+		}
+		if others := len(pids) - 1; others > 0 {
+			d.logf("Warning: freezing cgroup %s also briefly freezes the %d other processes in it", cgroup.Dir, others)
+		} else if d.verbose {
+			d.logf("Freezing with cgroup %s", cgroup.Dir)
+		}
+	}
+
+	// ptrace requests must all come from the thread that seized the target.
+	// Threads that never stop can't be detached, and stay seized until
+	// their tracer exits; if there are any, this thread is left locked,
+	// so Go ends it when dump's goroutine returns (see dumpOnOwnThread)
+	// instead of handing it, still their tracer, to other goroutines.
+	runtime.LockOSThread()
+	stillSeized := false
+	defer func() {
+		if !stillSeized {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	d.meet(meetReady)
+
+	d.logf("Starting freeze.")
+	stopStart := time.Now()
+	freezeStart := sampleClocks()
+	d.stopDeadline = time.Time{}
+	if d.maxStopTime > 0 {
+		d.stopDeadline = stopStart.Add(d.maxStopTime)
+	}
+
+	// Freeze all threads
+	frozenThreads, err := proc.FreezeAllThreads(d.pid, proc.FreezeOptions{
+		StopTimeout: d.stopTimeout,
+		Workers:     d.freezeWorkers,
+		Cgroup:      cgroup,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to freeze threads: %w", err)
+	}
+	if d.pidfd >= 0 && !proc.PidfdAlive(d.pidfd) {
+		// It exited at some point, and what we froze, and maybe some of
+		// what we copied, belongs to a process that reused its pid.
+		proc.UnfreezeAllThreads(frozenThreads)
+		return fmt.Errorf("target exited during the dump; pid %d now belongs to another process", d.pid)
+	}
+
+	freezeTime := time.Since(stopStart)
+	d.updateStats(func(s *Stats) { s.FreezeTime = freezeTime })
+	d.logf("[STW] Froze threads (took %v)", freezeTime)
+
+	// Threads stuck in uninterruptible sleep never reach ptrace-stop.
+	var unstopped []int
+	for _, t := range frozenThreads {
+		if !t.Stopped {
+			unstopped = append(unstopped, t.Tid)
+			state, _ := proc.ThreadState(d.pid, t.Tid)
+			d.logf("Warning: thread %d (state %q) did not stop within %v", t.Tid, state, d.stopTimeout)
+		}
+	}
+	d.updateStats(func(s *Stats) { s.UnstoppedThreads = len(unstopped) })
+	stillSeized = len(unstopped) > 0
+	if len(unstopped) > 0 && d.abortOnStuck {
+		proc.UnfreezeAllThreads(frozenThreads)
+		return fmt.Errorf("%d threads did not stop within %v", len(unstopped), d.stopTimeout)
+	}
+	// Don't copy anything a process that's still running could change.
+	d.meet(meetFrozen)
+	preThreads := time.Now()
+
+	// Collect register state
+	notedThreads, omittedThreads := d.selectThreads(frozenThreads)
+	if err := proc.CollectThreadRegisters(notedThreads); err != nil {
+		proc.UnfreezeAllThreads(frozenThreads)
+		return fmt.Errorf("failed to collect registers: %w", err)
+	}
+
+	// Threads can rename themselves, and change how they're scheduled,
+	// so those are read now too.
+	for i := range notedThreads {
+		t := &notedThreads[i]
+		if t.Stopped {
+			t.Name, _ = proc.ThreadName(d.pid, t.Tid)
+			t.Sched, _ = proc.ThreadSched(d.pid, t.Tid)
+		}
+	}
+
+	if d.verbose {
+		d.logf("[STW] Got thread registers (took %v)", time.Since(preThreads))
+	}
+
+	// Re-scan maps (authoritative at stop time)
+	preMaps := time.Now()
+	allFinalVMAs, err := proc.ParseMaps(d.pid)
+	if err != nil {
+		proc.UnfreezeAllThreads(frozenThreads)
+		return fmt.Errorf("failed to re-scan maps: %w", err)
+	}
+	if allFinalVMAs, err = d.splitVMAs(allFinalVMAs); err != nil {
+		proc.UnfreezeAllThreads(frozenThreads)
+		return err
+	}
+	finalVMAs := d.filterVMAs(allFinalVMAs)
+
+	if d.verbose {
+		d.logf("[STW] Got final VMAs (took %v)", time.Since(preMaps))
+	}
+
+	// Copy remaining dirty pages (re-scan after freeze to get current dirty state)
+	var readFailures copy.Failures
+	var uncopied []uncopiedRange // left for after the stop, past its budget
+	if direct {
+		// Leave room for the headers before the first segment.
+		if err := bufferManager.Reserve(elfcore.HeaderSize(class, len(allFinalVMAs)+1)); err != nil {
+			proc.UnfreezeAllThreads(frozenThreads)
+			return err
+		}
+	}
+	// Pre-copy's VMAs may not be the final ones; what it couldn't have
+	// copied of the final ones is copied in full, like what it couldn't read.
+	if !copyAll {
+		fresh, err := d.reconcileVMAs(vmas, finalVMAs, bufferManager)
+		if err != nil {
+			proc.UnfreezeAllThreads(frozenThreads)
+			return fmt.Errorf("failed to reconcile VMAs with pre-copy's: %w", err)
+		}
+		unread = append(unread, fresh...)
+		if changed != nil {
+			for _, r := range fresh {
+				changed.Add(r)
+			}
+		}
+	}
+	if copyAll {
+		uncopied, err = d.copyAllPages(finalVMAs, sampler, &readFailures, bufferManager)
+		if err != nil {
+			proc.UnfreezeAllThreads(frozenThreads)
+			return fmt.Errorf("failed to copy memory: %w", err)
+		}
+	} else {
+		uncopied, err = d.copyRemainingDirtyPages(finalVMAs, sampler, changed, unread, &readFailures, bufferManager)
+		if err != nil {
+			proc.UnfreezeAllThreads(frozenThreads)
+			return fmt.Errorf("failed to copy remaining dirty pages: %w", err)
+		}
+	}
+	if changed != nil {
+		discarded, err := discardedPages(d.pid, finalVMAs)
+		if err == nil && resuming {
+			err = punchRanges(bufferManager, finalVMAs, discarded)
+		}
+		if err != nil {
+			proc.UnfreezeAllThreads(frozenThreads)
+			return err
+		}
+		for _, r := range discarded {
+			changed.Add(r)
+		}
+	}
+
+	// Other processes in the group may have written to memory we share
+	// with them since we last copied it.
+	if d.group != nil && !copyAll {
+		uncopied = append(uncopied, d.copySharedMappings(finalVMAs, sampler, &readFailures, bufferManager)...)
+	}
+
+	// A sampled dump still has every thread's live stack, for backtraces.
+	if sampler != nil {
+		d.copyThreadStacks(notedThreads, finalVMAs, &readFailures, bufferManager)
+	}
+
+	// Record where the dynamic linker keeps its list of loaded objects,
+	// and make sure a partial dump still has it.
+	var linkMap *proc.LinkMap
+	if !is32 {
+		linkMap, err = proc.ReadLinkMap(d.pid)
+		if err != nil {
+			d.logf("Warning: failed to read dynamic linker state: %v", err)
+		}
+	}
+	if linkMap != nil && (sampler != nil || d.residentOnly) {
+		d.copyLinkMapPages(linkMap, finalVMAs, &readFailures, bufferManager)
+	}
+
+	d.meet(meetCopied)
+
+	// Unfreeze threads immediately after final delta copy
+	// The core file writing can take a long time, so we don't want to keep
+	// the target process frozen during that time
+	if err := proc.UnfreezeAllThreads(frozenThreads); err != nil {
+		return fmt.Errorf("failed to unfreeze threads: %w", err)
+	}
+	freezeEnd := sampleClocks()
+	resumeTarget()
+
+	if d.verbose {
+		d.logf("[STW] Unfrozen threads at STOP+%v", time.Since(stopStart))
+	}
+
+	stopTime := time.Since(stopStart)
+	overrun, err := d.finishOverrun(uncopied, &readFailures, bufferManager)
+	if err != nil {
+		return err
+	}
+	d.updateStats(func(s *Stats) {
+		s.StopTime = stopTime
+		s.ReadFailures = len(readFailures.List())
+		s.ReadFailureBytes = readFailures.Bytes()
+	})
+
+	d.logf("[STW] Done; total stop time was %v", stopTime)
+
+	if failed := readFailures.List(); len(failed) > 0 {
+		d.logf("Warning: %d bytes in %d ranges could not be read; they hold zeros or older pre-copy contents", readFailures.Bytes(), len(failed))
+		if d.verbose {
+			for _, f := range failed {
+				d.logf("  %x-%x (VMA %x): %v", f.Start, f.End, f.VMAStart, f.Errno)
+			}
+		}
+	}
+
+	// The scratch buffer is at its fullest before writing frees it.
+	if n, err := bufferManager.DiskUsage(); err == nil && !d.records {
+		d.updateStats(func(s *Stats) { s.ScratchBytes = n })
+		if d.verbose {
+			d.logf("Scratch buffer holds %d MB of the %d MB allocated in its window", n>>20, bufferManager.Allocated()>>20)
+		}
+	}
+
+	// Phase 4: Generate ELF core file
+	d.enterPhase("write")
+	if d.verbose {
+		d.logf("Phase 4: Generate ELF core file")
+	}
+
+	redacted, err := d.redact(finalVMAs, bufferManager)
+	if err != nil {
+		return fmt.Errorf("failed to redact memory: %w", err)
+	}
+
+	// Build file table from VMAs (for NT_FILE note)
+	var fileTable []elfcore.FileEntry
+	for _, vma := range allFinalVMAs {
+		// Only include file-backed mappings
+		if vma.Path != "" && vma.Inode != 0 {
+			fileTable = append(fileTable, elfcore.FileEntry{
+				Start:   vma.Start,
+				End:     vma.End,
+				FileOfs: vma.Offset,
+				Dev:     vma.Dev,
+				Inode:   vma.Inode,
+				Path:    vma.Path,
+			})
+		}
+	}
+
+	// Create core info
+	coreInfo := &elfcore.CoreInfo{
+		Pid:       d.pid,
+		Class:     class,
+		Threads:   d.convertThreads(notedThreads),
+		VMAs:      d.convertVMAs(allFinalVMAs),
+		FileTable: fileTable,
+		Unstopped: unstopped,
+
+		OmittedThreads: omittedThreads,
+
+		FreezeStart: freezeStart,
+		FreezeEnd:   freezeEnd,
+		Sample:      sampleInfo(sampler),
+
+		ReadFailures: convertFailures(readFailures.List()),
+		LinkMap:      convertLinkMap(linkMap),
+		Overrun:      overrun,
+		Redacted:     redacted,
+
+		Annotations: d.annotations,
+		Container:   convertContainer(d.container),
+	}
+	if d.verbose {
+		for _, t := range coreInfo.Threads {
+			d.logf("Thread %d: %s", t.Tid, threadSummary(t))
+		}
+	}
+	if d.pidView == PidsNamespace {
+		if err := d.translatePids(coreInfo); err != nil {
+			d.logf("Warning: writing host pids: %v", err)
+		}
+	}
+
+	// VMAs none of whose pages were copied, such as ones mapped since
+	// pre-copy and never touched, or in an incremental dump, that didn't
+	// change, need room too; they're all holes.
+	for _, vma := range finalVMAs {
+		if _, err := bufferManager.GetOffsetForVMA(uint64(vma.Start), vma.MemSize); err != nil {
+			return err
+		}
+	}
+	mem := newBufferMemory(bufferManager, coreInfo.VMAs)
+	// verifyWrite compares against it, and a resumed dump would need it.
+	mem.keep = d.verify != VerifyOff || jour != nil
+	mem.inPlace = direct
+
+	// The pages an incremental dump didn't copy are in its base.
+	var fullMem elfcore.MemorySource = mem
+	if base != nil {
+		inc, changedBytes := incrementalInfo(base.Info(), finalVMAs, changed)
+		d.updateStats(func(s *Stats) { s.ChangedBytes = changedBytes })
+		if d.verbose {
+			d.logf("%d bytes in %d ranges changed since the base", changedBytes, len(inc.Changed))
+		}
+		if !d.reflink {
+			coreInfo.Incremental = inc
+		}
+		fullMem = &elfcore.Overlay{Top: mem, Base: base, Changed: inc.Changed}
+	}
+	// A reflinked dump writes the full memory, sharing the base's blocks.
+	writeMem := elfcore.MemorySource(mem)
+	if d.reflink {
+		writeMem = fullMem
+	}
+
+	if goRuntime != nil {
+		gs, err := goRuntime.Goroutines(fullMem)
+		if err != nil {
+			d.logf("Warning: not recording goroutines: %v", err)
+		} else {
+			coreInfo.GoRuntime = convertGoRuntime(goRuntime, gs)
+			if d.verbose {
+				d.logf("Found %d goroutines", len(gs))
+			}
+		}
+	}
+
+	// The build IDs are mostly found in the copied memory, or with
+	// records, which can't be read back, in the target's.
+	var buildIDs []proc.BuildID
+	if d.notes == elfcore.NotesAll || d.checksums {
+		var idMem proc.MemoryReader = fullMem
+		if d.records {
+			idMem = proc.NewMemory(d.pid)
+		}
+		buildIDs = proc.BuildIDs(d.pid, allFinalVMAs, idMem)
+		coreInfo.BuildIDs = convertBuildIDs(buildIDs)
+
+		// A target in another mount namespace, as in a container,
+		// maps files the host knows by other paths, if at all.
+		if coreInfo.HostPaths, err = proc.HostPaths(d.pid, allFinalVMAs); err != nil {
+			d.logf("Warning: not recording host paths of mapped files: %v", err)
+		}
+	}
+
+	// Create notes
+	notes, err := elfcore.CreateCoreNotes(coreInfo, elfcore.NoteOptions{
+		Selection: d.notes,
+		Cmdline:   d.cmdline,
+		OmitAuxv:  d.omitAuxv,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create notes: %w", err)
+	}
+
+	coreInfo.Notes = notes
+
+	if d.records {
+		return d.finishRecords(bufferManager, coreInfo)
+	}
+
+	var manifest *Manifest
+	if d.checksums {
+		if manifest, err = d.makeManifest(coreInfo, writeMem, buildIDs); err != nil {
+			return err
+		}
+	}
+
+	// Write ELF core file
+	if err := d.writeCoreFile(out, coreInfo, mem, writeMem); err != nil {
+		return err
+	}
+	if d.reflink && d.verbose {
+		d.logf("Cloned %d bytes from the base", base.Cloned())
+	}
+
+	// Dump only asks for verification when out is a regular file.
+	if d.verify != VerifyOff {
+		if err := d.verifyWrite(outFile, coreInfo, writeMem); err != nil {
+			// The scratch buffer still has everything, so try once more.
+			d.logf("Warning: core file failed verification (%v); rewriting it", err)
+			if err := d.writeCoreFile(out, coreInfo, mem, writeMem); err != nil {
+				return err
+			}
+			if err := d.verifyWrite(outFile, coreInfo, writeMem); err != nil {
+				return fmt.Errorf("rewritten core file failed verification: %w", err)
+			}
+		}
+	}
+
+	if manifest != nil {
+		d.statsMu.Lock()
+		d.manifest = manifest
+		d.statsMu.Unlock()
+	}
+	return nil
+}
+
+// writeCoreFile writes the core described by info, with memory from src,
+// into out, streaming it unless out is a regular file. src is mem, the
+// scratch buffer, or for a reflinked dump, mem over the base.
+func (d *Dumper) writeCoreFile(out io.Writer, info *elfcore.CoreInfo, mem *bufferMemory, src elfcore.MemorySource) error {
+	preCore := time.Now()
+	var elfWriter *elfcore.ELFWriter
+	if f := regularFile(out); mem.inPlace {
+		elfWriter = elfcore.NewInPlaceWriter(f, info, mem, mem.segmentOffset)
+		elfWriter.SetCacheMode(d.writeCache)
+	} else if f != nil {
+		var err error
+		elfWriter, err = elfcore.NewFileWriter(f, info, src)
+		if err != nil {
+			return fmt.Errorf("failed to create ELF writer: %w", err)
+		}
+		elfWriter.SetSparse(d.sparse)
+		elfWriter.SetCacheMode(d.writeCache)
+		// Segments written at once get the writer's priority too.
+		var init func() error
+		if d.writeNice != 0 || d.writeIOPrio.Class != IOClassNone {
+			init = func() error { return setThreadPriority(d.writeNice, d.writeIOPrio) }
+		}
+		elfWriter.SetConcurrency(d.writeWorkers, init)
+	} else {
+		elfWriter = elfcore.NewStreamWriter(out, info, src)
+	}
+	defer elfWriter.Close()
+	elfWriter.SetWriteRate(d.writeRate)
+	if d.onProgress != nil {
+		elfWriter.SetProgress(func(written, total uint64) {
+			d.progress.Total = total
+			d.progressTo(written)
+		})
+	}
+
+	if err := runAtPriority(d.writeNice, d.writeIOPrio, elfWriter.WriteCore); err != nil {
+		return fmt.Errorf("failed to write core file: %w", err)
+	}
+
+	if d.verbose {
+		d.logf("Core dump completed in %v", time.Since(preCore).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// copyRemainingDirtyPages copies the remaining dirty pages after freeze
+// This is the final delta copy - we only copy pages that are still dirty
+// after the process has been frozen, ensuring we capture the final state.
+// It also tries again to read unread, the pages pre-copy couldn't. It
+// returns the dirty pages it didn't get to before the stop-time budget ran
+// out.
+func (d *Dumper) copyRemainingDirtyPages(vmas []proc.VMA, sampler *copy.Sampler, changed *copy.RangeSet, unread []copy.PageRange, failures *copy.Failures, bufferManager *buffer.Manager) ([]uncopiedRange, error) {
+	if d.verbose {
+		d.logf("Copying remaining dirty pages...")
+	}
+
+	// Create a new page map to scan for dirty pages after freeze
+	pageMap := copy.NewPageMap(d.pid)
+	defer pageMap.Close()
+	pageMap.SetResidentOnly(d.residentOnly)
+	pageMap.SetSkipSwapped(!d.swapIn)
+
+	// Get current dirty pages (after freeze)
+	preDisco := time.Now()
+	currentDirtyPages, err := pageMap.GetDirtyPages(convertVMAsToCopy(vmas))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current dirty pages: %w", err)
+	}
+	durDisco := time.Since(preDisco).Round(time.Millisecond)
+	if changed != nil {
+		changed.AddDirty(currentDirtyPages)
+	}
+	for _, r := range unread {
+		currentDirtyPages.AddRange(r)
+	}
+	if d.verbose {
+		d.logf("Found remaining dirty pages in %v", durDisco)
+	}
+
+	// Copy only the dirty pages using process_vm_readv
+	// This is the minimal final copy to capture the exact state at freeze time
+	if d.verbose {
+		d.logf("Found %d dirty pages to copy", currentDirtyPages.Len())
+	}
+	d.startProgress("freeze", 0, uint64(currentDirtyPages.Len())*uint64(copy.GetPageSize()))
+
+	preCopy := time.Now()
+
+	// An anonymous VMA mapped since pre-copy reads as entirely dirty,
+	// even the pages never touched, and has only holes in the buffer. Of
+	// those, copy only the pages faulted in, and not mapping the zero page,
+	// leaving the rest as holes.
+	present := make(map[uintptr][]copy.PageRange)
+	var copied uint64
+	var uncopied []uncopiedRange
+
+	// Contiguous dirty pages are copied with one process_vm_readv each.
+	for dirty, vma := range currentDirtyPages.Ranges() {
+		if d.pastStopBudget() {
+			uncopied = append(uncopied, uncopiedRange{dirty, *vma})
+			continue
+		}
+		t0 := time.Now()
+		ranges := []copy.PageRange{dirty}
+		if _, copiedBefore := bufferManager.GetExistingOffsetForVMA(uint64(vma.Start), vma.Size); vma.Anon && !copiedBefore {
+			if _, ok := present[vma.Start]; !ok {
+				rs, err := pageMap.PresentRanges(*vma)
+				if err != nil {
+					return nil, fmt.Errorf("failed to find present pages: %w", err)
+				}
+				zero, err := pageMap.ZeroPageRanges(*vma)
+				if err != nil {
+					return nil, fmt.Errorf("failed to find zero pages: %w", err)
+				}
+				present[vma.Start] = copy.SubtractRanges(rs, zero)
+			}
+			ranges = intersectRanges(dirty, present[vma.Start])
+		}
+		for _, r := range sampler.Filter(ranges, copy.GetPageSize()) {
+			// Unreadable pages are recorded in failures, not fatal.
+			left, err := d.copyWithinBudget(r, *vma, bufferManager, failures)
+			if err != nil {
+				return nil, err
+			}
+			if left.Start < left.End {
+				uncopied = append(uncopied, uncopiedRange{left, *vma})
+			}
+			copied += uint64(left.Start - r.Start)
+			d.progressTo(copied)
+		}
+		if d.verbose {
+			took := time.Since(t0)
+			if took > 10*time.Millisecond {
+				d.logf("Copied final dirty pages at %x-%x in %v", dirty.Start, dirty.End, took)
+			}
+		}
+	}
+
+	d.finishProgress()
+	d.updateStats(func(s *Stats) {
+		s.FinalDirtyPages = currentDirtyPages.Len()
+		s.BytesCopied += copied
+	})
+
+	if d.verbose {
+		durCopy := time.Since(preCopy).Round(time.Millisecond)
+		durTotal := time.Since(preDisco).Round(time.Millisecond)
+		d.logf("Copied final %d dirty pages in %v (discovery %v + copy %v)", currentDirtyPages.Len(), durTotal, durDisco, durCopy)
+	}
+
+	return uncopied, nil
+}
+
+// copyAllPages copies every page of vmas worth copying, as a pre-copy pass
+// does, for a dump that can't tell which pages changed since an earlier
+// copy; the target must be stopped. If the pagemap can't be read to find
+// the pages never touched, whole mappings are copied. Pages that can't be
+// read are recorded in failures. It returns the pages it didn't get to
+// before the stop-time budget ran out.
+func (d *Dumper) copyAllPages(vmas []proc.VMA, sampler *copy.Sampler, failures *copy.Failures, bufferManager *buffer.Manager) ([]uncopiedRange, error) {
+	pageMap := copy.NewPageMap(d.pid)
+	defer pageMap.Close()
+	pageMap.SetResidentOnly(d.residentOnly)
+	pageMap.SetSkipSwapped(!d.swapIn)
+
+	t0 := time.Now()
+	d.startProgress("freeze", 0, d.estimate)
+	usePagemap := true
+	var copied uint64
+	var uncopied []uncopiedRange
+	for _, vma := range convertVMAsToCopy(vmas) {
+		// Even the VMAs with nothing to copy need room, for their holes.
+		if _, err := bufferManager.GetOffsetForVMA(uint64(vma.Start), vma.Size); err != nil {
+			return nil, err
+		}
+		if vma.IsZero {
+			continue
+		}
+		ranges := []copy.PageRange{{Start: vma.Start, End: vma.End}}
+		if d.pastStopBudget() {
+			uncopied = append(uncopied, uncopiedRange{ranges[0], vma})
+			continue
+		}
+		if usePagemap {
+			rs, _, err := pageMap.PagesToCopy(vma)
+			if err != nil {
+				d.logf("Warning: copying mappings whole: %v", err)
+				usePagemap = false
+			} else {
+				ranges = rs
+			}
+		}
+		for _, r := range sampler.Filter(ranges, copy.GetPageSize()) {
+			// Unreadable pages are recorded in failures, not fatal.
+			left, err := d.copyWithinBudget(r, vma, bufferManager, failures)
+			if err != nil {
+				return nil, err
+			}
+			if left.Start < left.End {
+				uncopied = append(uncopied, uncopiedRange{left, vma})
+			}
+			copied += uint64(left.Start - r.Start)
+			d.progressTo(copied)
+		}
+	}
+
+	d.finishProgress()
+	d.updateStats(func(s *Stats) { s.BytesCopied += copied })
+	if d.verbose {
+		d.logf("Copied %d MB in %v", copied>>20, time.Since(t0).Round(time.Millisecond))
+	}
+	return uncopied, nil
+}
+
+// swapInDirtyPages copies the dirty pages that are swapped out, faulting
+// them back in, so the final copy finds them resident instead of waiting
+// on swap with the target stopped. If they're written again before the
+// freeze, they're copied again then. Pages that can't be read here are
+// left for the final copy.
+func (d *Dumper) swapInDirtyPages(vmas []copy.VMA, sampler *copy.Sampler, readLimit *throttle.Limiter, bufferManager *buffer.Manager) error {
+	pageMap := copy.NewPageMap(d.pid)
+	defer pageMap.Close()
+
+	t0 := time.Now()
+	var swappedIn uint64
+	for _, vma := range vmas {
+		if vma.IsZero {
+			continue
+		}
+		ranges, err := pageMap.SwappedDirtyRanges(vma)
+		if err != nil {
+			return fmt.Errorf("failed to find swapped-out pages: %w", err)
+		}
+		for _, r := range sampler.Filter(ranges, copy.GetPageSize()) {
+			readLimit.Wait(int(r.End - r.Start))
+			err := copyDirtyPages(d.pid, r.Start, uint64(r.End-r.Start), vma, bufferManager)
+			if errors.Is(err, buffer.ErrLowSpace) || errors.Is(err, buffer.ErrWindowFull) {
+				return err
+			}
+			if err == nil {
+				swappedIn += uint64(r.End - r.Start)
+			}
+		}
+	}
+	d.updateStats(func(s *Stats) {
+		s.SwappedInBytes = swappedIn
+		s.BytesCopied += swappedIn
+	})
+	if d.verbose && swappedIn > 0 {
+		d.logf("Swapped in %d bytes of dirty pages in %v", swappedIn, time.Since(t0).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// intersectRanges returns the parts of r in rs, which must be sorted.
+func intersectRanges(r copy.PageRange, rs []copy.PageRange) []copy.PageRange {
+	var result []copy.PageRange
+	for _, x := range rs {
+		start, end := max(r.Start, x.Start), min(r.End, x.End)
+		if start < end {
+			result = append(result, copy.PageRange{Start: start, End: end})
+		}
+	}
+	return result
+}
+
+// copyDirtyRange copies a run of dirty pages to the BufferManager. If the
+// run can't be read in one go, it's bisected so one bad page doesn't lose
+// its neighbors. Pages that can't be read are recorded in failures; only
+// other errors, like running out of scratch space, are returned.
+func copyDirtyRange(pid int, r copy.PageRange, vma copy.VMA, bufferManager *buffer.Manager, failures *copy.Failures) error {
+	return copy.CopyBisecting(r, uintptr(copy.GetPageSize()),
+		func(r copy.PageRange) error {
+			return copyDirtyPages(pid, r.Start, uint64(r.End-r.Start), vma, bufferManager)
+		},
+		func(err error) bool {
+			return !errors.Is(err, buffer.ErrLowSpace) && !errors.Is(err, buffer.ErrWindowFull)
+		},
+		func(r copy.PageRange, err error) { failures.Add(r, vma.Start, err) })
+}
+
+// An uncopiedRange is a run of pages in vma that the stop-time budget ran
+// out before copying.
+type uncopiedRange struct {
+	copy.PageRange
+	vma copy.VMA
+}
+
+// stopBudgetChunk is how much copyWithinBudget copies between checks of
+// the stop-time budget.
+const stopBudgetChunk = 4 << 20
+
+// pastStopBudget reports whether the target has been stopped for longer
+// than WithMaxStopTime allows.
+func (d *Dumper) pastStopBudget() bool {
+	return !d.stopDeadline.IsZero() && time.Now().After(d.stopDeadline)
+}
+
+// copyWithinBudget copies r as copyDirtyRange does, a read batch at a
+// time, or a smaller chunk if there's a stop-time budget, and returns the
+// part of r it didn't get to before the budget ran out, which is empty if
+// it copied all of r.
+func (d *Dumper) copyWithinBudget(r copy.PageRange, vma copy.VMA, bufferManager *buffer.Manager, failures *copy.Failures) (copy.PageRange, error) {
+	for r.Start < r.End && !d.pastStopBudget() {
+		end := min(r.End, r.Start+(uintptr(d.readBatch)&^uintptr(copy.GetPageSize()-1)))
+		if !d.stopDeadline.IsZero() {
+			end = min(end, r.Start+stopBudgetChunk)
+		}
+		if err := copyDirtyRange(d.pid, copy.PageRange{Start: r.Start, End: end}, vma, bufferManager, failures); err != nil {
+			return r, err
+		}
+		r.Start = end
+	}
+	return r, nil
+}
+
+// copyDirtyPages copies size bytes of dirty pages at pageAddr to the BufferManager
+func copyDirtyPages(pid int, pageAddr uintptr, size uint64, vma copy.VMA, bufferManager *buffer.Manager) error {
+	// Get the offset for this page in the temp file
+	vmaOffset, err := bufferManager.GetOffsetForVMA(uint64(vma.Start), vma.Size)
+	if err != nil {
+		return err
+	}
+	pageOffset := vmaOffset + buffer.TmpOffset(pageAddr-vma.Start)
+
+	// Copy the pages directly into the buffer
+	err = bufferManager.Fill(pageOffset, size, func(dst []byte, off uint64) error {
+		return copy.CopyMemory(pid, pageAddr+uintptr(off), dst)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read pages at %x: %w", pageAddr, err)
+	}
+
+	return nil
+}
+
+// sampleStackWindow is how much of each thread's stack, upwards from its
+// stack pointer, a sampled dump copies in full.
+const sampleStackWindow = 1 << 20
+
+// copyThreadStacks copies the live part of each stopped thread's stack,
+// up to sampleStackWindow bytes, so that sampled dumps still have
+// complete backtraces. Pages that can't be read are recorded in failures,
+// and other errors are logged and otherwise ignored.
+func (d *Dumper) copyThreadStacks(threads []proc.Thread, vmas []proc.VMA, failures *copy.Failures, bufferManager *buffer.Manager) {
+	copyVMAs := convertVMAsToCopy(vmas)
+	index := vmaindex.New(len(copyVMAs), func(i int) (uintptr, uintptr) {
+		return copyVMAs[i].Start, copyVMAs[i].End
+	})
+	pageSize := uintptr(copy.GetPageSize())
+	for _, t := range threads {
+		sp := t.StackPointer()
+		i, ok := index.Lookup(sp)
+		if !t.Stopped || !ok || copyVMAs[i].IsZero {
+			continue
+		}
+		vma := copyVMAs[i]
+		start := sp &^ (pageSize - 1)
+		r := copy.PageRange{Start: start, End: min(vma.End, start+sampleStackWindow)}
+		if err := copyDirtyRange(d.pid, r, vma, bufferManager, failures); err != nil {
+			d.logf("Warning: failed to copy stack of thread %d at %x-%x: %v", t.Tid, r.Start, r.End, err)
+		}
+	}
+}
+
+// copySharedMappings copies all of every writable shared mapping, for a
+// dump in a group. Their soft-dirty bits only track this process's
+// writes, not those of the other processes sharing them. Pages that can't
+// be read are recorded in failures, and other errors are logged and
+// otherwise ignored. It returns the pages it didn't get to before the
+// stop-time budget ran out.
+func (d *Dumper) copySharedMappings(vmas []proc.VMA, sampler *copy.Sampler, failures *copy.Failures, bufferManager *buffer.Manager) []uncopiedRange {
+	var uncopied []uncopiedRange
+	for _, v := range vmas {
+		if v.IsZero || v.Perms&proc.PermWrite == 0 || !v.Shared() {
+			continue
+		}
+		vma := convertVMAsToCopy([]proc.VMA{v})[0]
+		for _, r := range sampler.Filter([]copy.PageRange{{Start: vma.Start, End: vma.End}}, copy.GetPageSize()) {
+			left, err := d.copyWithinBudget(r, vma, bufferManager, failures)
+			switch {
+			case err != nil:
+				d.logf("Warning: failed to copy shared mapping at %x-%x: %v", r.Start, r.End, err)
+			case left.Start < left.End:
+				uncopied = append(uncopied, uncopiedRange{left, vma})
+			}
+		}
+	}
+	return uncopied
+}
+
+// finishOverrun deals with the pages the stop-time budget ran out before
+// copying, once the target has resumed: it copies them now for
+// OverrunFuzzy, recording those it can't read in failures, and returns
+// what the core's NT_LIVECORE_OVERRUN note says about them, or nil if
+// there are none.
+func (d *Dumper) finishOverrun(uncopied []uncopiedRange, failures *copy.Failures, bufferManager *buffer.Manager) (*elfcore.OverrunInfo, error) {
+	if len(uncopied) == 0 {
+		return nil, nil
+	}
+	o := &elfcore.OverrunInfo{Budget: d.maxStopTime, Fuzzy: d.stopOverrun == OverrunFuzzy}
+	var size uint64
+	for _, u := range uncopied {
+		o.Uncopied = append(o.Uncopied, elfcore.AddrRange{Start: u.Start, End: u.End})
+		size += uint64(u.End - u.Start)
+	}
+	slices.SortFunc(o.Uncopied, func(a, b elfcore.AddrRange) int { return cmp.Compare(a.Start, b.Start) })
+	d.updateStats(func(s *Stats) { s.UncopiedBytes = size })
+
+	if !o.Fuzzy {
+		d.logf("Warning: the %v stop-time budget ran out with %d bytes of dirty pages in %d ranges not copied; they hold older pre-copy contents or zeros", d.maxStopTime, size, len(uncopied))
+		return o, nil
+	}
+	d.logf("Warning: the %v stop-time budget ran out with %d bytes of dirty pages in %d ranges not copied; copying them with the target running", d.maxStopTime, size, len(uncopied))
+	for _, u := range uncopied {
+		if err := copyDirtyRange(d.pid, u.PageRange, u.vma, bufferManager, failures); err != nil {
+			return nil, fmt.Errorf("failed to copy pages after the stop: %w", err)
+		}
+	}
+	d.updateStats(func(s *Stats) { s.BytesCopied += size })
+	return o, nil
+}
+
+// copyLinkMapPages copies the pages holding the dynamic linker's r_debug
+// and link_map chain, which a sampled or resident-only dump might
+// otherwise miss; debuggers need them to find shared libraries. Pages
+// that can't be read are recorded in failures, and other errors are
+// logged and otherwise ignored.
+func (d *Dumper) copyLinkMapPages(lm *proc.LinkMap, vmas []proc.VMA, failures *copy.Failures, bufferManager *buffer.Manager) {
+	copyVMAs := convertVMAsToCopy(vmas)
+	index := vmaindex.New(len(copyVMAs), func(i int) (uintptr, uintptr) {
+		return copyVMAs[i].Start, copyVMAs[i].End
+	})
+	pageSize := uintptr(copy.GetPageSize())
+	for _, mr := range lm.Ranges {
+		start := mr.Start &^ (pageSize - 1)
+		end := (mr.End + pageSize - 1) &^ (pageSize - 1)
+		for _, i := range index.Overlapping(start, end) {
+			vma := copyVMAs[i]
+			if vma.IsZero {
+				continue
+			}
+			r := copy.PageRange{Start: max(start, vma.Start), End: min(end, vma.End)}
+			if err := copyDirtyRange(d.pid, r, vma, bufferManager, failures); err != nil {
+				d.logf("Warning: failed to copy link map pages at %x-%x: %v", r.Start, r.End, err)
+			}
+		}
+	}
+}
+
+// sampleInfo describes sampler for the NT_LIVECORE_SAMPLE note, or
+// returns nil if every page was copied.
+func sampleInfo(sampler *copy.Sampler) *elfcore.SampleInfo {
+	if sampler == nil {
+		return nil
+	}
+	return &elfcore.SampleInfo{
+		Seed:        sampler.Seed,
+		Threshold:   sampler.Threshold,
+		StackWindow: sampleStackWindow,
+	}
+}
+
+// sampleClocks reads the clocks recorded in the NT_LIVECORE_CLOCKS note.
+func sampleClocks() elfcore.ClockSample {
+	read := func(clock int32) int64 {
+		var ts unix.Timespec
+		if err := unix.ClockGettime(clock, &ts); err != nil {
+			return 0
+		}
+		return ts.Nano()
+	}
+	return elfcore.ClockSample{
+		Realtime:  read(unix.CLOCK_REALTIME),
+		Monotonic: read(unix.CLOCK_MONOTONIC),
+		Boottime:  read(unix.CLOCK_BOOTTIME),
+	}
+}
+
+// convertGoRuntime converts goroutines found with a proc.GoRuntime to an
+// elfcore.GoRuntime
+func convertGoRuntime(rt *proc.GoRuntime, gs []proc.Goroutine) *elfcore.GoRuntime {
+	result := &elfcore.GoRuntime{AllGs: rt.AllGs}
+	for _, g := range gs {
+		result.Goroutines = append(result.Goroutines, elfcore.Goroutine(g))
+	}
+	return result
+}
+
+// convertLinkMap converts a proc.LinkMap to an elfcore.LinkMap
+func convertLinkMap(lm *proc.LinkMap) *elfcore.LinkMap {
+	if lm == nil {
+		return nil
+	}
+	result := &elfcore.LinkMap{
+		Phdr:   lm.Phdr,
+		Phnum:  lm.Phnum,
+		Base:   lm.Base,
+		RDebug: lm.RDebug,
+	}
+	for _, e := range lm.Maps {
+		result.Maps = append(result.Maps, elfcore.LinkMapEntry{
+			Addr:  e.Addr,
+			LAddr: e.LAddr,
+			LD:    e.LD,
+			Name:  e.Name,
+		})
+	}
+	return result
+}
+
+// convertBuildIDs converts proc.BuildIDs to elfcore.BuildIDs
+func convertBuildIDs(ids []proc.BuildID) []elfcore.BuildID {
+	var result []elfcore.BuildID
+	for _, b := range ids {
+		id, err := hex.DecodeString(b.ID)
+		if err != nil {
+			continue
+		}
+		result = append(result, elfcore.BuildID{Start: b.Start, ID: id, Path: b.Path})
+	}
+	return result
+}
+
+// translatePids rewrites the process and thread IDs in info's notes as
+// the target sees them, if it's in another PID namespace. Threads that
+// have exited since, or a parent or session leader outside the namespace,
+// are 0, as the kernel writes them.
+func (d *Dumper) translatePids(info *elfcore.CoreInfo) error {
+	ns, err := proc.PidNamespaceOf(d.pid)
+	if err != nil {
+		return err
+	}
+	if ns.Own() {
+		return nil
+	}
+	ps, err := elfcore.ReadPSInfo(d.pid)
+	if err != nil {
+		return err
+	}
+	if d.verbose {
+		d.logf("Writing pids as the target's PID namespace sees them (it's pid %d there)", ns.ID(ps.Pid))
+	}
+	ps.Pid, ps.PPid, ps.PGrp, ps.Sid = ns.ID(ps.Pid), ns.ID(ps.PPid), ns.ID(ps.PGrp), ns.ID(ps.Sid)
+	info.PSInfo = ps
+	for i := range info.Threads {
+		info.Threads[i].Tid = ns.ID(info.Threads[i].Tid)
+	}
+	translate := func(tids []int) []int {
+		var out []int
+		for _, tid := range tids {
+			out = append(out, ns.ID(tid))
+		}
+		return out
+	}
+	info.Unstopped = translate(info.Unstopped)
+	info.OmittedThreads = translate(info.OmittedThreads)
+	return nil
+}
+
+// convertSched converts a proc.Sched to an elfcore.SchedInfo
+func convertSched(s *proc.Sched) *elfcore.SchedInfo {
+	if s == nil {
+		return nil
+	}
+	return &elfcore.SchedInfo{
+		Policy:     uint32(s.Policy),
+		RTPriority: uint32(s.RTPriority),
+		Priority:   int32(s.Priority),
+		Nice:       int32(s.Nice),
+		CPU:        int32(s.CPU),
+		Affinity:   s.Affinity,
+	}
+}
+
+// threadSummary describes t's name and scheduling state, for logs.
+func threadSummary(t elfcore.Thread) string {
+	var parts []string
+	if t.Name != "" {
+		parts = append(parts, t.Name)
+	}
+	if s := t.Sched; s != nil {
+		parts = append(parts, fmt.Sprintf("%s, priority %d, nice %d, last on CPU %d, may run on CPUs %s",
+			s.PolicyName(), s.Priority, s.Nice, s.CPU, s.AffinityList()))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// convertContainer converts a proc.Container to an elfcore.ContainerInfo
+func convertContainer(c *proc.Container) *elfcore.ContainerInfo {
+	if c == nil {
+		return nil
+	}
+	return &elfcore.ContainerInfo{
+		ID:        c.ID,
+		Runtime:   c.Runtime,
+		Name:      c.Name,
+		Image:     c.Image,
+		Cgroup:    c.Cgroup,
+		Pod:       c.Pod,
+		Namespace: c.Namespace,
+	}
+}
+
+// convertVMFlags converts proc.VMFlags to elfcore.VMFlags
+func convertVMFlags(flags []proc.VMFlag) []elfcore.VMFlag {
+	var result []elfcore.VMFlag
+	for _, f := range flags {
+		result = append(result, elfcore.VMFlag(f))
+	}
+	return result
+}
+
+// convertFailures converts copy.Failures to elfcore.ReadFailures
+func convertFailures(failures []copy.Failure) []elfcore.ReadFailure {
+	var result []elfcore.ReadFailure
+	for _, f := range failures {
+		result = append(result, elfcore.ReadFailure{
+			Start:    f.Start,
+			End:      f.End,
+			VMAStart: f.VMAStart,
+			Errno:    f.Errno,
+		})
+	}
+	return result
+}
+
+// convertThreads converts the stopped proc.Threads to elfcore.Threads.
+// Threads that never stopped or that exited have no registers to report;
+// emitting notes for them would show up as bogus threads at PC 0.
+func (d *Dumper) convertThreads(threads []proc.Thread) []elfcore.Thread {
+	var result []elfcore.Thread
+	for _, thread := range threads {
+		if !thread.Stopped {
+			continue
+		}
+		if thread.Exited {
+			d.logf("Thread %d exited during the dump; omitting its notes", thread.Tid)
+			continue
+		}
+		result = append(result, elfcore.Thread{
+			Tid:       thread.Tid,
+			Registers: thread.Registers,
+			FPRegs:    thread.FPRegs,
+			XState:    thread.XState,
+			Name:      thread.Name,
+			Sched:     convertSched(thread.Sched),
+
+			SigPending: thread.SigPending,
+			SigBlocked: thread.SigBlocked,
+			SigInfo:    thread.SigInfo,
+		})
+	}
+	return result
+}
+
+// selectThreads returns the threads to write notes for, as chosen by
+// WithThreads and WithMaxThreads, and the tids of the stopped threads it
+// leaves out. Threads that didn't stop are always returned, as they're
+// recorded separately.
+func (d *Dumper) selectThreads(threads []proc.Thread) (noted []proc.Thread, omitted []int) {
+	if d.tids == nil && d.maxThreads == 0 {
+		return threads, nil
+	}
+	for _, tid := range d.tids {
+		if !slices.ContainsFunc(threads, func(t proc.Thread) bool { return t.Tid == tid }) {
+			d.logf("Warning: thread %d not found", tid)
+		}
+	}
+	n := 0
+	for _, t := range threads {
+		if !t.Stopped {
+			noted = append(noted, t)
+			continue
+		}
+		if (d.tids == nil || slices.Contains(d.tids, t.Tid)) && (d.maxThreads == 0 || n < d.maxThreads) {
+			noted = append(noted, t)
+			n++
+			continue
+		}
+		omitted = append(omitted, t.Tid)
+	}
+	if d.verbose {
+		d.logf("Writing notes for %d of %d threads", n, n+len(omitted))
+	}
+	return noted, omitted
+}
+
+// convertVMAsToCopy converts proc.VMA to copy.VMA
+func convertVMAsToCopy(vmas []proc.VMA) []copy.VMA {
+	var result []copy.VMA
+	for _, vma := range vmas {
+		result = append(result, copy.VMA{
+			Start:  vma.Start,
+			End:    vma.End,
+			Size:   vma.MemSize,
+			Perms:  copy.Perm(vma.Perms),
+			IsZero: vma.IsZero,
+			Anon:   vma.Inode == 0 && !vma.VDSO(),
+		})
+		if vma.Hugetlb() {
+			result[len(result)-1].HugePageSize = vma.PageSize
+		}
+	}
+	return result
+}
+
+// splitVMAs splits the VMAs d's dump filter dumps only part of: at the
+// edges of its address ranges, and after their ELF headers.
+func (d *Dumper) splitVMAs(vmas []proc.VMA) ([]proc.VMA, error) {
+	return d.filter.SplitELFHeaders(d.pid, d.filter.SplitAtRanges(vmas))
+}
+
+// filterVMAs returns the VMAs d's dump filter accepts, the ones to copy.
+func (d *Dumper) filterVMAs(vmas []proc.VMA) []proc.VMA {
+	var result []proc.VMA
+	for _, vma := range vmas {
+		if vma.IsDumpable(d.filter) {
+			result = append(result, vma)
+		}
+	}
+	return result
+}
+
+// convertVMAs converts proc.VMA to elfcore.VMA, marking the ones d's dump
+// filter leaves out as omitted.
+func (d *Dumper) convertVMAs(vmas []proc.VMA) []elfcore.VMA {
+	var result []elfcore.VMA
+	for _, vma := range vmas {
+		flags := convertVMFlags(vma.VmFlags)
+		if !d.filter.RespectDontdump {
+			// The writer leaves out MADV_DONTDUMP mappings; these were
+			// copied, so have it write them.
+			flags = slices.DeleteFunc(flags, func(f elfcore.VMFlag) bool { return f == elfcore.VMFlag{'d', 'd'} })
+		}
+		result = append(result, elfcore.VMA{
+			Start:      vma.Start,
+			End:        vma.End,
+			Perms:      elfcore.Perm(vma.Perms),
+			Offset:     vma.Offset,
+			Dev:        vma.Dev,
+			Inode:      vma.Inode,
+			Path:       vma.Path,
+			Kind:       elfcore.VMAKind(vma.Kind),
+			VmFlags:    flags,
+			IsZero:     vma.IsZero,
+			Omit:       vma.ExcludeReason(d.filter),
+			FileOffset: vma.FileOffset,
+			MemSize:    vma.MemSize,
+		})
+		if vma.Hugetlb() {
+			result[len(result)-1].PageSize = vma.PageSize
+		}
+	}
+	return result
+}
@@ -0,0 +1,81 @@
+package elfcore
+
+import (
+	"debug/elf"
+	"runtime"
+)
+
+// An arch is what differs between the cores of the architectures livecore
+// supports: their machine type and class, and the layout of the register
+// notes. The other notes are laid out the same for all of a class.
+type arch struct {
+	machine      elf.Machine
+	class        elf.Class
+	prstatusSize int // NT_PRSTATUS
+	regOffset    int // of pr_reg in it
+	gregsetSize  int // pr_reg, elf_gregset_t, which pr_fpvalid follows
+	fpregsetSize int // NT_FPREGSET
+}
+
+var (
+	archAMD64 = &arch{
+		machine:      elf.EM_X86_64,
+		class:        elf.ELFCLASS64,
+		prstatusSize: 336,
+		regOffset:    112,
+		gregsetSize:  27 * 8, // user_regs_struct
+		fpregsetSize: 512,    // user_fpregs_struct, the FXSAVE area
+	}
+	archI386 = &arch{
+		machine:      elf.EM_386,
+		class:        elf.ELFCLASS32,
+		prstatusSize: 144,
+		regOffset:    72,
+		gregsetSize:  17 * 4, // i386's user_regs_struct
+		fpregsetSize: 108,    // user_i387_struct
+	}
+	archRISCV64 = &arch{
+		machine:      elf.EM_RISCV,
+		class:        elf.ELFCLASS64,
+		prstatusSize: 376,
+		regOffset:    112,
+		gregsetSize:  32 * 8, // user_regs_struct: pc, then x1 to x31
+		fpregsetSize: 33 * 8, // __riscv_d_ext_state: f0 to f31, fcsr, padding
+	}
+)
+
+// archs are the architectures livecore writes and reads cores of.
+var archs = []*arch{archAMD64, archI386, archRISCV64}
+
+// hostArch returns the architecture livecore runs on, whose processes it
+// dumps, but for 32-bit ones.
+func hostArch() *arch {
+	if runtime.GOARCH == "riscv64" {
+		return archRISCV64
+	}
+	return archAMD64
+}
+
+// archOf returns the architecture of cores of machine m and class c, or
+// nil if livecore doesn't support it.
+func archOf(m elf.Machine, c elf.Class) *arch {
+	for _, a := range archs {
+		if a.machine == m && a.class == c {
+			return a
+		}
+	}
+	return nil
+}
+
+// arch returns the architecture of info's process.
+func (info *CoreInfo) arch() *arch {
+	if info.is32() {
+		return archI386
+	}
+	if info.Machine != 0 {
+		if a := archOf(info.Machine, elf.ELFCLASS64); a != nil {
+			return a
+		}
+	}
+	return hostArch()
+}
@@ -0,0 +1,179 @@
+package elfcore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// CacheMode says how an ELFWriter treats the page cache when writing a
+// core file. Left alone, a big core fills the cache with pages nothing
+// will read, evicting the pages of the processes on the host, including
+// the one dumped.
+type CacheMode int
+
+const (
+	// CacheKeep writes through the page cache as usual.
+	CacheKeep CacheMode = iota
+	// CacheDrop preallocates each run of memory before writing it, and
+	// drops what's written from the page cache as it goes: every
+	// dropChunk, it starts writing back what it wrote, waits for what
+	// it started the time before, and drops that.
+	CacheDrop
+	// CacheDirect is like CacheDrop, but writes memory with O_DIRECT,
+	// bypassing the cache, where it's aligned for it, as memory from
+	// the scratch buffer is. If the filesystem doesn't support
+	// O_DIRECT, it's CacheDrop.
+	CacheDirect
+)
+
+// ParseCacheMode parses a CacheMode name: "keep", "drop", or "direct".
+func ParseCacheMode(s string) (CacheMode, error) {
+	switch s {
+	case "keep":
+		return CacheKeep, nil
+	case "drop":
+		return CacheDrop, nil
+	case "direct":
+		return CacheDirect, nil
+	}
+	return 0, fmt.Errorf("unknown cache mode %q (want keep, drop, or direct)", s)
+}
+
+// dropChunk is how much cacheOutput writes between dropping what it
+// wrote from the page cache.
+const dropChunk = 64 << 20
+
+// directAlign is the alignment of the memory, offsets, and sizes that
+// cacheOutput writes with O_DIRECT: the page size, which is a multiple of
+// any disk's logical block size.
+var directAlign = int64(os.Getpagesize())
+
+// cacheOutput is an output to a file that keeps what's written out of the
+// page cache; see CacheDrop and CacheDirect.
+// It's safe for concurrent use, as by segments written at once.
+type cacheOutput struct {
+	f      *os.File
+	direct *os.File // f opened again with O_DIRECT, or nil; closed by finish
+
+	mu             sync.Mutex
+	noDirect       bool  // direct writes failed, so stop trying them
+	lo, hi         int64 // range written since the last drop
+	prevLo, prevHi int64 // range being written back
+}
+
+func newCacheOutput(f *os.File, mode CacheMode) *cacheOutput {
+	c := &cacheOutput{f: f}
+	if mode == CacheDirect {
+		// Another open file description, so f's flags are untouched.
+		name := fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+		if d, err := os.OpenFile(name, os.O_WRONLY|unix.O_DIRECT, 0); err == nil {
+			c.direct = d
+		}
+	}
+	return c
+}
+
+// WriteAt writes p at off, a dropChunk at a time, so a huge write, as of
+// a whole segment from the scratch buffer, doesn't fill the cache first.
+func (c *cacheOutput) WriteAt(p []byte, off int64) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n, err := c.writeChunk(p[:min(len(p), dropChunk)], off)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p, off = p[n:], off+int64(n)
+	}
+	return written, nil
+}
+
+func (c *cacheOutput) writeChunk(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	direct := c.direct != nil && !c.noDirect
+	c.mu.Unlock()
+	if direct && c.aligned(p, off) {
+		n, err := c.direct.WriteAt(p, off)
+		if !errors.Is(err, unix.EINVAL) {
+			return n, err
+		}
+		// The filesystem wants other alignment; stop trying.
+		c.mu.Lock()
+		c.noDirect = true
+		c.mu.Unlock()
+	}
+	n, err := c.f.WriteAt(p, off)
+	c.wrote(off, int64(n))
+	return n, err
+}
+
+// aligned reports whether p can be written at off with O_DIRECT.
+func (c *cacheOutput) aligned(p []byte, off int64) bool {
+	return len(p) > 0 &&
+		int64(uintptr(unsafe.Pointer(&p[0])))%directAlign == 0 &&
+		off%directAlign == 0 && int64(len(p))%directAlign == 0
+}
+
+// wrote records that n bytes were written through the cache at off, and
+// drops what was written before once there's enough.
+func (c *cacheOutput) wrote(off, n int64) {
+	if n == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lo == c.hi {
+		c.lo, c.hi = off, off+n
+	} else {
+		c.lo, c.hi = min(c.lo, off), max(c.hi, off+n)
+	}
+	if c.hi-c.lo < dropChunk {
+		return
+	}
+	fd := int(c.f.Fd())
+	// Start writing this range back without waiting, then wait for the
+	// last one, which has likely finished by now, and drop it.
+	unix.SyncFileRange(fd, c.lo, c.hi-c.lo, unix.SYNC_FILE_RANGE_WRITE)
+	c.drop(c.prevLo, c.prevHi)
+	c.prevLo, c.prevHi = c.lo, c.hi
+	c.lo, c.hi = 0, 0
+}
+
+// drop waits for [lo, hi) to be written back and drops it from the cache.
+func (c *cacheOutput) drop(lo, hi int64) {
+	if lo == hi {
+		return
+	}
+	fd := int(c.f.Fd())
+	unix.SyncFileRange(fd, lo, hi-lo, unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+	unix.Fadvise(fd, lo, hi-lo, unix.FADV_DONTNEED)
+}
+
+func (c *cacheOutput) Truncate(size int64) error { return c.f.Truncate(size) }
+
+// preallocate allocates disk space for size bytes at off, so a run of
+// memory is written to contiguous blocks, if the filesystem can.
+func (c *cacheOutput) preallocate(off, size int64) {
+	unix.Fallocate(int(c.f.Fd()), 0, off, size)
+}
+
+// finish writes back and drops everything written, and closes the
+// O_DIRECT file.
+func (c *cacheOutput) finish() error {
+	if c.direct != nil {
+		c.direct.Close()
+		c.direct = nil
+	}
+	// Whatever was written by others, such as memory copied into the
+	// file through an mmap, goes too.
+	if err := c.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync core file: %w", err)
+	}
+	unix.Fadvise(int(c.f.Fd()), 0, 0, unix.FADV_DONTNEED)
+	return nil
+}
@@ -0,0 +1,92 @@
+package elfcore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// A SegmentChecksum is the SHA-256 of a PT_LOAD segment's contents, as
+// stored in the core: what's read back from the file, with holes as zeros.
+type SegmentChecksum struct {
+	Start, End uintptr
+	SHA256     [sha256.Size]byte
+}
+
+// HashSegments returns the checksum of each PT_LOAD segment that a core of
+// info, with memory from mem, has, in order. It reads mem much as the
+// writer would, so it must be called before writing the core if mem frees
+// what's been written.
+func HashSegments(info *CoreInfo, mem MemorySource) ([]SegmentChecksum, error) {
+	var sums []SegmentChecksum
+	buf := make([]byte, copyChunkSize)
+	zeros := make([]byte, copyChunkSize)
+	h := sha256.New()
+	for _, vma := range info.VMAs {
+		if !vma.IsDumpable() {
+			continue
+		}
+		h.Reset()
+		start, size := vma.Start, vma.Size()
+		extents := []Extent{{Offset: 0, Length: size}}
+		if vma.IsZero {
+			extents = nil
+		} else if el, ok := mem.(ExtentLister); ok {
+			var err error
+			extents, err = el.DataExtents(start, size)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find data extents for %x-%x: %w", vma.Start, vma.End, err)
+			}
+		}
+		var off uint64
+		for _, e := range extents {
+			hashZeros(h, zeros, e.Offset-off)
+			for n := uint64(0); n < e.Length; {
+				chunk := buf[:min(e.Length-n, copyChunkSize)]
+				if _, err := mem.ReadAt(chunk, start+uintptr(e.Offset+n)); err != nil {
+					return nil, fmt.Errorf("failed to read memory at %x: %w", start+uintptr(e.Offset+n), err)
+				}
+				h.Write(chunk)
+				n += uint64(len(chunk))
+			}
+			off = e.Offset + e.Length
+		}
+		hashZeros(h, zeros, size-off)
+		sum := SegmentChecksum{Start: vma.Start, End: vma.End}
+		h.Sum(sum.SHA256[:0])
+		sums = append(sums, sum)
+	}
+	return sums, nil
+}
+
+// HashCoreSegments returns the checksum of each PT_LOAD segment of the
+// core cr reads, in order, for comparing with HashSegments'.
+func HashCoreSegments(cr *CoreReader) ([]SegmentChecksum, error) {
+	var sums []SegmentChecksum
+	buf := make([]byte, copyChunkSize)
+	h := sha256.New()
+	for _, seg := range cr.Segments() {
+		h.Reset()
+		for addr := seg.Start; addr < seg.End; {
+			chunk := buf[:min(uint64(seg.End-addr), copyChunkSize)]
+			if _, err := cr.ReadAt(chunk, addr); err != nil {
+				return nil, fmt.Errorf("failed to read segment %x-%x: %w", seg.Start, seg.End, err)
+			}
+			h.Write(chunk)
+			addr += uintptr(len(chunk))
+		}
+		sum := SegmentChecksum{Start: seg.Start, End: seg.End}
+		h.Sum(sum.SHA256[:0])
+		sums = append(sums, sum)
+	}
+	return sums, nil
+}
+
+// hashZeros writes n zero bytes to h, zeros being a buffer of zeros.
+func hashZeros(h hash.Hash, zeros []byte, n uint64) {
+	for n > 0 {
+		k := min(n, uint64(len(zeros)))
+		h.Write(zeros[:k])
+		n -= k
+	}
+}
@@ -0,0 +1,47 @@
+package elfcore
+
+import "io"
+
+// MemorySource reads the memory of the process a core describes, by
+// virtual address. The ELFWriter reads PT_LOAD segment contents from it.
+//
+// Implementations include the scratch buffer livecore copies pages into,
+// a live process (proc.Memory), and an existing core (CoreReader), so a
+// core can be written from any of them.
+type MemorySource interface {
+	// ReadAt reads len(p) bytes of memory at addr. As with io.ReaderAt,
+	// it returns a non-nil error if n < len(p).
+	ReadAt(p []byte, addr uintptr) (n int, err error)
+}
+
+// A MemorySource may implement the interfaces below to make writing a
+// core cheaper. Without them, the writer reads each VMA in full and leaves
+// all-zero chunks as holes.
+
+// ExtentLister is implemented by a MemorySource that knows which parts of
+// a range hold data. The writer only reads those; the rest are left as
+// holes in the core and read as zeros.
+type ExtentLister interface {
+	// DataExtents returns the runs of [start, start+size) that hold
+	// data, as offsets from start.
+	DataExtents(start uintptr, size uint64) ([]Extent, error)
+}
+
+// MemoryWriterTo is implemented by a MemorySource that can write memory
+// to a file itself, such as from an mmap, avoiding a copy.
+type MemoryWriterTo interface {
+	// WriteMemoryTo writes size bytes of memory at addr to w at off.
+	WriteMemoryTo(w io.WriterAt, off int64, addr uintptr, size uint64) error
+}
+
+// MemoryReleaser is implemented by a MemorySource that can free its copy
+// of a range once the writer is done with it.
+type MemoryReleaser interface {
+	Release(start uintptr, size uint64) error
+}
+
+// Extent is a run of memory that holds data.
+type Extent struct {
+	Offset uint64 // from the start of the range
+	Length uint64
+}
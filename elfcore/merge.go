@@ -0,0 +1,170 @@
+package elfcore
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Overlay is a MemorySource that reads the ranges in Changed from Top and
+// everything else from Base: an incremental core's memory, over that of
+// the core it's based on.
+type Overlay struct {
+	Top, Base MemorySource
+	Changed   []AddrRange // sorted
+}
+
+func (o *Overlay) ReadAt(p []byte, addr uintptr) (int, error) {
+	n := 0
+	err := o.split(addr, uint64(len(p)), func(src MemorySource, a uintptr, off, size uint64) error {
+		if _, err := src.ReadAt(p[off:off+size], a); err != nil {
+			return err
+		}
+		n += int(size)
+		return nil
+	})
+	return n, err
+}
+
+// DataExtents returns the extents of each source's part of the range,
+// where it's an ExtentLister, so holes in the cores stay holes.
+func (o *Overlay) DataExtents(start uintptr, size uint64) ([]Extent, error) {
+	var extents []Extent
+	err := o.split(start, size, func(src MemorySource, a uintptr, off, size uint64) error {
+		el, ok := src.(ExtentLister)
+		if !ok {
+			extents = append(extents, Extent{Offset: off, Length: size})
+			return nil
+		}
+		es, err := el.DataExtents(a, size)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			e.Offset += off
+			if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == e.Offset {
+				extents[n-1].Length += e.Length
+			} else {
+				extents = append(extents, e)
+			}
+		}
+		return nil
+	})
+	return extents, err
+}
+
+// WriteMemoryTo writes each source's part of the range with its own
+// WriteMemoryTo, where it has one, so that the unchanged memory of a
+// CoreReader base can be cloned rather than copied.
+func (o *Overlay) WriteMemoryTo(w io.WriterAt, off int64, addr uintptr, size uint64) error {
+	var buf []byte
+	return o.split(addr, size, func(src MemorySource, a uintptr, pieceOff, size uint64) error {
+		dst := off + int64(pieceOff)
+		if wt, ok := src.(MemoryWriterTo); ok {
+			return wt.WriteMemoryTo(w, dst, a, size)
+		}
+		if buf == nil {
+			buf = make([]byte, copyChunkSize)
+		}
+		for done := uint64(0); done < size; {
+			chunk := buf[:min(size-done, copyChunkSize)]
+			if _, err := src.ReadAt(chunk, a+uintptr(done)); err != nil {
+				return err
+			}
+			if _, err := w.WriteAt(chunk, dst+int64(done)); err != nil {
+				return err
+			}
+			done += uint64(len(chunk))
+		}
+		return nil
+	})
+}
+
+// Release releases the range in both sources, where they can.
+func (o *Overlay) Release(start uintptr, size uint64) error {
+	for _, src := range []MemorySource{o.Top, o.Base} {
+		if r, ok := src.(MemoryReleaser); ok {
+			if err := r.Release(start, size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// split calls f for each part of [addr, addr+size) that comes from one
+// source, in order, with the part's offset from addr.
+func (o *Overlay) split(addr uintptr, size uint64, f func(src MemorySource, a uintptr, off, size uint64) error) error {
+	for off := uint64(0); off < size; {
+		a := addr + uintptr(off)
+		i := sort.Search(len(o.Changed), func(i int) bool { return o.Changed[i].End > a })
+		src, end := o.Base, uintptr(0)
+		switch {
+		case i == len(o.Changed):
+			end = addr + uintptr(size)
+		case o.Changed[i].Start <= a:
+			src, end = o.Top, o.Changed[i].End
+		default:
+			end = o.Changed[i].Start
+		}
+		n := min(size-off, uint64(end-a))
+		if err := f(src, a, off, n); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// CheckBase returns an error unless delta is an incremental core whose
+// base is base.
+func CheckBase(delta, base *CoreInfo) error {
+	inc := delta.Incremental
+	switch {
+	case inc == nil:
+		return fmt.Errorf("not an incremental core")
+	case base.FreezeStart == (ClockSample{}):
+		return fmt.Errorf("base has no NT_LIVECORE_CLOCKS note to identify it")
+	case delta.Pid != base.Pid:
+		return fmt.Errorf("core is of process %d, but its base is of process %d", delta.Pid, base.Pid)
+	case inc.Base != base.FreezeStart:
+		return fmt.Errorf("core is based on a dump taken at %v, not the one taken at %v",
+			time.Unix(0, inc.Base.Realtime).Format(time.RFC3339Nano),
+			time.Unix(0, base.FreezeStart.Realtime).Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// MergeCores returns what it takes to write the full core that a chain of
+// cores adds up to: a full core, cores[0], then incremental cores, each
+// based on the one before. The returned CoreInfo has the last core's notes,
+// less its NT_LIVECORE_INCREMENTAL note, and its VMAs, and the memory
+// reads each page from the last core that holds it. Pass them to
+// NewELFWriter or NewStreamWriter.
+//
+// The cores must stay open while the merged core is written.
+func MergeCores(cores []*CoreReader) (*CoreInfo, MemorySource, error) {
+	if len(cores) == 0 {
+		return nil, nil, fmt.Errorf("no cores to merge")
+	}
+	if cores[0].Info().Incremental != nil {
+		return nil, nil, fmt.Errorf("core 1 is incremental; merging must start from a full core")
+	}
+	var mem MemorySource = cores[0]
+	for i := 1; i < len(cores); i++ {
+		if err := CheckBase(cores[i].Info(), cores[i-1].Info()); err != nil {
+			return nil, nil, fmt.Errorf("core %d: %w", i+1, err)
+		}
+		mem = &Overlay{Top: cores[i], Base: mem, Changed: cores[i].Info().Incremental.Changed}
+	}
+
+	last := cores[len(cores)-1].Info()
+	info := &CoreInfo{Pid: last.Pid, VMAs: last.VMAs, Class: last.Class}
+	for _, n := range last.Notes {
+		if n.Name != LivecoreNoteName || n.Type != NT_LIVECORE_INCREMENTAL {
+			info.Notes = append(info.Notes, n)
+		}
+	}
+	return info, mem, nil
+}
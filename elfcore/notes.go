@@ -0,0 +1,998 @@
+package elfcore
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// NoteWriter handles writing ELF notes
+type NoteWriter struct {
+	buf bytes.Buffer
+}
+
+// NewNoteWriter creates a new note writer
+func NewNoteWriter() *NoteWriter {
+	return &NoteWriter{}
+}
+
+func padUpTo4Bytes(n int) int {
+	return (n + 3) &^ 3
+}
+
+// WriteNote writes a note to the buffer
+func (nw *NoteWriter) WriteNote(name string, noteType NoteType, data []byte) error {
+	// Calculate sizes
+	nameSize := padUpTo4Bytes(len(name) + 1) // +1 for null terminator
+	dataSize := padUpTo4Bytes(len(data))
+
+	// Write note header. As the kernel's, its sizes don't include the
+	// padding, so readers get the name and data back exactly.
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(name)+1))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(noteType))
+
+	if _, err := nw.buf.Write(header); err != nil {
+		return err
+	}
+
+	// Write name (null-terminated and padded)
+	nw.buf.WriteString(name)
+	for range nameSize - len(name) {
+		nw.buf.WriteByte(0)
+	}
+
+	if len(data) > 0 {
+		nw.buf.Write(data)
+		for range dataSize - len(data) {
+			nw.buf.WriteByte(0)
+		}
+	}
+
+	return nil
+}
+
+// Bytes returns the written notes as bytes
+func (nw *NoteWriter) Bytes() []byte {
+	return nw.buf.Bytes()
+}
+
+// Size returns the total size of written notes
+func (nw *NoteWriter) Size() int {
+	return nw.buf.Len()
+}
+
+// calculateNoteSize calculates the size of a note
+func (w *ELFWriter) calculateNoteSize(note Note) uint64 {
+	nameSize := len(note.Name) + 1
+	if nameSize%4 != 0 {
+		nameSize = ((nameSize + 3) / 4) * 4
+	}
+
+	dataSize := len(note.Data)
+	if dataSize%4 != 0 {
+		dataSize = ((dataSize + 3) / 4) * 4
+	}
+
+	return uint64(12 + nameSize + dataSize) // 12 bytes for header
+}
+
+// writeNote writes a single note to the file
+func (w *ELFWriter) writeNote(note Note, offset *uint64) error {
+	nw := NewNoteWriter()
+	if err := nw.WriteNote(note.Name, note.Type, note.Data); err != nil {
+		return err
+	}
+
+	_, err := w.file.WriteAt(nw.Bytes(), int64(*offset))
+	*offset += uint64(nw.Size())
+	return err
+}
+
+// NoteSelection selects which families of notes CreateCoreNotes generates.
+type NoteSelection int
+
+const (
+	// NotesAll generates every note livecore knows how to produce.
+	NotesAll NoteSelection = iota
+	// NotesMinimal generates only what debuggers need to find threads and
+	// mappings: NT_PRSTATUS, NT_AUXV, and NT_FILE.
+	NotesMinimal
+)
+
+// ParseNoteSelection parses a note selection name, "all" or "minimal".
+func ParseNoteSelection(s string) (NoteSelection, error) {
+	switch s {
+	case "all":
+		return NotesAll, nil
+	case "minimal":
+		return NotesMinimal, nil
+	}
+	return 0, fmt.Errorf("unknown note selection %q (want all or minimal)", s)
+}
+
+// Redaction says how to treat sensitive strings, such as the command line,
+// that would otherwise be copied into notes.
+type Redaction int
+
+const (
+	RedactNone Redaction = iota // keep as is
+	RedactHash                  // replace with "sha256:" and the hex SHA-256
+	RedactOmit                  // leave out entirely
+)
+
+// ParseRedaction parses a redaction name: "keep", "hash", or "omit".
+func ParseRedaction(s string) (Redaction, error) {
+	switch s {
+	case "keep":
+		return RedactNone, nil
+	case "hash":
+		return RedactHash, nil
+	case "omit":
+		return RedactOmit, nil
+	}
+	return 0, fmt.Errorf("unknown redaction %q (want keep, hash, or omit)", s)
+}
+
+// Apply returns s redacted according to r.
+func (r Redaction) Apply(s []byte) []byte {
+	switch r {
+	case RedactHash:
+		sum := sha256.Sum256(s)
+		return []byte("sha256:" + hex.EncodeToString(sum[:]))
+	case RedactOmit:
+		return nil
+	}
+	return s
+}
+
+// NoteOptions controls note generation.
+type NoteOptions struct {
+	Selection NoteSelection
+	Cmdline   Redaction // for pr_psargs in NT_PRPSINFO
+	OmitAuxv  bool      // leave out NT_AUXV
+}
+
+// CreateCoreNotes creates all the notes for a core file. Only NT_PRPSINFO
+// and NT_AUXV need more than info: if info.PSInfo or info.Auxv is nil, they
+// are read from /proc/<info.Pid>.
+func CreateCoreNotes(info *CoreInfo, opts NoteOptions) ([]Note, error) {
+	var notes []Note
+	pid, threads := info.Pid, info.Threads
+	all := opts.Selection == NotesAll
+
+	// NT_PRSTATUS has the process's parent, process group, and session,
+	// too, but a minimal core can do without them.
+	ps := info.PSInfo
+	if ps == nil {
+		var err error
+		if ps, err = ReadPSInfo(pid); err != nil && all {
+			return nil, fmt.Errorf("failed to create PRPSINFO note: %w", err)
+		}
+	}
+
+	// NT_PRSTATUS for each thread, each followed, as the kernel does, by
+	// the thread's other register notes: debuggers attribute those to the
+	// thread of the NT_PRSTATUS before them.
+	for _, thread := range threads {
+		prstatus := createPRStatusNote(thread, ps, info.arch())
+		if info.is32() {
+			prstatus = createPRStatusNote32(thread, ps)
+		}
+		notes = append(notes, prstatus)
+		if !all {
+			continue
+		}
+		// The siginfo_t ptrace gives is laid out for livecore, not for a
+		// 32-bit process's debugger, so it's left out of 32-bit cores;
+		// pr_cursig still has the signal.
+		if thread.SigInfo != nil && !info.is32() {
+			notes = append(notes, Note{Name: "CORE", Type: NT_SIGINFO, Data: thread.SigInfo})
+		}
+		if thread.FPRegs != nil {
+			notes = append(notes, createFPRegsetNote(thread))
+		}
+		if thread.XState != nil {
+			notes = append(notes, createXStateNote(thread))
+		}
+	}
+
+	// NT_PRPSINFO
+	if all && info.is32() {
+		notes = append(notes, createPRPSInfoNote32(ps, opts.Cmdline))
+	} else if all {
+		notes = append(notes, createPRPSInfoNote(ps, opts.Cmdline))
+	}
+
+	// NT_AUXV
+	if !opts.OmitAuxv {
+		auxv, err := createAuxvNote(pid, info.Auxv, info.is32())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AUXV note: %w", err)
+		}
+		notes = append(notes, auxv)
+	}
+
+	// NT_FILE
+	if len(info.FileTable) > 0 {
+		file := createFileNote(info.FileTable, info.is32())
+		notes = append(notes, file)
+	}
+
+	// NT_LIVECORE_THREAD_NAMES
+	if all && slices.ContainsFunc(threads, func(t Thread) bool { return t.Name != "" }) {
+		notes = append(notes, createThreadNamesNote(threads))
+	}
+
+	// NT_LIVECORE_SCHED
+	if all && slices.ContainsFunc(threads, func(t Thread) bool { return t.Sched != nil }) {
+		notes = append(notes, createSchedNote(threads))
+	}
+
+	// NT_LIVECORE_UNSTOPPED
+	if all && len(info.Unstopped) > 0 {
+		notes = append(notes, createTidsNote(NT_LIVECORE_UNSTOPPED, info.Unstopped))
+	}
+
+	// NT_LIVECORE_OMITTED_THREADS, even in minimal mode: without it,
+	// the threads left out look like they never existed.
+	if len(info.OmittedThreads) > 0 {
+		notes = append(notes, createTidsNote(NT_LIVECORE_OMITTED_THREADS, info.OmittedThreads))
+	}
+
+	// NT_LIVECORE_CLOCKS
+	if all && info.FreezeStart != (ClockSample{}) {
+		notes = append(notes, createClocksNote(info.FreezeStart, info.FreezeEnd))
+	}
+
+	// NT_LIVECORE_SAMPLE, even in minimal mode: without it, the missing
+	// pages look like real zeros.
+	if info.Sample != nil {
+		notes = append(notes, createSampleNote(*info.Sample))
+	}
+
+	// NT_LIVECORE_LINKMAP
+	if all && info.LinkMap != nil {
+		notes = append(notes, createLinkMapNote(info.LinkMap))
+	}
+
+	// NT_LIVECORE_BUILD_IDS
+	if all && len(info.BuildIDs) > 0 {
+		notes = append(notes, createBuildIDsNote(info.BuildIDs))
+	}
+
+	// NT_LIVECORE_HOST_PATHS
+	if all && len(info.HostPaths) > 0 {
+		notes = append(notes, createHostPathsNote(info.HostPaths))
+	}
+
+	// NT_LIVECORE_GOROUTINES
+	if all && info.GoRuntime != nil {
+		notes = append(notes, createGoroutinesNote(info.GoRuntime))
+	}
+
+	// NT_LIVECORE_READ_FAILURES, even in minimal mode, for the same reason.
+	if len(info.ReadFailures) > 0 {
+		notes = append(notes, createReadFailuresNote(info.ReadFailures))
+	}
+
+	// NT_LIVECORE_OMITTED, even in minimal mode, for the same reason.
+	if omitted := omittedRanges(info); len(omitted) > 0 {
+		notes = append(notes, createOmittedNote(omitted))
+	}
+
+	// NT_LIVECORE_REDACTED, even in minimal mode: without it, redacted
+	// memory looks like what the process held.
+	if len(info.Redacted) > 0 {
+		notes = append(notes, createRedactedNote(info.Redacted))
+	}
+
+	// NT_LIVECORE_INCREMENTAL, even in minimal mode: without it, the
+	// pages that didn't change look like real zeros.
+	if info.Incremental != nil {
+		notes = append(notes, createIncrementalNote(info.Incremental))
+	}
+
+	// NT_LIVECORE_OVERRUN, even in minimal mode: without it, the pages
+	// copied late look like the process's state at the stop.
+	if info.Overrun != nil {
+		notes = append(notes, createOverrunNote(info.Overrun))
+	}
+
+	// NT_LIVECORE_ANNOTATIONS, even in minimal mode: the user asked for it.
+	if len(info.Annotations) > 0 {
+		notes = append(notes, createAnnotationsNote(info.Annotations))
+	}
+
+	// NT_LIVECORE_CONTAINER, even in minimal mode, for the same reason.
+	if info.Container != nil {
+		notes = append(notes, createContainerNote(info.Container))
+	}
+
+	return notes, nil
+}
+
+// createPRStatusNote creates a NT_PRSTATUS note for a thread of a 64-bit
+// process of architecture a.
+func createPRStatusNote(thread Thread, ps *PSInfo, a *arch) Note {
+	// prstatus_t structure for 64-bit architectures (336 bytes total on
+	// x86-64):
+	// Verified with actual Linux kernel offsetof() output:
+	// - pr_info (elf_siginfo_t): 12 bytes (offset 0)
+	// - pr_cursig (short): 2 bytes (offset 12)
+	// - padding: 2 bytes
+	// - pr_sigpend (unsigned long): 8 bytes (offset 16)
+	// - pr_sighold (unsigned long): 8 bytes (offset 24)
+	// - pr_pid (pid_t): 4 bytes (offset 32)
+	// - pr_ppid (pid_t): 4 bytes (offset 36)
+	// - pr_pgrp (pid_t): 4 bytes (offset 40)
+	// - pr_sid (pid_t): 4 bytes (offset 44)
+	// - pr_utime (timeval): 16 bytes (offset 48)
+	// - pr_stime (timeval): 16 bytes (offset 64)
+	// - pr_cutime (timeval): 16 bytes (offset 80)
+	// - pr_cstime (timeval): 16 bytes (offset 96)
+	// - pr_reg (elf_gregset_t): 216 bytes on x86-64, 256 on RISC-V (offset 112)
+	// - pr_fpvalid (int): 4 bytes (offset 328 on x86-64)
+
+	prstatus := make([]byte, a.prstatusSize)
+
+	// pr_info and pr_cursig describe the signal the thread was receiving,
+	// if any. siginfo_t starts with si_signo, si_errno, and si_code;
+	// elf_siginfo has them as si_signo, si_code, and si_errno.
+	if len(thread.SigInfo) >= 12 {
+		si := thread.SigInfo
+		copy(prstatus[0:4], si[0:4])  // si_signo
+		copy(prstatus[4:8], si[8:12]) // si_code
+		copy(prstatus[8:12], si[4:8]) // si_errno
+		binary.LittleEndian.PutUint16(prstatus[12:], uint16(binary.LittleEndian.Uint32(si)))
+	}
+	binary.LittleEndian.PutUint64(prstatus[16:], thread.SigPending)
+	binary.LittleEndian.PutUint64(prstatus[24:], thread.SigBlocked)
+
+	// Set pr_pid (thread ID) at offset 32
+	binary.LittleEndian.PutUint32(prstatus[32:36], uint32(thread.Tid))
+
+	// pr_ppid, pr_pgrp, and pr_sid are the process's, if known
+	if ps != nil {
+		binary.LittleEndian.PutUint32(prstatus[36:40], uint32(ps.PPid))
+		binary.LittleEndian.PutUint32(prstatus[40:44], uint32(ps.PGrp))
+		binary.LittleEndian.PutUint32(prstatus[44:48], uint32(ps.Sid))
+	}
+
+	// Leave timing info as zeros (offsets 48-112)
+
+	// Copy register data starting at pr_reg, as much as we have, up to
+	// the size of elf_gregset_t. The registers from the thread should be
+	// in the correct format already.
+	fpvalid := a.regOffset + a.gregsetSize
+	copy(prstatus[a.regOffset:fpvalid], thread.Registers)
+
+	// pr_fpvalid (4 bytes): whether an NT_FPREGSET follows
+	if thread.FPRegs != nil {
+		binary.LittleEndian.PutUint32(prstatus[fpvalid:], 1)
+	}
+
+	return Note{
+		Name: "CORE",
+		Type: NT_PRSTATUS,
+		Data: prstatus,
+	}
+}
+
+// createPRStatusNote32 creates a NT_PRSTATUS note for a thread of a
+// 32-bit process. Its prstatus_t (144 bytes) is the i386 one: as
+// createPRStatusNote's, but with 32-bit longs and timevals, so pr_sigpend
+// is at 16, pr_pid at 24, pr_reg, the 68-byte i386 elf_gregset_t, at 72,
+// and pr_fpvalid at 140.
+func createPRStatusNote32(thread Thread, ps *PSInfo) Note {
+	prstatus := make([]byte, 144)
+
+	if len(thread.SigInfo) >= 12 {
+		si := thread.SigInfo
+		copy(prstatus[0:4], si[0:4])  // si_signo
+		copy(prstatus[4:8], si[8:12]) // si_code
+		copy(prstatus[8:12], si[4:8]) // si_errno
+		binary.LittleEndian.PutUint16(prstatus[12:], uint16(binary.LittleEndian.Uint32(si)))
+	}
+	// Signals above 32 don't fit in a 32-bit sigset.
+	binary.LittleEndian.PutUint32(prstatus[16:], uint32(thread.SigPending))
+	binary.LittleEndian.PutUint32(prstatus[20:], uint32(thread.SigBlocked))
+
+	binary.LittleEndian.PutUint32(prstatus[24:], uint32(thread.Tid))
+	if ps != nil {
+		binary.LittleEndian.PutUint32(prstatus[28:], uint32(ps.PPid))
+		binary.LittleEndian.PutUint32(prstatus[32:], uint32(ps.PGrp))
+		binary.LittleEndian.PutUint32(prstatus[36:], uint32(ps.Sid))
+	}
+
+	copy(prstatus[72:140], thread.Registers)
+
+	if thread.FPRegs != nil {
+		binary.LittleEndian.PutUint32(prstatus[140:], 1)
+	}
+
+	return Note{
+		Name: "CORE",
+		Type: NT_PRSTATUS,
+		Data: prstatus,
+	}
+}
+
+// createFPRegsetNote creates a NT_FPREGSET note
+func createFPRegsetNote(thread Thread) Note {
+	return Note{
+		Name: "CORE",
+		Type: NT_FPREGSET,
+		Data: thread.FPRegs,
+	}
+}
+
+// createXStateNote creates a NT_X86_XSTATE note. Unlike the older
+// register notes, its owner is "LINUX", which is what debuggers look for.
+func createXStateNote(thread Thread) Note {
+	return Note{
+		Name: "LINUX",
+		Type: NT_XSTATE,
+		Data: thread.XState,
+	}
+}
+
+// ReadPSInfo reads the process status for NT_PRPSINFO from /proc/<pid>,
+// as CreateCoreNotes does if CoreInfo.PSInfo is nil.
+func ReadPSInfo(pid int) (*PSInfo, error) {
+	// Read process info from /proc/<pid>/stat
+	statPath := fmt.Sprintf("/proc/%d/stat", pid)
+	statData, err := os.ReadFile(statPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stat: %w", err)
+	}
+
+	// Read command line
+	cmdlinePath := fmt.Sprintf("/proc/%d/cmdline", pid)
+	cmdlineData, err := os.ReadFile(cmdlinePath)
+	if err != nil {
+		cmdlineData = []byte{} // Empty if can't read
+	}
+
+	// Parse stat data
+	statStr := string(statData)
+	fields := strings.Fields(statStr)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("invalid stat format")
+	}
+
+	ps := &PSInfo{Pid: pid, Fname: "unknown", Args: cmdlineData}
+	if len(fields) > 2 {
+		ps.State = fields[2][0] // Process state character
+	}
+	if len(fields) > 18 {
+		if nice, err := strconv.Atoi(fields[18]); err == nil {
+			ps.Nice = int8(nice)
+		}
+	}
+	if len(fields) > 8 {
+		if flags, err := strconv.ParseUint(fields[8], 10, 64); err == nil {
+			ps.Flags = flags
+		}
+	}
+	if len(fields) > 3 {
+		ps.PPid, _ = strconv.Atoi(fields[3])
+	}
+	if len(fields) > 4 {
+		ps.PGrp, _ = strconv.Atoi(fields[4])
+	}
+	if len(fields) > 5 {
+		ps.Sid, _ = strconv.Atoi(fields[5])
+	}
+	if len(fields) > 1 {
+		// Remove parentheses from comm field
+		comm := fields[1]
+		if len(comm) > 2 && comm[0] == '(' && comm[len(comm)-1] == ')' {
+			ps.Fname = comm[1 : len(comm)-1]
+		}
+	}
+	return ps, nil
+}
+
+// createPRPSInfoNote creates a NT_PRPSINFO note
+func createPRPSInfoNote(ps *PSInfo, cmdline Redaction) Note {
+	// Create prpsinfo structure (136 bytes for 64-bit architectures)
+	prpsinfo := make([]byte, 136)
+
+	// pr_state (offset 0, 1 byte)
+	prpsinfo[0] = ps.State
+
+	// pr_sname (offset 1, 1 byte) - same as state
+	prpsinfo[1] = prpsinfo[0]
+
+	// pr_zomb (offset 2, 1 byte) - 1 if zombie
+	if prpsinfo[0] == 'Z' {
+		prpsinfo[2] = 1
+	}
+
+	// pr_nice (offset 3, 1 byte) - nice value
+	prpsinfo[3] = byte(ps.Nice)
+
+	// pr_flag (offset 8, 8 bytes) - process flags
+	binary.LittleEndian.PutUint64(prpsinfo[8:16], ps.Flags)
+
+	// pr_uid, pr_gid (offset 16, 4 bytes each)
+	binary.LittleEndian.PutUint32(prpsinfo[16:20], ps.Uid)
+	binary.LittleEndian.PutUint32(prpsinfo[20:24], ps.Gid)
+
+	// pr_pid, pr_ppid, pr_pgrp, pr_sid (offset 24, 4 bytes each)
+	binary.LittleEndian.PutUint32(prpsinfo[24:28], uint32(ps.Pid))
+	binary.LittleEndian.PutUint32(prpsinfo[28:32], uint32(ps.PPid))
+	binary.LittleEndian.PutUint32(prpsinfo[32:36], uint32(ps.PGrp))
+	binary.LittleEndian.PutUint32(prpsinfo[36:40], uint32(ps.Sid))
+
+	// pr_fname (offset 40, 16 bytes) - executable name
+	execName := ps.Fname
+	if len(execName) > 15 {
+		execName = execName[:15] // Truncate to fit
+	}
+	copy(prpsinfo[40:56], []byte(execName))
+
+	// pr_psargs (offset 56, 80 bytes) - command line arguments
+	copy(prpsinfo[56:136], psargs(ps, cmdline))
+
+	return Note{
+		Name: "CORE",
+		Type: NT_PRPSINFO,
+		Data: prpsinfo,
+	}
+}
+
+// createPRPSInfoNote32 creates a NT_PRPSINFO note for a 32-bit process.
+// Its prpsinfo (124 bytes) is the i386 one: as createPRPSInfoNote's, but
+// with a 32-bit pr_flag at 4, 16-bit pr_uid and pr_gid at 8, pr_pid at 12,
+// pr_fname at 28, and pr_psargs at 44.
+func createPRPSInfoNote32(ps *PSInfo, cmdline Redaction) Note {
+	prpsinfo := make([]byte, 124)
+
+	prpsinfo[0] = ps.State
+	prpsinfo[1] = ps.State
+	if ps.State == 'Z' {
+		prpsinfo[2] = 1
+	}
+	prpsinfo[3] = byte(ps.Nice)
+
+	binary.LittleEndian.PutUint32(prpsinfo[4:], uint32(ps.Flags))
+	binary.LittleEndian.PutUint16(prpsinfo[8:], uint16(ps.Uid))
+	binary.LittleEndian.PutUint16(prpsinfo[10:], uint16(ps.Gid))
+
+	binary.LittleEndian.PutUint32(prpsinfo[12:], uint32(ps.Pid))
+	binary.LittleEndian.PutUint32(prpsinfo[16:], uint32(ps.PPid))
+	binary.LittleEndian.PutUint32(prpsinfo[20:], uint32(ps.PGrp))
+	binary.LittleEndian.PutUint32(prpsinfo[24:], uint32(ps.Sid))
+
+	execName := ps.Fname
+	if len(execName) > 15 {
+		execName = execName[:15]
+	}
+	copy(prpsinfo[28:44], execName)
+	copy(prpsinfo[44:124], psargs(ps, cmdline))
+
+	return Note{
+		Name: "CORE",
+		Type: NT_PRPSINFO,
+		Data: prpsinfo,
+	}
+}
+
+// psargs returns ps's command line as pr_psargs has it: its arguments
+// separated by spaces, with cmdline applied, and cut to 79 bytes.
+func psargs(ps *PSInfo, cmdline Redaction) []byte {
+	if len(ps.Args) == 0 {
+		return nil
+	}
+	// Replace null bytes with spaces
+	args := bytes.ReplaceAll(ps.Args, []byte{0}, []byte{' '})
+	// Trim trailing spaces
+	args = bytes.TrimRight(args, " ")
+	args = cmdline.Apply(args)
+	if len(args) > 79 {
+		args = args[:79]
+	}
+	return args
+}
+
+// createAuxvNote creates a NT_AUXV note from auxvData, or if that's nil,
+// from /proc/<pid>/auxv. A 32-bit process's entries are pairs of 4-byte
+// values, rather than 8-byte ones.
+func createAuxvNote(pid int, auxvData []byte, is32 bool) (Note, error) {
+	if auxvData == nil {
+		var err error
+		auxvData, err = os.ReadFile(fmt.Sprintf("/proc/%d/auxv", pid))
+		if err != nil {
+			return Note{}, fmt.Errorf("failed to read auxv: %w", err)
+		}
+	} else {
+		auxvData = slices.Clone(auxvData) // may be extended below
+	}
+	entrySize := 16
+	if is32 {
+		entrySize = 8
+	}
+
+	// Validate that auxv data is properly formatted
+	if len(auxvData)%entrySize != 0 {
+		return Note{}, fmt.Errorf("invalid auxv data length: %d (should be multiple of %d)", len(auxvData), entrySize)
+	}
+
+	// The auxv data should end with AT_NULL (type=0, value=0), an entry of
+	// all zeros; add one if it's missing, or if there's no auxv data at all.
+	if len(auxvData) == 0 || slices.ContainsFunc(auxvData[len(auxvData)-entrySize:], func(b byte) bool { return b != 0 }) {
+		auxvData = append(auxvData, make([]byte, entrySize)...)
+	}
+
+	return Note{
+		Name: "CORE",
+		Type: NT_AUXV,
+		Data: auxvData,
+	}, nil
+}
+
+// createFileNote creates a NT_FILE note, which gives debuggers the file
+// behind each file-backed mapping. As in the kernel's, file offsets are in
+// units of the note's page size. Its numbers are longs: 4 bytes each for
+// a 32-bit process, rather than 8.
+func createFileNote(fileTable []FileEntry, is32 bool) Note {
+	var buf bytes.Buffer
+
+	// Temporary buffer for binary encoding
+	tmp := make([]byte, 8)
+	put := func(v uint64) {
+		if is32 {
+			binary.LittleEndian.PutUint32(tmp, uint32(v))
+			buf.Write(tmp[:4])
+			return
+		}
+		binary.LittleEndian.PutUint64(tmp, v)
+		buf.Write(tmp)
+	}
+
+	// Write count (number of entries), and page size
+	put(uint64(len(fileTable)))
+	put(pageSize)
+
+	// Write file entries (start, end, file offset)
+	for _, entry := range fileTable {
+		put(uint64(entry.Start))
+		put(uint64(entry.End))
+		put(entry.FileOfs / pageSize)
+	}
+
+	// Write path strings
+	for _, entry := range fileTable {
+		buf.WriteString(entry.Path)
+		buf.WriteByte(0) // null terminator
+	}
+
+	return Note{
+		Name: "CORE",
+		Type: NT_FILE,
+		Data: buf.Bytes(),
+	}
+}
+
+// createTidsNote creates a note of type typ listing tids, such as
+// NT_LIVECORE_UNSTOPPED.
+func createTidsNote(typ NoteType, tids []int) Note {
+	data := make([]byte, 4*len(tids))
+	for i, tid := range tids {
+		binary.LittleEndian.PutUint32(data[i*4:], uint32(tid))
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: typ,
+		Data: data,
+	}
+}
+
+// createThreadNamesNote creates a NT_LIVECORE_THREAD_NAMES note
+func createThreadNamesNote(threads []Thread) Note {
+	var buf bytes.Buffer
+	for _, t := range threads {
+		if t.Name != "" {
+			fmt.Fprintf(&buf, "%d=%s\x00", t.Tid, t.Name)
+		}
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_THREAD_NAMES,
+		Data: buf.Bytes(),
+	}
+}
+
+// createSchedNote creates a NT_LIVECORE_SCHED note
+func createSchedNote(threads []Thread) Note {
+	var data []byte
+	for _, t := range threads {
+		s := t.Sched
+		if s == nil {
+			continue
+		}
+		data = binary.LittleEndian.AppendUint32(data, uint32(t.Tid))
+		data = binary.LittleEndian.AppendUint32(data, s.Policy)
+		data = binary.LittleEndian.AppendUint32(data, s.RTPriority)
+		data = binary.LittleEndian.AppendUint32(data, uint32(s.Priority))
+		data = binary.LittleEndian.AppendUint32(data, uint32(s.Nice))
+		data = binary.LittleEndian.AppendUint32(data, uint32(s.CPU))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(s.Affinity)))
+		data = binary.LittleEndian.AppendUint32(data, 0) // padding
+		for _, w := range s.Affinity {
+			data = binary.LittleEndian.AppendUint64(data, w)
+		}
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_SCHED,
+		Data: data,
+	}
+}
+
+// createClocksNote creates a NT_LIVECORE_CLOCKS note
+func createClocksNote(start, end ClockSample) Note {
+	data := make([]byte, 0, 48)
+	for _, cs := range []ClockSample{start, end} {
+		data = binary.LittleEndian.AppendUint64(data, uint64(cs.Realtime))
+		data = binary.LittleEndian.AppendUint64(data, uint64(cs.Monotonic))
+		data = binary.LittleEndian.AppendUint64(data, uint64(cs.Boottime))
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_CLOCKS,
+		Data: data,
+	}
+}
+
+// createAnnotationsNote creates a NT_LIVECORE_ANNOTATIONS note
+func createAnnotationsNote(annotations []Annotation) Note {
+	var buf bytes.Buffer
+	for _, a := range annotations {
+		buf.WriteString(a.Key)
+		buf.WriteByte('=')
+		buf.WriteString(a.Value)
+		buf.WriteByte(0)
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_ANNOTATIONS,
+		Data: buf.Bytes(),
+	}
+}
+
+// createContainerNote creates a NT_LIVECORE_CONTAINER note
+func createContainerNote(c *ContainerInfo) Note {
+	var buf bytes.Buffer
+	for _, kv := range [][2]string{
+		{"id", c.ID},
+		{"runtime", c.Runtime},
+		{"name", c.Name},
+		{"image", c.Image},
+		{"cgroup", c.Cgroup},
+		{"pod", c.Pod},
+		{"namespace", c.Namespace},
+	} {
+		if kv[1] != "" {
+			buf.WriteString(kv[0] + "=" + kv[1])
+			buf.WriteByte(0)
+		}
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_CONTAINER,
+		Data: buf.Bytes(),
+	}
+}
+
+// createHostPathsNote creates a NT_LIVECORE_HOST_PATHS note
+func createHostPathsNote(paths map[string]string) Note {
+	var buf bytes.Buffer
+	for _, p := range slices.Sorted(maps.Keys(paths)) {
+		buf.WriteString(p)
+		buf.WriteByte(0)
+		buf.WriteString(paths[p])
+		buf.WriteByte(0)
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_HOST_PATHS,
+		Data: buf.Bytes(),
+	}
+}
+
+// createSampleNote creates a NT_LIVECORE_SAMPLE note
+func createSampleNote(si SampleInfo) Note {
+	data := make([]byte, 0, 24)
+	data = binary.LittleEndian.AppendUint64(data, si.Seed)
+	data = binary.LittleEndian.AppendUint64(data, si.Threshold)
+	data = binary.LittleEndian.AppendUint64(data, si.StackWindow)
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_SAMPLE,
+		Data: data,
+	}
+}
+
+// createReadFailuresNote creates a NT_LIVECORE_READ_FAILURES note
+func createReadFailuresNote(failures []ReadFailure) Note {
+	data := make([]byte, 0, 32*len(failures))
+	for _, f := range failures {
+		data = binary.LittleEndian.AppendUint64(data, uint64(f.Start))
+		data = binary.LittleEndian.AppendUint64(data, uint64(f.End))
+		data = binary.LittleEndian.AppendUint64(data, uint64(f.VMAStart))
+		data = binary.LittleEndian.AppendUint32(data, uint32(f.Errno))
+		data = binary.LittleEndian.AppendUint32(data, 0)
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_READ_FAILURES,
+		Data: data,
+	}
+}
+
+// omittedRanges returns the ranges whose contents aren't in the core:
+// VMAs that are left out or zero-filled, plus info.Omitted, sorted by
+// start address.
+func omittedRanges(info *CoreInfo) []OmittedRange {
+	var omitted []OmittedRange
+	for i := range info.VMAs {
+		vma := &info.VMAs[i]
+		reason := vma.omitReason()
+		if reason == "" {
+			reason = vma.zeroReason()
+		}
+		if reason != "" {
+			omitted = append(omitted, OmittedRange{Start: vma.Start, End: vma.End, Reason: reason})
+		}
+	}
+	omitted = append(omitted, info.Omitted...)
+	slices.SortStableFunc(omitted, func(a, b OmittedRange) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	return omitted
+}
+
+// createOmittedNote creates a NT_LIVECORE_OMITTED note
+func createOmittedNote(omitted []OmittedRange) Note {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(len(omitted)))
+	for _, o := range omitted {
+		data = binary.LittleEndian.AppendUint64(data, uint64(o.Start))
+		data = binary.LittleEndian.AppendUint64(data, uint64(o.End))
+	}
+	for _, o := range omitted {
+		data = append(data, o.Reason...)
+		data = append(data, 0)
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_OMITTED,
+		Data: data,
+	}
+}
+
+// createRedactedNote creates a NT_LIVECORE_REDACTED note
+func createRedactedNote(redacted []RedactedRange) Note {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(len(redacted)))
+	for _, r := range redacted {
+		data = binary.LittleEndian.AppendUint64(data, uint64(r.Start))
+		data = binary.LittleEndian.AppendUint64(data, uint64(r.End))
+	}
+	for _, r := range redacted {
+		data = append(data, r.Rule...)
+		data = append(data, 0)
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_REDACTED,
+		Data: data,
+	}
+}
+
+// createIncrementalNote creates a NT_LIVECORE_INCREMENTAL note
+func createIncrementalNote(inc *IncrementalInfo) Note {
+	var data []byte
+	for _, v := range []int64{inc.Base.Realtime, inc.Base.Monotonic, inc.Base.Boottime} {
+		data = binary.LittleEndian.AppendUint64(data, uint64(v))
+	}
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(inc.Changed)))
+	for _, r := range inc.Changed {
+		data = binary.LittleEndian.AppendUint64(data, uint64(r.Start))
+		data = binary.LittleEndian.AppendUint64(data, uint64(r.End))
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_INCREMENTAL,
+		Data: data,
+	}
+}
+
+// createOverrunNote creates a NT_LIVECORE_OVERRUN note
+func createOverrunNote(o *OverrunInfo) Note {
+	var flags uint64
+	if o.Fuzzy {
+		flags |= 1
+	}
+	data := binary.LittleEndian.AppendUint64(nil, uint64(o.Budget))
+	data = binary.LittleEndian.AppendUint64(data, flags)
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(o.Uncopied)))
+	for _, r := range o.Uncopied {
+		data = binary.LittleEndian.AppendUint64(data, uint64(r.Start))
+		data = binary.LittleEndian.AppendUint64(data, uint64(r.End))
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_OVERRUN,
+		Data: data,
+	}
+}
+
+// createLinkMapNote creates a NT_LIVECORE_LINKMAP note
+func createLinkMapNote(lm *LinkMap) Note {
+	var data []byte
+	for _, v := range []uint64{uint64(lm.Phdr), lm.Phnum, uint64(lm.Base), uint64(lm.RDebug), uint64(len(lm.Maps))} {
+		data = binary.LittleEndian.AppendUint64(data, v)
+	}
+	for _, e := range lm.Maps {
+		data = binary.LittleEndian.AppendUint64(data, uint64(e.Addr))
+		data = binary.LittleEndian.AppendUint64(data, uint64(e.LAddr))
+		data = binary.LittleEndian.AppendUint64(data, uint64(e.LD))
+	}
+	for _, e := range lm.Maps {
+		data = append(data, e.Name...)
+		data = append(data, 0)
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_LINKMAP,
+		Data: data,
+	}
+}
+
+// createBuildIDsNote creates a NT_LIVECORE_BUILD_IDS note
+func createBuildIDsNote(ids []BuildID) Note {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(len(ids)))
+	for _, b := range ids {
+		data = binary.LittleEndian.AppendUint64(data, uint64(b.Start))
+		data = binary.LittleEndian.AppendUint64(data, uint64(len(b.ID)))
+	}
+	for _, b := range ids {
+		data = append(data, b.ID...)
+	}
+	for _, b := range ids {
+		data = append(data, b.Path...)
+		data = append(data, 0)
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_BUILD_IDS,
+		Data: data,
+	}
+}
+
+// createGoroutinesNote creates a NT_LIVECORE_GOROUTINES note
+func createGoroutinesNote(rt *GoRuntime) Note {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(rt.AllGs))
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(rt.Goroutines)))
+	for _, g := range rt.Goroutines {
+		for _, v := range []uint64{uint64(g.Addr), g.ID, uint64(g.Status), uint64(g.WaitReason), uint64(g.StackLo), uint64(g.StackHi), uint64(g.SP), uint64(g.PC)} {
+			data = binary.LittleEndian.AppendUint64(data, v)
+		}
+	}
+	return Note{
+		Name: LivecoreNoteName,
+		Type: NT_LIVECORE_GOROUTINES,
+		Data: data,
+	}
+}
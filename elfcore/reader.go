@@ -0,0 +1,633 @@
+package elfcore
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// CoreReader reads a core file back: its notes, parsed into a CoreInfo,
+// and the memory in its PT_LOAD segments. It understands the notes
+// livecore writes, and the standard ones in cores from the kernel or gdb.
+type CoreReader struct {
+	r      io.ReaderAt
+	closer io.Closer // or nil
+	info   *CoreInfo
+	loads  []elf.ProgHeader // PT_LOAD, sorted by Vaddr
+
+	// file is r, if it's a file, for finding holes and cloning; see
+	// DataExtents and WriteMemoryTo.
+	file    *os.File
+	noClone atomic.Bool   // the filesystem refused to clone from file
+	cloned  atomic.Uint64 // bytes WriteMemoryTo cloned
+}
+
+// OpenCore opens and parses the core file at path.
+func OpenCore(path string) (*CoreReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open core file: %w", err)
+	}
+	cr, err := NewCoreReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cr.closer = f
+	return cr, nil
+}
+
+// NewCoreReader parses the core file in r.
+func NewCoreReader(r io.ReaderAt) (*CoreReader, error) {
+	ef, err := elf.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ELF: %w", err)
+	}
+	if ef.Type != elf.ET_CORE {
+		return nil, fmt.Errorf("not a core file (type %v)", ef.Type)
+	}
+	if ef.Class != elf.ELFCLASS64 && ef.Class != elf.ELFCLASS32 || ef.ByteOrder != binary.LittleEndian {
+		return nil, fmt.Errorf("unsupported core file class %v, byte order %v", ef.Class, ef.ByteOrder)
+	}
+
+	cr := &CoreReader{r: r, info: &CoreInfo{Class: ef.Class, Machine: ef.Machine}}
+	cr.file, _ = r.(*os.File)
+	for _, p := range ef.Progs {
+		switch p.Type {
+		case elf.PT_LOAD:
+			cr.loads = append(cr.loads, p.ProgHeader)
+		case elf.PT_NOTE:
+			data := make([]byte, p.Filesz)
+			if _, err := r.ReadAt(data, int64(p.Off)); err != nil {
+				return nil, fmt.Errorf("failed to read PT_NOTE: %w", err)
+			}
+			notes, err := parseNotes(data)
+			if err != nil {
+				return nil, err
+			}
+			cr.info.Notes = append(cr.info.Notes, notes...)
+		}
+	}
+	sort.Slice(cr.loads, func(i, j int) bool { return cr.loads[i].Vaddr < cr.loads[j].Vaddr })
+
+	if err := cr.parseInfo(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Close closes the underlying file, if OpenCore opened it.
+func (cr *CoreReader) Close() error {
+	if cr.closer != nil {
+		return cr.closer.Close()
+	}
+	return nil
+}
+
+// Info returns what the core's notes and program headers say about the
+// process. Threads, VMAs, FileTable, and the vendor-note fields are filled
+// in, and Notes holds every note in file order.
+//
+// Omitted lists every range from the NT_LIVECORE_OMITTED note, including
+// the ones CreateCoreNotes derives from VMAs, which aren't in the core's
+// VMAs when they were left out entirely.
+func (cr *CoreReader) Info() *CoreInfo {
+	return cr.info
+}
+
+// Segment is a PT_LOAD segment of a core file.
+type Segment struct {
+	Start, End uintptr // virtual address range
+	Perms      Perm
+	FileOffset uint64 // where its contents start in the core file
+	FileSize   uint64 // how much of it is stored; the rest reads as zeros
+}
+
+// Segments returns the core's PT_LOAD segments in address order.
+//
+// Unlike Info's VMAs, they say how much of each segment is stored: gdb
+// and the kernel store no contents for mappings they leave out.
+func (cr *CoreReader) Segments() []Segment {
+	segs := make([]Segment, len(cr.loads))
+	for i, p := range cr.loads {
+		segs[i] = Segment{
+			Start:      uintptr(p.Vaddr),
+			End:        uintptr(p.Vaddr + p.Memsz),
+			Perms:      permsFromFlags(p.Flags),
+			FileOffset: p.Off,
+			FileSize:   p.Filesz,
+		}
+	}
+	return segs
+}
+
+// permsFromFlags converts PF_* program header flags to a Perm.
+func permsFromFlags(flags elf.ProgFlag) Perm {
+	var perms Perm
+	if flags&elf.PF_R != 0 {
+		perms |= PermRead
+	}
+	if flags&elf.PF_W != 0 {
+		perms |= PermWrite
+	}
+	if flags&elf.PF_X != 0 {
+		perms |= PermExec
+	}
+	return perms
+}
+
+// ReadAt reads len(buf) bytes of the process's memory at addr, as
+// recorded in the core. Bytes past a segment's file size, up to its memory
+// size, read as zeros. It returns an error if any part of the range isn't
+// in a PT_LOAD segment. It makes CoreReader a MemorySource, so a core
+// can be rewritten, for instance with different notes.
+func (cr *CoreReader) ReadAt(buf []byte, addr uintptr) (int, error) {
+	n := 0
+	for n < len(buf) {
+		a := uint64(addr) + uint64(n)
+		p, err := cr.segment(a)
+		if err != nil {
+			return n, err
+		}
+		chunk := buf[n:min(len(buf), n+int(p.Vaddr+p.Memsz-a))]
+		off := a - p.Vaddr
+		fileChunk := chunk[:min(uint64(len(chunk)), p.Filesz-min(off, p.Filesz))]
+		if len(fileChunk) > 0 {
+			if _, err := cr.r.ReadAt(fileChunk, int64(p.Off+off)); err != nil {
+				return n, fmt.Errorf("failed to read core at %#x: %w", a, err)
+			}
+		}
+		clear(chunk[len(fileChunk):])
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// segment returns the PT_LOAD segment holding address a.
+func (cr *CoreReader) segment(a uint64) (elf.ProgHeader, error) {
+	i := sort.Search(len(cr.loads), func(i int) bool { return cr.loads[i].Vaddr+cr.loads[i].Memsz > a })
+	if i == len(cr.loads) || cr.loads[i].Vaddr > a {
+		return elf.ProgHeader{}, fmt.Errorf("address %#x not in core", a)
+	}
+	return cr.loads[i], nil
+}
+
+// parseNotes parses the notes in a PT_NOTE segment.
+func parseNotes(data []byte) ([]Note, error) {
+	var notes []Note
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, errors.New("truncated note header")
+		}
+		nameSize := int(binary.LittleEndian.Uint32(data[0:]))
+		descSize := int(binary.LittleEndian.Uint32(data[4:]))
+		typ := NoteType(binary.LittleEndian.Uint32(data[8:]))
+		data = data[12:]
+		if padUpTo4Bytes(nameSize)+padUpTo4Bytes(descSize) > len(data) {
+			return nil, fmt.Errorf("truncated note of type %#x", typ)
+		}
+		name := string(bytes.TrimRight(data[:nameSize], "\x00"))
+		data = data[padUpTo4Bytes(nameSize):]
+		desc := data[:descSize]
+		data = data[padUpTo4Bytes(descSize):]
+		notes = append(notes, Note{Name: name, Type: typ, Data: desc})
+	}
+	return notes, nil
+}
+
+// parseInfo fills in cr.info from its notes and program headers.
+func (cr *CoreReader) parseInfo() error {
+	info := cr.info
+
+	for _, n := range info.Notes {
+		var err error
+		switch {
+		case n.Name == "CORE" && n.Type == NT_PRSTATUS && info.is32():
+			if len(n.Data) < 140 {
+				return fmt.Errorf("short NT_PRSTATUS note (%d bytes)", len(n.Data))
+			}
+			info.Threads = append(info.Threads, Thread{
+				Tid:        int(binary.LittleEndian.Uint32(n.Data[24:])),
+				Registers:  n.Data[72:140],
+				SigPending: uint64(binary.LittleEndian.Uint32(n.Data[16:])),
+				SigBlocked: uint64(binary.LittleEndian.Uint32(n.Data[20:])),
+			})
+		case n.Name == "CORE" && n.Type == NT_PRSTATUS:
+			a := info.arch()
+			regsEnd := a.regOffset + a.gregsetSize
+			if len(n.Data) < regsEnd {
+				return fmt.Errorf("short NT_PRSTATUS note (%d bytes)", len(n.Data))
+			}
+			info.Threads = append(info.Threads, Thread{
+				Tid:        int(binary.LittleEndian.Uint32(n.Data[32:])),
+				Registers:  n.Data[a.regOffset:regsEnd],
+				SigPending: binary.LittleEndian.Uint64(n.Data[16:]),
+				SigBlocked: binary.LittleEndian.Uint64(n.Data[24:]),
+			})
+		case n.Name == "CORE" && n.Type == NT_FPREGSET && len(info.Threads) > 0:
+			// Register notes belong to the thread of the last NT_PRSTATUS.
+			info.Threads[len(info.Threads)-1].FPRegs = n.Data
+		case n.Name == "CORE" && n.Type == NT_SIGINFO && len(info.Threads) > 0:
+			info.Threads[len(info.Threads)-1].SigInfo = n.Data
+		case n.Name == "LINUX" && n.Type == NT_XSTATE && len(info.Threads) > 0:
+			info.Threads[len(info.Threads)-1].XState = n.Data
+		case n.Name == "CORE" && n.Type == NT_PRPSINFO && info.is32():
+			if len(n.Data) < 124 {
+				return fmt.Errorf("short NT_PRPSINFO note (%d bytes)", len(n.Data))
+			}
+			info.PSInfo = parsePSInfo32(n.Data)
+			info.Pid = info.PSInfo.Pid
+		case n.Name == "CORE" && n.Type == NT_PRPSINFO:
+			if len(n.Data) < 136 {
+				return fmt.Errorf("short NT_PRPSINFO note (%d bytes)", len(n.Data))
+			}
+			info.PSInfo = parsePSInfo(n.Data)
+			info.Pid = info.PSInfo.Pid
+		case n.Name == "CORE" && n.Type == NT_AUXV:
+			info.Auxv = n.Data
+		case n.Name == "CORE" && n.Type == NT_FILE:
+			info.FileTable, err = parseFileNote(n.Data, info.is32())
+		case n.Name == LivecoreNoteName:
+			err = info.parseLivecoreNote(n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if info.Pid == 0 && len(info.Threads) > 0 {
+		info.Pid = info.Threads[0].Tid
+	}
+
+	files := make(map[uintptr]FileEntry)
+	for _, fe := range info.FileTable {
+		files[fe.Start] = fe
+	}
+	for _, p := range cr.loads {
+		vma := VMA{
+			Start:      uintptr(p.Vaddr),
+			End:        uintptr(p.Vaddr + p.Memsz),
+			FileOffset: p.Off,
+			MemSize:    p.Memsz,
+			Perms:      permsFromFlags(p.Flags),
+			Kind:       VMAAnonymous,
+		}
+		if fe, ok := files[vma.Start]; ok {
+			vma.Path = fe.Path
+			vma.Offset = fe.FileOfs
+			vma.Kind = VMAFile
+		}
+		info.VMAs = append(info.VMAs, vma)
+	}
+	return nil
+}
+
+// parsePSInfo parses the 136-byte 64-bit prpsinfo in an NT_PRPSINFO note.
+// The command line comes back space-separated, as it's stored.
+func parsePSInfo(d []byte) *PSInfo {
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(d[off:]) }
+	return &PSInfo{
+		State: d[0],
+		Nice:  int8(d[3]),
+		Flags: binary.LittleEndian.Uint64(d[8:]),
+		Uid:   u32(16),
+		Gid:   u32(20),
+		Pid:   int(u32(24)),
+		PPid:  int(u32(28)),
+		PGrp:  int(u32(32)),
+		Sid:   int(u32(36)),
+		Fname: string(bytes.TrimRight(d[40:56], "\x00")),
+		Args:  bytes.TrimRight(d[56:136], "\x00"),
+	}
+}
+
+// parsePSInfo32 parses the 124-byte i386 prpsinfo in a 32-bit core's
+// NT_PRPSINFO note.
+func parsePSInfo32(d []byte) *PSInfo {
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(d[off:]) }
+	return &PSInfo{
+		State: d[0],
+		Nice:  int8(d[3]),
+		Flags: uint64(u32(4)),
+		Uid:   uint32(binary.LittleEndian.Uint16(d[8:])),
+		Gid:   uint32(binary.LittleEndian.Uint16(d[10:])),
+		Pid:   int(u32(12)),
+		PPid:  int(u32(16)),
+		PGrp:  int(u32(20)),
+		Sid:   int(u32(24)),
+		Fname: string(bytes.TrimRight(d[28:44], "\x00")),
+		Args:  bytes.TrimRight(d[44:124], "\x00"),
+	}
+}
+
+// parseFileNote parses an NT_FILE note, whose numbers are 4 bytes each in
+// a 32-bit core, and 8 in a 64-bit one. File offsets in the note are in
+// units of its page size; the returned entries have them in bytes.
+func parseFileNote(data []byte, is32 bool) ([]FileEntry, error) {
+	word := uint64(8)
+	long := func(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
+	if is32 {
+		word = 4
+		long = func(b []byte) uint64 { return uint64(binary.LittleEndian.Uint32(b)) }
+	}
+	if uint64(len(data)) < 2*word {
+		return nil, errors.New("short NT_FILE note")
+	}
+	count := long(data[0:])
+	pageSize := long(data[word:])
+	if count > (uint64(len(data))-2*word)/(3*word) {
+		return nil, fmt.Errorf("NT_FILE note claims %d entries", count)
+	}
+	names := bytes.Split(data[2*word+3*word*count:], []byte{0})
+	if uint64(len(names)) < count {
+		return nil, errors.New("NT_FILE note is missing file names")
+	}
+	var entries []FileEntry
+	for i := range count {
+		e := data[2*word+3*word*i:]
+		entries = append(entries, FileEntry{
+			Start:   uintptr(long(e[0:])),
+			End:     uintptr(long(e[word:])),
+			FileOfs: long(e[2*word:]) * pageSize,
+			Path:    string(names[i]),
+		})
+	}
+	return entries, nil
+}
+
+// parseLivecoreNote fills in the CoreInfo field corresponding to one of
+// livecore's vendor notes. Unknown types are ignored.
+func (info *CoreInfo) parseLivecoreNote(n Note) error {
+	d := n.Data
+	u64 := func(i int) uint64 { return binary.LittleEndian.Uint64(d[8*i:]) }
+	short := func(want int) error {
+		if len(d) < want {
+			return fmt.Errorf("short LIVECORE note type %d (%d bytes)", n.Type, len(d))
+		}
+		return nil
+	}
+
+	switch n.Type {
+	case NT_LIVECORE_UNSTOPPED:
+		for i := 0; i+4 <= len(d); i += 4 {
+			info.Unstopped = append(info.Unstopped, int(binary.LittleEndian.Uint32(d[i:])))
+		}
+	case NT_LIVECORE_OMITTED_THREADS:
+		for i := 0; i+4 <= len(d); i += 4 {
+			info.OmittedThreads = append(info.OmittedThreads, int(binary.LittleEndian.Uint32(d[i:])))
+		}
+	case NT_LIVECORE_CLOCKS:
+		if err := short(48); err != nil {
+			return err
+		}
+		info.FreezeStart = ClockSample{int64(u64(0)), int64(u64(1)), int64(u64(2))}
+		info.FreezeEnd = ClockSample{int64(u64(3)), int64(u64(4)), int64(u64(5))}
+	case NT_LIVECORE_ANNOTATIONS:
+		for kv := range bytes.SplitSeq(bytes.TrimSuffix(d, []byte{0}), []byte{0}) {
+			if len(kv) == 0 {
+				continue
+			}
+			a, err := ParseAnnotation(string(kv))
+			if err != nil {
+				return err
+			}
+			info.Annotations = append(info.Annotations, a)
+		}
+	case NT_LIVECORE_SAMPLE:
+		if err := short(24); err != nil {
+			return err
+		}
+		info.Sample = &SampleInfo{Seed: u64(0), Threshold: u64(1), StackWindow: u64(2)}
+	case NT_LIVECORE_READ_FAILURES:
+		for i := 0; i+32 <= len(d); i += 32 {
+			e := d[i:]
+			info.ReadFailures = append(info.ReadFailures, ReadFailure{
+				Start:    uintptr(binary.LittleEndian.Uint64(e[0:])),
+				End:      uintptr(binary.LittleEndian.Uint64(e[8:])),
+				VMAStart: uintptr(binary.LittleEndian.Uint64(e[16:])),
+				Errno:    syscall.Errno(binary.LittleEndian.Uint32(e[24:])),
+			})
+		}
+	case NT_LIVECORE_OMITTED:
+		if err := short(8); err != nil {
+			return err
+		}
+		count := u64(0)
+		if count > uint64(len(d)-8)/16 {
+			return fmt.Errorf("omitted-ranges note claims %d entries", count)
+		}
+		reasons := bytes.Split(d[8+16*count:], []byte{0})
+		for i := range int(count) {
+			o := OmittedRange{
+				Start: uintptr(binary.LittleEndian.Uint64(d[8+16*i:])),
+				End:   uintptr(binary.LittleEndian.Uint64(d[16+16*i:])),
+			}
+			if i < len(reasons) {
+				o.Reason = string(reasons[i])
+			}
+			info.Omitted = append(info.Omitted, o)
+		}
+	case NT_LIVECORE_REDACTED:
+		if err := short(8); err != nil {
+			return err
+		}
+		count := u64(0)
+		if count > uint64(len(d)-8)/16 {
+			return fmt.Errorf("redacted-ranges note claims %d entries", count)
+		}
+		rules := bytes.Split(d[8+16*count:], []byte{0})
+		for i := range int(count) {
+			r := RedactedRange{
+				Start: uintptr(binary.LittleEndian.Uint64(d[8+16*i:])),
+				End:   uintptr(binary.LittleEndian.Uint64(d[16+16*i:])),
+			}
+			if i < len(rules) {
+				r.Rule = string(rules[i])
+			}
+			info.Redacted = append(info.Redacted, r)
+		}
+	case NT_LIVECORE_INCREMENTAL:
+		if err := short(32); err != nil {
+			return err
+		}
+		inc := &IncrementalInfo{Base: ClockSample{int64(u64(0)), int64(u64(1)), int64(u64(2))}}
+		count := u64(3)
+		if count > uint64(len(d)-32)/16 {
+			return fmt.Errorf("incremental note claims %d ranges", count)
+		}
+		for i := range int(count) {
+			inc.Changed = append(inc.Changed, AddrRange{
+				Start: uintptr(u64(4 + 2*i)),
+				End:   uintptr(u64(5 + 2*i)),
+			})
+		}
+		info.Incremental = inc
+	case NT_LIVECORE_OVERRUN:
+		if err := short(24); err != nil {
+			return err
+		}
+		o := &OverrunInfo{Budget: time.Duration(u64(0)), Fuzzy: u64(1)&1 != 0}
+		count := u64(2)
+		if count > uint64(len(d)-24)/16 {
+			return fmt.Errorf("overrun note claims %d ranges", count)
+		}
+		for i := range int(count) {
+			o.Uncopied = append(o.Uncopied, AddrRange{
+				Start: uintptr(u64(3 + 2*i)),
+				End:   uintptr(u64(4 + 2*i)),
+			})
+		}
+		info.Overrun = o
+	case NT_LIVECORE_LINKMAP:
+		if err := short(40); err != nil {
+			return err
+		}
+		lm := &LinkMap{
+			Phdr:   uintptr(u64(0)),
+			Phnum:  u64(1),
+			Base:   uintptr(u64(2)),
+			RDebug: uintptr(u64(3)),
+		}
+		count := u64(4)
+		if count > uint64(len(d)-40)/24 {
+			return fmt.Errorf("link map note claims %d entries", count)
+		}
+		names := bytes.Split(d[40+24*count:], []byte{0})
+		for i := range int(count) {
+			e := d[40+24*i:]
+			lme := LinkMapEntry{
+				Addr:  uintptr(binary.LittleEndian.Uint64(e[0:])),
+				LAddr: uintptr(binary.LittleEndian.Uint64(e[8:])),
+				LD:    uintptr(binary.LittleEndian.Uint64(e[16:])),
+			}
+			if i < len(names) {
+				lme.Name = string(names[i])
+			}
+			lm.Maps = append(lm.Maps, lme)
+		}
+		info.LinkMap = lm
+	case NT_LIVECORE_GOROUTINES:
+		if err := short(16); err != nil {
+			return err
+		}
+		rt := &GoRuntime{AllGs: uintptr(u64(0))}
+		count := u64(1)
+		if count > uint64(len(d)-16)/64 {
+			return fmt.Errorf("goroutines note claims %d goroutines", count)
+		}
+		for i := range int(count) {
+			f := func(j int) uint64 { return u64(2 + 8*i + j) }
+			rt.Goroutines = append(rt.Goroutines, Goroutine{
+				Addr:       uintptr(f(0)),
+				ID:         f(1),
+				Status:     uint32(f(2)),
+				WaitReason: uint8(f(3)),
+				StackLo:    uintptr(f(4)),
+				StackHi:    uintptr(f(5)),
+				SP:         uintptr(f(6)),
+				PC:         uintptr(f(7)),
+			})
+		}
+		info.GoRuntime = rt
+	case NT_LIVECORE_BUILD_IDS:
+		if err := short(8); err != nil {
+			return err
+		}
+		count := u64(0)
+		if count > uint64(len(d)-8)/16 {
+			return fmt.Errorf("build IDs note claims %d entries", count)
+		}
+		rest := d[8+16*count:]
+		ids := make([]BuildID, count)
+		for i := range ids {
+			ids[i].Start = uintptr(u64(1 + 2*i))
+			n := u64(2 + 2*i)
+			if n > uint64(len(rest)) {
+				return fmt.Errorf("build IDs note is truncated")
+			}
+			ids[i].ID, rest = rest[:n], rest[n:]
+		}
+		paths := bytes.Split(rest, []byte{0})
+		for i := range ids {
+			if i < len(paths) {
+				ids[i].Path = string(paths[i])
+			}
+		}
+		info.BuildIDs = ids
+	case NT_LIVECORE_HOST_PATHS:
+		f := bytes.Split(bytes.TrimSuffix(d, []byte{0}), []byte{0})
+		info.HostPaths = make(map[string]string)
+		for i := 0; i+1 < len(f); i += 2 {
+			info.HostPaths[string(f[i])] = string(f[i+1])
+		}
+	case NT_LIVECORE_THREAD_NAMES:
+		// It follows the NT_PRSTATUS notes, so the threads are known.
+		byTid := make(map[int]*Thread)
+		for i := range info.Threads {
+			byTid[info.Threads[i].Tid] = &info.Threads[i]
+		}
+		for kv := range bytes.SplitSeq(bytes.TrimSuffix(d, []byte{0}), []byte{0}) {
+			tid, name, _ := bytes.Cut(kv, []byte("="))
+			if n, err := strconv.Atoi(string(tid)); err == nil && byTid[n] != nil {
+				byTid[n].Name = string(name)
+			}
+		}
+	case NT_LIVECORE_SCHED:
+		byTid := make(map[int]*Thread)
+		for i := range info.Threads {
+			byTid[info.Threads[i].Tid] = &info.Threads[i]
+		}
+		u32 := func(i int) uint32 { return binary.LittleEndian.Uint32(d[i:]) }
+		for len(d) >= 32 {
+			words := int(u32(24))
+			if len(d) < 32+8*words {
+				return fmt.Errorf("short NT_LIVECORE_SCHED note")
+			}
+			s := &SchedInfo{
+				Policy:     u32(4),
+				RTPriority: u32(8),
+				Priority:   int32(u32(12)),
+				Nice:       int32(u32(16)),
+				CPU:        int32(u32(20)),
+			}
+			for i := range words {
+				s.Affinity = append(s.Affinity, binary.LittleEndian.Uint64(d[32+8*i:]))
+			}
+			if t := byTid[int(u32(0))]; t != nil {
+				t.Sched = s
+			}
+			d = d[32+8*words:]
+		}
+	case NT_LIVECORE_CONTAINER:
+		c := new(ContainerInfo)
+		for kv := range bytes.SplitSeq(bytes.TrimSuffix(d, []byte{0}), []byte{0}) {
+			k, v, _ := bytes.Cut(kv, []byte("="))
+			switch string(k) {
+			case "id":
+				c.ID = string(v)
+			case "runtime":
+				c.Runtime = string(v)
+			case "name":
+				c.Name = string(v)
+			case "image":
+				c.Image = string(v)
+			case "cgroup":
+				c.Cgroup = string(v)
+			case "pod":
+				c.Pod = string(v)
+			case "namespace":
+				c.Namespace = string(v)
+			}
+		}
+		info.Container = c
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package elfcore
+
+import (
+	"bytes"
+	"debug/elf"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestCore writes info's core with mem using the named writer, file
+// or stream, and returns a reader for it.
+func writeTestCore(t *testing.T, kind string, info *CoreInfo, mem MemorySource) io.ReaderAt {
+	t.Helper()
+	switch kind {
+	case "file":
+		f, err := os.Create(filepath.Join(t.TempDir(), "core"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		w, err := NewFileWriter(f, info, mem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteCore(); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	case "stream":
+		var buf bytes.Buffer
+		if err := NewStreamWriter(&buf, info, mem).WriteCore(); err != nil {
+			t.Fatal(err)
+		}
+		return bytes.NewReader(buf.Bytes())
+	}
+	t.Fatalf("unknown writer %q", kind)
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, kind := range []string{"file", "stream"} {
+		t.Run(kind, func(t *testing.T) {
+			forEachLayout(t, func(t *testing.T, class elf.Class, notes bool) {
+				info, mem := testCoreInfo(t, class, notes)
+				cr, err := NewCoreReader(writeTestCore(t, kind, info, mem))
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkRoundTrip(t, cr, info, mem)
+			})
+		})
+	}
+}
+
+// checkRoundTrip checks that cr holds the core of info, with mem's
+// contents.
+func checkRoundTrip(t *testing.T, cr *CoreReader, info *CoreInfo, mem *testMemory) {
+	t.Helper()
+	got := cr.Info()
+
+	var want []VMA
+	for _, vma := range info.VMAs {
+		if vma.IsDumpable() {
+			want = append(want, vma)
+		}
+	}
+	if len(got.VMAs) != len(want) {
+		t.Fatalf("read %d VMAs; want %d", len(got.VMAs), len(want))
+	}
+	for i, vma := range got.VMAs {
+		w := want[i]
+		if vma.Start != w.Start || vma.End != w.End || vma.Perms != w.Perms {
+			t.Errorf("VMA %d = %x-%x %v; want %x-%x %v", i, vma.Start, vma.End, vma.Perms, w.Start, w.End, w.Perms)
+		}
+	}
+
+	if len(got.Notes) != len(info.Notes) {
+		t.Fatalf("read %d notes; want %d", len(got.Notes), len(info.Notes))
+	}
+	for i, n := range got.Notes {
+		w := info.Notes[i]
+		if n.Name != w.Name || n.Type != w.Type || !bytes.Equal(n.Data, w.Data) {
+			t.Errorf("note %d = %s %#x (%d bytes); want %s %#x (%d bytes)", i, n.Name, n.Type, len(n.Data), w.Name, w.Type, len(w.Data))
+		}
+	}
+	if len(got.Threads) != len(info.Threads) {
+		t.Errorf("read %d threads; want %d", len(got.Threads), len(info.Threads))
+	}
+	for i := range min(len(got.Threads), len(info.Threads)) {
+		if got.Threads[i].Tid != info.Threads[i].Tid {
+			t.Errorf("thread %d has tid %d; want %d", i, got.Threads[i].Tid, info.Threads[i].Tid)
+		}
+	}
+
+	for _, vma := range want {
+		buf := make([]byte, vma.Size())
+		if _, err := cr.ReadAt(buf, vma.Start); err != nil {
+			t.Errorf("ReadAt(%x-%x): %v", vma.Start, vma.End, err)
+			continue
+		}
+		for i, b := range buf {
+			addr := vma.Start + uintptr(i)
+			wantByte := mem.byteAt(addr)
+			if vma.IsZero {
+				wantByte = 0
+			}
+			if b != wantByte {
+				t.Errorf("byte at %#x = %#x; want %#x", addr, b, wantByte)
+				break
+			}
+		}
+	}
+	for page := range mem.holes {
+		buf := make([]byte, pageSize)
+		if _, err := cr.ReadAt(buf, page); err != nil {
+			t.Errorf("ReadAt(%#x): %v", page, err)
+		} else if !bytes.Equal(buf, make([]byte, pageSize)) {
+			t.Errorf("hole at %#x doesn't read back as zeros", page)
+		}
+	}
+
+	// Reads can span adjacent segments, but not gaps or left-out VMAs.
+	buf := make([]byte, 2*pageSize)
+	if _, err := cr.ReadAt(buf, want[1].Start-uintptr(pageSize)); err != nil {
+		t.Errorf("ReadAt across adjacent segments: %v", err)
+	}
+	for _, vma := range info.VMAs {
+		if !vma.IsDumpable() {
+			if _, err := cr.ReadAt(buf[:1], vma.Start); err == nil {
+				t.Errorf("ReadAt(%#x) in left-out VMA succeeded", vma.Start)
+			}
+		}
+	}
+	if _, err := cr.ReadAt(buf[:1], 0); err == nil {
+		t.Error("ReadAt(0) succeeded")
+	}
+}
+
+func TestRewriteFromCore(t *testing.T) {
+	// A CoreReader is a MemorySource, so a core can be written again
+	// from one, as when converting or merging cores.
+	info, mem := testCoreInfo(t, elf.ELFCLASS64, true)
+	cr, err := NewCoreReader(writeTestCore(t, "file", info, mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewCoreReader(writeTestCore(t, "stream", info, cr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, again, info, mem)
+}
@@ -0,0 +1,157 @@
+package elfcore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// DataExtents returns the runs of [start, start+size) that the core file
+// holds data for, found with SEEK_DATA and SEEK_HOLE; holes, and the parts
+// of segments past their file size, read as zeros. If the core isn't a
+// file, or its filesystem can't say, every stored byte counts as data. It
+// makes CoreReader an ExtentLister, so a core written from another keeps
+// its holes.
+func (cr *CoreReader) DataExtents(start uintptr, size uint64) ([]Extent, error) {
+	var extents []Extent
+	add := func(off, length uint64) {
+		if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == off {
+			extents[n-1].Length += length
+			return
+		}
+		extents = append(extents, Extent{Offset: off, Length: length})
+	}
+	for done := uint64(0); done < size; {
+		a := uint64(start) + done
+		p, err := cr.segment(a)
+		if err != nil {
+			return nil, err
+		}
+		n := min(size-done, p.Vaddr+p.Memsz-a)
+		if stored := min(n, p.Filesz-min(a-p.Vaddr, p.Filesz)); stored > 0 {
+			fileOff := int64(p.Off + (a - p.Vaddr))
+			runs, err := cr.dataRuns(fileOff, int64(stored))
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range runs {
+				add(done+uint64(r.Offset), r.Length)
+			}
+		}
+		done += n
+	}
+	return extents, nil
+}
+
+// dataRuns returns the runs of the size bytes of the core file at off
+// that hold data, as offsets from off.
+func (cr *CoreReader) dataRuns(off, size int64) ([]Extent, error) {
+	all := []Extent{{Offset: 0, Length: uint64(size)}}
+	if cr.file == nil {
+		return all, nil
+	}
+	fd := int(cr.file.Fd())
+	var runs []Extent
+	for pos, end := off, off+size; pos < end; {
+		data, err := unix.Seek(fd, pos, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) || err == nil && data >= end {
+			break // only holes from here
+		}
+		if err != nil {
+			return all, nil // no SEEK_DATA; assume it's all data
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find hole in core file: %w", err)
+		}
+		hole = min(hole, end)
+		runs = append(runs, Extent{Offset: uint64(data - off), Length: uint64(hole - data)})
+		pos = hole
+	}
+	return runs, nil
+}
+
+// WriteMemoryTo writes size bytes of memory at addr to w at off. When w
+// and the core are files on the same filesystem with reflinks, such as
+// XFS or btrfs, the blocks holding it are shared with w by FICLONERANGE,
+// where they're aligned for it, rather than copied. Writing a core from an
+// earlier one whose memory mostly hasn't changed, through an Overlay,
+// then takes little time and space.
+func (cr *CoreReader) WriteMemoryTo(w io.WriterAt, off int64, addr uintptr, size uint64) error {
+	dst, _ := w.(*os.File)
+	var buf []byte
+	for size > 0 {
+		a := uint64(addr)
+		p, err := cr.segment(a)
+		if err != nil {
+			return err
+		}
+		n := min(size, p.Vaddr+p.Memsz-a)
+		stored := min(n, p.Filesz-min(a-p.Vaddr, p.Filesz))
+		fileOff := int64(p.Off + (a - p.Vaddr))
+		if stored > 0 && (dst == nil || !cr.clone(dst, off, fileOff, stored)) {
+			if buf == nil {
+				buf = make([]byte, copyChunkSize)
+			}
+			for done := uint64(0); done < stored; {
+				chunk := buf[:min(stored-done, copyChunkSize)]
+				if _, err := cr.r.ReadAt(chunk, fileOff+int64(done)); err != nil {
+					return fmt.Errorf("failed to read core at %#x: %w", a+done, err)
+				}
+				if _, err := w.WriteAt(chunk, off+int64(done)); err != nil {
+					return err
+				}
+				done += uint64(len(chunk))
+			}
+		}
+		if stored < n {
+			if buf == nil {
+				buf = make([]byte, copyChunkSize)
+			}
+			for done := stored; done < n; {
+				zeros := buf[:min(n-done, copyChunkSize)]
+				clear(zeros)
+				if _, err := w.WriteAt(zeros, off+int64(done)); err != nil {
+					return err
+				}
+				done += uint64(len(zeros))
+			}
+		}
+		off, addr, size = off+int64(n), addr+uintptr(n), size-n
+	}
+	return nil
+}
+
+// clone shares the size bytes of the core file at srcOff with dst at off,
+// if the filesystem can, and reports whether it did.
+func (cr *CoreReader) clone(dst *os.File, off, srcOff int64, size uint64) bool {
+	ps := int64(pageSize)
+	if cr.file == nil || cr.noClone.Load() || off%ps != 0 || srcOff%ps != 0 || int64(size)%ps != 0 {
+		return false
+	}
+	err := unix.IoctlFileCloneRange(int(dst.Fd()), &unix.FileCloneRange{
+		Src_fd:      int64(cr.file.Fd()),
+		Src_offset:  uint64(srcOff),
+		Src_length:  size,
+		Dest_offset: uint64(off),
+	})
+	if err != nil {
+		if !errors.Is(err, unix.EINVAL) {
+			// No reflinks here, or not across these files; EINVAL
+			// could be just this range's alignment.
+			cr.noClone.Store(true)
+		}
+		return false
+	}
+	cr.cloned.Add(size)
+	return true
+}
+
+// Cloned returns how many bytes of memory WriteMemoryTo has shared with
+// the files it wrote to, rather than copying.
+func (cr *CoreReader) Cloned() uint64 {
+	return cr.cloned.Load()
+}
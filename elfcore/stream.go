@@ -0,0 +1,52 @@
+package elfcore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// streamWriter is an output that writes to a stream, such as stdout. It
+// relies on the ELFWriter only ever writing forward: a write past the
+// end of what's been written so far fills the gap with zeros.
+type streamWriter struct {
+	w   *bufio.Writer
+	pos int64 // bytes written so far
+}
+
+func newStreamWriter(w io.Writer) *streamWriter {
+	return &streamWriter{w: bufio.NewWriterSize(w, copyChunkSize)}
+}
+
+// zeros is the source of the zeros streamWriter fills gaps with.
+var zeros [64 << 10]byte
+
+func (s *streamWriter) WriteAt(p []byte, off int64) (int, error) {
+	if err := s.fill(off); err != nil {
+		return 0, err
+	}
+	n, err := s.w.Write(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+// Truncate writes zeros up to size.
+func (s *streamWriter) Truncate(size int64) error { return s.fill(size) }
+
+// fill writes zeros up to off.
+func (s *streamWriter) fill(off int64) error {
+	if off < s.pos {
+		return fmt.Errorf("can't write at offset %d of a stream already %d bytes long", off, s.pos)
+	}
+	for s.pos < off {
+		n, err := s.w.Write(zeros[:min(off-s.pos, int64(len(zeros)))])
+		s.pos += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes out anything still buffered.
+func (s *streamWriter) Flush() error { return s.w.Flush() }
@@ -0,0 +1,588 @@
+package elfcore
+
+import (
+	"debug/elf"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// VMAKind represents the type of memory mapping.
+type VMAKind int
+
+const (
+	VMAAnonymous VMAKind = 0
+	VMAFile      VMAKind = 1
+	VMAHeap      VMAKind = 2
+	VMAStack     VMAKind = 3
+	VMAShared    VMAKind = 4
+)
+
+// VMFlag constants
+var vmFlagDD = VMFlag{'d', 'd'} // MADV_DONTDUMP flag
+
+// Perm represents memory permissions.
+type Perm uint8
+
+const (
+	PermRead  Perm = 1 << 0
+	PermWrite Perm = 1 << 1
+	PermExec  Perm = 1 << 2
+)
+
+// VMFlag represents a single memory advice flag (2 characters).
+type VMFlag [2]byte
+
+// VMA represents a virtual memory area.
+type VMA struct {
+	Start   uintptr
+	End     uintptr
+	Perms   Perm
+	Offset  uint64
+	Dev     uint64
+	Inode   uint64
+	Path    string
+	Kind    VMAKind
+	VmFlags []VMFlag // Memory advice flags from smaps
+	IsZero  bool     // True if this VMA should be zero-filled (no permissions)
+	Omit    string   // If set, why the caller is leaving the VMA out of the core
+	// PageSize is the size of the VMA's pages if they're bigger than the
+	// base page, as with hugetlb mappings, or 0.
+	PageSize uint64
+	// Internal fields for tracking
+	FileOffset uint64 // Offset in core file
+	MemSize    uint64 // Size in core file
+}
+
+// Thread represents a thread in the target process.
+type Thread struct {
+	Tid       int
+	Registers []byte     // Raw register data
+	FPRegs    []byte     // NT_FPREGSET contents (user_fpregs_struct); nil if unknown
+	XState    []byte     // NT_X86_XSTATE contents (the XSAVE area); nil if unknown
+	Name      string     // its comm, from NT_LIVECORE_THREAD_NAMES; "" if unknown
+	Sched     *SchedInfo // from NT_LIVECORE_SCHED; nil if unknown
+
+	SigPending uint64 // pr_sigpend: signals pending for the thread
+	SigBlocked uint64 // pr_sighold: signals it blocks
+	SigInfo    []byte // NT_SIGINFO contents (siginfo_t) of the signal it's receiving, if any
+}
+
+// SchedInfo is a thread's scheduling state at stop time.
+type SchedInfo struct {
+	Policy     uint32   // SCHED_OTHER (0), SCHED_FIFO, SCHED_RR, and so on
+	RTPriority uint32   // 1 to 99 under a real-time policy, else 0
+	Priority   int32    // the kernel's priority, as /proc/<tid>/stat has it
+	Nice       int32    // -20 to 19
+	CPU        int32    // the CPU it last ran on
+	Affinity   []uint64 // the CPUs it may run on, as a bitmask, CPU 0 in bit 0 of the first word
+}
+
+// schedPolicies names the scheduling policies, from linux/sched.h.
+var schedPolicies = map[uint32]string{
+	0: "SCHED_OTHER",
+	1: "SCHED_FIFO",
+	2: "SCHED_RR",
+	3: "SCHED_BATCH",
+	5: "SCHED_IDLE",
+	6: "SCHED_DEADLINE",
+	7: "SCHED_EXT",
+}
+
+// PolicyName returns the name of s's policy, such as "SCHED_OTHER".
+func (s *SchedInfo) PolicyName() string {
+	if name, ok := schedPolicies[s.Policy]; ok {
+		return name
+	}
+	return fmt.Sprintf("policy %d", s.Policy)
+}
+
+// AffinityList returns the CPUs s may run on as a list of ranges, such as
+// "0-3,8", as in /proc/<pid>/status's Cpus_allowed_list.
+func (s *SchedInfo) AffinityList() string {
+	var ranges []string
+	cpus := len(s.Affinity) * 64
+	for cpu := 0; cpu < cpus; cpu++ {
+		if !s.allowed(cpu) {
+			continue
+		}
+		end := cpu
+		for end+1 < cpus && s.allowed(end+1) {
+			end++
+		}
+		if end == cpu {
+			ranges = append(ranges, strconv.Itoa(cpu))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", cpu, end))
+		}
+		cpu = end
+	}
+	return strings.Join(ranges, ",")
+}
+
+// allowed reports whether s may run on cpu.
+func (s *SchedInfo) allowed(cpu int) bool {
+	return s.Affinity[cpu/64]&(1<<(cpu%64)) != 0
+}
+
+// NoteType represents ELF note types.
+type NoteType uint32
+
+const (
+	NT_PRSTATUS NoteType = 1
+	NT_FPREGSET NoteType = 2
+	NT_PRPSINFO NoteType = 3
+	NT_AUXV     NoteType = 6
+	NT_XSTATE   NoteType = 0x202
+	NT_SIGINFO  NoteType = 0x53494749
+	NT_FILE     NoteType = 0x46494c45
+)
+
+// LivecoreNoteName is the owner name of livecore's vendor notes. Note types
+// are scoped by owner, so these don't collide with the kernel's "CORE" notes.
+const LivecoreNoteName = "LIVECORE"
+
+// Vendor note types, with LivecoreNoteName as owner.
+const (
+	// NT_LIVECORE_UNSTOPPED lists the threads that didn't reach ptrace-stop
+	// within the stop timeout, as little-endian uint32 tids. They have no
+	// register notes.
+	NT_LIVECORE_UNSTOPPED NoteType = 1
+
+	// NT_LIVECORE_CLOCKS holds two ClockSamples, taken when the freeze
+	// started and when the target was resumed, each as three little-endian
+	// int64 nanosecond counts: CLOCK_REALTIME, CLOCK_MONOTONIC, and
+	// CLOCK_BOOTTIME.
+	NT_LIVECORE_CLOCKS NoteType = 2
+
+	// NT_LIVECORE_ANNOTATIONS holds user-supplied annotations as a
+	// sequence of NUL-terminated "key=value" strings.
+	NT_LIVECORE_ANNOTATIONS NoteType = 3
+
+	// NT_LIVECORE_SAMPLE marks a sampled dump, and holds its SampleInfo as
+	// three little-endian uint64s: Seed, Threshold, and StackWindow.
+	NT_LIVECORE_SAMPLE NoteType = 4
+
+	// NT_LIVECORE_READ_FAILURES lists the ranges that couldn't be read at
+	// freeze time, as ReadFailures of 32 bytes each: little-endian uint64
+	// Start, End, and VMAStart, then uint32 Errno and 4 bytes of padding.
+	NT_LIVECORE_READ_FAILURES NoteType = 5
+
+	// NT_LIVECORE_OMITTED lists the address ranges whose contents aren't in
+	// the core, and why. It's laid out like NT_FILE: a little-endian uint64
+	// count, count pairs of uint64 start and end, then count NUL-terminated
+	// reason strings.
+	NT_LIVECORE_OMITTED NoteType = 6
+
+	// NT_LIVECORE_LINKMAP records the dynamic linker state at stop time.
+	// It holds little-endian uint64s AT_PHDR, AT_PHNUM, AT_BASE, the
+	// r_debug address, and a count, then count triples of link_map
+	// address, l_addr, and l_ld, then count NUL-terminated l_name strings.
+	NT_LIVECORE_LINKMAP NoteType = 7
+
+	// NT_LIVECORE_GOROUTINES lists a Go program's goroutines at stop time.
+	// It holds little-endian uint64s: the address of runtime.allgs and a
+	// count, then count records of eight: the g's address, goroutine ID,
+	// status, wait reason, stack bounds (lo, hi), and saved SP and PC.
+	NT_LIVECORE_GOROUTINES NoteType = 8
+
+	// NT_LIVECORE_OMITTED_THREADS lists the threads that were stopped but
+	// left out of the register notes, as little-endian uint32 tids.
+	NT_LIVECORE_OMITTED_THREADS NoteType = 9
+
+	// NT_LIVECORE_INCREMENTAL marks an incremental core and holds its
+	// IncrementalInfo: the base's FreezeStart as three little-endian int64s,
+	// as in NT_LIVECORE_CLOCKS, then a uint64 count and count pairs of
+	// uint64 start and end of the ranges the core holds.
+	NT_LIVECORE_INCREMENTAL NoteType = 10
+
+	// NT_LIVECORE_BUILD_IDS lists the GNU build IDs of the ELF files the
+	// process had mapped, for fetching their debug info: a uint64 count,
+	// then count pairs of uint64 address of the file's first mapping and
+	// build ID length, then the build IDs, back to back, then their paths,
+	// NUL-terminated.
+	NT_LIVECORE_BUILD_IDS NoteType = 11
+
+	// NT_LIVECORE_CONTAINER describes the container the process ran in,
+	// as NUL-terminated "key=value" strings: id, runtime, name, image,
+	// cgroup, pod, and namespace, leaving out those that are empty.
+	NT_LIVECORE_CONTAINER NoteType = 12
+
+	// NT_LIVECORE_HOST_PATHS maps the paths in NT_FILE, as the process saw
+	// them from its mount namespace, to paths that name the same files
+	// outside it, as NUL-terminated pairs of strings.
+	NT_LIVECORE_HOST_PATHS NoteType = 13
+
+	// NT_LIVECORE_THREAD_NAMES names the threads in the NT_PRSTATUS notes,
+	// as NUL-terminated "tid=name" strings, name being the thread's comm,
+	// leaving out threads whose names are unknown.
+	NT_LIVECORE_THREAD_NAMES NoteType = 14
+
+	// NT_LIVECORE_SCHED holds the scheduling state of the threads in the
+	// NT_PRSTATUS notes: for each whose state is known, a 32-byte SchedInfo
+	// header of little-endian uint32 tid, policy, and real-time priority,
+	// int32 priority, nice, and last CPU, and uint32 count of affinity mask
+	// words and padding, followed by the words, as uint64s.
+	NT_LIVECORE_SCHED NoteType = 15
+
+	// NT_LIVECORE_OVERRUN marks a core whose stop-time budget ran out
+	// before every dirty page was copied, and holds its OverrunInfo as
+	// little-endian uint64s: the budget in nanoseconds, flags (1 if
+	// Fuzzy), and a count, then count pairs of start and end of the
+	// ranges not copied while the process was stopped.
+	NT_LIVECORE_OVERRUN NoteType = 16
+
+	// NT_LIVECORE_REDACTED lists the address ranges whose contents were
+	// zeroed or masked before the core was written, and the rule that
+	// redacted each, laid out like NT_LIVECORE_OMITTED.
+	NT_LIVECORE_REDACTED NoteType = 17
+)
+
+// TypeName returns the conventional name of n's type, such as
+// "NT_PRSTATUS", or a hex number for types it doesn't know.
+func (n Note) TypeName() string {
+	var names map[NoteType]string
+	switch n.Name {
+	case "CORE", "LINUX":
+		names = map[NoteType]string{
+			NT_PRSTATUS: "NT_PRSTATUS",
+			NT_FPREGSET: "NT_FPREGSET",
+			NT_PRPSINFO: "NT_PRPSINFO",
+			NT_AUXV:     "NT_AUXV",
+			NT_XSTATE:   "NT_X86_XSTATE",
+			NT_SIGINFO:  "NT_SIGINFO",
+			NT_FILE:     "NT_FILE",
+		}
+	case LivecoreNoteName:
+		names = map[NoteType]string{
+			NT_LIVECORE_UNSTOPPED:       "NT_LIVECORE_UNSTOPPED",
+			NT_LIVECORE_CLOCKS:          "NT_LIVECORE_CLOCKS",
+			NT_LIVECORE_ANNOTATIONS:     "NT_LIVECORE_ANNOTATIONS",
+			NT_LIVECORE_SAMPLE:          "NT_LIVECORE_SAMPLE",
+			NT_LIVECORE_READ_FAILURES:   "NT_LIVECORE_READ_FAILURES",
+			NT_LIVECORE_OMITTED:         "NT_LIVECORE_OMITTED",
+			NT_LIVECORE_LINKMAP:         "NT_LIVECORE_LINKMAP",
+			NT_LIVECORE_GOROUTINES:      "NT_LIVECORE_GOROUTINES",
+			NT_LIVECORE_OMITTED_THREADS: "NT_LIVECORE_OMITTED_THREADS",
+			NT_LIVECORE_INCREMENTAL:     "NT_LIVECORE_INCREMENTAL",
+			NT_LIVECORE_BUILD_IDS:       "NT_LIVECORE_BUILD_IDS",
+			NT_LIVECORE_CONTAINER:       "NT_LIVECORE_CONTAINER",
+			NT_LIVECORE_HOST_PATHS:      "NT_LIVECORE_HOST_PATHS",
+			NT_LIVECORE_THREAD_NAMES:    "NT_LIVECORE_THREAD_NAMES",
+			NT_LIVECORE_SCHED:           "NT_LIVECORE_SCHED",
+			NT_LIVECORE_OVERRUN:         "NT_LIVECORE_OVERRUN",
+			NT_LIVECORE_REDACTED:        "NT_LIVECORE_REDACTED",
+		}
+	}
+	if name, ok := names[n.Type]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#x", uint32(n.Type))
+}
+
+// LinkMap is the dynamic linker's list of loaded objects at stop time.
+type LinkMap struct {
+	Phdr   uintptr // AT_PHDR
+	Phnum  uint64  // AT_PHNUM
+	Base   uintptr // AT_BASE
+	RDebug uintptr // address of r_debug
+	Maps   []LinkMapEntry
+}
+
+// LinkMapEntry is one struct link_map.
+type LinkMapEntry struct {
+	Addr  uintptr // where the struct is
+	LAddr uintptr // l_addr
+	LD    uintptr // l_ld
+	Name  string  // l_name
+}
+
+// BuildID is the GNU build ID of a file mapped into the process.
+type BuildID struct {
+	Start uintptr // of the file's first mapping
+	ID    []byte
+	Path  string
+}
+
+// ContainerInfo describes the container a process ran in.
+type ContainerInfo struct {
+	ID             string
+	Runtime        string // such as "docker" or "containerd"
+	Name           string
+	Image          string
+	Cgroup         string // its cgroup path
+	Pod, Namespace string // in Kubernetes
+}
+
+// GoRuntime is a Go program's goroutines at stop time.
+type GoRuntime struct {
+	AllGs      uintptr // address of runtime.allgs
+	Goroutines []Goroutine
+}
+
+// Goroutine is one runtime.g; see the runtime for what the values mean.
+type Goroutine struct {
+	Addr       uintptr // of the g
+	ID         uint64
+	Status     uint32 // _Grunnable, _Gwaiting, and so on
+	WaitReason uint8
+	StackLo    uintptr
+	StackHi    uintptr
+	SP, PC     uintptr // saved when it last stopped running
+}
+
+// OmittedRange is an address range whose contents aren't in the core.
+type OmittedRange struct {
+	Start, End uintptr
+	Reason     string
+}
+
+// RedactedRange is an address range whose contents were zeroed or masked
+// before the core was written.
+type RedactedRange struct {
+	Start, End uintptr
+	Rule       string // what redacted it, such as "environ" or "pattern AKIA[0-9A-Z]{16}"
+}
+
+// ReadFailure is a range of pages that couldn't be read from the target.
+// In the core, they hold zeros or whatever pre-copy read earlier.
+type ReadFailure struct {
+	Start, End uintptr
+	VMAStart   uintptr       // start of the containing VMA
+	Errno      syscall.Errno // 0 if unknown
+}
+
+// SampleInfo describes which pages a sampled dump copied. A page at addr
+// was copied if splitmix64(Seed^addr) < Threshold (see copy.Sampler), or
+// if it's within StackWindow bytes above a thread's stack pointer. Other
+// pages read as zeros in the core.
+type SampleInfo struct {
+	Seed        uint64
+	Threshold   uint64
+	StackWindow uint64
+}
+
+// IncrementalInfo marks an incremental core: one that holds only the pages
+// that changed since an earlier core of the same process, its base. Its
+// other pages read as zeros; MergeCores fills them in from the base.
+type IncrementalInfo struct {
+	// Base is the base's FreezeStart, which identifies it.
+	Base ClockSample
+	// Changed lists the ranges the core holds, sorted.
+	Changed []AddrRange
+}
+
+// OverrunInfo marks a core whose dump ran out of stop-time budget before
+// copying every dirty page. The rest of its memory is as of the stop, but
+// Uncopied's pages aren't.
+type OverrunInfo struct {
+	Budget time.Duration
+	// Fuzzy is set if Uncopied's pages were copied after the process
+	// resumed, so they may be newer than the registers and the rest of
+	// memory. Otherwise they hold what was copied before the stop, or
+	// zeros.
+	Fuzzy bool
+	// Uncopied lists the ranges not copied while the process was stopped,
+	// sorted.
+	Uncopied []AddrRange
+}
+
+// AddrRange is a half-open range [Start, End) of addresses.
+type AddrRange struct {
+	Start, End uintptr
+}
+
+// Annotation is a user-supplied key/value pair recorded in the core, such
+// as an incident ID or the reason the dump was taken.
+type Annotation struct {
+	Key   string
+	Value string
+}
+
+// ParseAnnotation parses a "key=value" annotation. The key must be
+// non-empty, and neither part may contain a NUL byte.
+func ParseAnnotation(s string) (Annotation, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return Annotation{}, fmt.Errorf("annotation %q is not of the form key=value", s)
+	}
+	if strings.ContainsRune(s, 0) {
+		return Annotation{}, fmt.Errorf("annotation %q contains a NUL byte", s)
+	}
+	return Annotation{Key: key, Value: value}, nil
+}
+
+// ClockSample is a reading of several clocks taken at (nearly) the same
+// instant, in nanoseconds since each clock's epoch. Recording all three
+// lets a core be lined up with logs (wall clock) and with traces, which
+// usually use the monotonic or boot-time clock.
+type ClockSample struct {
+	Realtime  int64
+	Monotonic int64
+	Boottime  int64
+}
+
+// Note represents an ELF note.
+type Note struct {
+	Name string
+	Type NoteType
+	Data []byte
+}
+
+// CoreInfo contains all information needed to generate a core file.
+type CoreInfo struct {
+	Pid     int
+	Threads []Thread
+	VMAs    []VMA
+	Notes   []Note
+	// File table for NT_FILE note
+	FileTable []FileEntry
+	// Threads that were seized but never stopped
+	Unstopped []int
+	// Threads that were stopped but whose notes were left out
+	OmittedThreads []int
+	// Clock readings at the start of the freeze and at resume; the
+	// NT_LIVECORE_CLOCKS note is written only if FreezeStart is set.
+	FreezeStart, FreezeEnd ClockSample
+	// User-supplied annotations, in the order given
+	Annotations []Annotation
+	// How pages were sampled, or nil if all were copied
+	Sample *SampleInfo
+	// Pages that couldn't be read
+	ReadFailures []ReadFailure
+	// Ranges left out for reasons not evident from VMAs, such as policy
+	// filters. VMAs that are left out or zero-filled are listed in the
+	// NT_LIVECORE_OMITTED note automatically.
+	Omitted []OmittedRange
+	// Ranges that were redacted, sorted
+	Redacted []RedactedRange
+	// Dynamic linker state, or nil for static executables
+	LinkMap *LinkMap
+	// Goroutines, for Go programs when asked for, or nil
+	GoRuntime *GoRuntime
+	// Build IDs of the mapped ELF files
+	BuildIDs []BuildID
+	// For a process in another mount namespace, paths outside it of the
+	// files in FileTable, keyed by their paths in it
+	HostPaths map[string]string
+	// The container the process ran in, or nil
+	Container *ContainerInfo
+	// For an incremental core, what it holds and what it's based on
+	Incremental *IncrementalInfo
+	// If the stop-time budget ran out, what wasn't copied in time, or nil
+	Overrun *OverrunInfo
+	// Process status for NT_PRPSINFO and the raw auxiliary vector for
+	// NT_AUXV. If nil, CreateCoreNotes reads them from /proc/<Pid>.
+	PSInfo *PSInfo
+	Auxv   []byte
+	// Class is elf.ELFCLASS32 for a 32-bit x86 process, running in compat
+	// mode, whose core is a 32-bit one too, with i386 registers and note
+	// layouts, and ELFCLASS64, or zero, for the rest.
+	Class elf.Class
+	// Machine is the 64-bit process's architecture, such as elf.EM_RISCV,
+	// which sets the layout of its registers; zero means livecore's own.
+	Machine elf.Machine
+}
+
+// is32 reports whether info is of a 32-bit process.
+func (info *CoreInfo) is32() bool { return info.Class == elf.ELFCLASS32 }
+
+// PSInfo is the process status recorded in NT_PRPSINFO.
+type PSInfo struct {
+	State                byte // as in /proc/<pid>/stat, such as 'S'
+	Nice                 int8
+	Flags                uint64 // kernel PF_* flags
+	Uid, Gid             uint32
+	Pid, PPid, PGrp, Sid int
+	Fname                string // executable name; truncated to 15 bytes
+	Args                 []byte // command line, NUL-separated as in /proc/<pid>/cmdline
+}
+
+// FileEntry represents a file in the NT_FILE note.
+type FileEntry struct {
+	Start   uintptr
+	End     uintptr
+	FileOfs uint64 // in bytes; page-aligned, as mappings are
+	Dev     uint64
+	Inode   uint64
+	Path    string
+}
+
+// ELF constants
+const (
+	ElfClass64  = 2
+	ElfData2LSB = 1
+	ElfVersion  = 1
+	ET_CORE     = 4
+	PT_NOTE     = 4
+	PT_LOAD     = 1
+)
+
+// GetELFMachine returns the ELF machine type for the current architecture.
+func GetELFMachine() uint16 {
+	return uint16(hostArch().machine)
+}
+
+// IsDumpable returns true if the VMA should be included in the core dump.
+func (vma *VMA) IsDumpable() bool {
+	return vma.omitReason() == ""
+}
+
+// omitReason returns why the VMA is left out of the core dump entirely,
+// or "" if it isn't.
+func (vma *VMA) omitReason() string {
+	if vma.Omit != "" {
+		return vma.Omit
+	}
+
+	// Check for MADV_DONTDUMP flag
+	if slices.Contains(vma.VmFlags, vmFlagDD) {
+		return "MADV_DONTDUMP"
+	}
+
+	// Skip vsyscall pages - they're not readable and not useful for debugging
+	if isVsyscallVMA(vma) {
+		return "vsyscall page"
+	}
+
+	// Skip non-readable VMAs - they won't have useful data
+	if !isReadableVMA(vma) {
+		return "not readable"
+	}
+
+	return ""
+}
+
+// zeroReason returns why a dumped VMA's contents are zeros rather than
+// what the target had, or "" if they aren't.
+func (vma *VMA) zeroReason() string {
+	switch {
+	case !vma.IsZero:
+		return ""
+	case vma.Perms == 0:
+		return "no access; zero-filled"
+	default:
+		return "kernel mapping; zero-filled"
+	}
+}
+
+// isVsyscallVMA checks if a VMA is a vsyscall page
+func isVsyscallVMA(vma *VMA) bool {
+	// vsyscall pages are typically at 0xffffffffff600000-0xffffffffff601000
+	return vma.Start >= 0xffffffffff600000 && vma.Start < 0xffffffffff601000
+}
+
+// isReadableVMA checks if a VMA should be readable based on its permissions
+func isReadableVMA(vma *VMA) bool {
+	// Execute-only VMAs count: the target can't read them, but
+	// /proc/<pid>/mem can, and debuggers need their code.
+	return vma.Perms&(PermRead|PermWrite|PermExec) != 0
+}
+
+// Size returns the size of the VMA.
+func (vma *VMA) Size() uint64 {
+	return vma.MemSize
+}
@@ -0,0 +1,287 @@
+package elfcore
+
+import (
+	"bytes"
+	"cmp"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// A Problem is something wrong with a core file, found by Validate.
+type Problem struct {
+	// Warning is set for problems most tools cope with, such as
+	// misaligned segments.
+	Warning bool
+	Msg     string
+}
+
+func (p Problem) String() string {
+	if p.Warning {
+		return "warning: " + p.Msg
+	}
+	return "error: " + p.Msg
+}
+
+// Sizes of the note descriptions Validate checks that don't depend on the
+// architecture; the register notes' are in its arch.
+const (
+	prpsinfoSize   = 136
+	prpsinfoSize32 = 124
+	siginfoSize    = 128
+	xsaveMinSize   = 576 // the legacy area and the XSAVE header
+)
+
+// Validate checks that the core file in r, size bytes long, is well-formed:
+// that its ELF and program headers are consistent, with segments inside
+// the file and not overlapping each other in the file or in memory, and
+// that its notes are laid out correctly and have the sizes and contents
+// debuggers expect. It returns the problems it finds, and an error only if
+// r can't be read. A core with no problems that aren't warnings should
+// load in gdb.
+func Validate(r io.ReaderAt, size int64) ([]Problem, error) {
+	const minPageSize = 4096 // any core's page size is a multiple
+	var problems []Problem
+	errorf := func(format string, args ...any) {
+		problems = append(problems, Problem{Msg: fmt.Sprintf(format, args...)})
+	}
+	warnf := func(format string, args ...any) {
+		problems = append(problems, Problem{Warning: true, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	var hdr [elfHeaderSize]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			errorf("file is too short for an ELF header (%d bytes)", size)
+			return problems, nil
+		}
+		return nil, fmt.Errorf("failed to read ELF header: %w", err)
+	}
+	ef, err := elf.NewFile(r)
+	if err != nil {
+		errorf("not a valid ELF file: %v", err)
+		return problems, nil
+	}
+	if ef.Type != elf.ET_CORE {
+		errorf("ELF type is %v, not ET_CORE", ef.Type)
+	}
+	if ef.Class != elf.ELFCLASS64 && ef.Class != elf.ELFCLASS32 || ef.ByteOrder != binary.LittleEndian {
+		errorf("ELF class %v, byte order %v; want little-endian", ef.Class, ef.ByteOrder)
+		return problems, nil
+	}
+	if archOf(ef.Machine, ef.Class) == nil {
+		errorf("machine is %v, not one livecore writes %v cores of", ef.Machine, ef.Class)
+	}
+	// The header's fields from e_phoff on are 4 bytes further along in a
+	// 64-bit core, whose e_entry and e_phoff are 8 bytes each.
+	ehdrSize, phdrSize := uint64(elfHeaderSize), uint64(phdrSize)
+	phoff, rest := binary.LittleEndian.Uint64(hdr[32:]), hdr[52:]
+	if ef.Class == elf.ELFCLASS32 {
+		ehdrSize, phdrSize = elfHeaderSize32, phdrSize32
+		phoff, rest = uint64(binary.LittleEndian.Uint32(hdr[28:])), hdr[40:]
+	}
+	if ehsize := binary.LittleEndian.Uint16(rest[0:]); uint64(ehsize) != ehdrSize {
+		errorf("ELF header size is %d, not %d", ehsize, ehdrSize)
+	}
+	if phentsize := binary.LittleEndian.Uint16(rest[2:]); uint64(phentsize) != phdrSize {
+		errorf("program header size is %d, not %d", phentsize, phdrSize)
+	}
+
+	// Each segment's contents, and the headers, should be in the file,
+	// with nothing overlapping.
+	type extent struct {
+		what     string
+		off, end uint64
+	}
+	extents := []extent{{"ELF and program headers", 0, phoff + phdrSize*uint64(len(ef.Progs))}}
+	var loads, misaligned []*elf.Prog
+	var noteData [][]byte
+	for i, p := range ef.Progs {
+		what := fmt.Sprintf("%v segment %d", p.Type, i)
+		if p.Type == elf.PT_LOAD {
+			what = fmt.Sprintf("PT_LOAD %#x-%#x", p.Vaddr, p.Vaddr+p.Memsz)
+		}
+		end := p.Off + p.Filesz
+		if end < p.Off || end > uint64(size) {
+			errorf("%s's contents end at offset %d, past the end of the %d-byte file; is it truncated?", what, end, size)
+			continue
+		}
+		if p.Filesz > 0 {
+			extents = append(extents, extent{what, p.Off, end})
+		}
+		switch p.Type {
+		case elf.PT_LOAD:
+			loads = append(loads, p)
+			if p.Filesz > p.Memsz {
+				errorf("%s stores %d bytes, more than its size", what, p.Filesz)
+			}
+			if p.Vaddr%minPageSize != 0 || p.Memsz%minPageSize != 0 {
+				errorf("%s isn't page-aligned", what)
+			}
+			if p.Align > 1 && p.Off%p.Align != p.Vaddr%p.Align {
+				misaligned = append(misaligned, p)
+			}
+		case elf.PT_NOTE:
+			if p.Off%noteAlign != 0 {
+				errorf("%s is at file offset %#x, which isn't %d-byte aligned", what, p.Off, noteAlign)
+			}
+			data := make([]byte, p.Filesz)
+			if _, err := r.ReadAt(data, int64(p.Off)); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", what, err)
+			}
+			noteData = append(noteData, data)
+		}
+	}
+	if len(misaligned) > 0 {
+		p := misaligned[0]
+		warnf("%d of %d PT_LOAD segments, starting with %#x-%#x at file offset %#x, aren't aligned in the file like their addresses, as some tools require",
+			len(misaligned), len(loads), p.Vaddr, p.Vaddr+p.Memsz, p.Off)
+	}
+	slices.SortFunc(extents, func(a, b extent) int { return cmp.Compare(a.off, b.off) })
+	for i := 1; i < len(extents); i++ {
+		if a, b := extents[i-1], extents[i]; b.off < a.end {
+			errorf("%s and %s overlap in the file", a.what, b.what)
+		}
+	}
+	slices.SortFunc(loads, func(a, b *elf.Prog) int { return cmp.Compare(a.Vaddr, b.Vaddr) })
+	for i := 1; i < len(loads); i++ {
+		if a, b := loads[i-1], loads[i]; b.Vaddr < a.Vaddr+a.Memsz {
+			errorf("PT_LOAD %#x-%#x and %#x-%#x overlap in memory", a.Vaddr, a.Vaddr+a.Memsz, b.Vaddr, b.Vaddr+b.Memsz)
+		}
+	}
+
+	if len(noteData) == 0 {
+		errorf("no PT_NOTE segment")
+	}
+	var notes []Note
+	for _, data := range noteData {
+		ns, err := parseNotes(data)
+		if err != nil {
+			errorf("malformed PT_NOTE segment: %v", err)
+		}
+		notes = append(notes, ns...)
+	}
+	problems = append(problems, validateNotes(notes, loads, ef.Class, ef.Machine)...)
+	return problems, nil
+}
+
+// validateNotes checks the notes of a core of the given class and machine
+// with the PT_LOAD segments loads, sorted by address.
+func validateNotes(notes []Note, loads []*elf.Prog, class elf.Class, machine elf.Machine) []Problem {
+	var problems []Problem
+	errorf := func(format string, args ...any) {
+		problems = append(problems, Problem{Msg: fmt.Sprintf(format, args...)})
+	}
+	warnf := func(format string, args ...any) {
+		problems = append(problems, Problem{Warning: true, Msg: fmt.Sprintf(format, args...)})
+	}
+	wantSize := func(n Note, want int) {
+		if len(n.Data) != want {
+			errorf("%s note is %d bytes, not %d", n.TypeName(), len(n.Data), want)
+		}
+	}
+	loaded := func(start, end uintptr) bool {
+		for _, p := range loads {
+			if uint64(start) >= p.Vaddr && uint64(end) <= p.Vaddr+p.Memsz {
+				return true
+			}
+		}
+		return false
+	}
+
+	info := CoreInfo{Class: class, Machine: machine}
+	a := info.arch()
+	tidOff, psinfoSize, auxvEntrySize := 32, prpsinfoSize, 16
+	if info.is32() {
+		tidOff, psinfoSize, auxvEntrySize = 24, prpsinfoSize32, 8
+	}
+
+	tids := make(map[int]bool)
+	counts := make(map[string]int)
+	for _, n := range notes {
+		counts[n.Name+" "+n.TypeName()]++
+		switch {
+		case n.Name == "CORE" && n.Type == NT_PRSTATUS:
+			wantSize(n, a.prstatusSize)
+			if len(n.Data) >= tidOff+4 {
+				tid := int(binary.LittleEndian.Uint32(n.Data[tidOff:]))
+				if tids[tid] {
+					errorf("more than one NT_PRSTATUS note for thread %d", tid)
+				}
+				tids[tid] = true
+			}
+		case n.Name == "CORE" && (n.Type == NT_FPREGSET || n.Type == NT_SIGINFO) || n.Name == "LINUX" && n.Type == NT_XSTATE:
+			if len(tids) == 0 {
+				errorf("%s note comes before any NT_PRSTATUS, so it belongs to no thread", n.TypeName())
+			}
+			switch n.Type {
+			case NT_FPREGSET:
+				wantSize(n, a.fpregsetSize)
+			case NT_SIGINFO:
+				wantSize(n, siginfoSize)
+			case NT_XSTATE:
+				if len(n.Data) < xsaveMinSize {
+					errorf("NT_X86_XSTATE note is %d bytes, less than the %d of an XSAVE area", len(n.Data), xsaveMinSize)
+				}
+			}
+		case n.Name == "CORE" && n.Type == NT_PRPSINFO:
+			wantSize(n, psinfoSize)
+		case n.Name == "CORE" && n.Type == NT_AUXV:
+			if es := auxvEntrySize; len(n.Data) == 0 || len(n.Data)%es != 0 {
+				errorf("NT_AUXV note is %d bytes, not a whole number of %d-byte entries", len(n.Data), es)
+			} else if !bytes.Equal(n.Data[len(n.Data)-es:], make([]byte, es)) {
+				errorf("NT_AUXV note doesn't end with AT_NULL")
+			}
+		case n.Name == "CORE" && n.Type == NT_FILE:
+			entries, err := parseFileNote(n.Data, info.is32())
+			if err != nil {
+				errorf("malformed NT_FILE note: %v", err)
+				break
+			}
+			ps := binary.LittleEndian.Uint64(n.Data[8:])
+			if info.is32() {
+				ps = uint64(binary.LittleEndian.Uint32(n.Data[4:]))
+			}
+			if ps == 0 || ps&(ps-1) != 0 {
+				errorf("NT_FILE note's page size is %d, not a power of two", ps)
+			}
+			for _, e := range entries {
+				if e.Start >= e.End {
+					errorf("NT_FILE entry %#x-%#x for %s is empty", e.Start, e.End, e.Path)
+				}
+			}
+		case n.Name == LivecoreNoteName:
+			if err := info.parseLivecoreNote(n); err != nil {
+				errorf("malformed %s note: %v", n.TypeName(), err)
+			}
+		}
+	}
+	if len(tids) == 0 {
+		errorf("no NT_PRSTATUS notes, so debuggers will find no threads")
+	}
+	for _, name := range []string{"CORE NT_PRPSINFO", "CORE NT_AUXV", "CORE NT_FILE"} {
+		if counts[name] > 1 {
+			errorf("%d %s notes; want at most one", counts[name], name[len("CORE "):])
+		}
+	}
+	if counts["CORE NT_AUXV"] == 0 {
+		warnf("no NT_AUXV note; debuggers may not find the executable's entry point or the dynamic linker")
+	}
+	if o := info.Overrun; o != nil {
+		warnf("the stop-time budget ran out with %d ranges not copied while the process was stopped", len(o.Uncopied))
+	}
+	if inc := info.Incremental; inc != nil {
+		for i, r := range inc.Changed {
+			if r.Start >= r.End || i > 0 && r.Start < inc.Changed[i-1].End {
+				errorf("NT_LIVECORE_INCREMENTAL ranges aren't sorted and disjoint at %#x-%#x", r.Start, r.End)
+				break
+			}
+			if !loaded(r.Start, r.End) {
+				errorf("NT_LIVECORE_INCREMENTAL range %#x-%#x isn't within a PT_LOAD segment", r.Start, r.End)
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,865 @@
+// Package elfcore writes and reads Linux ELF core files that gdb, lldb,
+// and other debuggers can load.
+//
+// To write a core, fill in a CoreInfo with the process's threads and VMAs,
+// set its Notes (CreateCoreNotes builds the usual ones from the rest of
+// the CoreInfo), and pass it to NewELFWriter (or NewStreamWriter, to
+// write to a pipe) along with a MemorySource for the VMAs' contents.
+// Nothing here needs a live process, so emulators and snapshot tools can
+// write cores too.
+//
+// CoreReader reads a core back into a CoreInfo.
+package elfcore
+
+import (
+	"cmp"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/bradfitz/livecore/internal/throttle"
+	"github.com/bradfitz/livecore/internal/vmaindex"
+)
+
+// ELFWriter handles writing ELF core files
+type ELFWriter struct {
+	file   output
+	offset uint64
+	info   *CoreInfo
+	mem    MemorySource
+	bufs   sync.Pool     // of *[]byte, for copying memory; see getBuf
+	owned  bool          // file was opened by NewELFWriter, so Close closes it
+	stream *streamWriter // set when writing to a stream rather than a file
+	sparse Sparse
+	limit  *throttle.Limiter // of write bandwidth; nil if unlimited
+	cache  CacheMode
+	cached *cacheOutput // the file, while WriteCore runs with cache set
+
+	concurrency int          // segments written at once; see SetConcurrency
+	workerInit  func() error // see SetConcurrency
+
+	progress func(written, total uint64) // see SetProgress
+
+	// inPlace, if set, says where each VMA's contents already are in
+	// the file; see NewInPlaceWriter.
+	inPlace func(VMA) (offset uint64, ok bool)
+}
+
+// Sparse says which zeros an ELFWriter leaves as holes in a core file,
+// rather than writing them out. Streams get zeros either way.
+type Sparse int
+
+const (
+	// SparseAuto leaves holes where the MemorySource has no data, as
+	// for pages the target never touched, and for all-zero pages it
+	// reads, unless the source writes memory out itself.
+	SparseAuto Sparse = iota
+	// SparseAlways also reads what the source has data for, to leave
+	// its all-zero pages as holes, at the cost of checking every page.
+	SparseAlways
+	// SparseNever writes every byte, for filesystems and tools that
+	// handle sparse files badly.
+	SparseNever
+)
+
+// ParseSparse parses a Sparse name: "auto", "always", or "never".
+func ParseSparse(s string) (Sparse, error) {
+	switch s {
+	case "auto":
+		return SparseAuto, nil
+	case "always":
+		return SparseAlways, nil
+	case "never":
+		return SparseNever, nil
+	}
+	return 0, fmt.Errorf("unknown sparse mode %q (want auto, always, or never)", s)
+}
+
+// output is where an ELFWriter writes the core. The writer lays the whole
+// core out first and then only ever writes forward, at or past the end of
+// what it wrote last, so a stream can be an output too; see streamWriter.
+type output interface {
+	io.WriterAt
+
+	// Truncate extends the output to size bytes, which reads as zeros
+	// beyond what was written.
+	Truncate(size int64) error
+}
+
+// NewELFWriter creates a new ELF core file writer. The core describes
+// info: its notes are info.Notes, written as is, and it has a PT_LOAD
+// segment for each dumpable VMA in info.VMAs, with contents from mem.
+func NewELFWriter(filename string, info *CoreInfo, mem MemorySource) (*ELFWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create core file: %w", err)
+	}
+
+	return &ELFWriter{
+		file:   file,
+		offset: 0,
+		info:   info,
+		mem:    mem,
+		owned:  true,
+	}, nil
+}
+
+// NewFileWriter is like NewELFWriter, but writes the core into file,
+// which it empties first. Closing the writer leaves file open.
+func NewFileWriter(file *os.File, info *CoreInfo, mem MemorySource) (*ELFWriter, error) {
+	if err := file.Truncate(0); err != nil {
+		return nil, fmt.Errorf("failed to truncate core file: %w", err)
+	}
+	return &ELFWriter{
+		file: file,
+		info: info,
+		mem:  mem,
+	}, nil
+}
+
+// NewInPlaceWriter is like NewFileWriter, but for a file that already
+// holds the core's memory: segmentOffset says where each VMA's contents
+// are, past the first HeaderSize bytes, which are left for the ELF and
+// program headers. Zero VMAs it has no place for go at the end, as holes.
+// The writer writes the headers, and the notes after the last segment,
+// leaving the memory where it is.
+func NewInPlaceWriter(file *os.File, info *CoreInfo, mem MemorySource, segmentOffset func(VMA) (offset uint64, ok bool)) *ELFWriter {
+	return &ELFWriter{
+		file:    file,
+		info:    info,
+		mem:     mem,
+		inPlace: segmentOffset,
+	}
+}
+
+// HeaderSize returns how many bytes the ELF header and phnum program
+// headers take up at the start of a core of the given class.
+func HeaderSize(class elf.Class, phnum int) uint64 {
+	if class == elf.ELFCLASS32 {
+		return elfHeaderSize32 + uint64(phnum)*phdrSize32
+	}
+	return elfHeaderSize + uint64(phnum)*phdrSize
+}
+
+// NewStreamWriter is like NewELFWriter, but writes the core to w in a
+// single forward pass, writing out the zeros a file would leave as holes.
+// w can be a pipe, a socket, or a compressor: anything that can't seek.
+// Closing the writer doesn't close w.
+func NewStreamWriter(w io.Writer, info *CoreInfo, mem MemorySource) *ELFWriter {
+	sw := newStreamWriter(w)
+	return &ELFWriter{
+		file:   sw,
+		info:   info,
+		mem:    mem,
+		stream: sw,
+	}
+}
+
+// SetSparse sets which zeros the writer leaves as holes. The default is
+// SparseAuto.
+func (w *ELFWriter) SetSparse(s Sparse) {
+	w.sparse = s
+}
+
+// SetCacheMode sets how the writer treats the page cache when writing a
+// file. The default is CacheKeep.
+func (w *ELFWriter) SetCacheMode(m CacheMode) {
+	w.cache = m
+}
+
+// SetWriteRate limits the writer to writing bytesPerSec bytes a second, so
+// writing a huge core doesn't starve other users of the disk. Zero means
+// no limit, the default.
+func (w *ELFWriter) SetWriteRate(bytesPerSec int64) {
+	w.limit = throttle.New(bytesPerSec)
+}
+
+// SetConcurrency sets how many PT_LOAD segments the writer writes to a
+// file at once, since their offsets are known up front. More than one
+// keeps a fast disk, such as NVMe, busy; a spinning disk is better off
+// with one, the default, which writes them in order, as is a stream,
+// always. With more, the MemorySource must be safe for concurrent use,
+// as livecore's scratch buffer, CoreReader, and Overlay are.
+//
+// If init isn't nil, each goroutine writing segments calls it first,
+// locked to an OS thread it never unlocks, so that init can set
+// per-thread state, such as an I/O priority, that then dies with it.
+func (w *ELFWriter) SetConcurrency(n int, init func() error) {
+	w.concurrency, w.workerInit = n, init
+}
+
+// SetProgress makes the writer call f after writing each PT_LOAD segment,
+// with how many bytes of memory it has written and will in all, holes
+// included.
+func (w *ELFWriter) SetProgress(f func(written, total uint64)) {
+	w.progress = f
+}
+
+// Close closes the ELF writer
+func (w *ELFWriter) Close() error {
+	if !w.owned {
+		return nil
+	}
+	return w.file.(*os.File).Close()
+}
+
+// WriteCore writes the complete ELF core file
+func (w *ELFWriter) WriteCore() error {
+	f, ok := w.file.(*os.File)
+	if !ok || w.cache == CacheKeep {
+		return w.writeCore()
+	}
+	w.cached = newCacheOutput(f, w.cache)
+	w.file = w.cached
+	defer func() { w.file, w.cached = f, nil }()
+	err := w.writeCore()
+	if ferr := w.cached.finish(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// writeCore writes the core to w.file.
+func (w *ELFWriter) writeCore() error {
+	if w.inPlace != nil {
+		return w.writeInPlace()
+	}
+
+	// Calculate layout
+	noteSize, noteOffset := w.calculateNoteLayout()
+	loadSegments := w.calculateLoadSegments(noteOffset + noteSize)
+	if err := checkLoadSegments(loadSegments); err != nil {
+		return err
+	}
+	if n := len(loadSegments); w.info.is32() && n > 0 && loadSegments[n-1].Offset+loadSegments[n-1].VMA.Size() > math.MaxUint32 {
+		return fmt.Errorf("a 32-bit core can't be over 4GB")
+	}
+	if w.limit != nil {
+		orig := w.file
+		w.file = throttledOutput{orig, throttle.WriterAt(orig, w.limit)}
+		defer func() { w.file = orig }()
+	}
+
+	// Write ELF header
+	if err := w.writeELFHeader(len(loadSegments) + 1); err != nil {
+		return fmt.Errorf("failed to write ELF header: %w", err)
+	}
+
+	// Write program headers
+	if err := w.writeProgramHeaders(noteOffset, noteSize, loadSegments); err != nil {
+		return fmt.Errorf("failed to write program headers: %w", err)
+	}
+
+	// Write PT_NOTE segment
+	if err := w.writeNoteSegment(noteOffset); err != nil {
+		return fmt.Errorf("failed to write note segment: %w", err)
+	}
+
+	// Write PT_LOAD segments
+	if err := w.writeLoadSegments(loadSegments, noteOffset+noteSize); err != nil {
+		return fmt.Errorf("failed to write load segments: %w", err)
+	}
+
+	if w.stream != nil {
+		return w.stream.Flush()
+	}
+	return nil
+}
+
+// writeInPlace writes the headers and notes of a core whose memory is
+// already in the file; see NewInPlaceWriter.
+func (w *ELFWriter) writeInPlace() error {
+	vmas := w.getDumpableVMAs()
+	headerEnd := HeaderSize(w.info.Class, len(vmas)+1)
+	var segments []LoadSegment
+	var unplaced []VMA
+	end := headerEnd
+	for _, vma := range vmas {
+		offset, ok := w.inPlace(vma)
+		switch {
+		case ok:
+			if offset < headerEnd {
+				return fmt.Errorf("VMA %x-%x is at offset %d, within the %d bytes of headers", vma.Start, vma.End, offset, headerEnd)
+			}
+			segments = append(segments, LoadSegment{VMA: vma, Offset: offset, Align: inPlaceAlign(vma, offset)})
+			end = max(end, offset+vma.Size())
+		case vma.IsZero:
+			unplaced = append(unplaced, vma)
+		default:
+			return fmt.Errorf("VMA %x-%x isn't in the core file", vma.Start, vma.End)
+		}
+	}
+	for _, vma := range unplaced {
+		align := max(pageSize, vma.PageSize)
+		end = (end + align - 1) &^ (align - 1)
+		segments = append(segments, LoadSegment{VMA: vma, Offset: end, Align: align})
+		end += vma.Size()
+	}
+	slices.SortFunc(segments, func(a, b LoadSegment) int { return cmp.Compare(a.VMA.Start, b.VMA.Start) })
+	if err := checkLoadSegments(segments); err != nil {
+		return err
+	}
+	if w.info.is32() && end > math.MaxUint32 {
+		return fmt.Errorf("a 32-bit core can't be over 4GB")
+	}
+
+	noteOffset, noteSize := (end+7)&^7, uint64(0)
+	for _, note := range w.info.Notes {
+		noteSize += w.calculateNoteSize(note)
+	}
+	if err := w.writeELFHeader(len(segments) + 1); err != nil {
+		return fmt.Errorf("failed to write ELF header: %w", err)
+	}
+	if err := w.writeProgramHeaders(noteOffset, noteSize, segments); err != nil {
+		return fmt.Errorf("failed to write program headers: %w", err)
+	}
+	if err := w.writeNoteSegment(noteOffset); err != nil {
+		return fmt.Errorf("failed to write note segment: %w", err)
+	}
+	// The file may have grown past the end of the notes to hold memory
+	// that isn't in any segment.
+	if err := w.file.Truncate(int64(noteOffset + noteSize)); err != nil {
+		return fmt.Errorf("failed to truncate core file: %w", err)
+	}
+	if w.progress != nil {
+		var total uint64
+		for _, segment := range segments {
+			total += segment.VMA.Size()
+		}
+		w.progress(total, total)
+	}
+	return nil
+}
+
+// throttledOutput is an output whose writes go through a rate limiter.
+type throttledOutput struct {
+	output
+	w io.WriterAt
+}
+
+func (t throttledOutput) WriteAt(p []byte, off int64) (int, error) { return t.w.WriteAt(p, off) }
+
+// inPlaceAlign returns the p_align of vma's segment, already at offset in
+// the file: its page size, or for a hugetlb mapping that the buffer didn't
+// place on a huge page boundary, the largest power of two it's aligned to
+// like its address, down to the base page size.
+func inPlaceAlign(vma VMA, offset uint64) uint64 {
+	align := max(pageSize, vma.PageSize)
+	for align > pageSize && offset%align != uint64(vma.Start)%align {
+		align /= 2
+	}
+	return align
+}
+
+// calculateNoteLayout calculates the size and offset of the note segment.
+func (w *ELFWriter) calculateNoteLayout() (noteSize, noteOffset uint64) {
+	// Start after ELF header and program headers
+	ehdrSize, phdrSize := w.headerSizes()
+	phdrCount := uint64(len(w.getDumpableVMAs()) + 1) // +1 for PT_NOTE
+
+	noteOffset = ehdrSize + phdrCount*phdrSize
+
+	// Calculate note size
+	noteSize = uint64(0)
+	for _, note := range w.info.Notes {
+		noteSize += w.calculateNoteSize(note)
+	}
+
+	return noteSize, noteOffset
+}
+
+// calculateLoadSegments calculates the layout of PT_LOAD segments, which
+// start after noteEnd at offsets aligned to segmentAlign, or to their
+// page size if that's larger.
+func (w *ELFWriter) calculateLoadSegments(noteEnd uint64) []LoadSegment {
+	var segments []LoadSegment
+	segmentAlign := w.segmentAlign()
+	offset := noteEnd
+
+	for _, vma := range w.getDumpableVMAs() {
+		align := max(segmentAlign, vma.PageSize)
+		offset = (offset + align - 1) &^ (align - 1)
+		segment := LoadSegment{
+			VMA:    vma,
+			Offset: offset,
+			Align:  max(pageSize, vma.PageSize),
+		}
+		segments = append(segments, segment)
+		offset += vma.Size()
+	}
+
+	return segments
+}
+
+// pageSize is the base page size of the kernel livecore runs on, and so
+// of the processes it dumps: 4K on x86-64, and 4K, 16K, or 64K on arm64.
+var pageSize = uint64(os.Getpagesize())
+
+// segmentAlign returns the alignment of PT_LOAD segments in the file: the
+// page size, so each segment's offset is congruent to its address as
+// p_align says, or the filesystem's block size if that's larger, so every
+// all-zero block of memory can be a hole.
+func (w *ELFWriter) segmentAlign() uint64 {
+	f, ok := w.file.(*os.File)
+	if w.cached != nil {
+		f, ok = w.cached.f, true
+	}
+	if !ok || w.sparse == SparseNever {
+		return pageSize
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil || uint64(st.Blksize) <= pageSize || st.Blksize&(st.Blksize-1) != 0 {
+		return pageSize
+	}
+	return uint64(st.Blksize)
+}
+
+// checkLoadSegments returns an error if any two PT_LOAD segments overlap in
+// the address space, which debuggers either reject or silently mis-resolve,
+// or if one isn't aligned in the file like its address, which tools that
+// mmap cores can't map.
+func checkLoadSegments(segments []LoadSegment) error {
+	for _, segment := range segments {
+		if a := segment.Align; a < pageSize || a&(a-1) != 0 || segment.Offset%a != uint64(segment.VMA.Start)%a {
+			return fmt.Errorf("VMA %x-%x is at file offset %#x, which isn't aligned to %#x like its address",
+				segment.VMA.Start, segment.VMA.End, segment.Offset, a)
+		}
+	}
+	index := vmaindex.New(len(segments), func(i int) (uintptr, uintptr) {
+		return segments[i].VMA.Start, segments[i].VMA.End
+	})
+	for i, segment := range segments {
+		for _, j := range index.Overlapping(segment.VMA.Start, segment.VMA.End) {
+			if j != i {
+				return fmt.Errorf("VMA %x-%x overlaps VMA %x-%x",
+					segment.VMA.Start, segment.VMA.End, segments[j].VMA.Start, segments[j].VMA.End)
+			}
+		}
+	}
+	return nil
+}
+
+// Sizes of the ELF header and of a program header, for 64-bit and 32-bit
+// cores.
+const (
+	elfHeaderSize   = 64 // Elf64_Ehdr
+	phdrSize        = 56 // Elf64_Phdr
+	elfHeaderSize32 = 52 // Elf32_Ehdr
+	phdrSize32      = 32 // Elf32_Phdr
+)
+
+// noteAlign is the alignment of the PT_NOTE segment and of each note's
+// name and description in it: 4 bytes, in 64-bit cores too, as the kernel
+// writes them.
+const noteAlign = 4
+
+// headerSizes returns the sizes of the ELF header and a program header.
+func (w *ELFWriter) headerSizes() (ehdr, phdr uint64) {
+	if w.info.is32() {
+		return elfHeaderSize32, phdrSize32
+	}
+	return elfHeaderSize, phdrSize
+}
+
+// writeELFHeader writes the ELF file header
+func (w *ELFWriter) writeELFHeader(phnum int) error {
+	ehdrSize, phdrSize := w.headerSizes()
+	header := make([]byte, ehdrSize)
+
+	// ELF magic
+	copy(header[0:4], []byte{0x7f, 'E', 'L', 'F'})
+
+	// Class (64-bit, or 32-bit for a compat-mode process)
+	header[4] = ElfClass64
+	if w.info.is32() {
+		header[4] = byte(elf.ELFCLASS32)
+	}
+
+	// Data encoding (little-endian)
+	header[5] = ElfData2LSB
+
+	// Version
+	header[6] = ElfVersion
+
+	// OS/ABI (System V), ABI version, and padding are zeros
+
+	// Type (ET_CORE)
+	binary.LittleEndian.PutUint16(header[16:18], ET_CORE)
+
+	// Machine (x86-64, i386, or RISC-V)
+	binary.LittleEndian.PutUint16(header[18:20], uint16(w.info.arch().machine))
+
+	// Version
+	binary.LittleEndian.PutUint32(header[20:24], ElfVersion)
+
+	// The rest differs only in the width of the entry point, program
+	// header offset, and section header offset: the entry point and
+	// section headers are 0 for core files, and the program headers
+	// follow the ELF header.
+	rest := header[24:]
+	if w.info.is32() {
+		binary.LittleEndian.PutUint32(rest[4:], uint32(ehdrSize))
+		rest = rest[12:]
+	} else {
+		binary.LittleEndian.PutUint64(rest[8:], ehdrSize)
+		rest = rest[24:]
+	}
+
+	// Flags (0), then the ELF header size, program header entry size,
+	// and number of program header entries; no section headers
+	binary.LittleEndian.PutUint16(rest[4:], uint16(ehdrSize))
+	binary.LittleEndian.PutUint16(rest[6:], uint16(phdrSize))
+	binary.LittleEndian.PutUint16(rest[8:], uint16(phnum))
+
+	_, err := w.file.WriteAt(header, 0)
+	return err
+}
+
+// writeProgramHeaders writes the program header table
+func (w *ELFWriter) writeProgramHeaders(noteOffset, noteSize uint64, loadSegments []LoadSegment) error {
+	ehdrSize, phdrSize := w.headerSizes()
+	phdrOffset := int64(ehdrSize)
+
+	// Write PT_NOTE header
+	notePhdr := w.createNotePhdr(noteOffset, noteSize)
+	if _, err := w.file.WriteAt(notePhdr, phdrOffset); err != nil {
+		return err
+	}
+	phdrOffset += int64(phdrSize)
+
+	// Write PT_LOAD headers
+	for _, segment := range loadSegments {
+		loadPhdr := w.createLoadPhdr(segment)
+		if _, err := w.file.WriteAt(loadPhdr, phdrOffset); err != nil {
+			return err
+		}
+		phdrOffset += int64(phdrSize)
+	}
+
+	return nil
+}
+
+// createNotePhdr creates a PT_NOTE program header
+func (w *ELFWriter) createNotePhdr(offset, size uint64) []byte {
+	// Readable, at no address, and 4-byte aligned, as the kernel's are
+	return w.phdr(PT_NOTE, uint32(elf.PF_R), offset, 0, size, noteAlign)
+}
+
+// createLoadPhdr creates a PT_LOAD program header
+func (w *ELFWriter) createLoadPhdr(segment LoadSegment) []byte {
+	flags := uint32(elf.PF_R)
+	if segment.VMA.Perms&PermWrite != 0 {
+		flags |= uint32(elf.PF_W)
+	}
+	if segment.VMA.Perms&PermExec != 0 {
+		flags |= uint32(elf.PF_X)
+	}
+	return w.phdr(PT_LOAD, flags, segment.Offset, uint64(segment.VMA.Start), segment.VMA.Size(), segment.Align)
+}
+
+// phdr encodes a program header whose segment is size bytes both in the
+// file, at offset, and in memory, at vaddr, which is also its physical
+// address.
+func (w *ELFWriter) phdr(typ, flags uint32, offset, vaddr, size, align uint64) []byte {
+	if w.info.is32() {
+		// Elf32_Phdr has p_flags after the sizes, not after p_type.
+		phdr := make([]byte, phdrSize32)
+		le := binary.LittleEndian
+		le.PutUint32(phdr[0:], typ)
+		le.PutUint32(phdr[4:], uint32(offset))
+		le.PutUint32(phdr[8:], uint32(vaddr))
+		le.PutUint32(phdr[12:], uint32(vaddr))
+		le.PutUint32(phdr[16:], uint32(size))
+		le.PutUint32(phdr[20:], uint32(size))
+		le.PutUint32(phdr[24:], flags)
+		le.PutUint32(phdr[28:], uint32(align))
+		return phdr
+	}
+	phdr := make([]byte, phdrSize)
+	le := binary.LittleEndian
+	le.PutUint32(phdr[0:], typ)
+	le.PutUint32(phdr[4:], flags)
+	le.PutUint64(phdr[8:], offset)
+	le.PutUint64(phdr[16:], vaddr)
+	le.PutUint64(phdr[24:], vaddr)
+	le.PutUint64(phdr[32:], size)
+	le.PutUint64(phdr[40:], size)
+	le.PutUint64(phdr[48:], align)
+	return phdr
+}
+
+// writeNoteSegment writes the PT_NOTE segment at offset.
+func (w *ELFWriter) writeNoteSegment(offset uint64) error {
+	for _, note := range w.info.Notes {
+		if err := w.writeNote(note, &offset); err != nil {
+			return fmt.Errorf("failed to write note %s: %w", note.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeLoadSegments writes the PT_LOAD segments, which start at noteEnd.
+func (w *ELFWriter) writeLoadSegments(segments []LoadSegment, noteEnd uint64) error {
+	var total uint64
+	end := noteEnd // with no segments, the notes end the file
+	for _, segment := range segments {
+		total += segment.VMA.Size()
+		end = max(end, segment.Offset+segment.VMA.Size())
+	}
+	var (
+		mu      sync.Mutex
+		written uint64
+	)
+	err := w.forEachSegment(segments, func(segment LoadSegment) error {
+		if err := w.writeLoadSegment(segment); err != nil {
+			return fmt.Errorf("failed to write load segment for VMA %x-%x: %w",
+				segment.VMA.Start, segment.VMA.End, err)
+		}
+		if w.progress != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			written += segment.VMA.Size()
+			w.progress(written, total)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Holes at the end of the last segment(s) were never written, so
+	// extend the file to its full size. The skipped regions stay sparse.
+	// A stream writes them out as zeros instead.
+	if err := w.file.Truncate(int64(end)); err != nil {
+		return fmt.Errorf("failed to extend core file to %d bytes: %w", end, err)
+	}
+	return nil
+}
+
+// forEachSegment calls f for each segment, in order, or for up to
+// w.concurrency of them at once when writing to a file. It returns the
+// first error, after which no more segments are started.
+func (w *ELFWriter) forEachSegment(segments []LoadSegment, f func(LoadSegment) error) error {
+	workers := min(w.concurrency, len(segments))
+	if workers <= 1 || w.stream != nil {
+		for _, segment := range segments {
+			if err := f(segment); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		next     atomic.Int64
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		failed.Store(true)
+	}
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w.workerInit != nil {
+				runtime.LockOSThread()
+				if err := w.workerInit(); err != nil {
+					fail(err)
+					return
+				}
+			}
+			for !failed.Load() {
+				i := next.Add(1) - 1
+				if i >= int64(len(segments)) {
+					return
+				}
+				if err := f(segments[i]); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// writeLoadSegment writes a single PT_LOAD segment
+func (w *ELFWriter) writeLoadSegment(segment LoadSegment) error {
+	// Zero VMAs are left as holes; writeLoadSegments extends the file
+	// over them, which is much more efficient than writing zeros.
+	if segment.VMA.IsZero {
+		if w.sparse == SparseNever {
+			return w.writeZeros(int64(segment.Offset), segment.VMA.Size())
+		}
+		return nil
+	}
+
+	start, size := segment.VMA.Start, segment.VMA.Size()
+
+	// Only write the parts that hold data; the rest stay holes.
+	extents := []Extent{{Offset: 0, Length: size}}
+	if el, ok := w.mem.(ExtentLister); ok && w.sparse != SparseNever {
+		var err error
+		extents, err = el.DataExtents(start, size)
+		if err != nil {
+			return fmt.Errorf("failed to find data extents for %x-%x: %w", segment.VMA.Start, segment.VMA.End, err)
+		}
+	}
+	for _, e := range extents {
+		if w.cached != nil {
+			w.cached.preallocate(int64(segment.Offset+e.Offset), int64(e.Length))
+		}
+		if err := w.writeMemory(int64(segment.Offset+e.Offset), start+uintptr(e.Offset), e.Length); err != nil {
+			return fmt.Errorf("failed to write VMA data for %x-%x: %w", segment.VMA.Start, segment.VMA.End, err)
+		}
+	}
+
+	// Let the memory source free its copy, if it can.
+	if r, ok := w.mem.(MemoryReleaser); ok {
+		if err := r.Release(start, size); err != nil {
+			// Log but don't fail - releasing is best effort. Not to
+			// stdout, which may be where the core is going.
+			fmt.Fprintf(os.Stderr, "Warning: failed to release memory for VMA %x-%x: %v\n",
+				segment.VMA.Start, segment.VMA.End, err)
+		}
+	}
+
+	return nil
+}
+
+// copyChunkSize is how much memory writeMemory reads at a time.
+const copyChunkSize = 1 << 20
+
+// writeMemory writes size bytes of memory at addr to the core file at
+// off. Pages that are all zeros are skipped, leaving holes, unless the
+// memory source writes them out itself or the writer isn't sparse.
+func (w *ELFWriter) writeMemory(off int64, addr uintptr, size uint64) error {
+	if wt, ok := w.mem.(MemoryWriterTo); ok && w.sparse != SparseAlways {
+		return wt.WriteMemoryTo(w.file, off, addr, size)
+	}
+	buf := w.getBuf()
+	defer w.bufs.Put(buf)
+	for size > 0 {
+		chunk := (*buf)[:min(size, copyChunkSize)]
+		if _, err := w.mem.ReadAt(chunk, addr); err != nil {
+			return fmt.Errorf("failed to read memory at %x: %w", addr, err)
+		}
+		var err error
+		if w.sparse == SparseNever {
+			_, err = w.file.WriteAt(chunk, off)
+		} else {
+			err = w.writeNonZero(chunk, off)
+		}
+		if err != nil {
+			return err
+		}
+		off += int64(len(chunk))
+		addr += uintptr(len(chunk))
+		size -= uint64(len(chunk))
+	}
+	return nil
+}
+
+// getBuf returns a buffer of copyChunkSize bytes, to put back in w.bufs
+// when done. Each segment being written needs its own.
+func (w *ELFWriter) getBuf() *[]byte {
+	if b, ok := w.bufs.Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, copyChunkSize)
+	return &b
+}
+
+// writeNonZero writes b to the core file at off, skipping pages that are
+// all zeros.
+func (w *ELFWriter) writeNonZero(b []byte, off int64) error {
+	pageSize := int(pageSize)
+	for len(b) > 0 {
+		// Skip a run of zero pages, then write a run of non-zero ones.
+		n := 0
+		for n < len(b) && isZero(b[n:min(n+pageSize, len(b))]) {
+			n += pageSize
+		}
+		n = min(n, len(b))
+		b, off = b[n:], off+int64(n)
+		n = 0
+		for n < len(b) && !isZero(b[n:min(n+pageSize, len(b))]) {
+			n += pageSize
+		}
+		n = min(n, len(b))
+		if n > 0 {
+			if _, err := w.file.WriteAt(b[:n], off); err != nil {
+				return err
+			}
+		}
+		b, off = b[n:], off+int64(n)
+	}
+	return nil
+}
+
+// writeZeros writes size zeros to the core file at off.
+func (w *ELFWriter) writeZeros(off int64, size uint64) error {
+	buf := w.getBuf()
+	defer w.bufs.Put(buf)
+	zeros := (*buf)[:min(size, copyChunkSize)]
+	clear(zeros)
+	for size > 0 {
+		n := min(size, uint64(len(zeros)))
+		if _, err := w.file.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+		off += int64(n)
+		size -= n
+	}
+	return nil
+}
+
+// isZero reports whether b is all zeros.
+func isZero(b []byte) bool {
+	for len(b) >= 8 {
+		if binary.LittleEndian.Uint64(b) != 0 {
+			return false
+		}
+		b = b[8:]
+	}
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// getDumpableVMAs returns VMAs that should be included in the core dump
+func (w *ELFWriter) getDumpableVMAs() []VMA {
+	var dumpable []VMA
+	for _, vma := range w.info.VMAs {
+		if vma.IsDumpable() {
+			dumpable = append(dumpable, vma)
+		}
+	}
+	return dumpable
+}
+
+// LoadSegment represents a PT_LOAD segment
+type LoadSegment struct {
+	VMA    VMA
+	Offset uint64
+	// Align is the segment's p_align: a power of two, at least the page
+	// size, modulo which Offset is congruent to the VMA's address, so the
+	// segment can be mapped from the file.
+	Align uint64
+}
@@ -0,0 +1,221 @@
+package elfcore
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testMemory is a MemorySource of synthetic memory: each byte is derived
+// from its address, except in the pages listed in holes, which are zeros.
+type testMemory struct {
+	holes map[uintptr]bool // by page address
+}
+
+// byteAt returns the byte testMemory has at addr.
+func (m *testMemory) byteAt(addr uintptr) byte {
+	if m.holes[addr&^(uintptr(pageSize)-1)] {
+		return 0
+	}
+	return byte(addr>>12) ^ byte(addr) ^ 0x5a
+}
+
+func (m *testMemory) ReadAt(p []byte, addr uintptr) (int, error) {
+	for i := range p {
+		p[i] = m.byteAt(addr + uintptr(i))
+	}
+	return len(p), nil
+}
+
+// DataExtents implements ExtentLister, leaving out the holes.
+func (m *testMemory) DataExtents(start uintptr, size uint64) ([]Extent, error) {
+	var extents []Extent
+	for off := uint64(0); off < size; off += pageSize {
+		if m.holes[start+uintptr(off)] {
+			continue
+		}
+		if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == off {
+			extents[n-1].Length += pageSize
+			continue
+		}
+		extents = append(extents, Extent{Offset: off, Length: pageSize})
+	}
+	return extents, nil
+}
+
+// testVMA returns an anonymous VMA of pages pages at start.
+func testVMA(start uintptr, pages int, perms Perm) VMA {
+	size := uint64(pages) * pageSize
+	return VMA{Start: start, End: start + uintptr(size), Perms: perms, MemSize: size}
+}
+
+// testCoreInfo returns a CoreInfo with VMAs of mixed sizes, all below
+// 4GB so a 32-bit core can hold them, and holes in some of them. With
+// notes, it has the usual notes for one thread, and one whose size isn't
+// a multiple of 4; without, it has none.
+func testCoreInfo(t *testing.T, class elf.Class, notes bool) (*CoreInfo, *testMemory) {
+	t.Helper()
+	const hugePage = 2 << 20
+	page := uintptr(pageSize)
+	huge := testVMA(0x4000_0000, int(hugePage/pageSize), PermRead|PermWrite)
+	huge.PageSize = hugePage
+	zero := testVMA(0x3000_0000, 2, PermRead)
+	zero.IsZero = true
+	omitted := testVMA(0x5000_0000, 4, PermRead)
+	omitted.Omit = "test"
+	info := &CoreInfo{
+		Pid:   1234,
+		Class: class,
+		VMAs: []VMA{
+			testVMA(0x1000_0000, 1, PermRead|PermExec),
+			testVMA(0x1000_0000+page, 3, PermRead),
+			testVMA(0x2000_0000, 17, PermRead|PermWrite),
+			zero,
+			huge,
+			omitted,
+			testVMA(0x6000_0000, 5, PermRead|PermWrite),
+		},
+	}
+	mem := &testMemory{holes: map[uintptr]bool{
+		0x2000_0000 + 2*page:          true,
+		0x2000_0000 + 3*page:          true,
+		0x4000_0000 + hugePage - page: true,
+	}}
+	if notes {
+		info.Threads = []Thread{{Tid: 1234, Name: "test"}}
+		info.PSInfo = &PSInfo{State: 'S', Pid: 1234, PPid: 1, Fname: "test", Args: []byte("test\x00-v")}
+		info.Auxv = make([]byte, 32)
+		var err error
+		info.Notes, err = CreateCoreNotes(info, NoteOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info.Notes = append(info.Notes, Note{Name: "TEST", Type: 0x7e57, Data: []byte("odd")})
+	}
+	return info, mem
+}
+
+// forEachLayout calls f with each class of core, with and without notes.
+func forEachLayout(t *testing.T, f func(t *testing.T, class elf.Class, notes bool)) {
+	for _, class := range []elf.Class{elf.ELFCLASS64, elf.ELFCLASS32} {
+		for _, notes := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v/notes=%v", class, notes), func(t *testing.T) {
+				f(t, class, notes)
+			})
+		}
+	}
+}
+
+func TestWriterSegmentLayout(t *testing.T) {
+	forEachLayout(t, func(t *testing.T, class elf.Class, notes bool) {
+		info, mem := testCoreInfo(t, class, notes)
+		path := filepath.Join(t.TempDir(), "core")
+		w, err := NewELFWriter(path, info, mem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteCore(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		cr, err := OpenCore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cr.Close()
+		if got := cr.Info().Class; got != class {
+			t.Errorf("class = %v; want %v", got, class)
+		}
+		if got, want := len(cr.Segments()), len(info.VMAs)-1; got != want {
+			t.Errorf("%d PT_LOAD segments; want %d", got, want)
+		}
+
+		// CoreReader doesn't keep p_align, so the headers are read
+		// again for it.
+		ef, err := elf.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ef.Close()
+		var loads, noteSegs int
+		for i, p := range ef.Progs {
+			switch p.Type {
+			case elf.PT_LOAD:
+				loads++
+				if p.Align < pageSize || p.Align&(p.Align-1) != 0 {
+					t.Errorf("PT_LOAD at %#x has p_align %#x", p.Vaddr, p.Align)
+				} else if p.Off%p.Align != p.Vaddr%p.Align {
+					t.Errorf("PT_LOAD at %#x: p_offset %#x %% p_align %#x != p_vaddr %% p_align", p.Vaddr, p.Off, p.Align)
+				}
+			case elf.PT_NOTE:
+				noteSegs++
+				if p.Align != 4 {
+					t.Errorf("PT_NOTE p_align = %d; want 4", p.Align)
+				}
+				if p.Off%4 != 0 {
+					t.Errorf("PT_NOTE p_offset = %#x; not 4-byte aligned", p.Off)
+				}
+			}
+			for _, q := range ef.Progs[i+1:] {
+				if p.Filesz > 0 && q.Filesz > 0 && p.Off < q.Off+q.Filesz && q.Off < p.Off+p.Filesz {
+					t.Errorf("%v at file offset %#x+%#x overlaps %v at %#x+%#x", p.Type, p.Off, p.Filesz, q.Type, q.Off, q.Filesz)
+				}
+				if p.Type == elf.PT_LOAD && q.Type == elf.PT_LOAD && p.Vaddr < q.Vaddr+q.Memsz && q.Vaddr < p.Vaddr+p.Memsz {
+					t.Errorf("PT_LOAD at %#x+%#x overlaps PT_LOAD at %#x+%#x", p.Vaddr, p.Memsz, q.Vaddr, q.Memsz)
+				}
+			}
+		}
+		if loads != len(info.VMAs)-1 || noteSegs != 1 {
+			t.Errorf("%d PT_LOAD and %d PT_NOTE segments; want %d and 1", loads, noteSegs, len(info.VMAs)-1)
+		}
+
+		if !notes {
+			return // Validate rightly complains there are no threads
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		problems, err := Validate(f, fi.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range problems {
+			t.Errorf("Validate: %v", p)
+		}
+	})
+}
+
+func TestCheckLoadSegments(t *testing.T) {
+	vma := testVMA(0x1000_0000, 2, PermRead)
+	tests := []struct {
+		name     string
+		segments []LoadSegment
+		wantErr  bool
+	}{
+		{"aligned", []LoadSegment{{VMA: vma, Offset: 4 * pageSize, Align: pageSize}}, false},
+		{"misaligned", []LoadSegment{{VMA: vma, Offset: 4*pageSize + 8, Align: pageSize}}, true},
+		{"align below page", []LoadSegment{{VMA: vma, Offset: 4 * pageSize, Align: 4}}, true},
+		{"align not power of two", []LoadSegment{{VMA: vma, Offset: 0, Align: 3 * pageSize}}, true},
+		{"overlap", []LoadSegment{
+			{VMA: vma, Offset: 4 * pageSize, Align: pageSize},
+			{VMA: testVMA(0x1000_0000+uintptr(pageSize), 2, PermRead), Offset: 8 * pageSize, Align: pageSize},
+		}, true},
+	}
+	for _, tt := range tests {
+		err := checkLoadSegments(tt.segments)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkLoadSegments = %v; want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
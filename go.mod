@@ -2,4 +2,7 @@ module github.com/bradfitz/livecore
 
 go 1.25
 
-require golang.org/x/sys v0.37.0
+require (
+	github.com/pierrec/lz4/v4 v4.1.31
+	golang.org/x/sys v0.37.0
+)
@@ -0,0 +1,110 @@
+package livecore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DumpAll dumps several processes side by side, writing ds[i]'s core to
+// ws[i]. Their final stops overlap: none of them starts its final copy
+// until all are frozen, and none resumes until all have copied, so memory
+// they share reads the same in every core.
+//
+// A dump that fails drops out without holding up the rest. DumpAll
+// returns each dump's error, nil if it succeeded, in the order of ds.
+func DumpAll(ctx context.Context, ds []*Dumper, ws []io.Writer) []error {
+	if len(ds) != len(ws) {
+		panic(fmt.Sprintf("livecore: DumpAll got %d dumpers but %d writers", len(ds), len(ws)))
+	}
+	r := newRendezvous(len(ds))
+	errs := make([]error, len(ds))
+	var wg sync.WaitGroup
+	for i, d := range ds {
+		d.group = &groupMember{r: r}
+		wg.Go(func() {
+			defer d.group.leave()
+			errs[i] = d.Dump(ctx, ws[i])
+		})
+	}
+	wg.Wait()
+	return errs
+}
+
+// A meetPoint is a place in the final stop where grouped dumps wait for
+// each other.
+type meetPoint int
+
+const (
+	meetReady  meetPoint = iota // about to freeze
+	meetFrozen                  // frozen, about to copy
+	meetCopied                  // copied, about to unfreeze
+
+	numMeetPoints
+)
+
+// A rendezvous lines up grouped dumps at each meetPoint in turn.
+type rendezvous struct {
+	mu       sync.Mutex
+	expected [numMeetPoints]int // dumps that haven't dropped out before each point
+	arrived  [numMeetPoints]int
+	release  [numMeetPoints]chan struct{}
+}
+
+func newRendezvous(n int) *rendezvous {
+	r := new(rendezvous)
+	for p := range numMeetPoints {
+		r.expected[p] = n
+		r.release[p] = make(chan struct{})
+	}
+	return r
+}
+
+// arrive waits at p until every dump still expected there has arrived.
+func (r *rendezvous) arrive(p meetPoint) {
+	r.mu.Lock()
+	r.arrived[p]++
+	r.check(p)
+	r.mu.Unlock()
+	<-r.release[p]
+}
+
+// drop stops expecting one dump at from and the points after it.
+func (r *rendezvous) drop(from meetPoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for p := from; p < numMeetPoints; p++ {
+		r.expected[p]--
+		r.check(p)
+	}
+}
+
+// check releases the dumps waiting at p if they're all there.
+func (r *rendezvous) check(p meetPoint) {
+	if r.arrived[p] == r.expected[p] && r.arrived[p] > 0 {
+		close(r.release[p])
+	}
+}
+
+// A groupMember is one dump's place in a rendezvous.
+type groupMember struct {
+	r    *rendezvous
+	next meetPoint // the next point to arrive at
+}
+
+// meet waits for the rest of the group at p.
+func (m *groupMember) meet(p meetPoint) {
+	m.r.arrive(p)
+	m.next = p + 1
+}
+
+// leave drops the dump from the points it hasn't reached.
+func (m *groupMember) leave() { m.r.drop(m.next) }
+
+// meet waits at p for the other dumps in d's group, if it's in one.
+func (d *Dumper) meet(p meetPoint) {
+	if d.group != nil {
+		d.group.meet(p)
+	}
+}
@@ -0,0 +1,114 @@
+package livecore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/internal/copy"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// openBase opens the base core of an incremental or reflinked dump, and
+// checks that it's a core of the target, not of another process that had
+// its pid, and that the kernel can say what changed since.
+func (d *Dumper) openBase() (*elfcore.CoreReader, error) {
+	ok, err := copy.SoftDirtySupported()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("dumps with a base need soft-dirty page tracking, which this kernel lacks (CONFIG_MEM_SOFT_DIRTY)")
+	}
+
+	base, err := elfcore.OpenCore(d.base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open base core: %w", err)
+	}
+	if err := d.checkBase(base.Info()); err != nil {
+		base.Close()
+		return nil, err
+	}
+	if d.reflink && base.Info().Incremental != nil {
+		// Its unchanged pages are holes, not the memory they held.
+		base.Close()
+		return nil, fmt.Errorf("a reflink base must be a full core, not an incremental one")
+	}
+	return base, nil
+}
+
+// checkBase checks that info describes a core of the target.
+func (d *Dumper) checkBase(info *elfcore.CoreInfo) error {
+	if info.Pid != d.pid {
+		return fmt.Errorf("base core is of process %d, not %d", info.Pid, d.pid)
+	}
+	frozen := info.FreezeStart
+	if frozen == (elfcore.ClockSample{}) {
+		return fmt.Errorf("base core has no NT_LIVECORE_CLOCKS note to identify it; it must be written by livecore with every note")
+	}
+	// The boot-time clock resets at boot, so compare boots by when
+	// they started, by the wall clock.
+	now := sampleClocks()
+	if boot := time.Duration((now.Realtime - now.Boottime) - (frozen.Realtime - frozen.Boottime)); boot.Abs() > time.Minute {
+		return fmt.Errorf("base core is from before the system last booted")
+	}
+	started, err := proc.StartTime(d.pid)
+	if err != nil {
+		return err
+	}
+	if time.Duration(frozen.Boottime) < started {
+		return fmt.Errorf("base core is of an earlier process with pid %d", d.pid)
+	}
+	return nil
+}
+
+// addSharedWritable adds every writable shared mapping in vmas to
+// changed. Soft-dirty bits only track the target's own writes to them, not
+// those of the other processes sharing them.
+func addSharedWritable(vmas []proc.VMA, changed *copy.RangeSet) {
+	for _, vma := range vmas {
+		if !vma.IsZero && vma.Perms&proc.PermWrite != 0 && vma.Shared() {
+			changed.Add(copy.PageRange{Start: vma.Start, End: vma.End})
+		}
+	}
+}
+
+// discardedPages returns the pages of vmas' anonymous mappings that
+// aren't present, to add to what changed. They read as zeros, but may not
+// have before: a page discarded since the base, or since an interrupted
+// dump copied it, as with MADV_DONTNEED, loses its soft-dirty bit along
+// with its contents.
+func discardedPages(pid int, vmas []proc.VMA) ([]copy.PageRange, error) {
+	pageMap := copy.NewPageMap(pid)
+	defer pageMap.Close()
+	var discarded []copy.PageRange
+	for _, vma := range convertVMAsToCopy(vmas) {
+		if !vma.Anon || vma.IsZero {
+			continue
+		}
+		present, err := pageMap.PresentRanges(vma)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find present pages: %w", err)
+		}
+		discarded = append(discarded, copy.SubtractRanges([]copy.PageRange{{Start: vma.Start, End: vma.End}}, present)...)
+	}
+	return discarded, nil
+}
+
+// incrementalInfo describes an incremental core of vmas, the VMAs copied,
+// holding the pages in changed, and returns how many bytes that is.
+func incrementalInfo(base *elfcore.CoreInfo, vmas []proc.VMA, changed *copy.RangeSet) (*elfcore.IncrementalInfo, uint64) {
+	var dumped []copy.PageRange
+	for _, vma := range vmas {
+		if !vma.IsZero {
+			dumped = append(dumped, copy.PageRange{Start: vma.Start, End: vma.End})
+		}
+	}
+	inc := &elfcore.IncrementalInfo{Base: base.FreezeStart}
+	var size uint64
+	for _, r := range changed.Intersect(dumped) {
+		inc.Changed = append(inc.Changed, elfcore.AddrRange{Start: r.Start, End: r.End})
+		size += uint64(r.End - r.Start)
+	}
+	return inc, size
+}
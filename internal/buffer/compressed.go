@@ -0,0 +1,282 @@
+package buffer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// compressedStore keeps the temp buffer's pages lz4-compressed, for hosts
+// whose scratch disk is smaller than the target's memory.
+//
+// Compressed pages are appended to a file and found through a two-level
+// page table indexed by temp offset. A page that's rewritten (because it
+// was dirtied again) reuses its old slot if it fits, and is otherwise
+// appended; the old space isn't reclaimed. Pages that are all zeros aren't
+// stored at all and read back as holes.
+type compressedStore struct {
+	file     *os.File
+	pageSize int
+
+	mu      sync.Mutex
+	chunks  map[uint64]*[chunkPages]slot // by page number / chunkPages
+	fileEnd int64                        // where the next blob goes
+
+	scratch []byte // fill buffer, fillChunk bytes
+	cbuf    []byte // compression output, one page
+	lz      lz4.Compressor
+}
+
+// chunkPages is the number of page slots per second-level table.
+const chunkPages = 512
+
+// fillChunk is how much Fill hands its callback at once.
+const fillChunk = 1 << 20
+
+// slot locates a stored page: the blob's file offset in the high 48 bits
+// and its length in the low 16. A zero slot is a hole. A blob as long as a
+// page holds the page uncompressed.
+type slot uint64
+
+func makeSlot(off int64, n int) slot { return slot(uint64(off)<<16 | uint64(n)) }
+func (s slot) off() int64            { return int64(s >> 16) }
+func (s slot) len() int              { return int(s & 0xffff) }
+
+func newCompressedStore(file *os.File) *compressedStore {
+	pageSize := os.Getpagesize()
+	return &compressedStore{
+		file:     file,
+		pageSize: pageSize,
+		chunks:   make(map[uint64]*[chunkPages]slot),
+		scratch:  make([]byte, fillChunk),
+		cbuf:     make([]byte, pageSize),
+	}
+}
+
+// slotFor returns a pointer to the slot of page number page, allocating
+// its chunk if create is set. It returns nil if the chunk doesn't exist
+// and create is false.
+func (cs *compressedStore) slotFor(page uint64, create bool) *slot {
+	c, ok := cs.chunks[page/chunkPages]
+	if !ok {
+		if !create {
+			return nil
+		}
+		c = new([chunkPages]slot)
+		cs.chunks[page/chunkPages] = c
+	}
+	return &c[page%chunkPages]
+}
+
+// checkAligned returns an error unless offset and size are page-aligned.
+func (cs *compressedStore) checkAligned(offset TmpOffset, size uint64) error {
+	if int64(offset)%int64(cs.pageSize) != 0 || size%uint64(cs.pageSize) != 0 {
+		return fmt.Errorf("unaligned range %d+%d in compressed buffer", offset, size)
+	}
+	return nil
+}
+
+func (cs *compressedStore) fill(offset TmpOffset, size uint64, fill func(dst []byte, off uint64) error) error {
+	if err := cs.checkAligned(offset, size); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for off := uint64(0); off < size; off += fillChunk {
+		dst := cs.scratch[:min(fillChunk, size-off)]
+		if err := fill(dst, off); err != nil {
+			return err
+		}
+		for p := 0; p < len(dst); p += cs.pageSize {
+			page := (uint64(offset) + off + uint64(p)) / uint64(cs.pageSize)
+			if err := cs.storePage(page, dst[p:p+cs.pageSize]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storePage compresses data into page number page's slot.
+func (cs *compressedStore) storePage(page uint64, data []byte) error {
+	if isZero(data) {
+		if s := cs.slotFor(page, false); s != nil {
+			*s = 0
+		}
+		return nil
+	}
+
+	// A page that doesn't compress to less than a page is stored as is.
+	blob := data
+	if n, err := cs.lz.CompressBlock(data, cs.cbuf); err == nil && n > 0 && n < len(data) {
+		blob = cs.cbuf[:n]
+	}
+
+	s := cs.slotFor(page, true)
+	off := cs.fileEnd
+	if *s != 0 && s.len() >= len(blob) {
+		off = s.off()
+	}
+	if _, err := cs.file.WriteAt(blob, off); err != nil {
+		return fmt.Errorf("failed to write compressed page: %w", err)
+	}
+	if off == cs.fileEnd {
+		cs.fileEnd += int64(len(blob))
+	}
+	*s = makeSlot(off, len(blob))
+	return nil
+}
+
+// loadPage decompresses page number page into dst, which must be one page
+// long. Holes read as zeros.
+func (cs *compressedStore) loadPage(page uint64, dst []byte) error {
+	s := cs.slotFor(page, false)
+	if s == nil || *s == 0 {
+		clear(dst)
+		return nil
+	}
+	if s.len() == cs.pageSize {
+		_, err := cs.file.ReadAt(dst, s.off())
+		return err
+	}
+	blob := cs.cbuf[:s.len()]
+	if _, err := cs.file.ReadAt(blob, s.off()); err != nil {
+		return fmt.Errorf("failed to read compressed page: %w", err)
+	}
+	n, err := lz4.UncompressBlock(blob, dst)
+	if err != nil {
+		return fmt.Errorf("failed to decompress page: %w", err)
+	}
+	clear(dst[n:])
+	return nil
+}
+
+func (cs *compressedStore) dataExtents(offset TmpOffset, size uint64) ([]Extent, error) {
+	if err := cs.checkAligned(offset, size); err != nil {
+		return nil, err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ps := uint64(cs.pageSize)
+	first := uint64(offset) / ps
+	var extents []Extent
+	for i := uint64(0); i < size/ps; i++ {
+		page := first + i
+		if _, ok := cs.chunks[page/chunkPages]; !ok {
+			// Skip to the next chunk.
+			i += chunkPages - page%chunkPages - 1
+			continue
+		}
+		if *cs.slotFor(page, false) == 0 {
+			continue
+		}
+		if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == i*ps {
+			extents[n-1].Length += ps
+		} else {
+			extents = append(extents, Extent{Offset: i * ps, Length: ps})
+		}
+	}
+	return extents, nil
+}
+
+func (cs *compressedStore) writeTo(w io.WriterAt, wOff int64, offset TmpOffset, size uint64) error {
+	if err := cs.checkAligned(offset, size); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ps := uint64(cs.pageSize)
+	for off := uint64(0); off < size; off += fillChunk {
+		buf := cs.scratch[:min(fillChunk, size-off)]
+		for p := uint64(0); p < uint64(len(buf)); p += ps {
+			if err := cs.loadPage((uint64(offset)+off+p)/ps, buf[p:p+ps]); err != nil {
+				return err
+			}
+		}
+		if _, err := w.WriteAt(buf, wOff+int64(off)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cs *compressedStore) zero(offset TmpOffset, length uint64) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ps := uint64(cs.pageSize)
+	buf := cs.scratch[:ps]
+	for pos := uint64(offset); pos < uint64(offset)+length; {
+		page := pos / ps
+		end := min((page+1)*ps, uint64(offset)+length)
+		if err := cs.loadPage(page, buf); err != nil {
+			return err
+		}
+		clear(buf[pos%ps : pos%ps+(end-pos)])
+		if err := cs.storePage(page, buf); err != nil {
+			return err
+		}
+		pos = end
+	}
+	return nil
+}
+
+// punchHole forgets the pages in the range. Their blobs' space isn't
+// reclaimed.
+func (cs *compressedStore) punchHole(offset TmpOffset, length uint64) error {
+	if err := cs.checkAligned(offset, length); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ps := uint64(cs.pageSize)
+	for page := uint64(offset) / ps; page < (uint64(offset)+length)/ps; page++ {
+		if s := cs.slotFor(page, false); s != nil {
+			*s = 0
+		}
+	}
+	return nil
+}
+
+// move hands the slots of the pages at src to those at dst, without
+// touching their blobs.
+func (cs *compressedStore) move(dst, src TmpOffset, size uint64) error {
+	if err := cs.checkAligned(src, size); err != nil {
+		return err
+	}
+	if err := cs.checkAligned(dst, 0); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ps := uint64(cs.pageSize)
+	for i := uint64(0); i < size/ps; i++ {
+		from := cs.slotFor(uint64(src)/ps+i, false)
+		if from == nil || *from == 0 {
+			if to := cs.slotFor(uint64(dst)/ps+i, false); to != nil {
+				*to = 0
+			}
+			continue
+		}
+		*cs.slotFor(uint64(dst)/ps+i, true), *from = *from, 0
+	}
+	return nil
+}
+
+// isZero reports whether b is all zeros.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
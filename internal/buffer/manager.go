@@ -1,11 +1,15 @@
 package buffer
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -15,62 +19,232 @@ import (
 // TmpOffset represents an offset in the temporary file.
 type TmpOffset int64
 
-// offAndSize is a comparable map key to represent a memory region by
-// its offset (in the target PID) and size.
-type offAndSize struct {
-	Offset uint64
-	Size   uint64
+// allocation is the space in the temp file for a range of the target's
+// addresses. A Manager's allocations are sorted by address and don't
+// overlap, so a range within one is found whatever VMA it was made for.
+type allocation struct {
+	start, end uint64    // the target's addresses
+	offset     TmpOffset // where start's bytes are
 }
 
 // Manager manages a temporary file for buffering memory data.
 type Manager struct {
-	file *os.File
+	file     *os.File
+	borrowed bool // file is the caller's, so Close leaves it open
 
-	mu          sync.Mutex               // Protects allocations and nextOffset.
-	allocations map[offAndSize]TmpOffset // VMA offset+size -> temp file offset.
-	nextOffset  TmpOffset                // Next available offset in temp file.
-	fsBlockSize uint64                   // Filesystem block size for alignment.
+	mu          sync.Mutex   // Protects allocations, nextOffset, and fileSize.
+	allocations []allocation // By address; see GetOffsetForVMA.
+	nextOffset  TmpOffset    // Next available offset in temp file.
+	fsBlockSize uint64       // Filesystem block size for alignment.
+	window      int64        // Most the allocations may add up to.
+	fileSize    int64        // Size the temp file has been grown to.
 
 	// Mmap information for direct writes
 	mmapData []byte // Mapped memory region.
 	mmapSize int64  // Size of the mapped region.
+
+	// z, if non-nil, stores pages compressed instead of in mmapData.
+	z *compressedStore
+
+	// rec, if non-nil, writes pages out as records instead of keeping
+	// them; see NewRecordManager.
+	rec *recordStore
+
+	// Set once the kernel has refused to clone or copy from the temp
+	// file to an output file; see copyToFile.
+	noClone, noCopyRange atomic.Bool
+
+	// Free space monitoring; see SetMinFree.
+	minFree     uint64
+	sinceStatfs atomic.Uint64 // bytes filled since the last statfs
+	lowSpaceErr atomic.Pointer[error]
+}
+
+// DefaultWindow is the default most a Manager's allocations may add up
+// to, which is how much address space its mmap reserves.
+const DefaultWindow = 512 << 30
+
+// growChunk is how much the temp file grows by at a time, as allocations
+// reach its end. Growing it doesn't allocate disk space; filling it does.
+const growChunk = 1 << 30
+
+// ErrWindowFull is returned (wrapped) by GetOffsetForVMA when an
+// allocation would go past the Manager's window.
+var ErrWindowFull = errors.New("scratch buffer window is full")
+
+// ErrLowSpace is returned (wrapped) by Fill when the temp file's
+// filesystem is running out of space.
+var ErrLowSpace = errors.New("scratch filesystem is almost full")
+
+// SetMinFree makes Fill fail with ErrLowSpace instead of writing once the
+// temp file's filesystem would have less than n bytes free. Writing into
+// the mmap on a full filesystem would otherwise fault (SIGBUS), or make
+// process_vm_readv fail with EFAULT, which looks like unreadable memory.
+func (bm *Manager) SetMinFree(n uint64) {
+	bm.minFree = n
+	bm.sinceStatfs.Store(n) // check on the next Fill
+}
+
+// checkSpace returns an error if writing size more bytes could bring free
+// space below the minimum. To keep this cheap, it only calls statfs once
+// a quarter of the minimum has been written since the last call.
+func (bm *Manager) checkSpace(size uint64) error {
+	if bm.minFree == 0 {
+		return nil
+	}
+	if errp := bm.lowSpaceErr.Load(); errp != nil {
+		return *errp
+	}
+	if bm.sinceStatfs.Add(size) < bm.minFree/4 && size < bm.minFree/4 {
+		return nil
+	}
+	bm.sinceStatfs.Store(0)
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(int(bm.file.Fd()), &st); err != nil {
+		return nil // can't tell; carry on
+	}
+	avail := st.Bavail * uint64(st.Bsize)
+	if avail < size+bm.minFree {
+		err := fmt.Errorf("%w: %d MB free, need %d MB more plus %d MB reserve", ErrLowSpace, avail>>20, size>>20, bm.minFree>>20)
+		bm.lowSpaceErr.Store(&err)
+		return err
+	}
+	return nil
 }
 
-// NewBufferManager creates a new BufferManager with a temporary file
-func NewBufferManager(outputFile string) (*Manager, error) {
-	// Create temp file in the same directory as output file
-	outputDir := filepath.Dir(outputFile)
-	tempFile, err := os.CreateTemp(outputDir, "livecore-buffer-*")
+// NewBufferManager creates a new BufferManager with a temporary file in
+// dir, whose allocations may add up to window bytes, or DefaultWindow if
+// it's 0. The file grows as space is allocated in it, a chunk at a time,
+// and is sparse until filled.
+func NewBufferManager(dir string, window int64) (*Manager, error) {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	tempFile, err := os.CreateTemp(dir, "livecore-buffer-*")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
 	tempPath := tempFile.Name()
 	os.Remove(tempPath) // so it doesn't persist after the program exits; we'll use the open fd only
 
-	// Get filesystem block size for alignment
-	fsBlockSize, err := getFilesystemBlockSize(tempFile)
+	bm, err := newMmapManager(tempFile, window)
 	if err != nil {
 		tempFile.Close()
-		return nil, fmt.Errorf("failed to get filesystem block size: %w", err)
+		return nil, err
 	}
+	return bm, nil
+}
 
-	// Create a large initial file and mmap for direct writes
-	mmapSize := int64(512 << 30) // 512GB
-	if err := tempFile.Truncate(mmapSize); err != nil {
-		tempFile.Close()
-		return nil, fmt.Errorf("failed to create large temp file: %w", err)
+// NewFileBufferManager is like NewBufferManager, but buffers in file
+// itself, which it empties first, rather than in a temp file, so that
+// what's copied can be left where it is: see Reserve. Closing the Manager
+// leaves file open. Allocations are aligned to the page size, at least.
+func NewFileBufferManager(file *os.File, window int64) (*Manager, error) {
+	if window <= 0 {
+		window = DefaultWindow
 	}
-	mmapData, err := unix.Mmap(int(tempFile.Fd()), 0, int(mmapSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err := file.Truncate(0); err != nil {
+		return nil, fmt.Errorf("failed to truncate %s: %w", file.Name(), err)
+	}
+	bm, err := newMmapManager(file, window)
 	if err != nil {
-		tempFile.Close()
-		return nil, fmt.Errorf("failed to mmap temp file: %w", err)
+		return nil, err
+	}
+	bm.borrowed = true
+	bm.fsBlockSize = max(bm.fsBlockSize, uint64(os.Getpagesize()))
+	return bm, nil
+}
+
+// NewNamedBufferManager is like NewBufferManager, but buffers in the file
+// at path, creating it if need be, and leaves it there, so that a later
+// Manager can take up what it holds: see Allocations and Restore.
+func NewNamedBufferManager(path string, window int64) (*Manager, error) {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scratch buffer: %w", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	bm, err := newMmapManager(file, window)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	bm.fileSize = fi.Size()
+	return bm, nil
+}
+
+// An Allocation is the space a Manager has for a range of the target's
+// addresses: those of a VMA, or what's left of them.
+type Allocation struct {
+	VMAStart, VMASize uint64
+	Offset            TmpOffset
+}
+
+// Allocations returns the Manager's allocations, by address.
+func (bm *Manager) Allocations() []Allocation {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	allocs := make([]Allocation, len(bm.allocations))
+	for i, a := range bm.allocations {
+		allocs[i] = Allocation{VMAStart: a.start, VMASize: a.end - a.start, Offset: a.offset}
+	}
+	return allocs
+}
+
+// Restore takes up allocs, the Allocations of an earlier Manager of the
+// same file, so what that one buffered can be read, or overwritten, at the
+// same offsets. It must be called before anything is allocated.
+func (bm *Manager) Restore(allocs []Allocation) error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if len(bm.allocations) > 0 || bm.z != nil || bm.rec != nil {
+		return fmt.Errorf("can't restore allocations into a buffer in use, or a compressed or record one")
+	}
+	allocs = slices.Clone(allocs)
+	slices.SortFunc(allocs, func(a, b Allocation) int { return cmp.Compare(a.VMAStart, b.VMAStart) })
+	for i, a := range allocs {
+		end := int64(a.Offset) + int64(a.VMASize)
+		if a.Offset < 0 || end > bm.fileSize || end > bm.window {
+			return fmt.Errorf("allocation of %d bytes at offset %d is past the end of the buffer", a.VMASize, a.Offset)
+		}
+		if i > 0 && a.VMAStart < allocs[i-1].VMAStart+allocs[i-1].VMASize {
+			return fmt.Errorf("allocations for %#x and %#x overlap", allocs[i-1].VMAStart, a.VMAStart)
+		}
+		bm.allocations = append(bm.allocations, allocation{start: a.VMAStart, end: a.VMAStart + a.VMASize, offset: a.Offset})
+		bm.nextOffset = max(bm.nextOffset, TmpOffset(end))
+	}
+	return nil
+}
+
+// newMmapManager returns a Manager that buffers in file through an mmap
+// of window bytes.
+func newMmapManager(file *os.File, window int64) (*Manager, error) {
+	// Get filesystem block size for alignment
+	fsBlockSize, err := getFilesystemBlockSize(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get filesystem block size: %w", err)
+	}
+
+	// Reserve the whole window in the mmap for direct writes. Only the
+	// part the file has grown to may be touched; past it, access faults.
+	mmapSize := (window + growChunk - 1) &^ (growChunk - 1)
+	mmapData, err := unix.Mmap(int(file.Fd()), 0, int(mmapSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mmap a %d GB scratch window (try a smaller one): %w", mmapSize>>30, err)
 	}
 
 	bm := &Manager{
-		file:        tempFile,
-		allocations: make(map[offAndSize]TmpOffset),
+		file:        file,
 		nextOffset:  0,
 		fsBlockSize: fsBlockSize,
+		window:      window,
 		mmapData:    mmapData,
 		mmapSize:    mmapSize,
 	}
@@ -78,6 +252,71 @@ func NewBufferManager(outputFile string) (*Manager, error) {
 	return bm, nil
 }
 
+// Reserve keeps the first n bytes of the file out of allocations, such as
+// for headers to be written there later. It must be called before
+// anything is allocated.
+func (bm *Manager) Reserve(n uint64) error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if len(bm.allocations) > 0 {
+		return fmt.Errorf("can't reserve space after allocating some")
+	}
+	bm.nextOffset = TmpOffset(n)
+	return nil
+}
+
+// NewCompressedBufferManager is like NewBufferManager, but keeps the
+// buffered pages lz4-compressed in the temp file, trading CPU for scratch
+// disk space. Its buffer can't be accessed through GetMmapPointer.
+func NewCompressedBufferManager(dir string, window int64) (*Manager, error) {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	tempFile, err := os.CreateTemp(dir, "livecore-buffer-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	os.Remove(tempFile.Name())
+	return newCompressedManager(tempFile, window), nil
+}
+
+// newCompressedManager returns a Manager that keeps pages compressed in
+// file.
+func newCompressedManager(file *os.File, window int64) *Manager {
+	// Allocations need only be page-aligned; they're never on disk.
+	return &Manager{
+		file:        file,
+		fsBlockSize: uint64(os.Getpagesize()),
+		window:      window,
+		z:           newCompressedStore(file),
+	}
+}
+
+// NewMemoryBufferManager is like NewBufferManager, or if compressed,
+// NewCompressedBufferManager, but buffers in memory, in a memfd, rather
+// than in a file on disk, so that filling it does no disk I/O. Its pages
+// count as shared memory, and can be swapped out. Don't SetMinFree on it:
+// a memfd's filesystem reports no free space.
+func NewMemoryBufferManager(window int64, compressed bool) (*Manager, error) {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	fd, err := unix.MemfdCreate("livecore-buffer", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create memfd: %w", err)
+	}
+	file := os.NewFile(uintptr(fd), "livecore-buffer")
+	if compressed {
+		return newCompressedManager(file, window), nil
+	}
+	bm, err := newMmapManager(file, window)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return bm, nil
+}
+
 // getFilesystemBlockSize gets the filesystem block size for the given file
 func getFilesystemBlockSize(file *os.File) (uint64, error) {
 	var stat syscall.Stat_t
@@ -87,45 +326,199 @@ func getFilesystemBlockSize(file *os.File) (uint64, error) {
 	return uint64(stat.Blksize), nil
 }
 
-// GetOffsetForVMA returns the offset in the temp file for the given VMA.
-func (bm *Manager) GetOffsetForVMA(vmaStart, vmaSize uint64) TmpOffset {
+// GetOffsetForVMA returns the offset in the temp file for the given VMA,
+// allocating space for it the first time. A VMA within the range of an
+// earlier allocation, such as one made for it before it shrank or was
+// split, is found there. Otherwise, what earlier allocations hold of its
+// range, such as before it grew or was merged with another, is moved into
+// the new one. It fails, wrapping ErrWindowFull, if there's no room left
+// in the window.
+func (bm *Manager) GetOffsetForVMA(vmaStart, vmaSize uint64) (TmpOffset, error) {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
 
-	key := offAndSize{Offset: vmaStart, Size: vmaSize}
-
-	if offset, ok := bm.allocations[key]; ok {
-		return offset
+	vmaEnd := vmaStart + vmaSize
+	if offset, ok := bm.lookup(vmaStart, vmaEnd); ok {
+		return offset, nil
 	}
 
 	// Allocate new space, aligned to filesystem block size
 	alignedOffset := TmpOffset((bm.nextOffset + TmpOffset(bm.fsBlockSize) - 1) &^ (TmpOffset(bm.fsBlockSize) - 1))
-	bm.allocations[key] = alignedOffset
-	bm.nextOffset = alignedOffset + TmpOffset(vmaSize)
+	end := int64(alignedOffset) + int64(vmaSize)
+	if end > bm.window {
+		return 0, fmt.Errorf("%w: %d MB allocated, need %d MB more, window is %d MB", ErrWindowFull, alignedOffset>>20, vmaSize>>20, bm.window>>20)
+	}
+	if bm.z == nil && bm.rec == nil && end > bm.fileSize {
+		size := min((end+growChunk-1)&^(growChunk-1), bm.mmapSize)
+		if err := bm.file.Truncate(size); err != nil {
+			return 0, fmt.Errorf("failed to grow temp file to %d MB: %w", size>>20, err)
+		}
+		bm.fileSize = size
+	}
+	for _, a := range bm.forget(vmaStart, vmaEnd) {
+		if err := bm.move(alignedOffset+TmpOffset(a.start-vmaStart), a.offset, a.end-a.start); err != nil {
+			return 0, fmt.Errorf("failed to move buffered pages at %#x: %w", a.start, err)
+		}
+	}
+	bm.allocations = slices.Insert(bm.allocations, bm.find(vmaStart), allocation{start: vmaStart, end: vmaEnd, offset: alignedOffset})
+	bm.nextOffset = TmpOffset(end)
+
+	return alignedOffset, nil
+}
+
+// find returns the index of the first allocation that ends after addr.
+func (bm *Manager) find(addr uint64) int {
+	return sort.Search(len(bm.allocations), func(i int) bool { return bm.allocations[i].end > addr })
+}
 
-	// File is already large enough (512GB), no need to extend
+// lookup returns where the bytes of [start, end) are in the temp file, if
+// they're all within one allocation.
+func (bm *Manager) lookup(start, end uint64) (TmpOffset, bool) {
+	if i := bm.find(start); i < len(bm.allocations) {
+		if a := bm.allocations[i]; a.start <= start && end <= a.end {
+			return a.offset + TmpOffset(start-a.start), true
+		}
+	}
+	return 0, false
+}
 
-	return alignedOffset
+// forget takes [start, end) out of the allocations, trimming or splitting
+// those it overlaps, and returns the parts taken out.
+func (bm *Manager) forget(start, end uint64) []allocation {
+	i := bm.find(start)
+	var forgotten, kept []allocation
+	j := i
+	for ; j < len(bm.allocations) && bm.allocations[j].start < end; j++ {
+		a := bm.allocations[j]
+		if a.start < start {
+			kept = append(kept, allocation{start: a.start, end: start, offset: a.offset})
+		}
+		s, e := max(a.start, start), min(a.end, end)
+		forgotten = append(forgotten, allocation{start: s, end: e, offset: a.offset + TmpOffset(s-a.start)})
+		if a.end > end {
+			kept = append(kept, allocation{start: end, end: a.end, offset: a.offset + TmpOffset(end-a.start)})
+		}
+	}
+	bm.allocations = slices.Replace(bm.allocations, i, j, kept...)
+	return forgotten
+}
+
+// Discard forgets the size bytes of the target's memory at start: their
+// space in the temp file is punched out, and a VMA allocated over them
+// again starts out with holes there, rather than what was copied. It's
+// for memory that's no longer mapped, or no longer the mapping copied.
+func (bm *Manager) Discard(start, size uint64) error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	for _, a := range bm.forget(start, start+size) {
+		if err := bm.PunchHole(a.offset, a.end-a.start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Allocated returns how much of the window has been allocated.
+func (bm *Manager) Allocated() uint64 {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return uint64(bm.nextOffset)
+}
+
+// DiskUsage returns how much disk space the temp file takes up: the
+// pages filled and not since punched out, or for a compressed buffer,
+// what they compressed to. A record Manager has no temp file.
+func (bm *Manager) DiskUsage() (uint64, error) {
+	if bm.rec != nil {
+		return 0, nil
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(int(bm.file.Fd()), &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Blocks) * 512, nil
 }
 
 // GetMmapPointer returns a pointer to the mmap data at the given offset.
 func (bm *Manager) GetMmapPointer(offset TmpOffset) (unsafe.Pointer, error) {
+	if bm.z != nil {
+		return nil, fmt.Errorf("compressed buffer has no mmap")
+	}
+	if bm.rec != nil {
+		return nil, fmt.Errorf("%w: it has no mmap", ErrNoReadBack)
+	}
 	if int64(offset) >= bm.mmapSize {
 		return nil, fmt.Errorf("offset %d exceeds mmap size %d", offset, bm.mmapSize)
 	}
 	return unsafe.Pointer(&bm.mmapData[offset]), nil
 }
 
-// GetExistingOffsetForVMA returns the offset in the temp file for the given VMA if it exists.
+// Fill stores size bytes at offset in the temp buffer, calling fill to
+// produce them. fill is passed a slice to fill in and that slice's offset
+// relative to offset; it may be called several times, for consecutive
+// parts of the range. If fill returns an error, Fill stops and returns it.
+//
+// Without compression, fill writes straight into the mmap, so on error
+// the range may be partly updated. With compression, ranges must be
+// page-aligned.
+func (bm *Manager) Fill(offset TmpOffset, size uint64, fill func(dst []byte, off uint64) error) error {
+	if err := bm.checkSpace(size); err != nil {
+		return err
+	}
+	if bm.z != nil {
+		return bm.z.fill(offset, size, fill)
+	}
+	if bm.rec != nil {
+		return bm.rec.fill(offset, size, fill)
+	}
+	if int64(offset)+int64(size) > bm.mmapSize {
+		return fmt.Errorf("offset %d + size %d exceeds mmap size %d", offset, size, bm.mmapSize)
+	}
+	return fill(bm.mmapData[offset:offset+TmpOffset(size)], 0)
+}
+
+// GetExistingOffsetForVMA returns the offset in the temp file for the
+// given VMA if it's all within one allocation; see GetOffsetForVMA.
 func (bm *Manager) GetExistingOffsetForVMA(vmaStart, vmaSize uint64) (tmpOffset TmpOffset, ok bool) {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
-	tmpOffset, ok = bm.allocations[offAndSize{Offset: vmaStart, Size: vmaSize}]
-	return
+	return bm.lookup(vmaStart, vmaStart+vmaSize)
+}
+
+// move moves size bytes at src in the temp file to dst, which mustn't
+// overlap it, leaving a hole at src. Holes in src stay holes in dst.
+func (bm *Manager) move(dst, src TmpOffset, size uint64) error {
+	if bm.z != nil {
+		return bm.z.move(dst, src, size)
+	}
+	if bm.rec != nil {
+		return bm.rec.move(dst, src, size)
+	}
+	if int64(max(dst, src))+int64(size) > bm.mmapSize {
+		return fmt.Errorf("offset %d + size %d exceeds mmap size %d", max(dst, src), size, bm.mmapSize)
+	}
+	extents, err := bm.DataExtents(src, size)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if err := bm.checkSpace(e.Length); err != nil {
+			return err
+		}
+		from, to := src+TmpOffset(e.Offset), dst+TmpOffset(e.Offset)
+		copy(bm.mmapData[to:to+TmpOffset(e.Length)], bm.mmapData[from:from+TmpOffset(e.Length)])
+	}
+	return bm.PunchHole(src, size)
 }
 
 // PunchHole punches a hole in the temp file to free disk space.
 func (bm *Manager) PunchHole(offset TmpOffset, length uint64) error {
+	if bm.z != nil {
+		return bm.z.punchHole(offset, length)
+	}
+	if bm.rec != nil {
+		return bm.rec.zero(offset, length)
+	}
 	// Use fallocate with FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE
 	// This requires the file to be opened with O_RDWR
 	err := unix.Fallocate(int(bm.file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, int64(offset), int64(length))
@@ -135,13 +528,79 @@ func (bm *Manager) PunchHole(offset TmpOffset, length uint64) error {
 	return nil
 }
 
+// Extent is a run of data in the temp file, relative to the start of the
+// range passed to DataExtents.
+type Extent struct {
+	Offset uint64
+	Length uint64
+}
+
+// DataExtents returns the runs of [offset, offset+size) in the temp file
+// that hold data, as reported by SEEK_DATA/SEEK_HOLE. Pages that were never
+// written are holes; callers can skip them and leave holes in the output.
+//
+// If the filesystem can't report holes, the whole range is returned as data.
+func (bm *Manager) DataExtents(offset TmpOffset, size uint64) ([]Extent, error) {
+	if bm.z != nil {
+		return bm.z.dataExtents(offset, size)
+	}
+	if bm.rec != nil {
+		return nil, ErrNoReadBack
+	}
+	fd := int(bm.file.Fd())
+	end := int64(offset) + int64(size)
+
+	var extents []Extent
+	for pos := int64(offset); pos < end; {
+		data, err := unix.Seek(fd, pos, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // no more data in the file
+		}
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return []Extent{{Offset: 0, Length: size}}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek to data at offset %d: %w", pos, err)
+		}
+		if data >= end {
+			break
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seek to hole at offset %d: %w", data, err)
+		}
+		hole = min(hole, end)
+		extents = append(extents, Extent{
+			Offset: uint64(data - int64(offset)),
+			Length: uint64(hole - data),
+		})
+		pos = hole
+	}
+	return extents, nil
+}
+
+// Zero overwrites length bytes at offset in the temp file with zeros.
+func (bm *Manager) Zero(offset TmpOffset, length uint64) error {
+	if bm.z != nil {
+		return bm.z.zero(offset, length)
+	}
+	if bm.rec != nil {
+		return bm.rec.zero(offset, length)
+	}
+	if int64(offset)+int64(length) > bm.mmapSize {
+		return fmt.Errorf("offset %d + size %d exceeds mmap size %d", offset, length, bm.mmapSize)
+	}
+	clear(bm.mmapData[offset : offset+TmpOffset(length)])
+	return nil
+}
+
 // Close closes the BufferManager and cleans up the temp file.
 func (bm *Manager) Close() error {
 	if bm.mmapData != nil {
 		unix.Munmap(bm.mmapData)
 		bm.mmapData = nil
 	}
-	if bm.file != nil {
+	if bm.file != nil && !bm.borrowed {
 		bm.file.Close()
 	}
 	return nil
@@ -149,7 +608,25 @@ func (bm *Manager) Close() error {
 
 // WriteDataTo writes data directly from the mmap buffer to the given io.WriterAt.
 // This avoids allocations by writing directly from the mmapped memory.
+// If writer is a file, the data is moved in the kernel instead, where it
+// can be: see copyToFile.
 func (bm *Manager) WriteDataTo(writer io.WriterAt, writerOffset int64, tmpOffset TmpOffset, size uint64) error {
+	if bm.z != nil {
+		return bm.z.writeTo(writer, writerOffset, tmpOffset, size)
+	}
+	if bm.rec != nil {
+		return ErrNoReadBack
+	}
+	if f, ok := writer.(*os.File); ok {
+		n, err := bm.copyToFile(f, writerOffset, tmpOffset, size)
+		if err != nil {
+			return err
+		}
+		writerOffset, tmpOffset, size = writerOffset+int64(n), tmpOffset+TmpOffset(n), size-n
+		if size == 0 {
+			return nil
+		}
+	}
 	// Check bounds carefully to avoid SIGBUS
 	if int64(tmpOffset) >= bm.mmapSize {
 		return fmt.Errorf("offset %d exceeds mmap size %d", tmpOffset, bm.mmapSize)
@@ -163,8 +640,64 @@ func (bm *Manager) WriteDataTo(writer io.WriterAt, writerOffset int64, tmpOffset
 	return err
 }
 
+// copyToFile copies size bytes at tmpOffset to f at off without passing
+// them through userspace: by sharing the blocks with FICLONERANGE, on a
+// filesystem with reflinks, when the ranges are block-aligned, or else
+// with copy_file_range, which the filesystem may also do by reflink or
+// on the storage. It returns how much it copied, which falls short if the
+// kernel can't do either for these files, such as when they're on
+// different filesystems; the rest is for the caller to write.
+func (bm *Manager) copyToFile(f *os.File, off int64, tmpOffset TmpOffset, size uint64) (uint64, error) {
+	srcFd, dstFd := int(bm.file.Fd()), int(f.Fd())
+	block := int64(bm.fsBlockSize)
+	if !bm.noClone.Load() && off%block == 0 && int64(tmpOffset)%block == 0 && int64(size)%block == 0 {
+		err := unix.IoctlFileCloneRange(dstFd, &unix.FileCloneRange{
+			Src_fd:      int64(srcFd),
+			Src_offset:  uint64(tmpOffset),
+			Src_length:  size,
+			Dest_offset: uint64(off),
+		})
+		if err == nil {
+			return size, nil
+		}
+		if !errors.Is(err, unix.EINVAL) {
+			// Not a reflink filesystem, or not the same one; EINVAL
+			// could be just this range's alignment.
+			bm.noClone.Store(true)
+		}
+	}
+
+	var copied uint64
+	for copied < size && !bm.noCopyRange.Load() {
+		srcOff, dstOff := int64(tmpOffset)+int64(copied), off+int64(copied)
+		n, err := unix.CopyFileRange(srcFd, &srcOff, dstFd, &dstOff, int(min(size-copied, 1<<30)), 0)
+		switch {
+		case errors.Is(err, unix.EXDEV), errors.Is(err, unix.EINVAL), errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.ENOSYS):
+			bm.noCopyRange.Store(true)
+		case err != nil:
+			return copied, fmt.Errorf("failed to copy %d bytes at offset %d: %w", size-copied, off+int64(copied), err)
+		case n == 0:
+			return copied, nil // shouldn't happen; let the caller write it
+		}
+		copied += uint64(max(n, 0))
+	}
+	return copied, nil
+}
+
 // WriteData writes data to the temp file at the given offset.
 func (bm *Manager) WriteData(offset TmpOffset, data []byte) error {
+	if err := bm.checkSpace(uint64(len(data))); err != nil {
+		return err
+	}
+	if bm.z != nil {
+		return bm.z.fill(offset, uint64(len(data)), func(dst []byte, off uint64) error {
+			copy(dst, data[off:])
+			return nil
+		})
+	}
+	if bm.rec != nil {
+		return bm.rec.writeData(offset, data)
+	}
 	_, err := bm.file.WriteAt(data, int64(offset))
 	if err != nil {
 		return fmt.Errorf("failed to write data at offset %d: %w", offset, err)
@@ -0,0 +1,373 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// recordStore writes what's put in the temp buffer to a stream of records
+// instead of keeping it, for dumps with no room for a scratch buffer.
+// Replaying the records in order, with ReplayRecords, rebuilds the buffer
+// as it would have been.
+//
+// The stream starts with recordMagic. Each record is a kind byte followed
+// by little-endian uint64s: for recData, the temp offset and length, then
+// the bytes; for recZero, the offset and length of a range that reads as
+// zeros; for recMove, the destination, source, and length of a move. The
+// last is recEnd: the number of allocations, each as its address, size,
+// and offset, and then the length of an opaque payload and the payload.
+type recordStore struct {
+	pageSize int
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	err     error  // the first write error; every later write fails with it
+	written uint64 // bytes written, including headers
+
+	scratch []byte // fill buffer, fillChunk bytes
+}
+
+// recordMagic starts a record stream.
+const recordMagic = "LCRECS1\n"
+
+// Record kinds.
+const (
+	recData byte = iota + 1
+	recZero
+	recMove
+	recEnd
+)
+
+// ErrNoReadBack is returned (wrapped) when a Manager that writes records
+// is asked for what it holds.
+var ErrNoReadBack = errors.New("a record stream can't be read back")
+
+func newRecordStore(w io.Writer) *recordStore {
+	rs := &recordStore{
+		pageSize: os.Getpagesize(),
+		w:        bufio.NewWriterSize(w, fillChunk),
+		scratch:  make([]byte, fillChunk),
+	}
+	rs.write([]byte(recordMagic))
+	return rs
+}
+
+// write writes b to the stream, unless an earlier write failed.
+func (rs *recordStore) write(b []byte) {
+	if rs.err != nil {
+		return
+	}
+	n, err := rs.w.Write(b)
+	rs.written += uint64(n)
+	if err != nil {
+		rs.err = fmt.Errorf("failed to write records: %w", err)
+	}
+}
+
+// header writes a record of kind kind with fields, but not its data.
+func (rs *recordStore) header(kind byte, fields ...uint64) {
+	buf := make([]byte, 1, 1+8*len(fields))
+	buf[0] = kind
+	for _, f := range fields {
+		buf = binary.LittleEndian.AppendUint64(buf, f)
+	}
+	rs.write(buf)
+}
+
+// data writes b, which is at offset, as recData records for its runs of
+// pages with data and recZero ones for its runs of zero pages.
+func (rs *recordStore) data(offset TmpOffset, b []byte) {
+	for len(b) > 0 {
+		zero := isZero(b[:min(rs.pageSize, len(b))])
+		n := 0
+		for n < len(b) && isZero(b[n:min(n+rs.pageSize, len(b))]) == zero {
+			n = min(n+rs.pageSize, len(b))
+		}
+		if zero {
+			rs.header(recZero, uint64(offset), uint64(n))
+		} else {
+			rs.header(recData, uint64(offset), uint64(n))
+			rs.write(b[:n])
+		}
+		offset, b = offset+TmpOffset(n), b[n:]
+	}
+}
+
+func (rs *recordStore) fill(offset TmpOffset, size uint64, fill func(dst []byte, off uint64) error) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for off := uint64(0); off < size; off += fillChunk {
+		dst := rs.scratch[:min(fillChunk, size-off)]
+		if err := fill(dst, off); err != nil {
+			return err
+		}
+		rs.data(offset+TmpOffset(off), dst)
+	}
+	return rs.err
+}
+
+func (rs *recordStore) writeData(offset TmpOffset, b []byte) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.data(offset, b)
+	return rs.err
+}
+
+func (rs *recordStore) zero(offset TmpOffset, length uint64) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.header(recZero, uint64(offset), length)
+	return rs.err
+}
+
+func (rs *recordStore) move(dst, src TmpOffset, size uint64) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.header(recMove, uint64(dst), uint64(src), size)
+	return rs.err
+}
+
+// finish writes the recEnd record and flushes the stream.
+func (rs *recordStore) finish(allocs []Allocation, payload []byte) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	fields := []uint64{uint64(len(allocs))}
+	for _, a := range allocs {
+		fields = append(fields, a.VMAStart, a.VMASize, uint64(a.Offset))
+	}
+	rs.header(recEnd, append(fields, uint64(len(payload)))...)
+	rs.write(payload)
+	if rs.err == nil {
+		if err := rs.w.Flush(); err != nil {
+			rs.err = fmt.Errorf("failed to write records: %w", err)
+		}
+	}
+	return rs.err
+}
+
+// NewRecordManager returns a Manager that keeps nothing: what's put in
+// it is written to w as it comes, as a stream of records, so there's no
+// scratch buffer to fill. Its allocations may add up to window bytes, or
+// DefaultWindow if it's 0. What it's given can't be read back; FinishRecords
+// ends the stream, and ReplayRecords turns it back into a Manager that
+// holds it all.
+func NewRecordManager(w io.Writer, window int64) *Manager {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	// Allocations need only be page-aligned; they're never on disk.
+	return &Manager{
+		fsBlockSize: uint64(os.Getpagesize()),
+		window:      window,
+		rec:         newRecordStore(w),
+	}
+}
+
+// FinishRecords ends a record Manager's stream with its allocations and
+// payload, which ReplayRecords returns as is.
+func (bm *Manager) FinishRecords(payload []byte) error {
+	if bm.rec == nil {
+		return fmt.Errorf("buffer doesn't write records")
+	}
+	return bm.rec.finish(bm.Allocations(), payload)
+}
+
+// RecordsWritten returns how many bytes a record Manager has written.
+func (bm *Manager) RecordsWritten() uint64 {
+	if bm.rec == nil {
+		return 0
+	}
+	bm.rec.mu.Lock()
+	defer bm.rec.mu.Unlock()
+	return bm.rec.written
+}
+
+// ReplayRecords reads a record stream from r, as written by a Manager
+// from NewRecordManager, and applies it to a temp file in dir, returning
+// a Manager of that file with the recorded allocations, and the stream's
+// payload. Its window is window, or DefaultWindow if it's 0, or more if
+// the allocations need it.
+func ReplayRecords(r io.Reader, dir string, window int64) (*Manager, []byte, error) {
+	br := bufio.NewReaderSize(r, fillChunk)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordMagic {
+		return nil, nil, fmt.Errorf("not a livecore record stream")
+	}
+
+	file, err := os.CreateTemp(dir, "livecore-buffer-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	os.Remove(file.Name())
+	allocs, payload, err := replay(br, file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	var end int64
+	for _, a := range allocs {
+		end = max(end, int64(a.Offset)+int64(a.VMASize))
+	}
+	if err := file.Truncate(max(end, 0)); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to size temp file: %w", err)
+	}
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	bm, err := newMmapManager(file, max(window, end))
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	bm.fileSize = end
+	if err := bm.Restore(allocs); err != nil {
+		bm.Close()
+		return nil, nil, err
+	}
+	return bm, payload, nil
+}
+
+// replay applies the records in r to file, up to and including the
+// recEnd record, whose allocations and payload it returns.
+func replay(r *bufio.Reader, file *os.File) ([]Allocation, []byte, error) {
+	fields := func(n int) ([]uint64, error) {
+		buf := make([]byte, 8*n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		f := make([]uint64, n)
+		for i := range f {
+			f[i] = binary.LittleEndian.Uint64(buf[8*i:])
+		}
+		return f, nil
+	}
+	buf := make([]byte, fillChunk)
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("record stream ends without its end record: %w", err)
+		}
+		switch kind {
+		case recData:
+			f, err := fields(2)
+			if err != nil {
+				return nil, nil, fmt.Errorf("truncated data record: %w", err)
+			}
+			for off, n := int64(f[0]), f[1]; n > 0; {
+				b := buf[:min(n, uint64(len(buf)))]
+				if _, err := io.ReadFull(r, b); err != nil {
+					return nil, nil, fmt.Errorf("truncated data record: %w", err)
+				}
+				if _, err := file.WriteAt(b, off); err != nil {
+					return nil, nil, fmt.Errorf("failed to write temp file: %w", err)
+				}
+				off, n = off+int64(len(b)), n-uint64(len(b))
+			}
+		case recZero:
+			f, err := fields(2)
+			if err != nil {
+				return nil, nil, fmt.Errorf("truncated zero record: %w", err)
+			}
+			if err := zeroRange(file, int64(f[0]), int64(f[1])); err != nil {
+				return nil, nil, err
+			}
+		case recMove:
+			f, err := fields(3)
+			if err != nil {
+				return nil, nil, fmt.Errorf("truncated move record: %w", err)
+			}
+			if err := moveRange(file, int64(f[0]), int64(f[1]), int64(f[2]), buf); err != nil {
+				return nil, nil, err
+			}
+		case recEnd:
+			f, err := fields(1)
+			if err != nil {
+				return nil, nil, fmt.Errorf("truncated end record: %w", err)
+			}
+			if f[0] > 1<<24 {
+				return nil, nil, fmt.Errorf("end record has %d allocations", f[0])
+			}
+			a, err := fields(3 * int(f[0]))
+			if err != nil {
+				return nil, nil, fmt.Errorf("truncated end record: %w", err)
+			}
+			allocs := make([]Allocation, f[0])
+			for i := range allocs {
+				allocs[i] = Allocation{VMAStart: a[3*i], VMASize: a[3*i+1], Offset: TmpOffset(a[3*i+2])}
+			}
+			if f, err = fields(1); err != nil {
+				return nil, nil, fmt.Errorf("truncated end record: %w", err)
+			}
+			if f[0] > 1<<30 {
+				return nil, nil, fmt.Errorf("end record has a %d-byte payload", f[0])
+			}
+			payload := make([]byte, f[0])
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return nil, nil, fmt.Errorf("truncated end record: %w", err)
+			}
+			return allocs, payload, nil
+		default:
+			return nil, nil, fmt.Errorf("unknown record kind %d", kind)
+		}
+	}
+}
+
+// zeroRange makes [off, off+n) of file read as zeros, punching out the
+// whole pages in it and writing zeros over the partial ones.
+func zeroRange(file *os.File, off, n int64) error {
+	ps := int64(os.Getpagesize())
+	start, end := (off+ps-1)&^(ps-1), (off+n)&^(ps-1)
+	if start >= end {
+		start, end = off+n, off+n
+	}
+	for _, r := range [][2]int64{{off, start}, {end, off + n}} {
+		if r[1] > r[0] {
+			if _, err := file.WriteAt(make([]byte, r[1]-r[0]), r[0]); err != nil {
+				return fmt.Errorf("failed to write temp file: %w", err)
+			}
+		}
+	}
+	if end > start {
+		if err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, start, end-start); err != nil {
+			return fmt.Errorf("failed to punch hole at offset %d length %d: %w", start, end-start, err)
+		}
+	}
+	return nil
+}
+
+// moveRange moves n bytes of file at src to dst, as Manager.move does,
+// through buf.
+func moveRange(file *os.File, dst, src, n int64, buf []byte) error {
+	ps := int64(os.Getpagesize())
+	if err := zeroRange(file, dst, n); err != nil {
+		return err
+	}
+	for off := int64(0); off < n; off += int64(len(buf)) {
+		b := buf[:min(int64(len(buf)), n-off)]
+		m, err := file.ReadAt(b, src+off)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read temp file: %w", err)
+		}
+		// Zero pages stay holes.
+		for p := 0; p < m; p += int(ps) {
+			page := b[p:min(p+int(ps), m)]
+			if isZero(page) {
+				continue
+			}
+			if _, err := file.WriteAt(page, dst+off+int64(p)); err != nil {
+				return fmt.Errorf("failed to write temp file: %w", err)
+			}
+		}
+	}
+	return zeroRange(file, src, n)
+}
@@ -0,0 +1,134 @@
+package buffer
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// pattern returns n bytes that aren't zero, differing with seed.
+func pattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i>>12) ^ byte(i) ^ seed | 1
+	}
+	return b
+}
+
+func TestRecordsReplay(t *testing.T) {
+	ps := uint64(os.Getpagesize())
+	var stream bytes.Buffer
+	rec := NewRecordManager(&stream, 0)
+
+	// The same operations go to an ordinary Manager, whose contents the
+	// replayed one must match.
+	want, err := NewBufferManager(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer want.Close()
+
+	const a, b = 0x10000000, 0x20000000
+	for _, bm := range []*Manager{rec, want} {
+		off, err := bm.GetOffsetForVMA(a, 8*ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A pass with data, a zero page, and data again; then a later
+		// pass that changes one page.
+		data := pattern(int(8*ps), 1)
+		clear(data[3*ps : 4*ps])
+		if err := bm.WriteData(off, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := bm.Fill(off+TmpOffset(5*ps), ps, func(dst []byte, _ uint64) error {
+			copy(dst, pattern(len(dst), 2))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// Part of a page zeroed, and a page no longer mapped.
+		if err := bm.Zero(off+TmpOffset(ps)+10, 20); err != nil {
+			t.Fatal(err)
+		}
+		if err := bm.Discard(a+7*ps, ps); err != nil {
+			t.Fatal(err)
+		}
+
+		// A second VMA, which then grows over the first's range, moving
+		// what the first one has.
+		off, err = bm.GetOffsetForVMA(b, 2*ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bm.WriteData(off, pattern(int(2*ps), 3)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bm.GetOffsetForVMA(a, 4*ps); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bm.GetOffsetForVMA(a-2*ps, 12*ps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rec.DataExtents(0, ps); err == nil {
+		t.Error("DataExtents of a record Manager succeeded")
+	}
+	if err := rec.FinishRecords([]byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, payload, err := ReplayRecords(&stream, t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.Close()
+	if string(payload) != "payload" {
+		t.Errorf("payload = %q; want %q", payload, "payload")
+	}
+	if g, w := got.Allocations(), want.Allocations(); len(g) != len(w) {
+		t.Fatalf("replayed %d allocations; want %d", len(g), len(w))
+	}
+	for _, vma := range []struct{ start, size uint64 }{{a - 2*ps, 12 * ps}, {b, 2 * ps}} {
+		gotOff, ok := got.GetExistingOffsetForVMA(vma.start, vma.size)
+		if !ok {
+			t.Fatalf("replayed Manager has no allocation for %#x", vma.start)
+		}
+		wantOff, _ := want.GetExistingOffsetForVMA(vma.start, vma.size)
+		g, w := make([]byte, vma.size), make([]byte, vma.size)
+		if err := got.WriteDataTo(sliceWriterAt(g), 0, gotOff, vma.size); err != nil {
+			t.Fatal(err)
+		}
+		if err := want.WriteDataTo(sliceWriterAt(w), 0, wantOff, vma.size); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(g, w) {
+			t.Errorf("replayed contents of %#x differ", vma.start)
+		}
+		ge, err := got.DataExtents(gotOff, vma.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n uint64
+		for _, e := range ge {
+			n += e.Length
+		}
+		if n == vma.size && vma.start != b {
+			t.Errorf("replayed %#x has no holes", vma.start)
+		}
+	}
+
+	stream.Reset()
+	stream.WriteString(recordMagic)
+	stream.Write([]byte{recData, 0})
+	if _, _, err := ReplayRecords(&stream, t.TempDir(), 0); err == nil {
+		t.Error("replaying a truncated stream succeeded")
+	}
+}
+
+// sliceWriterAt is an io.WriterAt into a byte slice.
+type sliceWriterAt []byte
+
+func (s sliceWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(s[off:], p), nil
+}
@@ -0,0 +1,206 @@
+package copy
+
+import (
+	"iter"
+	"math/bits"
+
+	"github.com/bradfitz/livecore/internal/vmaindex"
+)
+
+// DirtySet is a set of dirty pages, stored as one bitmap per VMA.
+//
+// At one bit per page it stays small (32KB per GB of address space) and
+// allocation-free to iterate, unlike a map keyed by page address, which
+// costs ~50 bytes per dirty page and adds GC pressure on huge targets.
+type DirtySet struct {
+	pageSize int
+	vmas     []VMA
+	bits     [][]uint64 // bits[i] has one bit per page of vmas[i]
+	count    int
+
+	index *vmaindex.Index // over vmas; built on first lookup
+}
+
+// newDirtySet returns an empty DirtySet covering vmas.
+func newDirtySet(vmas []VMA, pageSize int) *DirtySet {
+	ds := &DirtySet{
+		pageSize: pageSize,
+		vmas:     vmas,
+		bits:     make([][]uint64, len(vmas)),
+	}
+	for i, vma := range vmas {
+		pages := (int(vma.End-vma.Start) + pageSize - 1) / pageSize
+		ds.bits[i] = make([]uint64, (pages+63)/64)
+	}
+	return ds
+}
+
+// reset empties ds and makes it cover vmas, reusing its bitmaps where
+// they're big enough.
+func (ds *DirtySet) reset(vmas []VMA) {
+	ds.vmas = vmas
+	ds.count = 0
+	ds.index = nil
+	if cap(ds.bits) < len(vmas) {
+		ds.bits = make([][]uint64, len(vmas))
+	}
+	ds.bits = ds.bits[:len(vmas)]
+	for i, vma := range vmas {
+		pages := (int(vma.End-vma.Start) + ds.pageSize - 1) / ds.pageSize
+		words := (pages + 63) / 64
+		if cap(ds.bits[i]) < words {
+			ds.bits[i] = make([]uint64, words)
+			continue
+		}
+		ds.bits[i] = ds.bits[i][:words]
+		clear(ds.bits[i])
+	}
+}
+
+// add marks page number page (counted from the start of vmas[i]) dirty.
+func (ds *DirtySet) add(i, page int) {
+	w, mask := page/64, uint64(1)<<(page%64)
+	if ds.bits[i][w]&mask == 0 {
+		ds.bits[i][w] |= mask
+		ds.count++
+	}
+}
+
+// addAll marks every page of vmas[i] dirty.
+func (ds *DirtySet) addAll(i int) {
+	pages := (int(ds.vmas[i].End-ds.vmas[i].Start) + ds.pageSize - 1) / ds.pageSize
+	words := ds.bits[i]
+	for w, word := range words {
+		ds.count -= bits.OnesCount64(word)
+		words[w] = ^uint64(0)
+	}
+	if rem := pages % 64; rem != 0 {
+		words[len(words)-1] = 1<<rem - 1
+	}
+	ds.count += pages
+}
+
+// addRanges marks the pages of rs, which lie within vmas[i], dirty.
+func (ds *DirtySet) addRanges(i int, rs []PageRange) {
+	start := ds.vmas[i].Start
+	for _, r := range rs {
+		for addr := r.Start; addr < r.End; addr += uintptr(ds.pageSize) {
+			ds.add(i, int(addr-start)/ds.pageSize)
+		}
+	}
+}
+
+// AddRange marks the pages of r dirty, leaving out any not in ds's VMAs.
+func (ds *DirtySet) AddRange(r PageRange) {
+	for addr := r.Start; addr < r.End; addr += uintptr(ds.pageSize) {
+		if i, ok := ds.lookup(addr); ok {
+			ds.add(i, int(addr-ds.vmas[i].Start)/ds.pageSize)
+		}
+	}
+}
+
+// Len returns the number of dirty pages in the set.
+func (ds *DirtySet) Len() int {
+	if ds == nil {
+		return 0
+	}
+	return ds.count
+}
+
+// Ratio returns the fraction of the pages covered by ds that are dirty.
+func (ds *DirtySet) Ratio() float64 {
+	if ds == nil {
+		return 0
+	}
+	total := 0
+	for _, vma := range ds.vmas {
+		total += (int(vma.End-vma.Start) + ds.pageSize - 1) / ds.pageSize
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(ds.count) / float64(total)
+}
+
+// Contains reports whether the page containing addr is dirty.
+func (ds *DirtySet) Contains(addr uintptr) bool {
+	if ds == nil {
+		return false
+	}
+	i, ok := ds.lookup(addr)
+	if !ok {
+		return false
+	}
+	page := int(addr-ds.vmas[i].Start) / ds.pageSize
+	return ds.bits[i][page/64]&(1<<(page%64)) != 0
+}
+
+// lookup returns the index of the VMA containing addr.
+func (ds *DirtySet) lookup(addr uintptr) (int, bool) {
+	if ds.index == nil {
+		ds.index = vmaindex.New(len(ds.vmas), func(i int) (uintptr, uintptr) {
+			return ds.vmas[i].Start, ds.vmas[i].End
+		})
+	}
+	return ds.index.Lookup(addr)
+}
+
+// Pages iterates over the dirty pages in address order, yielding each
+// page's address and the VMA containing it.
+func (ds *DirtySet) Pages() iter.Seq2[uintptr, *VMA] {
+	return func(yield func(uintptr, *VMA) bool) {
+		if ds == nil {
+			return
+		}
+		for i := range ds.bits {
+			for addr := range ds.vmaPages(i) {
+				if !yield(addr, &ds.vmas[i]) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Ranges iterates over runs of contiguous dirty pages in address order,
+// yielding each run and the VMA containing it. Runs never span VMAs.
+func (ds *DirtySet) Ranges() iter.Seq2[PageRange, *VMA] {
+	return func(yield func(PageRange, *VMA) bool) {
+		if ds == nil {
+			return
+		}
+		for i := range ds.bits {
+			vma := &ds.vmas[i]
+			var run PageRange
+			for addr := range ds.vmaPages(i) {
+				if run.End == addr {
+					run.End += uintptr(ds.pageSize)
+					continue
+				}
+				if run.End != 0 && !yield(run, vma) {
+					return
+				}
+				run = PageRange{Start: addr, End: addr + uintptr(ds.pageSize)}
+			}
+			if run.End != 0 && !yield(run, vma) {
+				return
+			}
+		}
+	}
+}
+
+// vmaPages iterates over the addresses of the dirty pages in vmas[i].
+func (ds *DirtySet) vmaPages(i int) iter.Seq[uintptr] {
+	return func(yield func(uintptr) bool) {
+		start := ds.vmas[i].Start
+		for w, word := range ds.bits[i] {
+			for word != 0 {
+				page := w*64 + bits.TrailingZeros64(word)
+				word &= word - 1
+				if !yield(start + uintptr(page*ds.pageSize)) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package copy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Failure is a run of pages that couldn't be read from the target.
+type Failure struct {
+	PageRange
+	VMAStart uintptr       // start of the VMA containing the pages
+	Errno    syscall.Errno // why, or 0 if the error wasn't an errno
+}
+
+// Failures collects page read failures, merging adjacent pages that
+// failed the same way. The zero value is ready to use.
+type Failures struct {
+	list []Failure
+}
+
+// Add records that the pages in r, in the VMA starting at vmaStart,
+// couldn't be read because of err.
+func (f *Failures) Add(r PageRange, vmaStart uintptr, err error) {
+	var errno syscall.Errno
+	errors.As(err, &errno)
+	if n := len(f.list); n > 0 {
+		last := &f.list[n-1]
+		if last.End == r.Start && last.VMAStart == vmaStart && last.Errno == errno {
+			last.End = r.End
+			return
+		}
+	}
+	f.list = append(f.list, Failure{PageRange: r, VMAStart: vmaStart, Errno: errno})
+}
+
+// List returns the recorded failures, in the order they happened.
+func (f *Failures) List() []Failure {
+	return f.list
+}
+
+// Bytes returns the total size of the pages that couldn't be read.
+func (f *Failures) Bytes() uint64 {
+	var n uint64
+	for _, fl := range f.list {
+		n += uint64(fl.End - fl.Start)
+	}
+	return n
+}
+
+// CopyBisecting calls copyRange to copy r. If that fails with an error
+// unreadable reports true, it splits r in two at a page boundary and
+// copies each half the same way, down to single pages, calling fail for
+// each page that can't be read, so one bad page in a huge mapping costs
+// only itself, in a number of reads that grows with the log of r's size.
+// Other errors are returned at once.
+func CopyBisecting(r PageRange, pageSize uintptr, copyRange func(PageRange) error, unreadable func(error) bool, fail func(PageRange, error)) error {
+	err := copyRange(r)
+	if err == nil || !unreadable(err) {
+		return err
+	}
+	pages := (r.End - r.Start) / pageSize
+	if pages <= 1 {
+		fail(r, err)
+		return nil
+	}
+	mid := r.Start + pages/2*pageSize
+	if err := CopyBisecting(PageRange{Start: r.Start, End: mid}, pageSize, copyRange, unreadable, fail); err != nil {
+		return err
+	}
+	return CopyBisecting(PageRange{Start: mid, End: r.End}, pageSize, copyRange, unreadable, fail)
+}
@@ -0,0 +1,487 @@
+package copy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/bradfitz/livecore/proc"
+	"golang.org/x/sys/unix"
+)
+
+// PageMap reads a process's pagemap: which pages are soft-dirty (written
+// since the last ClearSoftDirty), resident, or swapped out. It's livecore's
+// only pagemap reader. Where the kernel supports it, it asks with the
+// PAGEMAP_SCAN ioctl, which answers with ranges; otherwise it reads a
+// VMA's entries a chunk at a time.
+type PageMap struct {
+	pid      int
+	pageSize int
+
+	// Reused across calls, so repeated scans of a large target don't
+	// churn the heap.
+	file     *os.File     // /proc/<pid>/pagemap, opened on first use
+	scratch  []byte       // pagemap entries; see forEachChunk
+	ratioSet *DirtySet    // for CalculateDirtyRatio
+	regions  []pageRegion // for scan
+
+	noScan bool // the kernel doesn't support PAGEMAP_SCAN
+
+	residentOnly bool // report only resident dirty pages
+	skipSwapped  bool // don't report dirty pages that are swapped out
+}
+
+// NewPageMap creates a new PageMap for the given process
+func NewPageMap(pid int) *PageMap {
+	return &PageMap{
+		pid:      pid,
+		pageSize: GetPageSize(),
+	}
+}
+
+// SetResidentOnly makes GetDirtyPages report only dirty pages that are
+// resident, so copying them never faults anything in.
+func (pm *PageMap) SetResidentOnly(v bool) {
+	pm.residentOnly = v
+}
+
+// SetSkipSwapped makes GetDirtyPages leave out dirty pages that are
+// swapped out, so copying them never waits on swap.
+func (pm *PageMap) SetSkipSwapped(v bool) {
+	pm.skipSwapped = v
+}
+
+// Close closes the pagemap file, if it's open.
+func (pm *PageMap) Close() error {
+	if pm.file == nil {
+		return nil
+	}
+	err := pm.file.Close()
+	pm.file = nil
+	return err
+}
+
+// ClearSoftDirty clears the soft-dirty bits for the process
+func (pm *PageMap) ClearSoftDirty() error {
+	clearRefsPath := fmt.Sprintf("/proc/%d/clear_refs", pm.pid)
+	file, err := os.OpenFile(clearRefsPath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open clear_refs: %w", err)
+	}
+	defer file.Close()
+
+	// Write "4" to clear soft-dirty bits
+	if _, err := file.WriteString("4\n"); err != nil {
+		return fmt.Errorf("failed to clear soft-dirty bits: %w", err)
+	}
+
+	return nil
+}
+
+// SoftDirtySupported reports whether the kernel tracks soft-dirty pages
+// (CONFIG_MEM_SOFT_DIRTY). Without it, no page ever reads as soft-dirty,
+// so there's no telling which pages changed. It checks by writing to a
+// fresh page of its own and reading back the page's pagemap entry.
+func SoftDirtySupported() (bool, error) {
+	pageSize := GetPageSize()
+	mem, err := unix.Mmap(-1, 0, pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return false, fmt.Errorf("failed to map test page: %w", err)
+	}
+	defer unix.Munmap(mem)
+	mem[0] = 1
+
+	f, err := os.Open("/proc/self/pagemap")
+	if err != nil {
+		return false, fmt.Errorf("failed to open pagemap: %w", err)
+	}
+	defer f.Close()
+	var entry [8]byte
+	page := uintptr(unsafe.Pointer(&mem[0])) / uintptr(pageSize)
+	if _, err := f.ReadAt(entry[:], int64(page*8)); err != nil {
+		return false, fmt.Errorf("failed to read pagemap entry: %w", err)
+	}
+	return binary.LittleEndian.Uint64(entry[:])&pmSoftDirty != 0, nil
+}
+
+// GetDirtyPages reads the pagemap to find dirty pages. The kernel doesn't
+// track soft-dirty bits for hugetlb mappings, so all their pages that
+// have been faulted in count as dirty.
+func (pm *PageMap) GetDirtyPages(vmas []VMA) (*DirtySet, error) {
+	dirtyPages := newDirtySet(vmas, pm.pageSize)
+	if err := pm.scanDirty(vmas, dirtyPages, true); err != nil {
+		return nil, err
+	}
+	return dirtyPages, nil
+}
+
+// scanDirty adds the dirty pages of vmas to dirtyPages, which must cover
+// vmas. If huge is set, that includes every faulted-in page of the
+// hugetlb VMAs; otherwise they're left out.
+func (pm *PageMap) scanDirty(vmas []VMA, dirtyPages *DirtySet, huge bool) error {
+	// smaps answers cheaply for whole VMAs: ones created since the last
+	// clear_refs are entirely soft-dirty, and ones with nothing resident or
+	// swapped out can't have any soft-dirty pages. Only the rest need their
+	// pagemap entries read. If smaps can't be read, scan everything.
+	smaps, _ := proc.ParseSMaps(pm.pid)
+
+	for i, vma := range vmas {
+		if vma.HugePageSize != 0 {
+			if !huge {
+				continue
+			}
+			present, err := pm.PresentRanges(vma)
+			if err != nil {
+				return fmt.Errorf("failed to scan hugetlb VMA %x-%x: %w", vma.Start, vma.End, err)
+			}
+			dirtyPages.addRanges(i, present)
+			continue
+		}
+		if info, ok := smaps[vma.Start]; ok && info.Size*1024 == uint64(vma.End-vma.Start) {
+			if info.AllSoftDirty() && (!pm.residentOnly || info.RSS == info.Size) && (!pm.skipSwapped || info.Swap == 0) {
+				dirtyPages.addAll(i)
+				continue
+			}
+			if info.RSS == 0 && info.Swap == 0 {
+				continue
+			}
+		}
+		if err := pm.scanVMAForDirtyPages(vma, i, dirtyPages); err != nil {
+			return fmt.Errorf("failed to scan VMA %x-%x: %w", vma.Start, vma.End, err)
+		}
+	}
+
+	return nil
+}
+
+// Pagemap entry bits; see Documentation/admin-guide/mm/pagemap.rst.
+const (
+	pmPFN       = 1<<55 - 1 // page frame number, if resident; 0 without CAP_SYS_ADMIN
+	pmSoftDirty = 1 << 55
+	pmSwapped   = 1 << 62
+	pmPresent   = 1 << 63
+)
+
+// pagemapChunk is how many pagemap entries forEachChunk reads at a time:
+// 512KB of entries, covering 256MB of address space.
+const pagemapChunk = 64 << 10
+
+// open opens the pagemap file, if it isn't already.
+func (pm *PageMap) open() error {
+	if pm.file != nil {
+		return nil
+	}
+	file, err := os.Open(fmt.Sprintf("/proc/%d/pagemap", pm.pid))
+	if err != nil {
+		return fmt.Errorf("failed to open pagemap: %w", err)
+	}
+	pm.file = file
+	return nil
+}
+
+// forEachChunk reads the pagemap entries covering vma, a chunk at a time
+// into pm.scratch, and calls f with each chunk's page-aligned start
+// address and raw entries, 8 bytes per page. The entries are only valid
+// during the call. It returns the number of entries read, which is less
+// than the VMA's page count if the kernel reported fewer.
+func (pm *PageMap) forEachChunk(vma VMA, f func(start uintptr, entries []byte)) (int, error) {
+	if err := pm.open(); err != nil {
+		return 0, err
+	}
+	if pm.scratch == nil {
+		pm.scratch = make([]byte, pagemapChunk*8)
+	}
+
+	// Calculate page-aligned start and end
+	start := vma.Start &^ uintptr(pm.pageSize-1)
+	end := (vma.End + uintptr(pm.pageSize-1)) &^ uintptr(pm.pageSize-1)
+	numPages := int((end - start) / uintptr(pm.pageSize))
+
+	read := 0
+	for read < numPages {
+		buf := pm.scratch[:min(numPages-read, pagemapChunk)*8]
+		addr := start + uintptr(read*pm.pageSize)
+		n, err := pm.file.ReadAt(buf, int64(addr/uintptr(pm.pageSize)*8))
+		if n >= 8 {
+			f(addr, buf[:n&^7]) // only whole entries
+			read += n / 8
+		}
+		if err != nil {
+			// Skip ranges that can't be read (like vsyscall, etc.)
+			if err == io.EOF || n == 0 {
+				break
+			}
+			return read, fmt.Errorf("failed to read pagemap entries: %w", err)
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return read, nil
+}
+
+// scanVMAForDirtyPages scans vmas[i] for dirty pages using a reusable buffer
+func (pm *PageMap) scanVMAForDirtyPages(vma VMA, i int, dirtyPages *DirtySet) error {
+	want, categories := uint64(pmSoftDirty), uint64(pageIsSoftDirty)
+	if pm.residentOnly {
+		want |= pmPresent
+		categories |= pageIsPresent
+	}
+	var unwanted, notCategories uint64
+	if pm.skipSwapped {
+		unwanted, notCategories = pmSwapped, pageIsSwapped
+	}
+
+	first := int((vma.Start &^ uintptr(pm.pageSize-1)) / uintptr(pm.pageSize))
+	if ranges, ok, err := pm.scan(vma, categories, notCategories, 0); ok {
+		if err != nil {
+			return err
+		}
+		for _, r := range ranges {
+			for addr := r.Start; addr < r.End; addr += uintptr(pm.pageSize) {
+				dirtyPages.add(i, int(addr/uintptr(pm.pageSize))-first)
+			}
+		}
+		return nil
+	}
+
+	_, err := pm.forEachChunk(vma, func(start uintptr, entries []byte) {
+		base := int(start/uintptr(pm.pageSize)) - first
+		for page := range len(entries) / 8 {
+			// Bit 55 is the soft-dirty bit
+			if e := binary.LittleEndian.Uint64(entries[page*8:]); e&want == want && e&unwanted == 0 {
+				dirtyPages.add(i, base+page)
+			}
+		}
+	})
+	return err
+}
+
+// PageRange is a half-open range [Start, End) of page-aligned addresses.
+type PageRange struct {
+	Start uintptr
+	End   uintptr
+}
+
+// SubtractRanges returns the parts of rs not in holes. Both must be
+// sorted.
+func SubtractRanges(rs, holes []PageRange) []PageRange {
+	var result []PageRange
+	for _, r := range rs {
+		for len(holes) > 0 && holes[0].End <= r.Start {
+			holes = holes[1:]
+		}
+		for _, h := range holes {
+			if h.Start >= r.End {
+				break
+			}
+			if h.Start > r.Start {
+				result = append(result, PageRange{Start: r.Start, End: h.Start})
+			}
+			r.Start = max(r.Start, h.End)
+		}
+		if r.Start < r.End {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// PresentRanges returns the ranges of vma whose pages have been faulted in,
+// either resident (bit 63) or swapped out (bit 62). Pages that were never
+// touched read back as zeros, so callers can leave them as holes instead of
+// copying them.
+//
+// If the pagemap can't be read, the whole VMA is reported as present.
+func (pm *PageMap) PresentRanges(vma VMA) ([]PageRange, error) {
+	return pm.rangesWith(vma, false, pmPresent|pmSwapped, pageIsPresent|pageIsSwapped)
+}
+
+// ResidentRanges returns the ranges of vma whose pages are resident in
+// RAM (bit 63). Like PresentRanges, it reports any pages the pagemap
+// doesn't cover as resident.
+func (pm *PageMap) ResidentRanges(vma VMA) ([]PageRange, error) {
+	return pm.rangesWith(vma, false, pmPresent, pageIsPresent)
+}
+
+// SwappedRanges returns the ranges of vma whose pages are swapped out
+// (bit 62). Reading them faults them back in, waiting on the swap device.
+func (pm *PageMap) SwappedRanges(vma VMA) ([]PageRange, error) {
+	return pm.rangesWith(vma, false, pmSwapped, pageIsSwapped)
+}
+
+// SwappedDirtyRanges returns the ranges of vma whose pages are both
+// swapped out and soft-dirty: those a final copy would have to fault in.
+func (pm *PageMap) SwappedDirtyRanges(vma VMA) ([]PageRange, error) {
+	return pm.rangesWith(vma, true, pmSwapped|pmSoftDirty, pageIsSwapped|pageIsSoftDirty)
+}
+
+// PagesToCopy returns the ranges of vma worth copying, and how many bytes
+// of it map the zero page and so are left out. For anonymous memory,
+// that's only the pages that have been faulted in: never-touched pages
+// stay as holes in the temp file and end up as holes in the core.
+// Untouched file-backed pages still read back the file's contents, so
+// those VMAs are copied in full. With SetResidentOnly, only resident pages
+// are copied from any VMA, and with SetSkipSwapped, swapped-out pages are
+// left out.
+func (pm *PageMap) PagesToCopy(vma VMA) (ranges []PageRange, zeroPageBytes uint64, err error) {
+	ranges = []PageRange{{Start: vma.Start, End: vma.End}}
+	switch {
+	case pm.residentOnly:
+		ranges, err = pm.ResidentRanges(vma)
+	case vma.Anon || vma.HugePageSize != 0:
+		// Reading a hugetlb mapping's untouched pages would take huge
+		// pages from the pool to fill with zeros.
+		ranges, err = pm.PresentRanges(vma)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to find present pages: %w", err)
+	}
+	// Anonymous pages that have only been read map the shared zero page;
+	// they're zeros, so they're left as holes too.
+	if vma.Anon {
+		zero, err := pm.ZeroPageRanges(vma)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to find zero pages: %w", err)
+		}
+		for _, r := range zero {
+			zeroPageBytes += uint64(r.End - r.Start)
+		}
+		ranges = SubtractRanges(ranges, zero)
+	}
+	if pm.skipSwapped && !pm.residentOnly {
+		swapped, err := pm.SwappedRanges(vma)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to find swapped-out pages: %w", err)
+		}
+		ranges = SubtractRanges(ranges, swapped)
+	}
+	return ranges, zeroPageBytes, nil
+}
+
+// ZeroPageRanges returns the ranges of vma whose pages map the kernel's
+// shared zero page, or its huge zero page: anonymous pages that have been
+// read but never written. They read as zeros, so callers can leave them as
+// holes instead of copying them.
+//
+// Without PAGEMAP_SCAN, it compares pagemap PFNs with the zero page's,
+// which finds no huge zero pages, and nothing at all unless the kernel
+// shows this process PFNs, as it does only with CAP_SYS_ADMIN.
+func (pm *PageMap) ZeroPageRanges(vma VMA) ([]PageRange, error) {
+	if ranges, ok, err := pm.scan(vma, pageIsPFNZero, 0, 0); ok {
+		return ranges, err
+	}
+	zero, err := zeroPFN()
+	if err != nil || zero == 0 {
+		return nil, err
+	}
+
+	var ranges []PageRange
+	_, err = pm.forEachChunk(vma, func(chunkStart uintptr, entries []byte) {
+		for i := range len(entries) / 8 {
+			e := binary.LittleEndian.Uint64(entries[i*8:])
+			if e&pmPresent == 0 || e&pmPFN != zero {
+				continue
+			}
+			addr := chunkStart + uintptr(i*pm.pageSize)
+			if n := len(ranges); n > 0 && ranges[n-1].End == addr {
+				ranges[n-1].End += uintptr(pm.pageSize)
+			} else {
+				ranges = append(ranges, PageRange{Start: addr, End: addr + uintptr(pm.pageSize)})
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// zeroPFN returns the page frame number of the shared zero page, or 0 if
+// the kernel hides PFNs from this process. It finds it by mapping a page
+// of its own that's only ever read.
+var zeroPFN = sync.OnceValues(func() (uint64, error) {
+	pageSize := GetPageSize()
+	mem, err := unix.Mmap(-1, 0, pageSize, unix.PROT_READ, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return 0, fmt.Errorf("failed to map test page: %w", err)
+	}
+	defer unix.Munmap(mem)
+
+	f, err := os.Open("/proc/self/pagemap")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open pagemap: %w", err)
+	}
+	defer f.Close()
+	var entry [8]byte
+	page := uintptr(unsafe.Pointer(&mem[0])) / uintptr(pageSize)
+	if _, err := f.ReadAt(entry[:], int64(page*8)); err != nil {
+		return 0, fmt.Errorf("failed to read pagemap entry: %w", err)
+	}
+	return binary.LittleEndian.Uint64(entry[:]) & pmPFN, nil
+})
+
+// rangesWith returns the ranges of vma whose pagemap entries have any of
+// the bits in mask set, or all of them if all is set, which are the pages
+// in any (or all) of the PAGEMAP_SCAN categories.
+func (pm *PageMap) rangesWith(vma VMA, all bool, mask, categories uint64) ([]PageRange, error) {
+	scanAll, scanAny := uint64(0), categories
+	if all {
+		scanAll, scanAny = categories, 0
+	}
+	if ranges, ok, err := pm.scan(vma, scanAll, 0, scanAny); ok {
+		return ranges, err
+	}
+
+	start := vma.Start &^ uintptr(pm.pageSize-1)
+	end := (vma.End + uintptr(pm.pageSize-1)) &^ uintptr(pm.pageSize-1)
+
+	var ranges []PageRange
+	n, err := pm.forEachChunk(vma, func(chunkStart uintptr, entries []byte) {
+		for i := range len(entries) / 8 {
+			e := binary.LittleEndian.Uint64(entries[i*8:]) & mask
+			if e == 0 || all && e != mask {
+				continue
+			}
+			addr := chunkStart + uintptr(i*pm.pageSize)
+			if n := len(ranges); n > 0 && ranges[n-1].End == addr {
+				ranges[n-1].End += uintptr(pm.pageSize)
+			} else {
+				ranges = append(ranges, PageRange{Start: addr, End: addr + uintptr(pm.pageSize)})
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything past what the kernel told us about is assumed present.
+	if tail := start + uintptr(n*pm.pageSize); tail < end {
+		if n := len(ranges); n > 0 && ranges[n-1].End == tail {
+			ranges[n-1].End = end
+		} else {
+			ranges = append(ranges, PageRange{Start: tail, End: end})
+		}
+	}
+
+	return ranges, nil
+}
+
+// CalculateDirtyRatio calculates the ratio of dirty pages. It reuses one
+// DirtySet from call to call rather than allocating bitmaps every pass.
+// Hugetlb VMAs, which pre-copy passes leave to the final copy, don't
+// count as dirty.
+func (pm *PageMap) CalculateDirtyRatio(vmas []VMA) (float64, error) {
+	if pm.ratioSet == nil {
+		pm.ratioSet = newDirtySet(vmas, pm.pageSize)
+	} else {
+		pm.ratioSet.reset(vmas)
+	}
+	if err := pm.scanDirty(vmas, pm.ratioSet, false); err != nil {
+		return 0, fmt.Errorf("failed to get dirty pages: %w", err)
+	}
+	return pm.ratioSet.Ratio(), nil
+}
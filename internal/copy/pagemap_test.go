@@ -0,0 +1,364 @@
+package copy
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakePageMap returns a PageMap that reads entries, one per page from
+// the page at start, from a file instead of a process's pagemap. The
+// file isn't a pagemap, so PAGEMAP_SCAN fails on it and the PageMap
+// falls back to reading entries, as it does on kernels before 6.7.
+func fakePageMap(t *testing.T, start uintptr, entries []uint64) *PageMap {
+	t.Helper()
+	pm := NewPageMap(-1) // no smaps, so every VMA is scanned
+	buf := make([]byte, 8*len(entries))
+	for i, e := range entries {
+		binary.LittleEndian.PutUint64(buf[8*i:], e)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "pagemap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.WriteAt(buf, int64(start/uintptr(pm.pageSize)*8)); err != nil {
+		t.Fatal(err)
+	}
+	pm.file = f
+	return pm
+}
+
+// pages returns the range of pages [first, last) from base.
+func pages(base uintptr, first, last int) PageRange {
+	ps := uintptr(GetPageSize())
+	return PageRange{Start: base + uintptr(first)*ps, End: base + uintptr(last)*ps}
+}
+
+func TestPageMapEntries(t *testing.T) {
+	base := uintptr(0x100) * uintptr(GetPageSize())
+	entries := []uint64{
+		0:  pmPresent | 42,
+		1:  pmPresent | pmSoftDirty | 43,
+		2:  pmSwapped,
+		3:  pmSwapped | pmSoftDirty,
+		4:  0,
+		5:  pmSoftDirty, // dirty, then dropped: reads as zeros
+		6:  pmPresent | pmSoftDirty | 44,
+		7:  pmPresent | 45,
+		8:  0,
+		9:  0,
+		10: pmSwapped | pmSoftDirty,
+	}
+	// The VMA runs two pages past the entries, as if the kernel had
+	// reported fewer than asked for.
+	vma := VMA{Start: base, End: pages(base, 0, len(entries)+2).End, Anon: true}
+
+	pm := fakePageMap(t, base, entries)
+	check := func(name string, f func(VMA) ([]PageRange, error), want ...PageRange) {
+		t.Helper()
+		got, err := f(vma)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s = %x; want %x", name, got, want)
+		}
+	}
+	// Past the entries, pages are assumed present.
+	check("PresentRanges", pm.PresentRanges, pages(base, 0, 4), pages(base, 6, 8), pages(base, 10, 13))
+	check("ResidentRanges", pm.ResidentRanges, pages(base, 0, 2), pages(base, 6, 8), pages(base, 11, 13))
+	check("SwappedRanges", pm.SwappedRanges, pages(base, 2, 4), pages(base, 10, 13))
+	check("SwappedDirtyRanges", pm.SwappedDirtyRanges, pages(base, 3, 4), pages(base, 10, 13))
+	if !pm.noScan {
+		t.Error("PAGEMAP_SCAN on a regular file didn't fall back to reading entries")
+	}
+
+	dirty := func(name string, residentOnly, skipSwapped bool, want ...PageRange) {
+		t.Helper()
+		pm.SetResidentOnly(residentOnly)
+		pm.SetSkipSwapped(skipSwapped)
+		ds, err := pm.GetDirtyPages([]VMA{vma})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := collectRanges(ds); !slices.Equal(got, want) {
+			t.Errorf("%s: dirty pages %x; want %x", name, got, want)
+		}
+	}
+	dirty("all", false, false, pages(base, 1, 2), pages(base, 3, 4), pages(base, 5, 7), pages(base, 10, 11))
+	dirty("resident only", true, false, pages(base, 1, 2), pages(base, 6, 7))
+	dirty("skip swapped", false, true, pages(base, 1, 2), pages(base, 5, 7))
+}
+
+func TestPageMapZeroPage(t *testing.T) {
+	zero, err := zeroPFN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zero == 0 {
+		t.Skip("the kernel hides PFNs from this process")
+	}
+	base := uintptr(0x100) * uintptr(GetPageSize())
+	entries := []uint64{pmPresent | 42, pmPresent | zero, pmPresent | zero, pmSwapped, pmPresent | 43}
+	vma := VMA{Start: base, End: pages(base, 0, len(entries)).End, Anon: true}
+	pm := fakePageMap(t, base, entries)
+
+	got, err := pm.ZeroPageRanges(vma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []PageRange{pages(base, 1, 3)}; !slices.Equal(got, want) {
+		t.Errorf("ZeroPageRanges = %x; want %x", got, want)
+	}
+	ranges, zeroBytes, err := pm.PagesToCopy(vma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []PageRange{pages(base, 0, 1), pages(base, 3, 5)}; !slices.Equal(ranges, want) {
+		t.Errorf("PagesToCopy = %x; want %x", ranges, want)
+	}
+	if want := uint64(2 * GetPageSize()); zeroBytes != want {
+		t.Errorf("PagesToCopy zero page bytes = %d; want %d", zeroBytes, want)
+	}
+}
+
+// testMapping maps n pages of private anonymous memory, unmapped when the
+// test ends, and returns it and its VMA.
+func testMapping(t *testing.T, n int) ([]byte, VMA) {
+	t.Helper()
+	mem, err := unix.Mmap(-1, 0, n*GetPageSize(), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Munmap(mem) })
+	start := uintptr(unsafe.Pointer(&mem[0]))
+	return mem, VMA{Start: start, End: start + uintptr(len(mem)), Size: uint64(len(mem)), Perms: PermRead | PermWrite, Anon: true}
+}
+
+// readSink keeps TestPageMapSelf's reads from being optimized away.
+var readSink byte
+
+func TestPageMapSelf(t *testing.T) {
+	ps := GetPageSize()
+	mem, vma := testMapping(t, 16)
+	for _, i := range []int{0, 1, 2, 9} {
+		mem[i*ps] = 1
+	}
+	for _, i := range []int{5, 6} {
+		readSink += mem[i*ps] // faults in the zero page
+	}
+
+	// PAGEMAP_SCAN, where there is one, and reading entries agree.
+	scanning := NewPageMap(os.Getpid())
+	defer scanning.Close()
+	reading := NewPageMap(os.Getpid())
+	reading.noScan = true
+	defer reading.Close()
+	for _, pm := range []*PageMap{scanning, reading} {
+		present, err := pm.PresentRanges(vma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []PageRange{pages(vma.Start, 0, 3), pages(vma.Start, 5, 7), pages(vma.Start, 9, 10)}
+		if !slices.Equal(present, want) {
+			t.Errorf("noScan=%v: PresentRanges = %x; want %x", pm.noScan, present, want)
+		}
+		swapped, err := pm.SwappedRanges(vma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(swapped) != 0 {
+			t.Errorf("noScan=%v: SwappedRanges = %x; want none", pm.noScan, swapped)
+		}
+	}
+
+	// Without PFNs, reading entries can't tell the zero page apart.
+	zero, err := scanning.ZeroPageRanges(vma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pfn, _ := zeroPFN(); !scanning.noScan || pfn != 0 {
+		if want := []PageRange{pages(vma.Start, 5, 7)}; !slices.Equal(zero, want) {
+			t.Errorf("ZeroPageRanges = %x; want %x", zero, want)
+		}
+	}
+}
+
+func TestPageMapSoftDirty(t *testing.T) {
+	if ok, err := SoftDirtySupported(); err != nil || !ok {
+		t.Skipf("no soft-dirty tracking: %v", err)
+	}
+	ps := GetPageSize()
+	mem, vma := testMapping(t, 8)
+	for i := range 8 {
+		mem[i*ps] = 1
+	}
+	pm := NewPageMap(os.Getpid())
+	defer pm.Close()
+	if err := pm.ClearSoftDirty(); err != nil {
+		t.Fatal(err)
+	}
+	mem[2*ps] = 2
+	mem[3*ps] = 2
+	mem[7*ps] = 2
+
+	ds, err := pm.GetDirtyPages([]VMA{vma})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PageRange{pages(vma.Start, 2, 4), pages(vma.Start, 7, 8)}
+	if got := collectRanges(ds); !slices.Equal(got, want) {
+		t.Errorf("dirty pages %x; want %x", got, want)
+	}
+	ratio, err := pm.CalculateDirtyRatio([]VMA{vma})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ratio != 3.0/8 {
+		t.Errorf("CalculateDirtyRatio = %v; want %v", ratio, 3.0/8)
+	}
+}
+
+// collectRanges returns ds's ranges.
+func collectRanges(ds *DirtySet) []PageRange {
+	var rs []PageRange
+	for r := range ds.Ranges() {
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func TestDirtySet(t *testing.T) {
+	ps := uintptr(GetPageSize())
+	// Two adjacent VMAs, neither a whole number of bitmap words, and a
+	// third after a gap.
+	vmas := []VMA{
+		{Start: 0x1000 * ps, End: 0x1000*ps + 70*ps},
+		{Start: 0x1000*ps + 70*ps, End: 0x1000*ps + 75*ps},
+		{Start: 0x2000 * ps, End: 0x2000*ps + 130*ps},
+	}
+	ds := newDirtySet(vmas, int(ps))
+	ds.add(0, 69)
+	ds.add(0, 69) // again
+	ds.addRanges(2, []PageRange{pages(vmas[2].Start, 63, 66)})
+	ds.AddRange(pages(vmas[1].Start, -1, 2)) // spans vmas 0 and 1
+	ds.AddRange(pages(vmas[2].End, 0, 4))    // in no VMA
+
+	wantRanges := []PageRange{
+		pages(vmas[0].Start, 69, 70),
+		pages(vmas[1].Start, 0, 2),
+		pages(vmas[2].Start, 63, 66),
+	}
+	if got := collectRanges(ds); !slices.Equal(got, wantRanges) {
+		t.Errorf("Ranges = %x; want %x", got, wantRanges)
+	}
+	if got, want := ds.Len(), 6; got != want {
+		t.Errorf("Len = %d; want %d", got, want)
+	}
+	if got, want := ds.Ratio(), 6.0/205; got != want {
+		t.Errorf("Ratio = %v; want %v", got, want)
+	}
+	for _, tt := range []struct {
+		addr uintptr
+		want bool
+	}{
+		{vmas[0].Start + 69*ps, true},
+		{vmas[0].Start + 69*ps + 1, true},
+		{vmas[0].Start + 68*ps, false},
+		{vmas[1].Start, true},
+		{vmas[2].Start + 64*ps, true},
+		{vmas[2].Start + 66*ps, false},
+		{vmas[2].End, false},
+		{0, false},
+	} {
+		if got := ds.Contains(tt.addr); got != tt.want {
+			t.Errorf("Contains(%#x) = %v; want %v", tt.addr, got, tt.want)
+		}
+	}
+	var pageAddrs []uintptr
+	for addr, vma := range ds.Pages() {
+		if addr < vma.Start || addr >= vma.End {
+			t.Errorf("page %#x yielded with VMA %x-%x", addr, vma.Start, vma.End)
+		}
+		pageAddrs = append(pageAddrs, addr)
+	}
+	if len(pageAddrs) != 6 || !slices.IsSorted(pageAddrs) {
+		t.Errorf("Pages = %x; want 6 in order", pageAddrs)
+	}
+
+	ds.addAll(0)
+	if got, want := ds.Len(), 70+2+3; got != want {
+		t.Errorf("after addAll, Len = %d; want %d", got, want)
+	}
+	if ds.Contains(vmas[0].Start+70*ps) != true { // vmas[1]'s first page
+		t.Error("addAll lost a page of the next VMA")
+	}
+	if got := collectRanges(ds)[0]; got != pages(vmas[0].Start, 0, 70) {
+		t.Errorf("after addAll, first range = %x; want all of VMA 0", got)
+	}
+
+	ds.reset(vmas[:2])
+	if ds.Len() != 0 || ds.Contains(vmas[0].Start+69*ps) || len(collectRanges(ds)) != 0 {
+		t.Error("reset left pages dirty")
+	}
+	var nilSet *DirtySet
+	if nilSet.Len() != 0 || nilSet.Ratio() != 0 || nilSet.Contains(0) || len(collectRanges(nilSet)) != 0 {
+		t.Error("nil DirtySet isn't empty")
+	}
+}
+
+func TestRangeSet(t *testing.T) {
+	var s RangeSet
+	s.Add(PageRange{Start: 0x5000, End: 0x6000})
+	s.Add(PageRange{Start: 0x1000, End: 0x3000})
+	s.Add(PageRange{Start: 0x3000, End: 0x4000}) // adjacent
+	s.Add(PageRange{Start: 0x2000, End: 0x2800}) // inside
+	s.Add(PageRange{Start: 0x9000, End: 0x9000}) // empty
+	s.Add(PageRange{Start: 0x5800, End: 0x7000}) // overlapping
+	want := []PageRange{{0x1000, 0x4000}, {0x5000, 0x7000}}
+	if got := s.Ranges(); !slices.Equal(got, want) {
+		t.Errorf("Ranges = %x; want %x", got, want)
+	}
+
+	got := s.Intersect([]PageRange{{0, 0x2000}, {0x3800, 0x5800}, {0x8000, 0x9000}})
+	want = []PageRange{{0x1000, 0x2000}, {0x3800, 0x4000}, {0x5000, 0x5800}}
+	if !slices.Equal(got, want) {
+		t.Errorf("Intersect = %x; want %x", got, want)
+	}
+
+	// Adding after Ranges re-sorts.
+	s.Add(PageRange{Start: 0, End: 0x1000})
+	want = []PageRange{{0, 0x4000}, {0x5000, 0x7000}}
+	if got := s.Ranges(); !slices.Equal(got, want) {
+		t.Errorf("after Add, Ranges = %x; want %x", got, want)
+	}
+}
+
+func TestSubtractRanges(t *testing.T) {
+	tests := []struct {
+		rs, holes, want []PageRange
+	}{
+		{nil, []PageRange{{0, 0x1000}}, nil},
+		{[]PageRange{{0x1000, 0x5000}}, nil, []PageRange{{0x1000, 0x5000}}},
+		{[]PageRange{{0x1000, 0x5000}}, []PageRange{{0x2000, 0x3000}}, []PageRange{{0x1000, 0x2000}, {0x3000, 0x5000}}},
+		{[]PageRange{{0x1000, 0x5000}}, []PageRange{{0, 0x2000}, {0x4000, 0x6000}}, []PageRange{{0x2000, 0x4000}}},
+		{[]PageRange{{0x1000, 0x2000}}, []PageRange{{0, 0x8000}}, nil},
+		{
+			[]PageRange{{0x1000, 0x3000}, {0x4000, 0x8000}},
+			[]PageRange{{0, 0x1000}, {0x2000, 0x5000}, {0x6000, 0x7000}, {0x9000, 0xa000}},
+			[]PageRange{{0x1000, 0x2000}, {0x5000, 0x6000}, {0x7000, 0x8000}},
+		},
+	}
+	for _, tt := range tests {
+		if got := SubtractRanges(tt.rs, tt.holes); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SubtractRanges(%x, %x) = %x; want %x", tt.rs, tt.holes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package copy
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The PAGEMAP_SCAN ioctl (Linux 6.7) reports which pages of a range are in
+// some categories as a list of ranges, instead of 8 bytes of pagemap per
+// page. See Documentation/admin-guide/mm/pagemap.rst.
+const pagemapScan = 0xc0606610 // _IOWR('f', 16, struct pm_scan_arg)
+
+// Page categories for PAGEMAP_SCAN.
+const (
+	pageIsPresent   = 1 << 3
+	pageIsSwapped   = 1 << 4
+	pageIsPFNZero   = 1 << 5 // maps the shared zero page or huge zero page
+	pageIsSoftDirty = 1 << 7
+)
+
+// pmScanArg is struct pm_scan_arg.
+type pmScanArg struct {
+	Size              uint64
+	Flags             uint64
+	Start             uint64
+	End               uint64
+	WalkEnd           uint64 // where the kernel stopped, if vec filled up
+	Vec               uint64 // *pageRegion
+	VecLen            uint64
+	MaxPages          uint64
+	CategoryInverted  uint64
+	CategoryMask      uint64 // categories a page must all be in
+	CategoryAnyofMask uint64 // categories a page must be in one of
+	ReturnMask        uint64
+}
+
+// pageRegion is struct page_region.
+type pageRegion struct {
+	Start, End, Categories uint64
+}
+
+// scanRegions is how many regions scan asks for per ioctl.
+const scanRegions = 4096
+
+// scan returns the page ranges of vma whose pages are in all the
+// categories in all, in none of those in none, and in any of those in
+// anyOf if that's not zero. It
+// reports false if the kernel doesn't support PAGEMAP_SCAN, in which case
+// the caller should read the pagemap instead, and scan always reports
+// false from then on.
+func (pm *PageMap) scan(vma VMA, all, none, anyOf uint64) ([]PageRange, bool, error) {
+	if pm.noScan {
+		return nil, false, nil
+	}
+	if err := pm.open(); err != nil {
+		return nil, true, err
+	}
+	if pm.regions == nil {
+		pm.regions = make([]pageRegion, scanRegions)
+	}
+
+	start := vma.Start &^ uintptr(pm.pageSize-1)
+	end := (vma.End + uintptr(pm.pageSize-1)) &^ uintptr(pm.pageSize-1)
+	var ranges []PageRange
+	for start < end {
+		arg := pmScanArg{
+			Size:              uint64(unsafe.Sizeof(pmScanArg{})),
+			Start:             uint64(start),
+			End:               uint64(end),
+			Vec:               uint64(uintptr(unsafe.Pointer(&pm.regions[0]))),
+			VecLen:            uint64(len(pm.regions)),
+			CategoryInverted:  none,
+			CategoryMask:      all | none,
+			CategoryAnyofMask: anyOf,
+			ReturnMask:        all | none | anyOf,
+		}
+		n, _, errno := unix.Syscall(unix.SYS_IOCTL, pm.file.Fd(), pagemapScan, uintptr(unsafe.Pointer(&arg)))
+		runtime.KeepAlive(pm.regions)
+		if errno != 0 {
+			// ENOTTY before Linux 6.7; EINVAL if it doesn't know a
+			// category.
+			if errors.Is(errno, unix.ENOTTY) || errors.Is(errno, unix.EINVAL) {
+				pm.noScan = true
+				return nil, false, nil
+			}
+			return nil, true, fmt.Errorf("PAGEMAP_SCAN failed: %w", errno)
+		}
+		for _, r := range pm.regions[:n] {
+			if k := len(ranges); k > 0 && ranges[k-1].End == uintptr(r.Start) {
+				ranges[k-1].End = uintptr(r.End)
+			} else {
+				ranges = append(ranges, PageRange{Start: uintptr(r.Start), End: uintptr(r.End)})
+			}
+		}
+		if arg.WalkEnd <= uint64(start) {
+			break // no progress; shouldn't happen
+		}
+		start = uintptr(arg.WalkEnd)
+	}
+	return ranges, true, nil
+}
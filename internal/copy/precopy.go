@@ -1,14 +1,17 @@
 package copy
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/bradfitz/livecore/internal/buffer"
+	"github.com/bradfitz/livecore/internal/throttle"
 	"golang.org/x/sys/unix"
 )
 
@@ -17,11 +20,31 @@ type PreCopyEngine struct {
 	pid            int
 	maxPasses      int
 	dirtyThreshold float64
+	timeBudget     time.Duration // 0 means no limit
 	pageMap        *PageMap
 	bufferManager  *buffer.Manager
 	verbose        bool
+	sampler        *Sampler  // nil copies every page
+	changed        *RangeSet // if set, copy only these pages; see SetChanged
+	dirty          *RangeSet // after the first pass, the pages the pass before dirtied, which are all a pass copies
+	onPass         func(PassResult)
+	onProgress     func(pass int, copied uint64)
+	onClear        func(stale []PageRange) error
+	readLimit      *throttle.Limiter // nil if reads aren't limited
+	workers        int               // goroutines reading batches at once
+	readBatch      uint64            // most bytes one read copies; see SetReadBatch
+	pass           int               // the pass running, from 1
+	zeroPages      uint64            // bytes of zero-page mappings skipped so far in this pass
+
+	mu     sync.Mutex // guards copied and unread, and calls to onProgress
+	copied uint64     // bytes copied so far in this pass
+	unread RangeSet   // pages a pass couldn't read, left for the final copy
 }
 
+// DefaultReadBatch is how much of the target's memory one
+// process_vm_readv reads at most, unless SetReadBatch says otherwise.
+const DefaultReadBatch = 4 << 20
+
 // NewPreCopyEngine creates a new pre-copy engine
 func NewPreCopyEngine(pid int, maxPasses int, dirtyThreshold float64, workers int, bufferManager *buffer.Manager, verbose bool) *PreCopyEngine {
 	return &PreCopyEngine{
@@ -31,153 +54,80 @@ func NewPreCopyEngine(pid int, maxPasses int, dirtyThreshold float64, workers in
 		pageMap:        NewPageMap(pid),
 		bufferManager:  bufferManager,
 		verbose:        verbose,
+		workers:        max(workers, 1),
+		readBatch:      DefaultReadBatch,
 	}
 }
 
-// PageMap represents the soft-dirty view of pages (imported from proc package)
-type PageMap struct {
-	pid      int
-	pageSize int
-
-	scratch bytes.Buffer // reusable buffer for pagemap reads
+// SetReadBatch sets how many bytes of the target's memory one read copies
+// at most. A pass splits what it copies into batches of that size, which
+// its workers read in parallel, so no single process_vm_readv runs long,
+// and one that fails costs only its batch a retry. It's rounded down to
+// whole pages.
+func (pce *PreCopyEngine) SetReadBatch(n uint64) {
+	pageSize := uint64(pce.pageMap.pageSize)
+	pce.readBatch = max(n&^(pageSize-1), pageSize)
 }
 
-// NewPageMap creates a new PageMap for the given process
-func NewPageMap(pid int) *PageMap {
-	return &PageMap{
-		pid:      pid,
-		pageSize: GetPageSize(),
-	}
+// SetSampler makes the engine copy only the pages s samples.
+func (pce *PreCopyEngine) SetSampler(s *Sampler) {
+	pce.sampler = s
 }
 
-// ClearSoftDirty clears the soft-dirty bits for the process
-func (pm *PageMap) ClearSoftDirty() error {
-	clearRefsPath := fmt.Sprintf("/proc/%d/clear_refs", pm.pid)
-	file, err := os.OpenFile(clearRefsPath, os.O_WRONLY, 0)
-	if err != nil {
-		return fmt.Errorf("failed to open clear_refs: %w", err)
-	}
-	defer file.Close()
-
-	// Write "4" to clear soft-dirty bits
-	if _, err := file.WriteString("4\n"); err != nil {
-		return fmt.Errorf("failed to clear soft-dirty bits: %w", err)
-	}
-
-	return nil
+// SetResidentOnly makes the engine copy only pages that are resident in
+// RAM, skipping swapped-out pages and file pages not in the page cache.
+func (pce *PreCopyEngine) SetResidentOnly(v bool) {
+	pce.pageMap.SetResidentOnly(v)
 }
 
-// GetDirtyPages reads the pagemap to find dirty pages
-func (pm *PageMap) GetDirtyPages(vmas []VMA) (map[uintptr]*VMA, error) {
-	dirtyPages := make(map[uintptr]*VMA)
-
-	for _, vma := range vmas {
-		if err := pm.scanVMAForDirtyPages(vma, dirtyPages); err != nil {
-			return nil, fmt.Errorf("failed to scan VMA %x-%x: %w", vma.Start, vma.End, err)
-		}
-	}
-
-	return dirtyPages, nil
+// SetSkipSwapped makes the engine leave out pages that are swapped out,
+// rather than faulting them back in to copy them.
+func (pce *PreCopyEngine) SetSkipSwapped(v bool) {
+	pce.pageMap.SetSkipSwapped(v)
 }
 
-// scanVMAForDirtyPages scans a VMA for dirty pages using a reusable buffer
-func (pm *PageMap) scanVMAForDirtyPages(vma VMA, dirtyPages map[uintptr]*VMA) error {
-	pagemapPath := fmt.Sprintf("/proc/%d/pagemap", pm.pid)
-	file, err := os.Open(pagemapPath)
-	if err != nil {
-		return fmt.Errorf("failed to open pagemap: %w", err)
-	}
-	defer file.Close()
-
-	// Calculate page-aligned start and end
-	start := vma.Start &^ uintptr(pm.pageSize-1)
-	end := (vma.End + uintptr(pm.pageSize-1)) &^ uintptr(pm.pageSize-1)
-
-	// Calculate the number of pages in this VMA
-	numPages := int((end - start) / uintptr(pm.pageSize))
-	if numPages == 0 {
-		return nil
-	}
-
-	// Calculate the total bytes needed for all pagemap entries
-	// Each pagemap entry is 8 bytes
-	totalBytes := numPages * 8
-
-	// Reset buffer for reuse
-	buf := &pm.scratch
-	buf.Reset()
-
-	// Ensure buffer has enough capacity
-	if buf.Cap() < totalBytes {
-		buf.Grow(totalBytes - buf.Cap())
-	}
-
-	// Calculate the starting offset in the pagemap file
-	startOffset := int64(start / uintptr(pm.pageSize) * 8)
-
-	// Read all pagemap entries for this VMA in one system call
-	// Get available buffer space and ensure it's large enough
-	available := buf.AvailableBuffer()
-	if len(available) < totalBytes {
-		// If available buffer is too small, we need to grow more
-		buf.Grow(totalBytes - len(available))
-		available = buf.AvailableBuffer()
-	}
-	readBuffer := available[:totalBytes]
-	n, err := file.ReadAt(readBuffer, startOffset)
-	if err != nil {
-		// Skip VMAs that can't be read (like vsyscall, etc.)
-		if err == os.ErrNotExist || n == 0 {
-			return nil
-		}
-		return fmt.Errorf("failed to read pagemap entries: %w", err)
-	}
-
-	// Process each pagemap entry from the buffer
-	for i := range numPages {
-		addr := start + uintptr(i*pm.pageSize)
-		entryOffset := i * 8
-
-		// Check if we have enough data for this entry
-		if entryOffset+8 > len(readBuffer) {
-			break
-		}
-
-		// Parse the entry from the buffer
-		entry := readBuffer[entryOffset : entryOffset+8]
-		entryValue := uint64(entry[0]) | uint64(entry[1])<<8 | uint64(entry[2])<<16 | uint64(entry[3])<<24 |
-			uint64(entry[4])<<32 | uint64(entry[5])<<40 | uint64(entry[6])<<48 | uint64(entry[7])<<56
-
-		// Bit 55 is the soft-dirty bit
-		softDirty := (entryValue & (1 << 55)) != 0
-
-		if softDirty {
-			dirtyPages[addr] = &vma
-		}
-	}
+// SetChanged makes the engine copy only the pages in s, for an incremental
+// dump, adding to s the pages found dirty before and after each pass. The
+// pages soft-dirty when it starts are those changed since the last clear,
+// which, if nothing else has cleared them, was during the dump of the base.
+func (pce *PreCopyEngine) SetChanged(s *RangeSet) {
+	pce.changed = s
+}
 
-	return nil
+// SetPassHook makes the engine call f with each pass's result as soon as
+// the pass finishes.
+func (pce *PreCopyEngine) SetPassHook(f func(PassResult)) {
+	pce.onPass = f
 }
 
-// CalculateDirtyRatio calculates the ratio of dirty pages
-func (pm *PageMap) CalculateDirtyRatio(vmas []VMA) (float64, error) {
-	dirtyPages, err := pm.GetDirtyPages(vmas)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get dirty pages: %w", err)
-	}
+// SetProgressHook makes the engine call f as each pass starts, and as it
+// copies each range of pages, with the pass and how much it has copied.
+func (pce *PreCopyEngine) SetProgressHook(f func(pass int, copied uint64)) {
+	pce.onProgress = f
+}
 
-	totalPages := 0
-	for _, vma := range vmas {
-		pages := int((vma.End - vma.Start + uintptr(pm.pageSize-1)) / uintptr(pm.pageSize))
-		totalPages += pages
-	}
+// SetClearHook makes the engine call f before each time it clears the
+// soft-dirty bits, with the pages whose copies in the buffer it can't then
+// vouch for: all it's to copy, before the first clear, and before each
+// later one, those found dirty since the one before, those it couldn't
+// read, and hugetlb pages. The rest are current unless soft-dirty after
+// it. If f fails, so does RunPreCopy.
+func (pce *PreCopyEngine) SetClearHook(f func(stale []PageRange) error) {
+	pce.onClear = f
+}
 
-	if totalPages == 0 {
-		return 0, nil
-	}
+// SetTimeBudget makes the engine start no pass it expects to end more
+// than d after pre-copy started, judging by how long the pass before took.
+// The first pass always runs, since the final copy only copies what's
+// dirty after it.
+func (pce *PreCopyEngine) SetTimeBudget(d time.Duration) {
+	pce.timeBudget = d
+}
 
-	dirtyCount := len(dirtyPages)
-	return float64(dirtyCount) / float64(totalPages), nil
+// SetReadLimiter makes the engine's reads of the target's memory wait on
+// l, to cap the memory bandwidth the passes take from the running target.
+func (pce *PreCopyEngine) SetReadLimiter(l *throttle.Limiter) {
+	pce.readLimit = l
 }
 
 // VMA represents a virtual memory area
@@ -187,6 +137,11 @@ type VMA struct {
 	Size   uint64
 	Perms  Perm
 	IsZero bool // True if this VMA should be zero-filled (no permissions)
+	Anon   bool // True for private anonymous mappings, whose untouched pages read as zeros
+	// HugePageSize is the page size of a hugetlb mapping, or 0. Without
+	// soft-dirty bits to say what changed, its pages are copied only once
+	// the target is stopped.
+	HugePageSize uint64
 	// Add other fields as needed
 }
 
@@ -202,10 +157,43 @@ const (
 // PreCopyResult contains the result of pre-copy
 type PreCopyResult struct {
 	Passes          int
+	PassResults     []PassResult
 	TotalTime       time.Duration
 	FinalDirtyRatio float64
+	StopReason      StopReason
 	VMAs            []VMA
-	DirtyPages      map[uintptr]*VMA
+	DirtyPages      *DirtySet
+	// Unread are the pages passes couldn't read, even through
+	// /proc/<pid>/mem, for the final copy to try again.
+	Unread []PageRange
+}
+
+// StopReason says why pre-copy stopped.
+type StopReason string
+
+const (
+	StopThreshold  StopReason = "threshold"   // the dirty ratio fell below the threshold
+	StopConverged  StopReason = "converged"   // a pass didn't shrink the dirty set enough to be worth another
+	StopTimeBudget StopReason = "time budget" // another pass would have run past the time budget
+	StopMaxPasses  StopReason = "max passes"
+)
+
+// convergedFraction is how much of the last pass's dirty set a pass can
+// leave dirty before pre-copy stops as converged: past that, the target
+// writes as fast as passes copy, so more of them only cost it bandwidth
+// without shortening the final copy.
+const convergedFraction = 0.9
+
+// PassResult describes one pre-copy pass.
+type PassResult struct {
+	Duration    time.Duration
+	DirtyRatio  float64 // of pages dirtied during the pass
+	DirtyPages  int     // pages dirtied during the pass
+	DirtyRate   float64 // DirtyPages a second
+	BytesCopied uint64
+	// ZeroPageBytes is how much memory mapped the shared zero page, and
+	// was left as holes rather than copied.
+	ZeroPageBytes uint64
 }
 
 // RunPreCopy runs the iterative pre-copy process
@@ -215,21 +203,40 @@ func (pce *PreCopyEngine) RunPreCopy(vmas []VMA) (*PreCopyResult, error) {
 	}
 
 	startTime := time.Now()
+	defer pce.pageMap.Close()
+
+	// Find what changed since the base before forgetting it.
+	if pce.changed != nil {
+		since, err := pce.pageMap.GetDirtyPages(vmas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find pages changed since the base: %w", err)
+		}
+		pce.changed.AddDirty(since)
+	}
 
 	// Clear soft-dirty bits
+	if err := pce.clearHook(vmas, true); err != nil {
+		return nil, err
+	}
 	if err := pce.pageMap.ClearSoftDirty(); err != nil {
 		return nil, fmt.Errorf("failed to clear soft-dirty bits: %w", err)
 	}
 
 	// Run pre-copy passes
+	var passResults []PassResult
+	stop := StopMaxPasses
 	for pass := 1; pass <= pce.maxPasses; pass++ {
 		if pce.verbose {
 			log.Printf("Pre-copy pass %d/%d", pass, pce.maxPasses)
 		}
 
 		passStart := time.Now()
+		pce.pass, pce.copied, pce.zeroPages = pass, 0, 0
+		if pce.onProgress != nil {
+			pce.onProgress(pass, 0)
+		}
 
-		// Copy all pages
+		// Copy all pages, or after the first pass, those dirtied since
 		if err := pce.copyAllPages(vmas); err != nil {
 			return nil, fmt.Errorf("failed to copy pages in pass %d: %w", pass, err)
 		}
@@ -239,11 +246,28 @@ func (pce *PreCopyEngine) RunPreCopy(vmas []VMA) (*PreCopyResult, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to calculate dirty ratio: %w", err)
 		}
+		if pce.changed != nil {
+			pce.changed.AddDirty(pce.pageMap.ratioSet)
+		}
 
 		passTime := time.Since(passStart)
+		dirtyPages := pce.pageMap.ratioSet.Len()
+		dirtyRate := float64(dirtyPages) / passTime.Seconds()
 		if pce.verbose {
-			log.Printf("Pass %d completed in %v, dirty ratio: %.2f%%",
-				pass, passTime, dirtyRatio*100)
+			log.Printf("Pass %d completed in %v, dirty ratio: %.2f%% (%d pages, %.0f/s), %d KB of zero pages skipped",
+				pass, passTime, dirtyRatio*100, dirtyPages, dirtyRate, pce.zeroPages>>10)
+		}
+		pr := PassResult{
+			Duration:      passTime,
+			DirtyRatio:    dirtyRatio,
+			DirtyPages:    dirtyPages,
+			DirtyRate:     dirtyRate,
+			BytesCopied:   pce.copied,
+			ZeroPageBytes: pce.zeroPages,
+		}
+		passResults = append(passResults, pr)
+		if pce.onPass != nil {
+			pce.onPass(pr)
 		}
 
 		// Check if we should stop
@@ -252,11 +276,33 @@ func (pce *PreCopyEngine) RunPreCopy(vmas []VMA) (*PreCopyResult, error) {
 				log.Printf("Dirty ratio %.2f%% below threshold %.2f%%, stopping pre-copy",
 					dirtyRatio*100, pce.dirtyThreshold*100)
 			}
+			stop = StopThreshold
+			break
+		}
+		if n := len(passResults); n > 1 && pass < pce.maxPasses && float64(dirtyPages) >= convergedFraction*float64(passResults[n-2].DirtyPages) {
+			if pce.verbose {
+				log.Printf("Pass %d left %d pages dirty, against %d after the pass before; stopping pre-copy",
+					pass, dirtyPages, passResults[n-2].DirtyPages)
+			}
+			stop = StopConverged
+			break
+		}
+		if pass < pce.maxPasses && pce.timeBudget > 0 && time.Since(startTime)+passTime > pce.timeBudget {
+			if pce.verbose {
+				log.Printf("Another pass would take pre-copy past its %v budget, stopping", pce.timeBudget)
+			}
+			stop = StopTimeBudget
 			break
 		}
 
-		// Clear soft-dirty bits for next pass
+		// Clear soft-dirty bits for next pass, which copies only what this
+		// one left dirty: the rest hasn't been written since it was copied.
 		if pass < pce.maxPasses {
+			pce.dirty = new(RangeSet)
+			pce.dirty.AddDirty(pce.pageMap.ratioSet)
+			if err := pce.clearHook(vmas, false); err != nil {
+				return nil, err
+			}
 			if err := pce.pageMap.ClearSoftDirty(); err != nil {
 				return nil, fmt.Errorf("failed to clear soft-dirty bits: %w", err)
 			}
@@ -268,117 +314,272 @@ func (pce *PreCopyEngine) RunPreCopy(vmas []VMA) (*PreCopyResult, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get final dirty pages: %w", err)
 	}
-
-	finalDirtyRatio, err := pce.pageMap.CalculateDirtyRatio(vmas)
-	if err != nil {
-		return nil, fmt.Errorf("failed to calculate final dirty ratio: %w", err)
+	if pce.changed != nil {
+		pce.changed.AddDirty(dirtyPages)
 	}
+	finalDirtyRatio := dirtyPages.Ratio()
 
 	totalTime := time.Since(startTime)
 
 	if pce.verbose {
-		log.Printf("Pre-copy completed in %v, final dirty ratio: %.2f%%",
-			totalTime, finalDirtyRatio*100)
+		log.Printf("Pre-copy completed in %v after %d passes (%s), final dirty ratio: %.2f%%",
+			totalTime, len(passResults), stop, finalDirtyRatio*100)
 	}
 
 	return &PreCopyResult{
-		Passes:          pce.maxPasses,
+		Passes:          len(passResults),
+		PassResults:     passResults,
 		TotalTime:       totalTime,
 		FinalDirtyRatio: finalDirtyRatio,
+		StopReason:      stop,
 		VMAs:            vmas,
 		DirtyPages:      dirtyPages,
+		Unread:          pce.unread.Ranges(),
 	}, nil
 }
 
-// copyAllPages copies all pages in the given VMAs
-func (pce *PreCopyEngine) copyAllPages(vmas []VMA) error {
-	if pce.verbose {
-		log.Printf("Copying %d VMAs using process_vm_readv", len(vmas))
+// clearHook calls the clear hook, if any, before a clear: the first, or
+// one after a pass.
+func (pce *PreCopyEngine) clearHook(vmas []VMA, first bool) error {
+	if pce.onClear == nil {
+		return nil
 	}
-
-	// Copy each VMA using process_vm_readv
+	var stale RangeSet
+	if first {
+		for _, vma := range vmas {
+			stale.Add(PageRange{Start: vma.Start, End: vma.End})
+		}
+		if pce.changed == nil {
+			return pce.onClear(stale.Ranges())
+		}
+		return pce.onClear(pce.changed.Intersect(stale.Ranges()))
+	}
+	stale.AddDirty(pce.pageMap.ratioSet)
+	pce.mu.Lock()
+	for _, r := range pce.unread.Ranges() {
+		stale.Add(r)
+	}
+	pce.mu.Unlock()
 	for _, vma := range vmas {
-		if err := pce.copyVMA(vma); err != nil {
-			return fmt.Errorf("failed to copy VMA %x-%x: %w", vma.Start, vma.End, err)
+		if vma.HugePageSize != 0 {
+			stale.Add(PageRange{Start: vma.Start, End: vma.End})
 		}
 	}
+	return pce.onClear(stale.Ranges())
+}
 
-	return nil
+// readJob is a batch of a VMA's pages for a pass's workers to copy.
+type readJob struct {
+	vma       VMA
+	vmaOffset buffer.TmpOffset // where vma starts in the buffer
+	r         PageRange
 }
 
-// copyVMA copies a single VMA
-func (pce *PreCopyEngine) copyVMA(vma VMA) error {
-	t0 := time.Now()
+// copyAllPages copies the pages in the given VMAs that the pass needs: all
+// of them in the first, and only those dirtied since in the passes after.
+// It finds the pages to copy in each VMA in turn, and pce.workers goroutines copy them, a batch
+// at a time.
+func (pce *PreCopyEngine) copyAllPages(vmas []VMA) error {
 	if pce.verbose {
-		defer func() {
-			d := time.Since(t0)
-			if d > 10*time.Millisecond {
-				log.Printf("copyVMA %x-%x (%d bytes) took %v", vma.Start, vma.End, vma.Size, d)
+		log.Printf("Copying %d VMAs using process_vm_readv, with %d workers", len(vmas), pce.workers)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		failed   atomic.Bool
+		errOnce  sync.Once
+		firstErr error
+	)
+	jobs := make(chan readJob, pce.workers)
+	for range pce.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if failed.Load() {
+					continue // drain
+				}
+				if err := pce.copyBatch(job); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+				}
 			}
 		}()
 	}
 
-	// Calculate page-aligned boundaries
-	pageSize := uint64(GetPageSize())
-	start := uint64(vma.Start) &^ (pageSize - 1)
-	end := (uint64(vma.End) + pageSize - 1) &^ (pageSize - 1)
+	var err error
+	for _, vma := range vmas {
+		if failed.Load() {
+			break
+		}
+		if err = pce.copyVMA(vma, jobs); err != nil {
+			err = fmt.Errorf("failed to copy VMA %x-%x: %w", vma.Start, vma.End, err)
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
 
+// copyVMA queues the pages of vma that need copying on jobs, in batches
+// of at most pce.readBatch bytes.
+func (pce *PreCopyEngine) copyVMA(vma VMA, jobs chan<- readJob) error {
 	// Get the offset for this VMA region in the temp file (once per VMA)
-	vmaOffset := pce.bufferManager.GetOffsetForVMA(uint64(vma.Start), uint64(vma.End-vma.Start))
-
-	// Get the mmap pointer for this VMA
-	mmapPtr, err := pce.bufferManager.GetMmapPointer(vmaOffset)
+	vmaOffset, err := pce.bufferManager.GetOffsetForVMA(uint64(vma.Start), uint64(vma.End-vma.Start))
 	if err != nil {
-		return fmt.Errorf("failed to get mmap pointer: %w", err)
+		return err
 	}
 
-	// Handle zero VMAs (no permissions) - skip process_vm_readv
-	if vma.IsZero {
+	// Handle zero VMAs (no permissions) - skip process_vm_readv. Hugetlb
+	// VMAs are all copied in the final copy anyway.
+	if vma.IsZero || vma.HugePageSize != 0 {
 		// Just allocate space in buffer manager to create a hole in the output file
 		// No need to actually write zeros - the file will be sparse
 		return nil
 	}
 
-	// Copy the entire VMA in one ProcessVMReadv call
-	vmaSize := end - start
-	err = CopyMemoryToMmap(pce.pid, uintptr(start), vmaSize, mmapPtr)
+	ranges, zeroPages, err := pce.pageMap.PagesToCopy(vma)
 	if err != nil {
-		// For readable VMAs, process_vm_readv failures are fatal
-		return fmt.Errorf("failed to read VMA %x-%x: %w", vma.Start, vma.End, err)
+		return err
+	}
+	pce.zeroPages += zeroPages
+	if pce.changed != nil {
+		ranges = pce.changed.Intersect(ranges)
+	}
+	if pce.dirty != nil {
+		ranges = pce.dirty.Intersect(ranges)
+	}
+	ranges = pce.sampler.Filter(ranges, pce.pageMap.pageSize)
+	for _, r := range ranges {
+		for start := r.Start; start < r.End; {
+			end := min(r.End, start+uintptr(pce.readBatch))
+			jobs <- readJob{vma: vma, vmaOffset: vmaOffset, r: PageRange{Start: start, End: end}}
+			start = end
+		}
 	}
+	return nil
+}
 
-	// No sync needed - we're reading from mmap memory directly
+// copyBatch copies a batch of pages. Pages that can't be read are left
+// for the final copy to try again.
+func (pce *PreCopyEngine) copyBatch(job readJob) error {
+	t0 := time.Now()
+	err := CopyBisecting(job.r, uintptr(pce.pageMap.pageSize),
+		func(r PageRange) error { return pce.copyRange(job.vmaOffset, job.vma, r) },
+		func(err error) bool { return errors.Is(err, unix.EFAULT) },
+		func(r PageRange, _ error) {
+			pce.mu.Lock()
+			pce.unread.Add(r)
+			pce.mu.Unlock()
+		})
+	if err != nil {
+		return fmt.Errorf("failed to read VMA %x-%x: %w", job.vma.Start, job.vma.End, err)
+	}
+	if d := time.Since(t0); pce.verbose && d > 10*time.Millisecond {
+		log.Printf("Reading %x-%x (%d bytes) took %v", job.r.Start, job.r.End, job.r.End-job.r.Start, d)
+	}
 
+	pce.mu.Lock()
+	defer pce.mu.Unlock()
+	pce.copied += uint64(job.r.End - job.r.Start)
+	if pce.onProgress != nil {
+		pce.onProgress(pce.pass, pce.copied)
+	}
 	return nil
 }
 
+// copyRange copies the pages of r, in vma, to the buffer, where vma starts
+// at vmaOffset.
+func (pce *PreCopyEngine) copyRange(vmaOffset buffer.TmpOffset, vma VMA, r PageRange) error {
+	return pce.bufferManager.Fill(vmaOffset+buffer.TmpOffset(r.Start-vma.Start), uint64(r.End-r.Start), func(dst []byte, off uint64) error {
+		if pce.readLimit == nil {
+			return CopyMemory(pce.pid, r.Start+uintptr(off), dst)
+		}
+		for len(dst) > 0 {
+			n := min(len(dst), throttle.Chunk)
+			pce.readLimit.Wait(n)
+			if err := CopyMemory(pce.pid, r.Start+uintptr(off), dst[:n]); err != nil {
+				return err
+			}
+			dst, off = dst[n:], off+uint64(n)
+		}
+		return nil
+	})
+}
+
 // GetPageSize returns the system page size
 func GetPageSize() int {
-	// This would return the actual page size
-	return 4096
+	return os.Getpagesize()
 }
 
-// CopyMemoryToMmap copies memory from a process to mmap using ProcessVMReadv
-func CopyMemoryToMmap(pid int, srcAddr uintptr, size uint64, mmapPtr unsafe.Pointer) error {
-	localIovec := unix.Iovec{
-		Base: (*byte)(mmapPtr),
-		Len:  size,
-	}
-	remoteIovec := unix.RemoteIovec{
-		Base: srcAddr,
-		Len:  int(size),
-	}
+// CopyMemory copies len(dst) bytes at srcAddr in process pid into dst
+// using ProcessVMReadv. A read that stops short, as one does at a page
+// that can't be faulted in, is continued from where it stopped, so the
+// error for that page is returned rather than dst being left partly
+// unfilled. Failures to fault in a page for lack of memory, such as when
+// swapping it in under memory pressure, are retried a few times. Pages
+// ProcessVMReadv can't read are read from /proc/<pid>/mem if possible.
+func CopyMemory(pid int, srcAddr uintptr, dst []byte) error {
+	retries := 0
+	for len(dst) > 0 {
+		localIovec := unix.Iovec{
+			Base: unsafe.SliceData(dst),
+			Len:  uint64(len(dst)),
+		}
+		remoteIovec := unix.RemoteIovec{
+			Base: srcAddr,
+			Len:  len(dst),
+		}
 
-	_, err := unix.ProcessVMReadv(pid, []unix.Iovec{localIovec}, []unix.RemoteIovec{remoteIovec}, 0)
-	if err != nil {
-		if err == unix.ENOENT || err == unix.EFAULT {
-			return err // Let caller decide how to handle unreadable memory
+		n, err := unix.ProcessVMReadv(pid, []unix.Iovec{localIovec}, []unix.RemoteIovec{remoteIovec}, 0)
+		if (err == unix.ENOMEM || err == unix.EAGAIN) && retries < readRetries {
+			retries++
+			time.Sleep(time.Duration(retries) * readRetryDelay)
+			continue
+		}
+		if err == unix.EFAULT || err == nil && n == 0 {
+			n = readProcMem(pid, srcAddr, dst)
+			if n == 0 {
+				return unix.EFAULT // Let caller decide how to handle unreadable memory
+			}
+		} else if err != nil {
+			if err == unix.ENOENT {
+				return err
+			}
+			return fmt.Errorf("failed to read memory at %x: %w", srcAddr, err)
 		}
-		return fmt.Errorf("failed to read memory at %x: %w", srcAddr, err)
+		dst = dst[n:]
+		srcAddr += uintptr(n)
 	}
 	return nil
 }
 
+// readProcMem reads what it can of len(dst) bytes at addr in process pid
+// into dst through /proc/<pid>/mem, returning how many bytes it read. It's
+// CopyMemory's fallback: like a debugger's reads, it reads mappings the
+// target itself can't, such as execute-only ones, which ProcessVMReadv
+// fails on.
+func readProcMem(pid int, addr uintptr, dst []byte) int {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	n, _ := f.ReadAt(dst, int64(addr))
+	return n
+}
+
+// readRetries is how many times CopyMemory retries a read that failed for
+// lack of memory, waiting readRetryDelay longer each time.
+const (
+	readRetries    = 3
+	readRetryDelay = 10 * time.Millisecond
+)
+
 // AlignToPage aligns a value to page boundary
 func AlignToPage(size uint64) uint64 {
 	pageSize := uint64(GetPageSize())
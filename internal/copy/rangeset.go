@@ -0,0 +1,61 @@
+package copy
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+)
+
+// RangeSet is a set of pages, kept as ranges. An incremental dump uses one
+// to track which pages changed since its base.
+type RangeSet struct {
+	ranges []PageRange
+	sorted bool // ranges is sorted, disjoint, and coalesced
+}
+
+// Add adds the pages in r to s.
+func (s *RangeSet) Add(r PageRange) {
+	if r.Start < r.End {
+		s.ranges = append(s.ranges, r)
+		s.sorted = false
+	}
+}
+
+// AddDirty adds the pages in ds to s.
+func (s *RangeSet) AddDirty(ds *DirtySet) {
+	for r := range ds.Ranges() {
+		s.Add(r)
+	}
+}
+
+// Ranges returns the pages in s as sorted, disjoint ranges, with none
+// adjacent to another.
+func (s *RangeSet) Ranges() []PageRange {
+	if s.sorted {
+		return s.ranges
+	}
+	slices.SortFunc(s.ranges, func(a, b PageRange) int { return cmp.Compare(a.Start, b.Start) })
+	var merged []PageRange
+	for _, r := range s.ranges {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			merged[n-1].End = max(merged[n-1].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	s.ranges, s.sorted = merged, true
+	return s.ranges
+}
+
+// Intersect returns the parts of rs, which must be sorted, that are in s.
+func (s *RangeSet) Intersect(rs []PageRange) []PageRange {
+	ranges := s.Ranges()
+	var result []PageRange
+	for _, r := range rs {
+		i := sort.Search(len(ranges), func(i int) bool { return ranges[i].End > r.Start })
+		for ; i < len(ranges) && ranges[i].Start < r.End; i++ {
+			result = append(result, PageRange{Start: max(r.Start, ranges[i].Start), End: min(r.End, ranges[i].End)})
+		}
+	}
+	return result
+}
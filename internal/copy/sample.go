@@ -0,0 +1,68 @@
+package copy
+
+import "math"
+
+// Sampler picks a pseudo-random subset of pages to copy, for sampled
+// dumps. The choice depends only on the page address and the seed, so it
+// is the same in every pass and can be recomputed by whoever analyzes the
+// core: a page at addr is sampled if mix(seed^addr) < Threshold, where mix
+// is the SplitMix64 finalizer.
+//
+// A nil *Sampler samples every page.
+type Sampler struct {
+	Seed      uint64
+	Threshold uint64 // fraction of pages to keep, scaled to 2^64
+}
+
+// NewSampler returns a Sampler keeping about fraction (0 to 1) of pages,
+// or nil if fraction is 1 or more.
+func NewSampler(fraction float64, seed uint64) *Sampler {
+	if fraction >= 1 {
+		return nil
+	}
+	return &Sampler{
+		Seed:      seed,
+		Threshold: uint64(fraction * math.Exp2(64)),
+	}
+}
+
+// Sampled reports whether the page at addr is in the sample.
+func (s *Sampler) Sampled(addr uintptr) bool {
+	if s == nil {
+		return true
+	}
+	return mix(s.Seed^uint64(addr)) < s.Threshold
+}
+
+// Filter returns the sampled parts of ranges, merging adjacent sampled
+// pages back into ranges.
+func (s *Sampler) Filter(ranges []PageRange, pageSize int) []PageRange {
+	if s == nil {
+		return ranges
+	}
+	var out []PageRange
+	for _, r := range ranges {
+		for addr := r.Start; addr < r.End; addr += uintptr(pageSize) {
+			if !s.Sampled(addr) {
+				continue
+			}
+			end := min(addr+uintptr(pageSize), r.End)
+			if n := len(out); n > 0 && out[n-1].End == addr {
+				out[n-1].End = end
+			} else {
+				out = append(out, PageRange{Start: addr, End: end})
+			}
+		}
+	}
+	return out
+}
+
+// mix is the SplitMix64 finalizer.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
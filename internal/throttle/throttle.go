@@ -0,0 +1,79 @@
+// Package throttle limits how fast livecore reads a target's memory and
+// writes its core, so dumping a huge process doesn't take the memory
+// bandwidth or disk the process itself needs.
+package throttle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket allowing a number of bytes a second, in bursts
+// of up to a tenth of a second's worth. A nil *Limiter allows everything.
+type Limiter struct {
+	rate float64 // bytes a second
+
+	mu     sync.Mutex
+	tokens float64 // negative when callers are waiting off a debt
+	last   time.Time
+}
+
+// New returns a Limiter allowing bytesPerSec bytes a second, or nil if
+// bytesPerSec isn't positive.
+func New(bytesPerSec int64) *Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &Limiter{rate: float64(bytesPerSec), last: time.Now()}
+}
+
+// Wait blocks until n more bytes are allowed. A request larger than a
+// burst waits as long as it would take at the limit.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate/10)
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / l.rate * float64(time.Second)))
+	}
+}
+
+// Chunk is how many bytes callers should ask Wait for at a time, so that
+// large transfers are spread out rather than waiting once and bursting.
+const Chunk = 1 << 20
+
+// WriterAt returns w, with its writes limited by l. Large writes are split
+// into Chunk-sized ones.
+func WriterAt(w io.WriterAt, l *Limiter) io.WriterAt {
+	if l == nil {
+		return w
+	}
+	return &writerAt{w, l}
+}
+
+type writerAt struct {
+	w io.WriterAt
+	l *Limiter
+}
+
+func (t *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+Chunk)]
+		t.l.Wait(len(chunk))
+		m, err := t.w.WriteAt(chunk, off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,316 @@
+package upload
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3's limits on multipart uploads.
+const (
+	maxParts    = 10000
+	minPartSize = 5 << 20
+)
+
+// unsignedPayload is the x-amz-content-sha256 of a request whose body
+// isn't covered by its signature, so parts needn't be read twice. TLS
+// protects them instead.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Uploader uploads to an S3 bucket, or one of a service with S3's API,
+// signing requests with AWS Signature Version 4.
+type s3Uploader struct {
+	scheme, host string // of the endpoint
+	pathStyle    bool   // bucket in the path rather than the host name
+	bucket, key  string
+	region       string
+
+	accessKey, secretKey, sessionToken string
+}
+
+func newS3Uploader(scheme, bucket, key string) (*s3Uploader, error) {
+	u := &s3Uploader{scheme: "https", bucket: bucket, key: key}
+	switch scheme {
+	case "s3":
+		u.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		u.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		u.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		if u.accessKey == "" || u.secretKey == "" {
+			return nil, fmt.Errorf("uploading to S3 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		u.region = cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+		if ep := os.Getenv("AWS_ENDPOINT_URL"); ep != "" {
+			e, err := url.Parse(ep)
+			if err != nil || e.Host == "" {
+				return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL %q", ep)
+			}
+			u.scheme, u.host, u.pathStyle = e.Scheme, e.Host, true
+		} else {
+			u.host = "s3." + u.region + ".amazonaws.com"
+			// A bucket name with dots doesn't match the wildcard
+			// certificate as a host name.
+			u.pathStyle = strings.Contains(bucket, ".")
+		}
+	case "gs":
+		// Cloud Storage's XML API takes S3's requests, signed with an
+		// HMAC key, in the pseudo-region "auto".
+		u.accessKey = os.Getenv("GCS_HMAC_ACCESS_KEY_ID")
+		u.secretKey = os.Getenv("GCS_HMAC_SECRET")
+		if u.accessKey == "" || u.secretKey == "" {
+			return nil, fmt.Errorf("uploading to Cloud Storage needs an HMAC key in GCS_HMAC_ACCESS_KEY_ID and GCS_HMAC_SECRET")
+		}
+		u.region = "auto"
+		u.host = "storage.googleapis.com"
+		u.pathStyle = true
+	}
+	return u, nil
+}
+
+func (u *s3Uploader) upload(ctx context.Context, r io.ReaderAt, size int64, opts Options) error {
+	if size <= opts.PartSize {
+		_, _, err := retry(ctx, opts, "PUT", func() (*http.Response, error) {
+			return u.do(ctx, "PUT", nil, io.NewSectionReader(r, 0, size), size, unsignedPayload)
+		})
+		return err
+	}
+
+	uploadID, err := u.createMultipart(ctx, opts)
+	if err != nil {
+		return err
+	}
+	etags, err := u.uploadParts(ctx, r, size, uploadID, opts)
+	if err == nil {
+		err = u.completeMultipart(ctx, uploadID, etags, opts)
+	}
+	if err != nil {
+		// Don't leave the parts to be billed for.
+		abortCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		u.do(abortCtx, "DELETE", url.Values{"uploadId": {uploadID}}, nil, 0, emptySHA256)
+		return err
+	}
+	return nil
+}
+
+// emptySHA256 is the SHA-256 of no bytes, in hex.
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+func (u *s3Uploader) createMultipart(ctx context.Context, opts Options) (string, error) {
+	_, body, err := retry(ctx, opts, "CreateMultipartUpload", func() (*http.Response, error) {
+		return u.do(ctx, "POST", url.Values{"uploads": {""}}, nil, 0, emptySHA256)
+	})
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &res); err != nil || res.UploadID == "" {
+		return "", fmt.Errorf("CreateMultipartUpload returned no upload ID: %s", errorText(body))
+	}
+	return res.UploadID, nil
+}
+
+// uploadParts uploads r in opts.PartSize parts, opts.Concurrency at a
+// time, and returns their ETags.
+func (u *s3Uploader) uploadParts(ctx context.Context, r io.ReaderAt, size int64, uploadID string, opts Options) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	n := int((size + opts.PartSize - 1) / opts.PartSize)
+	etags := make([]string, n)
+	parts := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		done     int
+	)
+	for range min(opts.Concurrency, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range parts {
+				off := int64(i) * opts.PartSize
+				partSize := min(opts.PartSize, size-off)
+				q := url.Values{"partNumber": {fmt.Sprint(i + 1)}, "uploadId": {uploadID}}
+				header, _, err := retry(ctx, opts, fmt.Sprintf("UploadPart %d", i+1), func() (*http.Response, error) {
+					return u.do(ctx, "PUT", q, io.NewSectionReader(r, off, partSize), partSize, unsignedPayload)
+				})
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				etags[i] = header.Get("ETag")
+				if done++; err == nil && done*10/n != (done-1)*10/n {
+					opts.Logf("Uploaded %d of %d parts", done, n)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range n {
+		select {
+		case parts <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(parts)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return etags, nil
+}
+
+func (u *s3Uploader) completeMultipart(ctx context.Context, uploadID string, etags []string, opts Options) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var req struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range etags {
+		req.Parts = append(req.Parts, part{i + 1, etag})
+	}
+	data, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	_, body, err := retry(ctx, opts, "CompleteMultipartUpload", func() (*http.Response, error) {
+		return u.do(ctx, "POST", url.Values{"uploadId": {uploadID}}, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(sum[:]))
+	})
+	if err != nil {
+		return err
+	}
+	// It can fail after sending a 200 status.
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("CompleteMultipartUpload failed: %s", errorText(body))
+	}
+	return nil
+}
+
+// do sends a signed request for the object with query parameters q and
+// size bytes of body, whose SHA-256 is payloadHash.
+func (u *s3Uploader) do(ctx context.Context, method string, q url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	target := &url.URL{Scheme: u.scheme, Host: u.host, Path: "/" + u.key, RawPath: "/" + s3Escape(u.key, false)}
+	if u.pathStyle {
+		target.Path = "/" + u.bucket + target.Path
+		target.RawPath = "/" + s3Escape(u.bucket, true) + target.RawPath
+	} else {
+		target.Host = u.bucket + "." + u.host
+	}
+	target.RawQuery = canonicalQuery(q)
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	u.sign(req, payloadHash, time.Now())
+	return http.DefaultClient.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req, as of t.
+func (u *s3Uploader) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if u.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", u.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + u.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := []byte("AWS4" + u.secretKey)
+	for _, s := range []string{date, u.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns q encoded as Signature Version 4 wants it: sorted
+// by name, with everything but unreserved characters escaped.
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for name, values := range q {
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape escapes s as Signature Version 4 wants: every byte but
+// letters, digits, and "-._~" is percent-encoded, as is "/" if
+// escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,193 @@
+// Package upload copies finished cores to object storage: Amazon S3, or
+// anything speaking its API, Google Cloud Storage through its
+// S3-compatible XML API, or any server accepting an HTTP PUT. Large files
+// go up in parts, several at a time, and every request is retried.
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Options configures an upload.
+type Options struct {
+	// Logf, if set, is called with progress messages.
+	Logf func(format string, args ...any)
+
+	// PartSize is the size of each part of a multipart upload. Zero
+	// means DefaultPartSize; it's raised as needed to stay within the
+	// 10000 parts S3 allows.
+	PartSize int64
+
+	// Concurrency is how many parts are uploaded at once. Zero means 4.
+	Concurrency int
+}
+
+// DefaultPartSize is the default size of each part of a multipart upload.
+const DefaultPartSize = 64 << 20
+
+// Retry policy for each request.
+const (
+	attempts     = 5
+	firstBackoff = time.Second
+)
+
+// Dest returns where File would upload a file named name to dst: if dst
+// ends in a slash, it's a prefix, to which name's base name is appended.
+func Dest(dst, name string) string {
+	if strings.HasSuffix(dst, "/") {
+		return dst + path.Base(name)
+	}
+	return dst
+}
+
+// Check returns an error if dst isn't a destination File knows how to
+// upload to, or its credentials are missing.
+func Check(dst string) error {
+	_, err := newUploader(dst)
+	return err
+}
+
+// File uploads the file at name to dst, which is an s3:// or gs://
+// bucket and object name, or an http:// or https:// URL to PUT it to. A
+// dst ending in a slash is a prefix; see Dest. It returns where the file
+// went.
+//
+// S3 credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_SESSION_TOKEN, its region from AWS_REGION or AWS_DEFAULT_REGION,
+// and AWS_ENDPOINT_URL, if set, points at another S3-compatible service.
+// Cloud Storage needs an HMAC key, in GCS_HMAC_ACCESS_KEY_ID and
+// GCS_HMAC_SECRET.
+func File(ctx context.Context, dst, name string, opts Options) (string, error) {
+	dst = Dest(dst, name)
+	u, err := newUploader(dst)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if opts.Logf == nil {
+		opts.Logf = func(string, ...any) {}
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = DefaultPartSize
+	}
+	opts.PartSize = max(opts.PartSize, (fi.Size()+maxParts-1)/maxParts, minPartSize)
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	start := time.Now()
+	if err := u.upload(ctx, f, fi.Size(), opts); err != nil {
+		return "", fmt.Errorf("failed to upload %s to %s: %w", name, dst, err)
+	}
+	opts.Logf("Uploaded %s (%.1f MB) to %s in %v", name, float64(fi.Size())/(1<<20), dst, time.Since(start).Round(time.Millisecond))
+	return dst, nil
+}
+
+// An uploader uploads to one destination.
+type uploader interface {
+	upload(ctx context.Context, r io.ReaderAt, size int64, opts Options) error
+}
+
+// newUploader returns the uploader for dst.
+func newUploader(dst string) (uploader, error) {
+	u, err := url.Parse(dst)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload destination: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &putUploader{url: dst}, nil
+	case "s3", "gs":
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("upload destination %q needs a bucket and an object name or prefix", dst)
+		}
+		return newS3Uploader(u.Scheme, u.Host, key)
+	}
+	return nil, fmt.Errorf("unknown upload destination %q (want s3://, gs://, or https://)", dst)
+}
+
+// putUploader uploads with a single HTTP PUT, as to a presigned URL.
+type putUploader struct {
+	url string
+}
+
+func (p *putUploader) upload(ctx context.Context, r io.ReaderAt, size int64, opts Options) error {
+	_, _, err := retry(ctx, opts, "PUT", func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "PUT", p.url, io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		return http.DefaultClient.Do(req)
+	})
+	return err
+}
+
+// retry calls do until it succeeds, backing off after each network error
+// or response saying to try again (5xx or 429), and returns the body of
+// the successful response and its headers. Other error responses aren't
+// retried.
+func retry(ctx context.Context, opts Options, what string, do func() (*http.Response, error)) (http.Header, []byte, error) {
+	backoff := firstBackoff
+	var err error
+	for i := range attempts {
+		if i > 0 {
+			opts.Logf("Retrying %s in %v after: %v", what, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+		var res *http.Response
+		res, err = do()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			continue
+		}
+		body, rerr := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		res.Body.Close()
+		switch {
+		case rerr != nil:
+			err = rerr
+		case res.StatusCode/100 == 2:
+			return res.Header, body, nil
+		case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+			err = fmt.Errorf("%s: %s", res.Status, errorText(body))
+		default:
+			return nil, nil, fmt.Errorf("%s: %s", res.Status, errorText(body))
+		}
+	}
+	return nil, nil, fmt.Errorf("%s failed %d times: %w", what, attempts, err)
+}
+
+// errorText returns an error response's body, trimmed for a message.
+func errorText(body []byte) string {
+	s := strings.TrimSpace(string(body))
+	if len(s) > 500 {
+		s = s[:500] + "..."
+	}
+	if s == "" {
+		return "no details"
+	}
+	return s
+}
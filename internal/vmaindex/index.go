@@ -0,0 +1,81 @@
+// Package vmaindex indexes address ranges for fast point and overlap
+// lookups, so resolving a page to its VMA doesn't need a linear scan of
+// hundreds of thousands of mappings.
+package vmaindex
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+)
+
+// Index is an immutable index over a set of half-open address ranges
+// [start, end). It refers to ranges by their position in the caller's
+// slice, so it works with any of the VMA types in livecore.
+//
+// Ranges from /proc/<pid>/maps never overlap, so this is a sorted slice
+// with binary search rather than a full interval tree. Overlapping input
+// is still answered correctly, which is what validation needs.
+type Index struct {
+	ents   []entry   // sorted by start
+	maxEnd []uintptr // maxEnd[i] is the largest end in ents[:i+1]
+}
+
+type entry struct {
+	start, end uintptr
+	i          int // position in the caller's slice
+}
+
+// New returns an index over n ranges, where bounds(i) returns the
+// half-open range of the i'th one.
+func New(n int, bounds func(i int) (start, end uintptr)) *Index {
+	ix := &Index{
+		ents:   make([]entry, n),
+		maxEnd: make([]uintptr, n),
+	}
+	for i := range n {
+		start, end := bounds(i)
+		ix.ents[i] = entry{start: start, end: end, i: i}
+	}
+	slices.SortStableFunc(ix.ents, func(a, b entry) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	var maxEnd uintptr
+	for k, e := range ix.ents {
+		maxEnd = max(maxEnd, e.end)
+		ix.maxEnd[k] = maxEnd
+	}
+	return ix
+}
+
+// Len returns the number of ranges in the index.
+func (ix *Index) Len() int {
+	return len(ix.ents)
+}
+
+// Lookup returns the position of a range containing addr. If several
+// ranges contain addr, the one with the highest start wins.
+func (ix *Index) Lookup(addr uintptr) (i int, ok bool) {
+	// First range starting after addr; only ranges before it can match.
+	k := sort.Search(len(ix.ents), func(k int) bool { return ix.ents[k].start > addr })
+	for k--; k >= 0 && ix.maxEnd[k] > addr; k-- {
+		if ix.ents[k].end > addr {
+			return ix.ents[k].i, true
+		}
+	}
+	return 0, false
+}
+
+// Overlapping returns the positions of the ranges that overlap
+// [start, end), ordered by range start.
+func (ix *Index) Overlapping(start, end uintptr) []int {
+	k := sort.Search(len(ix.ents), func(k int) bool { return ix.ents[k].start >= end })
+	var found []int
+	for k--; k >= 0 && ix.maxEnd[k] > start; k-- {
+		if ix.ents[k].end > start {
+			found = append(found, ix.ents[k].i)
+		}
+	}
+	slices.Reverse(found)
+	return found
+}
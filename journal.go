@@ -0,0 +1,197 @@
+package livecore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/bradfitz/livecore/internal/buffer"
+	"github.com/bradfitz/livecore/internal/copy"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// A journal records how far a resumable dump got (see WithJournal): where
+// in its scratch buffer it put each VMA's pages, and which of those it
+// can't vouch for. The rest match the target's memory, unless soft-dirty:
+// the journal is written before each time the dump clears the soft-dirty
+// bits, listing the pages it hadn't copied since the clear before.
+type journal struct {
+	Pid     int
+	Started time.Duration // the process's start time, since boot
+	VMAs    []journalVMA  // as the dump found them
+	Buffer  []buffer.Allocation
+	Stale   []copy.PageRange
+}
+
+// journalVMA is what a journal records of a VMA, enough to tell whether
+// it's still the same mapping.
+type journalVMA struct {
+	Start, End uintptr
+	Perms      proc.Perm
+	Offset     uint64
+	Dev, Inode uint64
+	Path       string
+}
+
+func toJournalVMA(vma proc.VMA) journalVMA {
+	return journalVMA{
+		Start:  vma.Start,
+		End:    vma.End,
+		Perms:  vma.Perms,
+		Offset: vma.Offset,
+		Dev:    vma.Dev,
+		Inode:  vma.Inode,
+		Path:   vma.Path,
+	}
+}
+
+// bufferPath returns the path of the scratch buffer of the dump journaled
+// at path.
+func bufferPath(path string) string { return path + ".buf" }
+
+// openJournal opens the scratch buffer of a resumable dump, taking up
+// what an interrupted dump of the target left in it, if d's journal is
+// from one, and returns the journal to keep, and whether it's resuming.
+func (d *Dumper) openJournal() (*buffer.Manager, *journal, bool, error) {
+	started, err := proc.StartTime(d.pid)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	j := &journal{Pid: d.pid, Started: started}
+
+	data, err := os.ReadFile(d.journal)
+	resuming := err == nil
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// A buffer with no journal has nothing we can trust.
+		if err := os.Remove(bufferPath(d.journal)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, false, err
+		}
+	case err != nil:
+		return nil, nil, false, fmt.Errorf("failed to read journal: %w", err)
+	default:
+		var prev journal
+		if err := json.Unmarshal(data, &prev); err != nil {
+			return nil, nil, false, fmt.Errorf("failed to parse journal %s: %w", d.journal, err)
+		}
+		if prev.Pid != d.pid {
+			return nil, nil, false, fmt.Errorf("journal %s is of process %d, not %d", d.journal, prev.Pid, d.pid)
+		}
+		if prev.Started != started {
+			return nil, nil, false, fmt.Errorf("journal %s is of an earlier process with pid %d", d.journal, d.pid)
+		}
+		j = &prev
+	}
+
+	bm, err := buffer.NewNamedBufferManager(bufferPath(d.journal), d.bufferWindow)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if resuming {
+		if err := bm.Restore(j.Buffer); err != nil {
+			bm.Close()
+			return nil, nil, false, fmt.Errorf("journal %s doesn't match its buffer: %w", d.journal, err)
+		}
+	}
+	return bm, j, resuming, nil
+}
+
+// write replaces the journal at path with j, renaming a new file over it so
+// that an interruption leaves the old one or the new one.
+func (j *journal) write(path string) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
+
+// resume adds to changed the pages of vmas whose copies in bm, as j left
+// them, can't be vouched for: those j lists as stale, and all of those of
+// VMAs that aren't the mappings they were. It discards them from bm, so
+// that those not copied again read as zeros, along with what bm holds of
+// mappings that are gone.
+func resume(j *journal, bm *buffer.Manager, vmas []proc.VMA, changed *copy.RangeSet) error {
+	same := make(map[journalVMA]bool)
+	for _, v := range j.VMAs {
+		same[v] = true
+	}
+	var stale copy.RangeSet
+	for _, r := range j.Stale {
+		stale.Add(r)
+	}
+	var mapped []copy.PageRange
+	for _, vma := range vmas {
+		mapped = append(mapped, copy.PageRange{Start: vma.Start, End: vma.End})
+		if !same[toJournalVMA(vma)] {
+			stale.Add(mapped[len(mapped)-1])
+		}
+	}
+	for _, r := range stale.Intersect(mapped) {
+		changed.Add(r)
+	}
+
+	var buffered []copy.PageRange
+	for _, a := range j.Buffer {
+		buffered = append(buffered, copy.PageRange{Start: uintptr(a.VMAStart), End: uintptr(a.VMAStart + a.VMASize)})
+	}
+	for _, r := range copy.SubtractRanges(buffered, mapped) {
+		stale.Add(r)
+	}
+	for _, r := range stale.Ranges() {
+		if err := bm.Discard(uint64(r.Start), uint64(r.End-r.Start)); err != nil {
+			return fmt.Errorf("failed to discard stale pages: %w", err)
+		}
+	}
+	return nil
+}
+
+// punchRanges punches the pages in ranges out of the copies of vmas in
+// bm.
+func punchRanges(bm *buffer.Manager, vmas []proc.VMA, ranges []copy.PageRange) error {
+	var rs copy.RangeSet
+	for _, r := range ranges {
+		rs.Add(r)
+	}
+	for _, vma := range vmas {
+		off, ok := bm.GetExistingOffsetForVMA(uint64(vma.Start), vma.MemSize)
+		if !ok {
+			continue
+		}
+		for _, r := range rs.Intersect([]copy.PageRange{{Start: vma.Start, End: vma.End}}) {
+			if err := bm.PunchHole(off+buffer.TmpOffset(r.Start-vma.Start), uint64(r.End-r.Start)); err != nil {
+				return fmt.Errorf("failed to discard stale pages: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeJournal removes the journal at path and its scratch buffer, once
+// the core they were for is written.
+func removeJournal(path string) {
+	os.Remove(path)
+	os.Remove(bufferPath(path))
+}
@@ -1,504 +1,697 @@
-package main
+// Package livecore writes core files of running Linux processes while
+// stopping them only briefly.
+//
+// It copies the target's memory into a scratch buffer while the target
+// keeps running, re-copying the pages it dirties for a few passes, then
+// stops it just long enough to copy what's still dirty and read its
+// registers. The core is written from the buffer after the target resumes.
+//
+//	d := livecore.New(pid, livecore.WithPasses(3))
+//	f, err := os.Create("app.core")
+//	...
+//	err = d.Dump(ctx, f)
+//
+// Dumping needs the same privileges as attaching a debugger, and with
+// Yama's ptrace_scope above 0, even more; see the livecore command's
+// -fix-yama flag.
+package livecore
 
 import (
-	"flag"
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"os"
-	"os/signal"
+	"regexp"
 	"runtime"
-	"strconv"
-	"strings"
-	"syscall"
+	"sync"
 	"time"
-	"unsafe"
 
-	"github.com/bradfitz/livecore/internal/buffer"
+	"github.com/bradfitz/livecore/elfcore"
 	"github.com/bradfitz/livecore/internal/copy"
-	"github.com/bradfitz/livecore/internal/elfcore"
-	"github.com/bradfitz/livecore/internal/proc"
-	"golang.org/x/sys/unix"
+	"github.com/bradfitz/livecore/proc"
 )
 
-// Config holds the configuration for livecore
-type Config struct {
-	Pid            int
-	OutputFile     string
-	MaxPasses      int
-	DirtyThreshold float64
-	Concurrency    int
-	Verbose        bool
-	FixYama        bool
+// A Dumper dumps one process. Create one with New.
+type Dumper struct {
+	pid            int
+	maxPasses      int
+	maxPreCopyTime time.Duration // 0 means no limit
+	noPreCopy      bool          // copy everything with the target stopped, without soft-dirty tracking
+	direct         bool          // copy straight into the core file, without pre-copy
+	dirtyThreshold float64       // fraction of pages
+	concurrency    int
+	readBatch      uint64 // most bytes one process_vm_readv reads
+	verbose        bool
+	logf           func(format string, args ...any)
+	onProgress     func(Progress) // nil if no one's watching
+	stopTimeout    time.Duration
+	abortOnStuck   bool          // fail rather than dump without threads that don't stop
+	maxStopTime    time.Duration // 0 means no limit
+	stopOverrun    StopOverrun
+	freezeWorkers  int
+	freezeMethod   FreezeMethod
+	notes          elfcore.NoteSelection
+	pidView        PidView
+	cmdline        elfcore.Redaction // command line in notes and memory
+	omitEnviron    bool              // zero the environment strings in memory
+	redactRanges   []proc.AddrRange  // to zero in memory
+	redactPatterns []*regexp.Regexp  // whose matches to mask in memory
+	omitAuxv       bool
+	annotations    []elfcore.Annotation
+	container      *proc.Container
+	quiesceTimeout time.Duration // 0 means don't ask the target to quiesce
+	sample         float64       // percentage of pages to copy
+	sampleSeed     uint64
+	residentOnly   bool
+	swapIn         bool // fault in swapped-out pages to copy them
+	compressBuffer bool
+	spaceCheck     bool
+	verify         VerifyMode
+	sparse         elfcore.Sparse
+	writeCache     elfcore.CacheMode
+	tempDir        string // for the scratch buffer; "" means $TMPDIR, or next to the output
+	bufferWindow   int64  // 0 means buffer.DefaultWindow
+	bufferMode     BufferMode
+	memoryMax      int64 // most page data BufferAuto buffers in memory; 0 means defaultMemoryMax
+	readRate       int64 // bytes a second the pre-copy reads at most; 0 means no limit
+	writeRate      int64 // bytes a second the core is written at most; 0 means no limit
+	writeWorkers   int   // segments written at once
+	writeNice      int
+	writeIOPrio    IOPriority
+	filter         proc.DumpFilter
+	goroutines     bool
+	checksums      bool
+	tids           []int        // threads to write notes for; nil means all
+	maxThreads     int          // most threads to write notes for; 0 means all
+	base           string       // for an incremental or reflinked dump, the base core's path
+	reflink        bool         // write a full core, cloning what's unchanged from base
+	journal        string       // for a resumable dump, its journal's path
+	records        bool         // write page records for Replay, not a core
+	pidfd          int          // -1 if none
+	group          *groupMember // set by DumpAll
+
+	statsMu    sync.Mutex
+	stats      Stats
+	manifest   *Manifest // set by a successful Dump with checksums
+	phaseStart time.Time // of stats.Phase
+
+	stopDeadline time.Time // when the target has been stopped too long; zero if never
+	progress     progress  // reported to onProgress
+	estimate     uint64    // of the memory to copy, if there's an onProgress to tell
 }
 
-// parseFlags parses command line flags
-func parseFlags() (*Config, error) {
-	config := &Config{}
-
-	flag.IntVar(&config.MaxPasses, "passes", 2, "maximum pre-copy passes")
-	flag.Float64Var(&config.DirtyThreshold, "dirty-thresh", 5.0, "stop when dirty < threshold (percentage)")
-	flag.IntVar(&config.Concurrency, "concurrency", runtime.GOMAXPROCS(0), "concurrent read workers")
-	flag.BoolVar(&config.Verbose, "verbose", false, "show progress and statistics")
-	flag.BoolVar(&config.FixYama, "fix-yama", false, "automatically fix yama.ptrace_scope sysctl and restore on exit")
-
-	flag.Parse()
-
-	// Parse positional arguments
-	args := flag.Args()
-	if len(args) != 2 {
-		return nil, fmt.Errorf("usage: livecore [flags] <pid> <output.core>")
-	}
-
-	pid, err := strconv.Atoi(args[0])
-	if err != nil {
-		return nil, fmt.Errorf("invalid PID: %w", err)
-	}
-
-	config.Pid = pid
-	config.OutputFile = args[1]
-
-	// Validate configuration
-	if config.MaxPasses < 1 {
-		return nil, fmt.Errorf("max passes must be >= 1")
-	}
-
-	if config.DirtyThreshold < 0 || config.DirtyThreshold > 100 {
-		return nil, fmt.Errorf("dirty threshold must be between 0 and 100")
-	}
-
-	if config.Concurrency < 1 {
-		return nil, fmt.Errorf("concurrency must be >= 1")
-	}
-
-	// Convert percentage to ratio
-	config.DirtyThreshold = config.DirtyThreshold / 100.0
-
-	return config, nil
+// An Option configures a Dumper.
+type Option func(*Dumper)
+
+// New returns a Dumper for process pid. Without options, it makes two
+// pre-copy passes, stopping early when under 5% of pages are dirty, and
+// writes every note livecore knows.
+func New(pid int, opts ...Option) *Dumper {
+	d := &Dumper{
+		pid:            pid,
+		maxPasses:      2,
+		dirtyThreshold: 0.05,
+		concurrency:    runtime.GOMAXPROCS(0),
+		readBatch:      copy.DefaultReadBatch,
+		writeWorkers:   1,
+		logf:           log.Printf,
+		stopTimeout:    5 * time.Second,
+		sample:         100,
+		spaceCheck:     true,
+		swapIn:         true,
+		filter:         proc.DefaultDumpFilter,
+		pidfd:          -1,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	for d.sampleSeed == 0 {
+		d.sampleSeed = rand.Uint64()
+	}
+	return d
 }
 
-// checkYamaSysctl returns the value of yama.ptrace_scope.
-func checkYamaSysctl() (int, error) {
-	data, err := os.ReadFile("/proc/sys/kernel/yama/ptrace_scope")
-	if err != nil {
-		return 0, fmt.Errorf("failed to read yama.ptrace_scope: %w", err)
-	}
-
-	value, err := strconv.Atoi(strings.TrimSpace(string(data)))
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse yama.ptrace_scope value: %w", err)
-	}
-
-	return value, nil
-}
-
-// setYamaSysctl sets the yama.ptrace_scope sysctl value
-func setYamaSysctl(value int) error {
-	return os.WriteFile("/proc/sys/kernel/yama/ptrace_scope", []byte(fmt.Sprintf("%d\n", value)), 0644)
+// WithPasses sets the maximum number of pre-copy passes. Pre-copy stops
+// sooner once the dirty ratio is below WithDirtyThreshold's, or a pass
+// leaves nearly as many pages dirty as the one before, since the target
+// is then writing as fast as passes copy. Zero copies everything while
+// the target is stopped, as WithNoPreCopy does.
+func WithPasses(n int) Option { return func(d *Dumper) { d.maxPasses = n } }
+
+// WithNoPreCopy skips pre-copy, copying all of the target's memory while
+// it's stopped, so the stop lasts as long as the copy. It doesn't need
+// the kernel's soft-dirty page tracking, which pre-copy uses to find the
+// pages written since they were copied; Dump falls back to it, with a
+// warning, when that tracking is missing or the target's clear_refs
+// can't be written. An incremental dump can't do without it.
+func WithNoPreCopy(v bool) Option { return func(d *Dumper) { d.noPreCopy = v } }
+
+// WithDirect copies the target's memory straight into the core file, where
+// the segments will be, rather than into a scratch buffer to be written
+// out afterwards, halving the disk I/O and space a dump takes. The headers
+// go in space left for them at the start, and the notes at the end. It
+// implies WithNoPreCopy, since there's nowhere to keep what pre-copy read
+// until the final layout is known. Dump falls back to buffering, with a
+// warning, when writing to anything but a regular file. It can't be used
+// with WithCompressBuffer or WithVerifyWrite, which need the buffer, or
+// for a dump with a base (WithIncremental or WithReflinkBase).
+func WithDirect(v bool) Option { return func(d *Dumper) { d.direct = v } }
+
+// WithRecords makes Dump write a stream of records to its output instead
+// of a core, with no scratch buffer: each pre-copy pass's pages, and those
+// copied while the target is stopped, are written out as they're read, so
+// a page dirtied between passes is in the stream more than once. The
+// stream ends with the notes and the layout of the memory, and Replay
+// turns it into the core. It suits hosts with room for neither a scratch
+// buffer nor the core, with the output piped through a compressor to
+// somewhere else. What's been copied can't be read back while dumping, so
+// it can't be used with WithDirect, WithVerifyWrite, WithChecksums,
+// WithGoroutines, redaction, a journal, or a base.
+func WithRecords(v bool) Option { return func(d *Dumper) { d.records = v } }
+
+// WithMaxPreCopyTime limits how long pre-copy runs: no pass is started
+// that would likely end more than t after the first one started, judging
+// by the pass before. The first pass always runs. Zero means no limit,
+// the default.
+func WithMaxPreCopyTime(t time.Duration) Option { return func(d *Dumper) { d.maxPreCopyTime = t } }
+
+// WithDirtyThreshold ends pre-copy early once fewer than pct percent of
+// pages were dirtied during a pass.
+func WithDirtyThreshold(pct float64) Option {
+	return func(d *Dumper) { d.dirtyThreshold = pct / 100 }
 }
 
-// fixYamaSysctl temporarily sets yama.ptrace_scope to 0 and returns a cleanup function
-func fixYamaSysctl() (func(), error) {
-	originalValue, err := checkYamaSysctl()
-	if err != nil {
-		return nil, err
-	}
+// WithConcurrency sets how many workers read memory during pre-copy.
+func WithConcurrency(n int) Option { return func(d *Dumper) { d.concurrency = n } }
 
-	if originalValue == 0 {
-		// Already set to 0, no need to change
-		return func() {}, nil
-	}
+// WithReadBatch sets how many bytes of the target's memory one
+// process_vm_readv reads at most, rounded down to whole pages; the default
+// is 4MB. Pre-copy's workers each read a batch at a time, so smaller
+// batches spread a huge mapping across them, and keep any one read, and
+// the retry of one that fails, short.
+func WithReadBatch(n uint64) Option { return func(d *Dumper) { d.readBatch = n } }
 
-	// Set to 0
-	if err := setYamaSysctl(0); err != nil {
-		return nil, fmt.Errorf("failed to set yama.ptrace_scope to 0: %w", err)
-	}
+// WithVerbose logs progress and statistics.
+func WithVerbose(v bool) Option { return func(d *Dumper) { d.verbose = v } }
 
-	// Return cleanup function
-	return func() {
-		if err := setYamaSysctl(originalValue); err != nil {
-			log.Printf("Warning: failed to restore yama.ptrace_scope to %d: %v", originalValue, err)
-		}
-	}, nil
+// WithLogf sets where the Dumper logs. The default is log.Printf.
+func WithLogf(logf func(format string, args ...any)) Option {
+	return func(d *Dumper) { d.logf = logf }
 }
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	config, err := parseFlags()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Check yama sysctl and handle it
-	yamaValue, err := checkYamaSysctl()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
-	}
-
-	var cleanupYama func()
-	if yamaValue != 0 {
-		if config.FixYama {
-			// Automatically fix yama sysctl
-			cleanupYama, err = fixYamaSysctl()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: failed to fix yama sysctl: %v\n", err)
-				os.Exit(1)
-			}
-			log.Printf("Temporarily set yama.ptrace_scope to 0 (was %d)", yamaValue)
-		} else {
-			// Fail with instructions
-			fmt.Fprintf(os.Stderr, "Error: yama.ptrace_scope is set to %d (non-zero), which prevents ptrace\n", yamaValue)
-			fmt.Fprintf(os.Stderr, "To fix this, run: sudo sysctl kernel.yama.ptrace_scope=0\n")
-			fmt.Fprintf(os.Stderr, "Or use the --fix-yama flag to automatically fix and restore it\n")
-			os.Exit(1)
-		}
-	}
-
-	// Set up signal handling to ensure cleanup on exit
-	if cleanupYama != nil {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		go func() {
-			<-sigChan
-			log.Println("Received signal, cleaning up...")
-			cleanupYama()
-			os.Exit(1)
-		}()
-	}
-
-	// Run livecore
-	err = runLivecore(config)
-
-	// Clean up yama sysctl if we modified it
-	if cleanupYama != nil {
-		cleanupYama()
-	}
+// WithProgress makes the Dumper call f as it goes, one call at a time:
+// when each phase or pre-copy pass starts, and every tenth of a second or
+// so while it copies memory or writes the core. Some calls come while the
+// target is stopped, so f should be quick.
+func WithProgress(f func(Progress)) Option { return func(d *Dumper) { d.onProgress = f } }
+
+// WithStopTimeout sets how long to wait for threads to stop when freezing
+// the target. Zero waits forever; threads in uninterruptible sleep may
+// never stop.
+func WithStopTimeout(timeout time.Duration) Option {
+	return func(d *Dumper) { d.stopTimeout = timeout }
+}
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
-	}
+// WithAbortOnStopTimeout makes Dump fail if any thread doesn't stop within
+// the stop timeout, rather than dumping without it.
+func WithAbortOnStopTimeout(abort bool) Option {
+	return func(d *Dumper) { d.abortOnStuck = abort }
 }
 
-// runLivecore is the main function
-func runLivecore(config *Config) error {
-	if config.Verbose {
-		log.Printf("livecore: dumping process %d to %s\n", config.Pid, config.OutputFile)
-	}
+// WithMaxStopTime limits how long the target stays stopped. If freezing it,
+// reading its registers and maps, and copying its dirty pages take longer
+// than t, the copy stops where it got to and the target resumes;
+// WithStopOverrun says what becomes of the pages not yet copied, which are
+// listed in a LIVECORE note. Zero means no limit, the default.
+func WithMaxStopTime(t time.Duration) Option { return func(d *Dumper) { d.maxStopTime = t } }
 
-	// Create BufferManager for efficient memory buffering
-	bufferManager, err := buffer.NewBufferManager(config.OutputFile)
-	if err != nil {
-		return fmt.Errorf("failed to create buffer manager: %w", err)
-	}
-	defer bufferManager.Close()
+// WithStopOverrun says what Dump does with the pages it hadn't copied when
+// WithMaxStopTime's budget ran out. The default is OverrunFuzzy.
+func WithStopOverrun(o StopOverrun) Option { return func(d *Dumper) { d.stopOverrun = o } }
 
-	// Phase 1: Discovery
-	if config.Verbose {
-		log.Println("Phase 1: Discovery")
-	}
+// WithFreezeWorkers sets how many OS threads seize the target's threads
+// in parallel when it has hundreds; see proc.FreezeOptions.Workers.
+func WithFreezeWorkers(n int) Option { return func(d *Dumper) { d.freezeWorkers = n } }
 
-	// Parse VMAs
-	vmas, err := proc.ParseMaps(config.Pid)
-	if err != nil {
-		return fmt.Errorf("failed to parse maps: %w", err)
-	}
+// WithFreezeMethod sets how the target is frozen. With FreezeCgroup, its
+// whole cgroup is frozen while its threads are seized.
+func WithFreezeMethod(m FreezeMethod) Option { return func(d *Dumper) { d.freezeMethod = m } }
 
-	if config.Verbose {
-		log.Printf("Found %d VMAs", len(vmas))
-	}
+// WithPidView sets whose view of process and thread IDs the notes give.
+// The default, PidsNamespace, is the target's, as the kernel's cores do.
+func WithPidView(v PidView) Option { return func(d *Dumper) { d.pidView = v } }
 
-	// Parse threads
-	threads, err := proc.ParseThreads(config.Pid)
-	if err != nil {
-		return fmt.Errorf("failed to parse threads: %w", err)
-	}
+// WithNotes selects which notes to write.
+func WithNotes(sel elfcore.NoteSelection) Option { return func(d *Dumper) { d.notes = sel } }
 
-	if config.Verbose {
-		log.Printf("Found %d threads", len(threads))
-	}
+// WithCmdline says what to do with the command line, both in NT_PRPSINFO
+// and in the dumped memory.
+func WithCmdline(r elfcore.Redaction) Option { return func(d *Dumper) { d.cmdline = r } }
 
-	// Parse auxiliary vector
-	_, err = proc.GetAuxv(config.Pid)
-	if err != nil {
-		return fmt.Errorf("failed to get auxv: %w", err)
-	}
-
-	// Phase 2: Pre-copy (if enabled)
-	if config.Verbose {
-		log.Printf("MaxPasses: %d, DirtyThreshold: %.2f", config.MaxPasses, config.DirtyThreshold)
-	}
-	if config.MaxPasses > 0 {
-		if config.Verbose {
-			log.Println("Phase 2: Pre-copy")
-		}
+// WithOmitEnviron zeroes the environment strings in the dumped memory.
+func WithOmitEnviron(omit bool) Option { return func(d *Dumper) { d.omitEnviron = omit } }
 
-		preCopyEngine := copy.NewPreCopyEngine(
-			config.Pid,
-			config.MaxPasses,
-			config.DirtyThreshold,
-			config.Concurrency,
-			bufferManager,
-			config.Verbose,
-		)
-
-		// Convert proc.VMA to copy.VMA
-		copyVMAs := convertVMAsToCopy(vmas)
-		result, err := preCopyEngine.RunPreCopy(copyVMAs)
-		if err != nil {
-			return fmt.Errorf("pre-copy failed: %w", err)
-		}
+// WithRedactRanges zeroes the memory in rs before the core is written.
+// Like the other redactions, they're listed in a LIVECORE note.
+func WithRedactRanges(rs ...proc.AddrRange) Option {
+	return func(d *Dumper) { d.redactRanges = append(d.redactRanges, rs...) }
+}
 
-		if config.Verbose {
-			log.Printf("Pre-copy completed in %v", result.TotalTime)
-		}
-	}
+// WithRedactPatterns overwrites every match of res in the copied memory
+// with asterisks before the core is written, such as with SecretPatterns.
+// Each page copied is searched, which takes time for a big process, and
+// matches longer than 16 KB may be missed.
+func WithRedactPatterns(res ...*regexp.Regexp) Option {
+	return func(d *Dumper) { d.redactPatterns = append(d.redactPatterns, res...) }
+}
 
-	// Phase 3: Final stop and delta copy
-	if config.Verbose {
-		log.Println("Phase 3: Final stop and delta copy")
-	}
+// WithOmitAuxv leaves out the NT_AUXV note.
+func WithOmitAuxv(omit bool) Option { return func(d *Dumper) { d.omitAuxv = omit } }
 
-	log.Printf("Starting freeze.")
-	stopStart := time.Now()
+// WithAnnotations records annotations in a LIVECORE note.
+func WithAnnotations(as ...elfcore.Annotation) Option {
+	return func(d *Dumper) { d.annotations = append(d.annotations, as...) }
+}
 
-	// Freeze all threads
-	frozenThreads, err := proc.FreezeAllThreads(config.Pid)
-	if err != nil {
-		return fmt.Errorf("failed to freeze threads: %w", err)
-	}
+// WithContainer records c, the container the target runs in, in a
+// LIVECORE note. See proc.FindContainer.
+func WithContainer(c *proc.Container) Option { return func(d *Dumper) { d.container = c } }
 
-	log.Printf("[STW] Froze threads (took %v)", time.Since(stopStart))
-	preThreads := time.Now()
+// WithQuiesceTimeout asks a target using the quiesce package to reach a
+// clean point before it's frozen, waiting up to timeout for it.
+func WithQuiesceTimeout(timeout time.Duration) Option {
+	return func(d *Dumper) { d.quiesceTimeout = timeout }
+}
 
-	// Collect register state
-	if err := proc.CollectThreadRegisters(frozenThreads); err != nil {
-		proc.UnfreezeAllThreads(frozenThreads)
-		return fmt.Errorf("failed to collect registers: %w", err)
-	}
+// WithSample copies only a pseudo-random pct percent of pages, plus each
+// thread's live stack, chosen with seed (or a random seed, if zero).
+func WithSample(pct float64, seed uint64) Option {
+	return func(d *Dumper) { d.sample, d.sampleSeed = pct, seed }
+}
 
-	if config.Verbose {
-		log.Printf("[STW] Got thread registers (took %v)", time.Since(preThreads))
-	}
+// WithResidentOnly copies only pages resident in RAM.
+func WithResidentOnly(v bool) Option { return func(d *Dumper) { d.residentOnly = v } }
+
+// WithThreads limits the register notes to the threads in tids. The
+// whole process is still frozen; the other threads' registers just aren't
+// collected, and they're listed in a LIVECORE note instead.
+func WithThreads(tids []int) Option { return func(d *Dumper) { d.tids = tids } }
+
+// WithMaxThreads limits the register notes to the first n threads, in
+// /proc/<pid>/task order, after any WithThreads selection. Zero means no
+// limit.
+func WithMaxThreads(n int) Option { return func(d *Dumper) { d.maxThreads = n } }
+
+// WithSwapIn sets whether swapped-out pages are faulted back in to be
+// copied, the default. Without it, they're left out, so the target never
+// waits on swap for the dump's sake; they read as zeros, or as their
+// pre-copy contents if they were swapped out since.
+func WithSwapIn(v bool) Option { return func(d *Dumper) { d.swapIn = v } }
+
+// WithCompressBuffer keeps buffered pages lz4-compressed.
+func WithCompressBuffer(v bool) Option { return func(d *Dumper) { d.compressBuffer = v } }
+
+// WithSpaceCheck sets whether Dump refuses to start when the scratch
+// buffer's filesystem looks too small. It's on by default.
+func WithSpaceCheck(v bool) Option { return func(d *Dumper) { d.spaceCheck = v } }
+
+// WithVerifyWrite reads the core back after writing it and checks it
+// against the scratch buffer.
+func WithVerifyWrite(mode VerifyMode) Option { return func(d *Dumper) { d.verify = mode } }
+
+// WithSparse sets which zeros are left as holes in the core file; see
+// elfcore.Sparse. The default is elfcore.SparseAuto.
+func WithSparse(s elfcore.Sparse) Option { return func(d *Dumper) { d.sparse = s } }
+
+// WithWriteCache sets how writing a core file treats the page cache; see
+// elfcore.CacheMode. CacheDrop and CacheDirect keep a big core from
+// evicting the pages of the host's processes, the target's included, at
+// the cost of waiting for the disk. The default is elfcore.CacheKeep.
+func WithWriteCache(m elfcore.CacheMode) Option { return func(d *Dumper) { d.writeCache = m } }
+
+// WithChecksums makes Dump checksum each of the core's segments, and the
+// target's executable, and find the build IDs of the files it has mapped,
+// for Manifest to return once it's done. Checksumming reads the whole
+// scratch buffer once more, after the target has resumed.
+func WithChecksums(v bool) Option { return func(d *Dumper) { d.checksums = v } }
+
+// WithTempDir sets where the scratch buffer goes, such as on a fast local
+// disk when the core goes to slower network storage. By default it goes in
+// $TMPDIR, if that's set, or else next to the output file, or in
+// os.TempDir if the output isn't a file. A direct dump has no scratch
+// buffer, and a resumable one keeps it next to its journal.
+func WithTempDir(dir string) Option { return func(d *Dumper) { d.tempDir = dir } }
+
+// WithBufferWindow sets the most the scratch buffer may hold, counting
+// the holes of memory that isn't copied: at least the size of the
+// target's mappings. The buffer reserves that much address space, and
+// grows its file as needed; a dump that wouldn't fit fails before
+// freezing the target. Zero means 512GB, the default.
+func WithBufferWindow(n int64) Option { return func(d *Dumper) { d.bufferWindow = n } }
+
+// WithBuffer sets where the scratch buffer goes: on disk, in a temporary
+// file, the default; or in memory, in a memfd, so that copying does no
+// disk I/O until the core is written. With BufferAuto, it goes in memory
+// if the dump looks like it will copy at most memoryMax bytes, and at most
+// half the memory the system has available, and on disk otherwise; zero
+// means 4GB. A buffer in memory counts against livecore's memory cgroup. A direct dump
+// has no buffer, and a resumable one keeps it in a file, so they can't
+// use BufferMemory, and BufferAuto leaves theirs as it is.
+func WithBuffer(mode BufferMode, memoryMax int64) Option {
+	return func(d *Dumper) { d.bufferMode, d.memoryMax = mode, memoryMax }
+}
 
-	// Re-scan maps (authoritative at stop time)
-	preMaps := time.Now()
-	finalVMAs, err := proc.ParseMaps(config.Pid)
-	if err != nil {
-		proc.UnfreezeAllThreads(frozenThreads)
-		return fmt.Errorf("failed to re-scan maps: %w", err)
-	}
+// WithReadRate limits how fast the pre-copy passes read the target's
+// memory, in bytes a second, so they take less memory bandwidth from it.
+// The final copy, with the target frozen, isn't limited. Zero means no
+// limit, the default.
+func WithReadRate(bytesPerSec int64) Option { return func(d *Dumper) { d.readRate = bytesPerSec } }
+
+// WithWriteRate limits how fast the core is written, in bytes a second.
+// Zero means no limit, the default.
+func WithWriteRate(bytesPerSec int64) Option { return func(d *Dumper) { d.writeRate = bytesPerSec } }
+
+// WithWriteConcurrency sets how many segments of the core are written at
+// once, when writing to a regular file; see elfcore.ELFWriter.SetConcurrency.
+// The default, 1, suits any disk; a few more keep NVMe busy.
+func WithWriteConcurrency(n int) Option { return func(d *Dumper) { d.writeWorkers = n } }
+
+// WithWritePriority sets the nice value and I/O priority of the thread
+// writing the core, which runs after the target is thawed, so that it
+// yields to the target and everything else on the machine. A nice value of
+// zero and the zero IOPriority leave livecore's own priorities alone.
+func WithWritePriority(nice int, iop IOPriority) Option {
+	return func(d *Dumper) { d.writeNice, d.writeIOPrio = nice, iop }
+}
 
-	if config.Verbose {
-		log.Printf("[STW] Got final VMAs (took %v)", time.Since(preMaps))
-	}
+// WithDumpFilter selects which VMAs are dumped; the default is
+// proc.DefaultDumpFilter. VMAs it leaves out aren't copied at all, and are
+// listed in a LIVECORE note.
+func WithDumpFilter(f proc.DumpFilter) Option { return func(d *Dumper) { d.filter = f } }
+
+// WithPidfd names the target by pidfd as well as by pid, so it can't be
+// confused with another process that reuses its pid: Dump checks, once
+// the target is frozen, that the pidfd's process is still alive. The
+// pidfd must refer to pid; see proc.PidfdPid.
+func WithPidfd(fd int) Option { return func(d *Dumper) { d.pidfd = fd } }
+
+// WithGoroutines, for a Go target, records its goroutines' IDs, states,
+// and stack bounds in a LIVECORE note, found using the symbol table and
+// DWARF in its executable. For other targets, it only logs a warning.
+func WithGoroutines(v bool) Option { return func(d *Dumper) { d.goroutines = v } }
+
+// WithIncremental makes Dump write an incremental core, holding only the
+// pages that changed since base, the path of an earlier core of the same
+// process written by livecore; the rest are left as holes. It uses the
+// soft-dirty bits, so base must be the last core livecore wrote of the
+// process, and nothing else may have cleared them since.
+// elfcore.MergeCores rebuilds the full core. It can't be combined with
+// WithSample, WithResidentOnly, or DumpAll.
+func WithIncremental(base string) Option {
+	return func(d *Dumper) { d.base, d.reflink = base, false }
+}
 
-	// Copy remaining dirty pages (re-scan after freeze to get current dirty state)
-	if err := copyRemainingDirtyPages(config, finalVMAs, bufferManager); err != nil {
-		proc.UnfreezeAllThreads(frozenThreads)
-		return fmt.Errorf("failed to copy remaining dirty pages: %w", err)
-	}
+// WithReflinkBase makes Dump write a full core, but copy only the pages
+// that changed since base, as WithIncremental does, taking the rest from
+// base's file. Where the filesystem has reflinks, such as XFS or btrfs,
+// and the core is a regular file on the same one, base's blocks are
+// shared with the core rather than copied, so dumping a process again and
+// again costs little more than the memory it changed each time. Elsewhere
+// they're copied. It has WithIncremental's requirements, and replaces it.
+func WithReflinkBase(base string) Option {
+	return func(d *Dumper) { d.base, d.reflink = base, true }
+}
 
-	// Unfreeze threads immediately after final delta copy
-	// The core file writing can take a long time, so we don't want to keep
-	// the target process frozen during that time
-	if err := proc.UnfreezeAllThreads(frozenThreads); err != nil {
-		return fmt.Errorf("failed to unfreeze threads: %w", err)
-	}
+// WithJournal makes Dump resumable: if it's interrupted, as by a crash,
+// the OOM killer, or a cancelled context, another Dump with the same
+// journal path takes up where it left off, rather than copying all the
+// memory again. Its scratch buffer is the file path+".buf", not an
+// unlinked temporary file, and path records where each VMA's pages are in
+// it, and which of them it can't vouch for, each time pre-copy clears the
+// soft-dirty bits. A Dump that finds path left by an interrupted dump of
+// the target checks that its mappings are the same, and copies again only
+// the pages of those that aren't, those the journal doesn't vouch for, and
+// those soft-dirty since, before writing the whole core from the buffer.
+// Both files are removed once the core is written. Nothing else may clear
+// the soft-dirty bits in between. It needs pre-copy, and can't be combined
+// with WithDirect, WithCompressBuffer, WithSample, a base, or DumpAll.
+func WithJournal(path string) Option { return func(d *Dumper) { d.journal = path } }
+
+// VerifyMode says how much of a core WithVerifyWrite checks.
+type VerifyMode int
+
+const (
+	VerifyOff    VerifyMode = iota // don't check
+	VerifySample                   // compare one page in 64
+	VerifyAll                      // compare every page
+)
 
-	if config.Verbose {
-		log.Printf("[STW] Unfrozen threads at STOP+%v", time.Since(stopStart))
-	}
+// ParseVerifyMode parses a VerifyMode name: off, sample, or all.
+func ParseVerifyMode(s string) (VerifyMode, error) {
+	switch s {
+	case "off":
+		return VerifyOff, nil
+	case "sample":
+		return VerifySample, nil
+	case "all":
+		return VerifyAll, nil
+	}
+	return 0, fmt.Errorf("unknown verify mode %q (want off, sample, or all)", s)
+}
 
-	stopTime := time.Since(stopStart)
+// BufferMode says where WithBuffer puts the scratch buffer.
+type BufferMode int
 
-	log.Printf("[STW] Done; total stop time was %v", stopTime)
+const (
+	BufferDisk   BufferMode = iota // in a temporary file; see WithTempDir
+	BufferMemory                   // in a memfd
+	BufferAuto                     // in memory if the dump is small enough, or else on disk
+)
 
-	// Phase 4: Generate ELF core file
-	if config.Verbose {
-		log.Println("Phase 4: Generate ELF core file")
-	}
+// ParseBufferMode parses a BufferMode name: disk, memory, or auto.
+func ParseBufferMode(s string) (BufferMode, error) {
+	switch s {
+	case "disk":
+		return BufferDisk, nil
+	case "memory":
+		return BufferMemory, nil
+	case "auto":
+		return BufferAuto, nil
+	}
+	return 0, fmt.Errorf("unknown buffer mode %q (want disk, memory, or auto)", s)
+}
 
-	// Build file table from VMAs (for NT_FILE note)
-	var fileTable []elfcore.FileEntry
-	for _, vma := range finalVMAs {
-		// Only include file-backed mappings
-		if vma.Path != "" && vma.Inode != 0 {
-			fileTable = append(fileTable, elfcore.FileEntry{
-				Start:   vma.Start,
-				End:     vma.End,
-				FileOfs: vma.Offset,
-				Dev:     vma.Dev,
-				Inode:   vma.Inode,
-				Path:    vma.Path,
-			})
-		}
-	}
+// FreezeMethod says how WithFreezeMethod freezes the target.
+type FreezeMethod int
 
-	// Create core info
-	coreInfo := &elfcore.CoreInfo{
-		Pid:       config.Pid,
-		Threads:   convertThreads(frozenThreads),
-		VMAs:      convertVMAs(finalVMAs),
-		FileTable: fileTable,
-	}
+const (
+	FreezePtrace FreezeMethod = iota // seize threads one by one, rescanning for new ones
+	FreezeCgroup                     // seize threads while the target's cgroup is frozen
+)
 
-	// Create notes
-	notes, err := elfcore.CreateCoreNotes(config.Pid, coreInfo.Threads, coreInfo.FileTable)
-	if err != nil {
-		return fmt.Errorf("failed to create notes: %w", err)
+// ParseFreezeMethod parses a FreezeMethod name: ptrace or cgroup.
+func ParseFreezeMethod(s string) (FreezeMethod, error) {
+	switch s {
+	case "ptrace":
+		return FreezePtrace, nil
+	case "cgroup":
+		return FreezeCgroup, nil
 	}
+	return 0, fmt.Errorf("unknown freeze method %q (want ptrace or cgroup)", s)
+}
 
-	coreInfo.Notes = notes
-
-	// Write ELF core file
-	preCore := time.Now()
-	elfWriter, err := elfcore.NewELFWriter(config.OutputFile, coreInfo, bufferManager)
-	if err != nil {
-		return fmt.Errorf("failed to create ELF writer: %w", err)
-	}
-	defer elfWriter.Close()
+// StopOverrun says what WithStopOverrun does with the pages left uncopied
+// when the stop-time budget runs out.
+type StopOverrun int
 
-	if err := elfWriter.WriteCore(); err != nil {
-		return fmt.Errorf("failed to write core file: %w", err)
-	}
+const (
+	// OverrunFuzzy copies them once the target has resumed, so they may
+	// be newer than the registers and the rest of memory.
+	OverrunFuzzy StopOverrun = iota
+	// OverrunAbort leaves them as pre-copy last read them, or zeros.
+	OverrunAbort
+)
 
-	if config.Verbose {
-		log.Printf("Core dump completed in %v", time.Since(preCore).Round(time.Millisecond))
+// ParseStopOverrun parses a StopOverrun name: fuzzy or abort.
+func ParseStopOverrun(s string) (StopOverrun, error) {
+	switch s {
+	case "fuzzy":
+		return OverrunFuzzy, nil
+	case "abort":
+		return OverrunAbort, nil
 	}
-
-	return nil
+	return 0, fmt.Errorf("unknown stop overrun policy %q (want fuzzy or abort)", s)
 }
 
-// copyRemainingDirtyPages copies the remaining dirty pages after freeze
-// This is the final delta copy - we only copy pages that are still dirty
-// after the process has been frozen, ensuring we capture the final state
-func copyRemainingDirtyPages(config *Config, vmas []proc.VMA, bufferManager *buffer.Manager) error {
-	if config.Verbose {
-		log.Println("Copying remaining dirty pages...")
-	}
-
-	// Create a new page map to scan for dirty pages after freeze
-	pageMap := copy.NewPageMap(config.Pid)
+// PidView says whose view of process and thread IDs a core's notes give,
+// when the target is in another PID namespace, as in a container.
+type PidView int
 
-	// Get current dirty pages (after freeze)
-	preDisco := time.Now()
-	currentDirtyPages, err := pageMap.GetDirtyPages(convertVMAsToCopy(vmas))
-	if err != nil {
-		return fmt.Errorf("failed to get current dirty pages: %w", err)
-	}
-	durDisco := time.Since(preDisco).Round(time.Millisecond)
-	if config.Verbose {
-		log.Printf("Found remaining dirty pages in %v", durDisco)
-	}
+const (
+	PidsNamespace PidView = iota // the IDs the target sees in its own namespace
+	PidsHost                     // the IDs livecore sees
+)
 
-	// Copy only the dirty pages using process_vm_readv
-	// This is the minimal final copy to capture the exact state at freeze time
-	if config.Verbose {
-		log.Printf("Found %d dirty pages to copy", len(currentDirtyPages))
+// ParsePidView parses a PidView name: namespace or host.
+func ParsePidView(s string) (PidView, error) {
+	switch s {
+	case "namespace":
+		return PidsNamespace, nil
+	case "host":
+		return PidsHost, nil
 	}
+	return 0, fmt.Errorf("unknown pid view %q (want namespace or host)", s)
+}
 
-	preCopy := time.Now()
+// PhaseError is the error Dump returns, recording which phase of the dump
+// went wrong.
+type PhaseError struct {
+	Phase string // setup, discovery, precopy, freeze, or write
+	Err   error
+}
 
-	for pageAddr, vma := range currentDirtyPages {
-		t0 := time.Now()
-		if err := copyDirtyPage(config.Pid, pageAddr, *vma, bufferManager); err != nil {
-			// Log but don't fail - some pages might not be readable
-			if config.Verbose {
-				log.Printf("Warning: failed to copy page at %x: %v", pageAddr, err)
-			}
+func (e *PhaseError) Error() string { return e.Err.Error() }
+func (e *PhaseError) Unwrap() error { return e.Err }
+
+// check reports whether d's options make sense.
+func (d *Dumper) check() error {
+	based := "an incremental dump"
+	if d.reflink {
+		based = "a dump with a reflink base"
+	}
+	switch {
+	case d.dirtyThreshold < 0 || d.dirtyThreshold > 1:
+		return fmt.Errorf("dirty threshold must be between 0 and 100")
+	case d.concurrency < 1:
+		return fmt.Errorf("concurrency must be >= 1")
+	case d.readBatch < uint64(os.Getpagesize()):
+		return fmt.Errorf("read batch must be at least a page")
+	case d.writeWorkers < 1:
+		return fmt.Errorf("write concurrency must be >= 1")
+	case d.sample <= 0 || d.sample > 100:
+		return fmt.Errorf("sample must be above 0 and at most 100")
+	case d.freezeWorkers < 0:
+		return fmt.Errorf("freeze workers must be >= 0")
+	case d.base != "" && (d.sample < 100 || d.residentOnly):
+		return fmt.Errorf("%s can't be sampled or resident-only", based)
+	case d.base != "" && (d.noPreCopy || d.direct):
+		return fmt.Errorf("%s needs pre-copy's soft-dirty tracking", based)
+	case d.direct && d.compressBuffer:
+		return fmt.Errorf("a direct dump has no buffer to compress")
+	case d.direct && d.verify != VerifyOff:
+		return fmt.Errorf("a direct dump has no buffer to verify the core against")
+	case d.direct && d.bufferMode == BufferMemory:
+		return fmt.Errorf("a direct dump has no buffer to keep in memory")
+	case d.memoryMax < 0:
+		return fmt.Errorf("the most to buffer in memory must be >= 0")
+	case d.reflink && (d.cmdline != elfcore.RedactNone || d.omitEnviron || len(d.redactRanges) > 0 || len(d.redactPatterns) > 0):
+		// Redacting only zeros the copied pages, not the base's.
+		return fmt.Errorf("a dump with a reflink base can't redact memory")
+	case d.base != "" && d.group != nil:
+		return fmt.Errorf("%s of several processes at once isn't supported", based)
+	case d.journal != "" && (d.noPreCopy || d.direct || d.maxPasses == 0):
+		return fmt.Errorf("a resumable dump needs pre-copy's soft-dirty tracking")
+	case d.journal != "" && (d.compressBuffer || d.sample < 100):
+		return fmt.Errorf("a resumable dump can't compress its buffer or be sampled")
+	case d.journal != "" && d.bufferMode == BufferMemory:
+		return fmt.Errorf("a resumable dump keeps its buffer in a file, not in memory")
+	case d.journal != "" && (d.base != "" || d.group != nil):
+		return fmt.Errorf("a resumable dump can't have a base or be of several processes at once")
+	case d.records && (d.direct || d.journal != "" || d.base != ""):
+		return fmt.Errorf("a dump to records can't be direct, resumable, or have a base")
+	case d.records && (d.verify != VerifyOff || d.checksums || d.goroutines):
+		return fmt.Errorf("a dump to records can't read its memory back to verify, checksum, or find goroutines")
+	case d.records && (d.cmdline != elfcore.RedactNone || d.omitEnviron || len(d.redactRanges) > 0 || len(d.redactPatterns) > 0):
+		return fmt.Errorf("a dump to records can't redact memory")
+	case d.records && (d.compressBuffer || d.bufferMode == BufferMemory):
+		return fmt.Errorf("a dump to records has no buffer to compress or keep in memory")
+	}
+	if d.pidfd >= 0 {
+		pid, err := proc.PidfdPid(d.pidfd)
+		if err != nil {
+			return err
 		}
-		if config.Verbose {
-			d := time.Since(t0)
-			if d > 10*time.Millisecond {
-				log.Printf("Copied final dirty page at %x in %v", pageAddr, d)
-			}
+		if pid != d.pid {
+			return fmt.Errorf("pidfd %d refers to process %d, not %d", d.pidfd, pid, d.pid)
 		}
 	}
-
-	if config.Verbose {
-		durCopy := time.Since(preCopy).Round(time.Millisecond)
-		durTotal := time.Since(preDisco).Round(time.Millisecond)
-		log.Printf("Copied final %d dirty pages in %v (discovery %v + copy %v)", len(currentDirtyPages), durTotal, durDisco, durCopy)
-	}
-
 	return nil
 }
 
-// copyDirtyPage copies a single dirty page to the BufferManager
-func copyDirtyPage(pid int, pageAddr uintptr, vma copy.VMA, bufferManager *buffer.Manager) error {
-	// Get page size
-	pageSize := copy.GetPageSize()
-
-	// Get the offset for this page in the temp file
-	pageOffset := bufferManager.GetOffsetForVMA(uint64(vma.Start), vma.Size)
-
-	// Get the mmap pointer for this page
-	vmaBase, err := bufferManager.GetMmapPointer(pageOffset)
+// Dump dumps the process to w.
+//
+// If w is a regular file, the core is written straight into it, from its
+// start. Otherwise, such as for a pipe, the core is streamed to w in one
+// pass, holes and all; with WithVerifyWrite, which has to read the core
+// back, it's written to a temporary file first and copied to w. The
+// scratch buffer, as large as the memory copied, goes in the WithTempDir
+// directory, in $TMPDIR, next to the output file, or in os.TempDir.
+//
+// Cancelling ctx stops the dump between phases. Once the target is
+// frozen, the dump carries on until it's resumed, so the target isn't left
+// stopped.
+func (d *Dumper) Dump(ctx context.Context, w io.Writer) error {
+	if err := d.check(); err != nil {
+		return &PhaseError{Phase: "setup", Err: err}
+	}
+	if err := d.preflight(); err != nil {
+		return &PhaseError{Phase: "setup", Err: err}
+	}
+	if regularFile(w) != nil || d.verify == VerifyOff {
+		return d.dumpOnOwnThread(ctx, w)
+	}
+
+	dir := d.tempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f, err := os.CreateTemp(dir, "livecore-*.core")
 	if err != nil {
-		return fmt.Errorf("failed to get mmap pointer: %w", err)
+		return &PhaseError{Phase: "setup", Err: fmt.Errorf("failed to create temporary core file: %w", err)}
 	}
-	// Then adjust up to where in that VMA the page is
-	mmapPtr := unsafe.Add(vmaBase, uintptr(pageAddr-vma.Start))
-
-	// Copy the page directly to mmap
-	err = copy.CopyMemoryToMmap(pid, pageAddr, uint64(pageSize), mmapPtr)
-	if err != nil {
-		// Skip pages that can't be read (like vsyscall, etc.)
-		if err == unix.ENOENT || err == unix.EFAULT {
-			return nil
-		}
-		return fmt.Errorf("failed to read page at %x: %w", pageAddr, err)
+	defer f.Close()
+	os.Remove(f.Name()) // we only need the open fd
+	if err := d.dumpOnOwnThread(ctx, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return &PhaseError{Phase: "write", Err: err}
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return &PhaseError{Phase: "write", Err: fmt.Errorf("failed to copy core: %w", err)}
 	}
-
 	return nil
 }
 
-// convertThreads converts proc.Thread to elfcore.Thread
-func convertThreads(threads []proc.Thread) []elfcore.Thread {
-	var result []elfcore.Thread
-	for _, thread := range threads {
-		result = append(result, elfcore.Thread{
-			Tid:       thread.Tid,
-			Registers: thread.Registers,
-		})
-	}
-	return result
+// dumpOnOwnThread runs dump on a goroutine of its own, which exits when
+// it's done. If dump leaves its OS thread locked, tracing threads that
+// never stopped, the thread exits with it, and the kernel detaches them.
+func (d *Dumper) dumpOnOwnThread(ctx context.Context, out io.Writer) error {
+	errc := make(chan error, 1)
+	go func() { errc <- d.dump(ctx, out) }()
+	return <-errc
 }
 
-// convertVMAsToCopy converts proc.VMA to copy.VMA
-func convertVMAsToCopy(vmas []proc.VMA) []copy.VMA {
-	var result []copy.VMA
-	for _, vma := range vmas {
-		result = append(result, copy.VMA{
-			Start:  vma.Start,
-			End:    vma.End,
-			Size:   vma.MemSize,
-			Perms:  copy.Perm(vma.Perms),
-			IsZero: vma.IsZero,
-		})
+// regularFile returns w if it's a regular file, and nil otherwise.
+func regularFile(w io.Writer) *os.File {
+	if f, ok := w.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			return f
+		}
 	}
-	return result
+	return nil
 }
 
-// convertVMAs converts proc.VMA to elfcore.VMA
-func convertVMAs(vmas []proc.VMA) []elfcore.VMA {
-	var result []elfcore.VMA
-	for _, vma := range vmas {
-		result = append(result, elfcore.VMA{
-			Start:      vma.Start,
-			End:        vma.End,
-			Perms:      elfcore.Perm(vma.Perms),
-			Offset:     vma.Offset,
-			Dev:        vma.Dev,
-			Inode:      vma.Inode,
-			Path:       vma.Path,
-			Kind:       elfcore.VMAKind(vma.Kind),
-			IsZero:     vma.IsZero,
-			FileOffset: vma.FileOffset,
-			MemSize:    vma.MemSize,
-		})
+// EstimateSize estimates how many bytes of memory dumping the process
+// would copy, which is about how much disk space both the scratch buffer
+// and the core take.
+func (d *Dumper) EstimateSize() (uint64, error) {
+	vmas, err := proc.ParseMaps(d.pid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse maps: %w", err)
 	}
-	return result
+	total, _ := d.estimateDumpSize(d.filterVMAs(vmas))
+	return total, nil
 }
@@ -0,0 +1,97 @@
+package livecore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// A Manifest describes a core for checking it once it's been shipped to
+// another machine: what each segment should hash to, and what the process
+// was running, so the right binaries and debug info can be found. Dump
+// makes one with WithChecksums; Dumper.Manifest returns it. It's meant to
+// be written next to the core as JSON.
+type Manifest struct {
+	Pid       int       `json:"pid"`
+	Hostname  string    `json:"hostname,omitempty"`
+	Time      time.Time `json:"time"` // when the target was frozen
+	Exe       string    `json:"exe,omitempty"`
+	ExeSHA256 string    `json:"exeSHA256,omitempty"`
+
+	// BuildIDs lists the build IDs of the ELF files the target had
+	// mapped, its executable and shared libraries.
+	BuildIDs []proc.BuildID `json:"buildIDs,omitempty"`
+
+	// HostPaths maps the paths of files the target mapped, as it saw
+	// them, to paths outside its mount namespace, if it had its own.
+	HostPaths map[string]string `json:"hostPaths,omitempty"`
+
+	// Segments lists the core's PT_LOAD segments and the SHA-256 of
+	// each's contents, with holes as zeros, in the order they're in the
+	// core, so they can be checked even after the core is compressed
+	// and decompressed.
+	Segments []ManifestSegment `json:"segments"`
+
+	// Core, if set, is the SHA-256 and size of the core file as written,
+	// compressed or not. Dump doesn't know it; the caller fills it in.
+	Core *FileChecksum `json:"core,omitempty"`
+}
+
+// A ManifestSegment is the checksum of one of a core's PT_LOAD segments.
+type ManifestSegment struct {
+	Start  string `json:"start"` // hex address
+	End    string `json:"end"`
+	SHA256 string `json:"sha256"`
+}
+
+// A FileChecksum is the SHA-256 and size of a file.
+type FileChecksum struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Manifest returns the manifest of the core Dump wrote, if WithChecksums
+// asked for one and Dump succeeded, or else nil.
+func (d *Dumper) Manifest() *Manifest {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	return d.manifest
+}
+
+// makeManifest builds the manifest of the core of info, with memory from
+// mem, hashing every segment. It has to be called before the core is
+// written, which frees mem's pages as it goes.
+func (d *Dumper) makeManifest(info *elfcore.CoreInfo, mem elfcore.MemorySource, buildIDs []proc.BuildID) (*Manifest, error) {
+	start := time.Now()
+	m := &Manifest{
+		Pid:       d.pid,
+		Time:      time.Unix(0, info.FreezeStart.Realtime),
+		BuildIDs:  buildIDs,
+		HostPaths: info.HostPaths,
+	}
+	m.Hostname, _ = os.Hostname()
+	var err error
+	if m.Exe, m.ExeSHA256, err = proc.ExeSHA256(d.pid); err != nil {
+		d.logf("Warning: not recording the executable's checksum: %v", err)
+	}
+	sums, err := elfcore.HashSegments(info, mem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum segments: %w", err)
+	}
+	for _, s := range sums {
+		m.Segments = append(m.Segments, ManifestSegment{
+			Start:  fmt.Sprintf("%x", s.Start),
+			End:    fmt.Sprintf("%x", s.End),
+			SHA256: hex.EncodeToString(s.SHA256[:]),
+		})
+	}
+	if d.verbose {
+		d.logf("Checksummed %d segments and found %d build IDs (took %v)",
+			len(m.Segments), len(m.BuildIDs), time.Since(start).Round(time.Millisecond))
+	}
+	return m, nil
+}
@@ -0,0 +1,115 @@
+package livecore
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/internal/buffer"
+	"github.com/bradfitz/livecore/internal/vmaindex"
+)
+
+// bufferMemory is the elfcore.MemorySource for a dump: the pages copied
+// into the scratch buffer, which it frees as each VMA is written out
+// unless told to keep them.
+type bufferMemory struct {
+	bm    *buffer.Manager
+	vmas  []elfcore.VMA
+	index *vmaindex.Index
+	keep  bool // don't free pages once written, so the core can be verified
+
+	// inPlace says the buffer is the core file, with each VMA's pages
+	// where its segment goes.
+	inPlace bool
+}
+
+func newBufferMemory(bm *buffer.Manager, vmas []elfcore.VMA) *bufferMemory {
+	return &bufferMemory{
+		bm:   bm,
+		vmas: vmas,
+		index: vmaindex.New(len(vmas), func(i int) (uintptr, uintptr) {
+			return vmas[i].Start, vmas[i].End
+		}),
+	}
+}
+
+// offset returns where the size bytes at addr are in the temp file. They
+// must be within one VMA.
+func (m *bufferMemory) offset(addr uintptr, size uint64) (buffer.TmpOffset, error) {
+	i, ok := m.index.Lookup(addr)
+	if !ok || uint64(m.vmas[i].End-addr) < size {
+		return 0, fmt.Errorf("range %x+%x is not within a VMA", addr, size)
+	}
+	vma := m.vmas[i]
+	tmpOffset, ok := m.bm.GetExistingOffsetForVMA(uint64(vma.Start), vma.Size())
+	if !ok {
+		return 0, fmt.Errorf("VMA %x-%x was not copied during pre-copy phase", vma.Start, vma.End)
+	}
+	return tmpOffset + buffer.TmpOffset(addr-vma.Start), nil
+}
+
+// segmentOffset returns where vma's pages are in the buffer, for
+// elfcore.NewInPlaceWriter.
+func (m *bufferMemory) segmentOffset(vma elfcore.VMA) (uint64, bool) {
+	tmpOffset, ok := m.bm.GetExistingOffsetForVMA(uint64(vma.Start), vma.Size())
+	return uint64(tmpOffset), ok
+}
+
+func (m *bufferMemory) ReadAt(p []byte, addr uintptr) (int, error) {
+	tmpOffset, err := m.offset(addr, uint64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	if err := m.bm.WriteDataTo(sliceWriter(p), 0, tmpOffset, uint64(len(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (m *bufferMemory) DataExtents(start uintptr, size uint64) ([]elfcore.Extent, error) {
+	tmpOffset, err := m.offset(start, size)
+	if err != nil {
+		return nil, err
+	}
+	// Pages that were never faulted in were never copied and are holes
+	// in the temp file.
+	extents, err := m.bm.DataExtents(tmpOffset, size)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]elfcore.Extent, len(extents))
+	for i, e := range extents {
+		result[i] = elfcore.Extent{Offset: e.Offset, Length: e.Length}
+	}
+	return result, nil
+}
+
+func (m *bufferMemory) WriteMemoryTo(w io.WriterAt, off int64, addr uintptr, size uint64) error {
+	tmpOffset, err := m.offset(addr, size)
+	if err != nil {
+		return err
+	}
+	return m.bm.WriteDataTo(w, off, tmpOffset, size)
+}
+
+// Release punches the range out of the temp file to free disk space.
+func (m *bufferMemory) Release(start uintptr, size uint64) error {
+	if m.keep {
+		return nil
+	}
+	tmpOffset, err := m.offset(start, size)
+	if err != nil {
+		return err
+	}
+	return m.bm.PunchHole(tmpOffset, size)
+}
+
+// sliceWriter is an io.WriterAt into a byte slice.
+type sliceWriter []byte
+
+func (s sliceWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(s)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(s[off:], p), nil
+}
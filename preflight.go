@@ -0,0 +1,218 @@
+package livecore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/livecore/internal/copy"
+	"github.com/bradfitz/livecore/proc"
+	"golang.org/x/sys/unix"
+)
+
+// A CheckResult is the outcome of one of Preflight's checks.
+type CheckResult struct {
+	Name string // what was checked, such as "ptrace access"
+	Err  error  // why it failed, or nil if it passed
+	Fix  string // what to do about a failure
+
+	// Warning is set for failures that only make the dump worse, or
+	// might make it fail, rather than certainly.
+	Warning bool
+}
+
+// Failed reports whether the check failed outright.
+func (r CheckResult) Failed() bool { return r.Err != nil && !r.Warning }
+
+// Preflight checks, without stopping or otherwise disturbing pid, that
+// the calling process can dump it: that it may ptrace it, given its
+// capabilities, the target's owner and dumpable flag, and the Yama LSM;
+// that it can read the target's memory; whether it can pre-copy, which
+// needs to read the target's pagemap, clear its soft-dirty bits, and a
+// kernel that tracks them; and whether it runs under a seccomp filter,
+// which may block the system calls it needs. Dump runs these checks first
+// and fails on the first that fails outright, with its Fix.
+func Preflight(pid int) []CheckResult {
+	var results []CheckResult
+	add := func(name string, err error, fix string) {
+		results = append(results, CheckResult{Name: name, Err: err, Fix: fix})
+	}
+	warn := func(name string, err error, fix string) {
+		results = append(results, CheckResult{Name: name, Err: err, Fix: fix, Warning: true})
+	}
+
+	target, err := proc.ReadStatus(pid)
+	if err == nil && target.NoMemory {
+		err = fmt.Errorf("process %d is a kernel thread or a zombie, with no memory", pid)
+	}
+	add("process", err, "check the pid; it has to be a live user-space process")
+	if err != nil {
+		return results
+	}
+	self, err := proc.ReadStatus(os.Getpid())
+	if err != nil {
+		add("capabilities", err, "livecore needs /proc mounted")
+		return results
+	}
+	const capHow = "(sudo setcap cap_sys_ptrace+ep livecore, or docker run --cap-add SYS_PTRACE)"
+	capFix := "run livecore as root or with CAP_SYS_PTRACE " + capHow
+
+	err = nil
+	if !self.HasPtraceCap() {
+		for i := range 3 {
+			if target.Uids[i] != self.Uids[0] || target.Gids[i] != self.Gids[0] {
+				err = fmt.Errorf("without CAP_SYS_PTRACE, only processes of uid %d and gid %d can be traced; this one is uid %d, gid %d",
+					self.Uids[0], self.Gids[0], target.Uids[1], target.Gids[1])
+				break
+			}
+		}
+	}
+	add("ptrace access", err, "run livecore as the target's user, as root, or with CAP_SYS_PTRACE "+capHow)
+
+	err = nil
+	if !target.Dumpable() && !self.HasPtraceCap() {
+		err = fmt.Errorf("the target isn't dumpable, having changed credentials or called prctl(PR_SET_DUMPABLE, 0)")
+	}
+	add("dumpable", err, capFix)
+
+	scope, err := yamaScope()
+	if err == nil {
+		switch {
+		case scope == 0:
+		case scope == 3:
+			err = fmt.Errorf("yama.ptrace_scope is 3, which forbids ptrace until reboot")
+		case !self.HasPtraceCap():
+			err = fmt.Errorf("yama.ptrace_scope is %d, which allows attaching to other processes only with CAP_SYS_PTRACE", scope)
+		}
+	}
+	fix := "run sudo sysctl kernel.yama.ptrace_scope=0 (livecore -fix-yama does so for the dump), or " + capFix
+	if scope == 3 {
+		fix = "reboot; ptrace_scope 3 can't be lowered"
+	}
+	add("yama", err, fix)
+
+	addr, err := readableAddr(pid)
+	if err == nil {
+		var b [1]byte
+		_, err = proc.NewMemory(pid).ReadAt(b[:], addr)
+	}
+	fix = "fix the ptrace access problems above"
+	if errors.Is(err, unix.ENOSYS) || self.Seccomp == 2 && errors.Is(err, unix.EPERM) {
+		fix = "livecore's seccomp filter blocks process_vm_readv; run it unconfined (docker run --security-opt seccomp=unconfined)"
+	}
+	add("memory reads", err, fix)
+
+	// Without these, the dump still works, but copies everything with the
+	// target stopped.
+	const fallback = "otherwise livecore copies everything with the target stopped, as -no-precopy does, for a longer stop"
+	if err == nil {
+		err = readPagemap(pid, addr)
+	}
+	warn("pagemap", err, "reading pagemap needs the same access as ptrace; fix the problems above; "+fallback)
+	warn("clear_refs", openClearRefs(pid), "clear_refs is writable only by the target's owner and root; run livecore as one of them; "+fallback)
+	ok, err := copy.SoftDirtySupported()
+	if err == nil && !ok {
+		err = errNoSoftDirty
+	}
+	warn("soft-dirty", err, "use a kernel built with CONFIG_MEM_SOFT_DIRTY; "+fallback)
+
+	err = nil
+	if self.Seccomp != 0 {
+		err = fmt.Errorf("livecore runs under a seccomp filter, as in a container, which may block ptrace or process_vm_readv")
+	}
+	warn("seccomp", err, "if the dump fails with EPERM or ENOSYS, run livecore unconfined (docker run --security-opt seccomp=unconfined)")
+
+	return results
+}
+
+// preflight runs Preflight, logging warnings and returning the first
+// failure, with what to do about it.
+func (d *Dumper) preflight() error {
+	for _, r := range Preflight(d.pid) {
+		switch {
+		case r.Failed():
+			return fmt.Errorf("%s: %w (to fix: %s)", r.Name, r.Err, r.Fix)
+		case r.Err != nil && d.verbose:
+			d.logf("Warning: %s: %v", r.Name, r.Err)
+		}
+	}
+	return nil
+}
+
+// errNoSoftDirty is why a kernel built without CONFIG_MEM_SOFT_DIRTY
+// can't pre-copy.
+var errNoSoftDirty = errors.New("this kernel doesn't track soft-dirty pages (CONFIG_MEM_SOFT_DIRTY)")
+
+// whyNoPreCopy returns why pre-copy can't find the pages pid writes after
+// they're copied, or nil if it can.
+func whyNoPreCopy(pid int) error {
+	ok, err := copy.SoftDirtySupported()
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return errNoSoftDirty
+	}
+	addr, err := readableAddr(pid)
+	if err != nil {
+		return err
+	}
+	if err := readPagemap(pid, addr); err != nil {
+		return err
+	}
+	return openClearRefs(pid)
+}
+
+// readPagemap reads pid's pagemap entry for the page at addr.
+func readPagemap(pid int, addr uintptr) error {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/pagemap", pid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var entry [8]byte
+	if _, err := f.ReadAt(entry[:], int64(addr/uintptr(os.Getpagesize()))*8); err != nil {
+		return fmt.Errorf("failed to read pagemap: %w", err)
+	}
+	return nil
+}
+
+// openClearRefs checks that pid's clear_refs can be written. Opening it is
+// enough: writing it would clear the soft-dirty bits an incremental dump
+// relies on.
+func openClearRefs(pid int) error {
+	f, err := os.OpenFile(fmt.Sprintf("/proc/%d/clear_refs", pid), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// yamaScope returns the Yama LSM's ptrace_scope, or 0 if Yama isn't
+// enabled.
+func yamaScope() (int, error) {
+	data, err := os.ReadFile("/proc/sys/kernel/yama/ptrace_scope")
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// readableAddr returns the start of pid's first readable mapping.
+func readableAddr(pid int) (uintptr, error) {
+	vmas, err := proc.ParseMaps(pid)
+	if err != nil {
+		return 0, err
+	}
+	for _, vma := range vmas {
+		if vma.Perms&proc.PermRead != 0 && !vma.IsZero {
+			return vma.Start, nil
+		}
+	}
+	return 0, fmt.Errorf("process %d has no readable memory", pid)
+}
@@ -0,0 +1,86 @@
+package livecore
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// An IOPriority is an I/O scheduling class and level, as set by ionice(1).
+// The zero value leaves the I/O priority alone.
+type IOPriority struct {
+	Class IOClass
+	Level int // 0 (highest) to 7, for IOClassBestEffort
+}
+
+// IOClass is an I/O scheduling class.
+type IOClass int
+
+// I/O scheduling classes; see ioprio_set(2).
+const (
+	IOClassNone       IOClass = 0
+	IOClassBestEffort IOClass = 2
+	IOClassIdle       IOClass = 3
+)
+
+// ParseIOPriority parses an I/O priority: "idle", "be" for the
+// best-effort class's default level 4, or "be:N" for its level N.
+func ParseIOPriority(s string) (IOPriority, error) {
+	class, level, hasLevel := strings.Cut(s, ":")
+	switch {
+	case class == "idle" && !hasLevel:
+		return IOPriority{Class: IOClassIdle}, nil
+	case class == "be" && !hasLevel:
+		return IOPriority{Class: IOClassBestEffort, Level: 4}, nil
+	case class == "be":
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 {
+			return IOPriority{}, fmt.Errorf("bad best-effort I/O priority level %q (want 0 to 7)", level)
+		}
+		return IOPriority{Class: IOClassBestEffort, Level: n}, nil
+	}
+	return IOPriority{}, fmt.Errorf("unknown I/O priority %q (want idle, be, or be:N)", s)
+}
+
+// runAtPriority runs f on a thread of its own with the given nice value,
+// if it's not zero, and I/O priority. Both are per-thread on Linux, so
+// they don't slow the rest of the dump. The thread exits when f returns,
+// rather than going back to the Go scheduler with its priority lowered.
+func runAtPriority(nice int, iop IOPriority, f func() error) error {
+	if nice == 0 && iop.Class == IOClassNone {
+		return f()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread() // never unlocked, so the thread exits with the goroutine
+		if err := setThreadPriority(nice, iop); err != nil {
+			errc <- err
+			return
+		}
+		errc <- f()
+	}()
+	return <-errc
+}
+
+// setThreadPriority sets the nice value, if it's not zero, and I/O
+// priority of the calling goroutine's thread, which it must have locked
+// and never unlock.
+func setThreadPriority(nice int, iop IOPriority) error {
+	tid := unix.Gettid()
+	if nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil {
+			return fmt.Errorf("failed to set writer nice value to %d: %w", nice, err)
+		}
+	}
+	if iop.Class != IOClassNone {
+		const ioprioWhoProcess = 1 // IOPRIO_WHO_PROCESS; a tid means that thread
+		prio := uintptr(iop.Class)<<13 | uintptr(iop.Level)
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), prio); errno != 0 {
+			return fmt.Errorf("failed to set writer I/O priority: %w", errno)
+		}
+	}
+	return nil
+}
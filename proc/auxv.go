@@ -0,0 +1,65 @@
+package proc
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Auxiliary vector entry types; see getauxval(3).
+const (
+	AT_NULL  = 0
+	AT_PHDR  = 3 // address of the executable's program headers
+	AT_PHENT = 4 // size of a program header
+	AT_PHNUM = 5 // number of program headers
+	AT_BASE  = 7 // base address of the dynamic linker
+	AT_ENTRY = 9 // executable's entry point
+)
+
+// ParseAuxv parses a raw auxiliary vector, as returned by GetAuxv, into a
+// map from entry type to value.
+func ParseAuxv(auxv []byte) map[uint64]uint64 {
+	m := make(map[uint64]uint64)
+	for i := 0; i+16 <= len(auxv); i += 16 {
+		typ := binary.LittleEndian.Uint64(auxv[i:])
+		if typ == AT_NULL {
+			break
+		}
+		m[typ] = binary.LittleEndian.Uint64(auxv[i+8:])
+	}
+	return m
+}
+
+// ELFClass returns the ELF class of pid: elf.ELFCLASS32 for a 32-bit x86
+// process, running in compat mode, or else ELFCLASS64. It's read from the
+// executable's ELF header, or if that can't be read, told from the size
+// of its program headers, AT_PHENT, in the auxiliary vector, whose entries
+// are 32 or 64 bits a field, too.
+func (fs FS) ELFClass(pid int) (elf.Class, error) {
+	if f, err := os.Open(fs.path(pid, "exe")); err == nil {
+		var ident [elf.EI_NIDENT]byte
+		_, err := f.ReadAt(ident[:], 0)
+		f.Close()
+		if err == nil && string(ident[:4]) == elf.ELFMAG {
+			switch c := elf.Class(ident[elf.EI_CLASS]); c {
+			case elf.ELFCLASS32, elf.ELFCLASS64:
+				return c, nil
+			}
+		}
+	}
+
+	auxv, err := fs.GetAuxv(pid)
+	if err != nil {
+		return elf.ELFCLASSNONE, err
+	}
+	if ParseAuxv(auxv)[AT_PHENT] == 56 { // sizeof(Elf64_Phdr)
+		return elf.ELFCLASS64, nil
+	}
+	for i := 0; i+8 <= len(auxv); i += 8 {
+		if binary.LittleEndian.Uint32(auxv[i:]) == AT_PHENT && binary.LittleEndian.Uint32(auxv[i+4:]) == 32 { // sizeof(Elf32_Phdr)
+			return elf.ELFCLASS32, nil
+		}
+	}
+	return elf.ELFCLASSNONE, fmt.Errorf("can't tell whether process %d is 32- or 64-bit", pid)
+}
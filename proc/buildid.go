@@ -0,0 +1,168 @@
+package proc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A BuildID is the GNU build ID of a file mapped into a process, which
+// symbol servers such as debuginfod index debug info by.
+type BuildID struct {
+	Start uintptr `json:"-"`    // of the file's first mapping
+	Path  string  `json:"path"` // as in /proc/<pid>/maps
+	ID    string  `json:"id"`   // in hex
+}
+
+// ntGNUBuildID is the type of a "GNU" note holding a build ID.
+const ntGNUBuildID = 3
+
+// errNoBuildID is returned by ReadBuildID for an ELF file without one.
+var errNoBuildID = errors.New("no build ID note")
+
+// BuildIDs returns the build IDs of the ELF files mapped into pid among
+// vmas, in the order they're first mapped. Each is found in the file's
+// first mapping in mem, if it's non-nil and maps the file from its start,
+// since the ELF header and the build ID note are normally in the first
+// page; failing that, the file is read through /proc/<pid>/map_files, so
+// one deleted or replaced since it was mapped is read as mapped. Files
+// that aren't ELF, have no build ID, or can't be read are left out.
+func (fs FS) BuildIDs(pid int, vmas []VMA, mem MemoryReader) []BuildID {
+	var ids []BuildID
+	seen := make(map[string]bool)
+	for _, vma := range vmas {
+		if vma.Inode == 0 || vma.Path == "" || seen[vma.Path] {
+			continue
+		}
+		seen[vma.Path] = true
+		if mem != nil && vma.Offset == 0 {
+			if id, err := readMappedBuildID(mem, vma.Start, vma.End); err == nil {
+				ids = append(ids, BuildID{Start: vma.Start, Path: vma.Path, ID: id})
+				continue
+			}
+		}
+		f, err := os.Open(fs.path(pid, "map_files", fmt.Sprintf("%x-%x", vma.Start, vma.End)))
+		if err != nil {
+			continue
+		}
+		id, err := ReadBuildID(f)
+		f.Close()
+		if err == nil {
+			ids = append(ids, BuildID{Start: vma.Start, Path: vma.Path, ID: id})
+		}
+	}
+	return ids
+}
+
+// readMappedBuildID returns the build ID, in hex, of the ELF file mapped
+// from its start at [start, end) in mem, if its note is within that
+// mapping. Only 64-bit little-endian files are understood.
+func readMappedBuildID(mem MemoryReader, start, end uintptr) (string, error) {
+	size := uint64(end - start)
+	var ehdr [64]byte
+	if size < uint64(len(ehdr)) {
+		return "", errNoBuildID
+	}
+	if _, err := mem.ReadAt(ehdr[:], start); err != nil {
+		return "", err
+	}
+	if string(ehdr[:4]) != elf.ELFMAG || elf.Class(ehdr[elf.EI_CLASS]) != elf.ELFCLASS64 || elf.Data(ehdr[elf.EI_DATA]) != elf.ELFDATA2LSB {
+		return "", errors.New("not a 64-bit little-endian ELF file")
+	}
+	le := binary.LittleEndian
+	phoff, phentsize, phnum := le.Uint64(ehdr[32:]), uint64(le.Uint16(ehdr[54:])), uint64(le.Uint16(ehdr[56:]))
+	if phentsize < 56 || phoff > size || phnum*phentsize > size-phoff {
+		return "", errNoBuildID
+	}
+	phdrs := make([]byte, phnum*phentsize)
+	if _, err := mem.ReadAt(phdrs, start+uintptr(phoff)); err != nil {
+		return "", err
+	}
+	for i := uint64(0); i < phnum; i++ {
+		ph := phdrs[i*phentsize:]
+		off, filesz := le.Uint64(ph[8:]), le.Uint64(ph[32:])
+		if elf.ProgType(le.Uint32(ph)) != elf.PT_NOTE || off > size || filesz > size-off || filesz > 1<<20 {
+			continue
+		}
+		data := make([]byte, filesz)
+		if _, err := mem.ReadAt(data, start+uintptr(off)); err != nil {
+			continue
+		}
+		if id, ok := findBuildIDNote(data, le); ok {
+			return hex.EncodeToString(id), nil
+		}
+	}
+	return "", errNoBuildID
+}
+
+// ReadBuildID returns the build ID, in hex, of the ELF file r, from its
+// NT_GNU_BUILD_ID note.
+func ReadBuildID(r io.ReaderAt) (string, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_NOTE || p.Filesz > 1<<20 {
+			continue
+		}
+		data := make([]byte, p.Filesz)
+		if _, err := p.ReadAt(data, 0); err != nil {
+			continue
+		}
+		if id, ok := findBuildIDNote(data, f.ByteOrder); ok {
+			return hex.EncodeToString(id), nil
+		}
+	}
+	return "", errNoBuildID
+}
+
+// findBuildIDNote returns the description of the NT_GNU_BUILD_ID note
+// among the notes in data, if there is one.
+func findBuildIDNote(data []byte, order binary.ByteOrder) ([]byte, bool) {
+	align4 := func(n uint32) int { return int((uint64(n) + 3) &^ 3) }
+	for len(data) >= 12 {
+		namesz, descsz, typ := order.Uint32(data), order.Uint32(data[4:]), order.Uint32(data[8:])
+		data = data[12:]
+		if align4(namesz) > len(data) {
+			break
+		}
+		name := data[:namesz]
+		data = data[align4(namesz):]
+		if int(descsz) > len(data) {
+			break
+		}
+		desc := data[:descsz]
+		data = data[min(len(data), align4(descsz)):]
+		if typ == ntGNUBuildID && bytes.Equal(name, []byte("GNU\x00")) && len(desc) > 0 {
+			return desc, true
+		}
+	}
+	return nil, false
+}
+
+// ExeSHA256 returns the path of pid's executable and the SHA-256, in hex,
+// of its contents, read through /proc/<pid>/exe so that it's the file
+// running even if it's since been deleted or replaced.
+func (fs FS) ExeSHA256(pid int) (path, sum string, err error) {
+	path, err = os.Readlink(fs.path(pid, "exe"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read executable path: %w", err)
+	}
+	f, err := os.Open(fs.path(pid, "exe"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open executable: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", "", fmt.Errorf("failed to read executable: %w", err)
+	}
+	return path, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,267 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A CgroupFreezer freezes every process in a cgroup at once, using cgroup
+// v2's cgroup.freeze or, on hosts without it, the v1 freezer controller.
+//
+// Set as FreezeOptions.Cgroup, it lets FreezeAllThreads seize a target's
+// threads while none of them can run or create new threads, instead of
+// racing them one at a time.
+type CgroupFreezer struct {
+	// Dir is the cgroup's directory, such as /sys/fs/cgroup/system.slice/app.service.
+	Dir string
+
+	// V1 is set when Dir is in the v1 freezer hierarchy.
+	V1 bool
+}
+
+// FindCgroupFreezer returns a freezer for pid's cgroup, preferring v2.
+//
+// It fails if pid is in the root cgroup, which can't be frozen, or if the
+// calling process is in the same cgroup or below it, as it would freeze
+// itself.
+func (fs FS) FindCgroupFreezer(pid int) (*CgroupFreezer, error) {
+	target, err := readCgroups(fs.path(pid, "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	self, err := readCgroups("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := cgroupMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	err = fmt.Errorf("no cgroup v2 or v1 freezer hierarchy is mounted for process %d", pid)
+	for _, v1 := range []bool{false, true} {
+		key := "cgroup2"
+		if v1 {
+			key = "freezer"
+		}
+		cg, ok := target[key]
+		m, mounted := mounts[key]
+		switch {
+		case !ok || !mounted:
+			continue
+		case cg == "/":
+			// On hybrid hosts, the v1 freezer may still work.
+			err = fmt.Errorf("process %d is in the root cgroup, which can't be frozen", pid)
+			continue
+		case self[key] == cg || strings.HasPrefix(self[key], cg+"/"):
+			return nil, fmt.Errorf("livecore is in process %d's cgroup %s and would freeze itself", pid, cg)
+		}
+		rel, ok := strings.CutPrefix(cg, m.root)
+		if !ok {
+			return nil, fmt.Errorf("cgroup %s is outside the hierarchy mounted at %s", cg, m.point)
+		}
+		return &CgroupFreezer{Dir: filepath.Join(m.point, rel), V1: v1}, nil
+	}
+	return nil, err
+}
+
+// readCgroups parses a /proc/<pid>/cgroup file, returning the cgroup path
+// in each hierarchy, keyed by controller name, or "cgroup2" for the
+// unified hierarchy.
+func readCgroups(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroups: %w", err)
+	}
+	cgroups := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		f := strings.SplitN(s.Text(), ":", 3)
+		if len(f) != 3 {
+			continue
+		}
+		if f[0] == "0" && f[1] == "" {
+			cgroups["cgroup2"] = f[2]
+			continue
+		}
+		for _, c := range strings.Split(f[1], ",") {
+			cgroups[c] = f[2]
+		}
+	}
+	return cgroups, s.Err()
+}
+
+// cgroupMount is where a cgroup hierarchy is mounted.
+type cgroupMount struct {
+	root  string // the cgroup mounted, usually /
+	point string
+}
+
+// cgroupMounts finds the unified cgroup hierarchy and the v1 freezer
+// hierarchy in the calling process's mounts, keyed as in readCgroups.
+func cgroupMounts() (map[string]cgroupMount, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %w", err)
+	}
+	mounts := make(map[string]cgroupMount)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		// ID parent major:minor root mount-point options [optional...] - type source super-options
+		pre, post, ok := strings.Cut(s.Text(), " - ")
+		f, g := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(f) < 5 || len(g) < 3 {
+			continue
+		}
+		m := cgroupMount{root: unescapeMountinfo(f[3]), point: unescapeMountinfo(f[4])}
+		if m.root == "/" {
+			m.root = ""
+		}
+		switch {
+		case g[0] == "cgroup2":
+			if _, ok := mounts["cgroup2"]; !ok {
+				mounts["cgroup2"] = m
+			}
+		case g[0] == "cgroup" && strings.Contains(","+g[2]+",", ",freezer,"):
+			if _, ok := mounts["freezer"]; !ok {
+				mounts["freezer"] = m
+			}
+		}
+	}
+	return mounts, s.Err()
+}
+
+// unescapeMountinfo undoes mountinfo's octal escaping of spaces and other
+// awkward bytes in paths.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Procs returns the IDs of the processes in the cgroup itself, not
+// counting its descendants, which are frozen along with it.
+func (c *CgroupFreezer) Procs() ([]int, error) {
+	data, err := os.ReadFile(filepath.Join(c.Dir, "cgroup.procs"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup.procs: %w", err)
+	}
+	var pids []int
+	for _, f := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// Freeze freezes the cgroup and waits until the kernel reports it frozen
+// or until deadline, if it isn't zero. It refuses to freeze a cgroup that
+// someone else froze, as Thaw would then undo their freeze. If the cgroup
+// doesn't finish freezing in time, it's thawed again.
+func (c *CgroupFreezer) Freeze(deadline time.Time) error {
+	state, err := c.read(c.controlFile())
+	if err != nil {
+		return err
+	}
+	if state != c.stateValue(false) {
+		return fmt.Errorf("cgroup %s is already frozen", c.Dir)
+	}
+	if err := c.write(true); err != nil {
+		return err
+	}
+	for delay := 100 * time.Microsecond; ; delay = min(2*delay, 10*time.Millisecond) {
+		frozen, err := c.frozen()
+		if err == nil && frozen {
+			return nil
+		}
+		if err == nil && !deadline.IsZero() && time.Now().After(deadline) {
+			err = fmt.Errorf("cgroup %s didn't freeze in time; are tasks in uninterruptible sleep?", c.Dir)
+		}
+		if err != nil {
+			c.Thaw()
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Thaw lets the cgroup's processes run again.
+func (c *CgroupFreezer) Thaw() error { return c.write(false) }
+
+// controlFile returns the name of the file that freezes the cgroup.
+func (c *CgroupFreezer) controlFile() string {
+	if c.V1 {
+		return "freezer.state"
+	}
+	return "cgroup.freeze"
+}
+
+// stateValue returns what to write to controlFile to freeze or thaw.
+func (c *CgroupFreezer) stateValue(freeze bool) string {
+	switch {
+	case c.V1 && freeze:
+		return "FROZEN"
+	case c.V1:
+		return "THAWED"
+	case freeze:
+		return "1"
+	}
+	return "0"
+}
+
+// write asks the kernel to freeze or thaw the cgroup.
+func (c *CgroupFreezer) write(freeze bool) error {
+	name, val := c.controlFile(), c.stateValue(freeze)
+	if err := os.WriteFile(filepath.Join(c.Dir, name), []byte(val), 0); err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", val, name, err)
+	}
+	return nil
+}
+
+// read returns the contents of one of the cgroup's files, trimmed.
+func (c *CgroupFreezer) read(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(c.Dir, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// frozen reports whether the kernel has finished freezing the cgroup.
+func (c *CgroupFreezer) frozen() (bool, error) {
+	if c.V1 {
+		// THAWED, FREEZING, or FROZEN.
+		state, err := c.read("freezer.state")
+		return state == "FROZEN", err
+	}
+	events, err := c.read("cgroup.events")
+	if err != nil {
+		return false, err
+	}
+	for line := range strings.Lines(events) {
+		if strings.TrimSpace(line) == "frozen 1" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
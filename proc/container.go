@@ -0,0 +1,291 @@
+package proc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Container is a container some process runs in, as found by
+// FindContainer.
+type Container struct {
+	ID      string // the full ID
+	Runtime string // "docker", "containerd", "cri-o", or "" if found only by its cgroup
+	Name    string // if the runtime names it
+	Image   string
+	Cgroup  string // its cgroup path, as in /proc/<pid>/cgroup
+
+	// Pod and Namespace are its Kubernetes pod and namespace, if the
+	// runtime recorded them.
+	Pod, Namespace string
+
+	// InitPid is the ID of its first process, in the caller's PID
+	// namespace.
+	InitPid int
+}
+
+// Where container runtimes keep their state.
+var (
+	dockerSocket    = "/var/run/docker.sock"
+	containerdTasks = "/run/containerd/io.containerd.runtime.v2.task" // <namespace>/<id>/{init.pid,config.json}
+	crioContainers  = "/run/containers/storage/overlay-containers"    // <id>/userdata/{pidfile,config.json}
+)
+
+// containerIDRE matches a container ID within a cgroup path component,
+// such as "docker-<id>.scope" or "cri-containerd-<id>.scope".
+var containerIDRE = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// FindContainer finds the container whose ID is or starts with id, or,
+// with Docker, whose name is id. It asks Docker's API, if its socket is
+// there, then looks in containerd's and CRI-O's state directories, which
+// Kubernetes nodes have, and finally falls back to looking for the ID in
+// every process's cgroup path.
+func (fs FS) FindContainer(id string) (*Container, error) {
+	if id == "" {
+		return nil, fmt.Errorf("empty container ID")
+	}
+	if _, err := os.Stat(dockerSocket); err == nil {
+		c, err := dockerContainer(id)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			return c, fs.finishContainer(c)
+		}
+	}
+	c, err := runtimeStateContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		if c, err = fs.cgroupContainer(id); err != nil {
+			return nil, err
+		}
+	}
+	return c, fs.finishContainer(c)
+}
+
+// finishContainer fills in c's cgroup path from its init process, checking
+// that it's still running.
+func (fs FS) finishContainer(c *Container) error {
+	if c.InitPid <= 0 {
+		return fmt.Errorf("container %s isn't running", shortID(c.ID))
+	}
+	if c.Cgroup != "" {
+		return nil
+	}
+	cgroups, err := readCgroups(fs.path(c.InitPid, "cgroup"))
+	if err != nil {
+		return fmt.Errorf("container %s: %w", shortID(c.ID), err)
+	}
+	c.Cgroup = cgroups["cgroup2"]
+	if c.Cgroup == "" {
+		c.Cgroup = cgroups["pids"]
+	}
+	return nil
+}
+
+// dockerContainer asks the Docker daemon about a container, returning nil
+// if it doesn't know it.
+func dockerContainer(id string) (*Container, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", dockerSocket)
+			},
+		},
+	}
+	res, err := client.Get("http://docker/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask Docker about container %s: %w", id, err)
+	}
+	defer res.Body.Close()
+	var info struct {
+		ID    string `json:"Id"`
+		Name  string
+		Image string // the image's ID
+		State struct {
+			Pid int
+		}
+		Config struct {
+			Image  string // as the container was created with
+			Labels map[string]string
+		}
+		Message string // on errors
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse Docker's reply about container %s: %w", id, err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Docker: %s", info.Message)
+	}
+	c := &Container{
+		ID:        info.ID,
+		Runtime:   "docker",
+		Name:      strings.TrimPrefix(info.Name, "/"),
+		Image:     info.Config.Image,
+		Pod:       info.Config.Labels["io.kubernetes.pod.name"],
+		Namespace: info.Config.Labels["io.kubernetes.pod.namespace"],
+		InitPid:   info.State.Pid,
+	}
+	if c.Image == "" {
+		c.Image = info.Image
+	}
+	return c, nil
+}
+
+// runtimeStateContainer looks for a container in containerd's and CRI-O's
+// state directories, returning nil if neither has it.
+func runtimeStateContainer(id string) (*Container, error) {
+	if !isHexPrefix(id) {
+		return nil, nil
+	}
+	type candidate struct {
+		runtime, dir, pidFile string
+	}
+	var found []candidate
+	dirs, _ := filepath.Glob(filepath.Join(containerdTasks, "*", id+"*"))
+	for _, dir := range dirs {
+		found = append(found, candidate{"containerd", dir, "init.pid"})
+	}
+	dirs, _ = filepath.Glob(filepath.Join(crioContainers, id+"*", "userdata"))
+	for _, dir := range dirs {
+		found = append(found, candidate{"cri-o", dir, "pidfile"})
+	}
+	switch {
+	case len(found) == 0:
+		return nil, nil
+	case len(found) > 1:
+		return nil, fmt.Errorf("%d containers' IDs start with %s; give more of it", len(found), id)
+	}
+
+	f := found[0]
+	c := &Container{Runtime: f.runtime}
+	if f.runtime == "cri-o" {
+		c.ID = filepath.Base(filepath.Dir(f.dir))
+	} else {
+		c.ID = filepath.Base(f.dir)
+	}
+	data, err := os.ReadFile(filepath.Join(f.dir, f.pidFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find container %s's init process: %w", shortID(c.ID), err)
+	}
+	if c.InitPid, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+		return nil, fmt.Errorf("invalid pid in %s: %w", filepath.Join(f.dir, f.pidFile), err)
+	}
+
+	// The OCI runtime spec records the rest as annotations, under
+	// containerd's names or CRI-O's.
+	var spec struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if data, err := os.ReadFile(filepath.Join(f.dir, "config.json")); err == nil {
+		json.Unmarshal(data, &spec)
+	}
+	a := func(keys ...string) string {
+		for _, k := range keys {
+			if v := spec.Annotations[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	c.Name = a("io.kubernetes.cri.container-name", "io.kubernetes.container.name")
+	c.Image = a("io.kubernetes.cri.image-name", "io.kubernetes.cri-o.ImageName")
+	c.Pod = a("io.kubernetes.cri.sandbox-name", "io.kubernetes.pod.name")
+	c.Namespace = a("io.kubernetes.cri.sandbox-namespace", "io.kubernetes.pod.namespace")
+	return c, nil
+}
+
+// cgroupContainer finds a container by the ID in its processes' cgroup
+// paths, taking its init process to be the one whose parent isn't in it.
+func (fs FS) cgroupContainer(id string) (*Container, error) {
+	if !isHexPrefix(id) {
+		return nil, fmt.Errorf("no container named %q", id)
+	}
+	pids, err := fs.ListPids()
+	if err != nil {
+		return nil, err
+	}
+	var c *Container
+	members := make(map[int]bool)
+	for _, pid := range pids {
+		cgroups, err := readCgroups(fs.path(pid, "cgroup"))
+		if err != nil {
+			continue // exited
+		}
+		for _, cg := range cgroups {
+			full := containerIDRE.FindString(filepath.Base(cg))
+			if !strings.HasPrefix(full, id) {
+				continue
+			}
+			if c == nil {
+				c = &Container{ID: full, Runtime: cgroupRuntime(cg)}
+			} else if c.ID != full {
+				return nil, fmt.Errorf("more than one container's ID starts with %s; give more of it", id)
+			}
+			members[pid] = true
+			break
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("no container %s found in any process's cgroup", id)
+	}
+	var roots []int
+	for pid := range members {
+		if st, err := fs.ReadStatus(pid); err == nil && !members[st.PPid] {
+			roots = append(roots, pid)
+		}
+	}
+	if len(roots) > 0 {
+		c.InitPid = slices.Min(roots)
+	}
+	return c, nil
+}
+
+// cgroupRuntime guesses which runtime made a container's cgroup from its
+// path.
+func cgroupRuntime(cg string) string {
+	switch {
+	case strings.Contains(cg, "docker"):
+		return "docker"
+	case strings.Contains(cg, "containerd"):
+		return "containerd"
+	case strings.Contains(cg, "crio"):
+		return "cri-o"
+	}
+	return ""
+}
+
+// isHexPrefix reports whether s could be the start of a container ID.
+func isHexPrefix(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// shortID returns the short form of a container ID, as Docker shows it.
+func shortID(id string) string {
+	return id[:min(len(id), 12)]
+}
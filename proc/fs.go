@@ -0,0 +1,126 @@
+// Package proc reads the state of a running Linux process: its memory
+// mappings (maps and smaps), soft-dirty page tracking (pagemap), threads
+// and their registers (via ptrace), and the dynamic linker's list of loaded
+// objects.
+//
+// Functions that read files under procfs are methods on FS, so tools
+// looking at another mount of procfs (say, a host's /proc mounted into a
+// container) can point them there. The package-level functions of the same
+// names use DefaultFS.
+//
+// The ptrace functions (FreezeAllThreads and friends) act on the caller's
+// view of thread IDs and require the same privileges as a debugger.
+package proc
+
+import (
+	"debug/elf"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// FS is a procfs mount.
+type FS struct {
+	// Root is where procfs is mounted. If empty, /proc is used.
+	Root string
+}
+
+// DefaultFS is the procfs mounted at /proc.
+var DefaultFS FS
+
+// path returns the path of a file in pid's procfs directory.
+func (fs FS) path(pid int, elem ...string) string {
+	root := fs.Root
+	if root == "" {
+		root = "/proc"
+	}
+	return filepath.Join(append([]string{root, strconv.Itoa(pid)}, elem...)...)
+}
+
+// taskPath returns the path of a file in a thread's procfs directory.
+func (fs FS) taskPath(pid, tid int, name string) string {
+	return fs.path(pid, "task", strconv.Itoa(tid), name)
+}
+
+// ParseMaps parses /proc/<pid>/maps, merging in VmFlags from smaps.
+func ParseMaps(pid int) ([]VMA, error) { return DefaultFS.ParseMaps(pid) }
+
+// ParseSMaps parses /proc/<pid>/smaps, keyed by VMA start address.
+func ParseSMaps(pid int) (map[uintptr]SMapsInfo, error) { return DefaultFS.ParseSMaps(pid) }
+
+// ParseThreads lists the threads in /proc/<pid>/task.
+func ParseThreads(pid int) ([]Thread, error) { return DefaultFS.ParseThreads(pid) }
+
+// ThreadState returns the scheduler state letter of a thread.
+func ThreadState(pid, tid int) (byte, error) { return DefaultFS.ThreadState(pid, tid) }
+
+// ThreadName returns the name (comm) of a thread.
+func ThreadName(pid, tid int) (string, error) { return DefaultFS.ThreadName(pid, tid) }
+
+// ThreadSched returns the scheduling state of a thread.
+func ThreadSched(pid, tid int) (*Sched, error) { return DefaultFS.ThreadSched(pid, tid) }
+
+// GetProcessInfo reads a process's comm and stat.
+func GetProcessInfo(pid int) (ProcessInfo, error) { return DefaultFS.GetProcessInfo(pid) }
+
+// ReadStatus parses /proc/<pid>/status.
+func ReadStatus(pid int) (Status, error) { return DefaultFS.ReadStatus(pid) }
+
+// FindByName returns the ID of the one process named name; see
+// FS.FindByName.
+func FindByName(name string) (int, error) { return DefaultFS.FindByName(name) }
+
+// FindContainer finds a container by ID or name; see FS.FindContainer.
+func FindContainer(id string) (*Container, error) { return DefaultFS.FindContainer(id) }
+
+// Descendants returns the IDs of pid's children, their children, and so
+// on; see FS.Descendants.
+func Descendants(pid int) ([]int, error) { return DefaultFS.Descendants(pid) }
+
+// ListPids returns the IDs of the processes in /proc.
+func ListPids() ([]int, error) { return DefaultFS.ListPids() }
+
+// GetStringAreas reads the argument and environment string ranges.
+func GetStringAreas(pid int) (StringAreas, error) { return DefaultFS.GetStringAreas(pid) }
+
+// StartTime returns when a process started, as time since boot.
+func StartTime(pid int) (time.Duration, error) { return DefaultFS.StartTime(pid) }
+
+// BuildIDs returns the build IDs of the ELF files mapped into pid; see
+// FS.BuildIDs.
+func BuildIDs(pid int, vmas []VMA, mem MemoryReader) []BuildID {
+	return DefaultFS.BuildIDs(pid, vmas, mem)
+}
+
+// HostPaths returns where the caller can open the files pid maps from
+// another mount namespace; see FS.HostPaths.
+func HostPaths(pid int, vmas []VMA) (map[string]string, error) { return DefaultFS.HostPaths(pid, vmas) }
+
+// PidNamespaceOf returns the PID namespace pid is in.
+func PidNamespaceOf(pid int) (*PidNamespace, error) { return DefaultFS.PidNamespaceOf(pid) }
+
+// ExeSHA256 returns the path and SHA-256 of a process's executable.
+func ExeSHA256(pid int) (path, sum string, err error) { return DefaultFS.ExeSHA256(pid) }
+
+// ELFClass returns whether a process is 32- or 64-bit; see FS.ELFClass.
+func ELFClass(pid int) (elf.Class, error) { return DefaultFS.ELFClass(pid) }
+
+// GetAuxv reads a process's raw auxiliary vector.
+func GetAuxv(pid int) ([]byte, error) { return DefaultFS.GetAuxv(pid) }
+
+// ReadLinkMap reads the dynamic linker's list of loaded objects.
+func ReadLinkMap(pid int) (*LinkMap, error) { return DefaultFS.ReadLinkMap(pid) }
+
+// FindGoRuntime looks for the Go runtime in pid's executable; see
+// FS.FindGoRuntime.
+func FindGoRuntime(pid int) (*GoRuntime, error) { return DefaultFS.FindGoRuntime(pid) }
+
+// FindCgroupFreezer returns a freezer for pid's cgroup; see
+// FS.FindCgroupFreezer.
+func FindCgroupFreezer(pid int) (*CgroupFreezer, error) { return DefaultFS.FindCgroupFreezer(pid) }
+
+// FreezeAllThreads seizes and stops every thread of pid; see
+// FS.FreezeAllThreads.
+func FreezeAllThreads(pid int, opts FreezeOptions) ([]Thread, error) {
+	return DefaultFS.FreezeAllThreads(pid, opts)
+}
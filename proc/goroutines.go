@@ -0,0 +1,260 @@
+package proc
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// GoRuntime says where to find a Go program's goroutines: the address of
+// runtime.allgs, the slice of every g the runtime has created, and the
+// layout of the g struct, from the executable's symbol table and DWARF.
+type GoRuntime struct {
+	AllGs uintptr // address of runtime.allgs, a []*g
+	G     GLayout
+}
+
+// GLayout holds the offsets in runtime.g of the fields livecore records.
+type GLayout struct {
+	Size       uint64
+	StackLo    uint64 // stack.lo
+	StackHi    uint64 // stack.hi
+	Goid       uint64
+	Status     uint64 // atomicstatus
+	WaitReason uint64
+	SchedSP    uint64 // sched.sp
+	SchedPC    uint64 // sched.pc
+}
+
+// Goroutine is the state of one runtime.g.
+type Goroutine struct {
+	Addr       uintptr // of the g
+	ID         uint64
+	Status     uint32 // a runtime _G* constant, with _Gscan (0x1000) set while the GC scans it
+	WaitReason uint8  // a runtime waitReason, when waiting
+	StackLo    uintptr
+	StackHi    uintptr
+	SP, PC     uintptr // saved when it last stopped running; stale while it runs
+}
+
+// GoroutineDead is runtime._Gdead, the status of a g waiting to be reused.
+const GoroutineDead = 6
+
+// maxGoroutines bounds how many gs Goroutines will read, in case allgs
+// reads as garbage.
+const maxGoroutines = 1 << 24
+
+// MemoryReader reads a process's memory, live (Memory) or as copied.
+type MemoryReader interface {
+	ReadAt(p []byte, addr uintptr) (int, error)
+}
+
+// FindGoRuntime looks for the Go runtime in pid's executable. It fails
+// for programs not written in Go, and for Go programs built without a
+// symbol table or DWARF (-ldflags=-s or -w).
+func (fs FS) FindGoRuntime(pid int) (*GoRuntime, error) {
+	f, err := elf.Open(fs.path(pid, "exe"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open executable: %w", err)
+	}
+	defer f.Close()
+
+	syms, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, fmt.Errorf("failed to read symbols: %w", err)
+	}
+	rt := new(GoRuntime)
+	for _, s := range syms {
+		if s.Name == "runtime.allgs" {
+			rt.AllGs = uintptr(s.Value)
+			break
+		}
+	}
+	if rt.AllGs == 0 {
+		return nil, fmt.Errorf("no runtime.allgs symbol; not a Go program, or its symbol table was stripped")
+	}
+
+	// Position-independent executables are loaded at a random bias,
+	// found by comparing where the program headers ended up with where
+	// the executable says they are.
+	if f.Type == elf.ET_DYN {
+		auxv, err := fs.GetAuxv(pid)
+		if err != nil {
+			return nil, err
+		}
+		phdrVaddr, ok := programHeaderVaddr(f)
+		if !ok {
+			return nil, fmt.Errorf("can't find the executable's program headers in memory")
+		}
+		rt.AllGs += uintptr(ParseAuxv(auxv)[AT_PHDR] - phdrVaddr)
+	}
+
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DWARF: %w", err)
+	}
+	rt.G, err = gLayout(d)
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// programHeaderVaddr returns the virtual address an executable's program
+// headers are loaded at.
+func programHeaderVaddr(f *elf.File) (uint64, bool) {
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_PHDR {
+			return p.Vaddr, true
+		}
+	}
+	// Without PT_PHDR, they're right after the 64-byte ELF header, in the
+	// segment that maps the start of the file.
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Off == 0 {
+			return p.Vaddr + 64, true
+		}
+	}
+	return 0, false
+}
+
+// gLayout finds the offsets of the fields of runtime.g that livecore
+// records.
+func gLayout(d *dwarf.Data) (GLayout, error) {
+	g, err := findStruct(d, "runtime.g")
+	if err != nil {
+		return GLayout{}, err
+	}
+	var l GLayout
+	l.Size = uint64(g.ByteSize)
+	for _, f := range []struct {
+		path []string
+		off  *uint64
+	}{
+		{[]string{"stack", "lo"}, &l.StackLo},
+		{[]string{"stack", "hi"}, &l.StackHi},
+		{[]string{"goid"}, &l.Goid},
+		{[]string{"atomicstatus"}, &l.Status},
+		{[]string{"waitreason"}, &l.WaitReason},
+		{[]string{"sched", "sp"}, &l.SchedSP},
+		{[]string{"sched", "pc"}, &l.SchedPC},
+	} {
+		off, ok := fieldOffset(g, f.path)
+		if !ok {
+			return GLayout{}, fmt.Errorf("runtime.g has no field %v; unsupported Go version?", f.path)
+		}
+		*f.off = off
+	}
+	return l, nil
+}
+
+// findStruct returns the struct type named name.
+func findStruct(d *dwarf.Data, name string) (*dwarf.StructType, error) {
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DWARF: %w", err)
+		}
+		if e == nil {
+			return nil, fmt.Errorf("no DWARF type %s", name)
+		}
+		if e.Tag == dwarf.TagStructType && e.Val(dwarf.AttrName) == name {
+			t, err := d.Type(e.Offset)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read DWARF type %s: %w", name, err)
+			}
+			if st, ok := t.(*dwarf.StructType); ok {
+				return st, nil
+			}
+		}
+		if e.Children && e.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+		}
+	}
+}
+
+// fieldOffset returns the offset of the field reached by following path
+// through nested structs from t.
+func fieldOffset(t *dwarf.StructType, path []string) (uint64, bool) {
+	var off uint64
+	for i, name := range path {
+		var field *dwarf.StructField
+		for _, f := range t.Field {
+			if f.Name == name {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return 0, false
+		}
+		off += uint64(field.ByteOffset)
+		if i == len(path)-1 {
+			break
+		}
+		typ := field.Type
+		for {
+			// Go's named types are typedefs of unnamed ones.
+			td, ok := typ.(*dwarf.TypedefType)
+			if !ok {
+				break
+			}
+			typ = td.Type
+		}
+		next, ok := typ.(*dwarf.StructType)
+		if !ok {
+			return 0, false
+		}
+		t = next
+	}
+	return off, true
+}
+
+// Goroutines reads the goroutines in allgs from mem, leaving out dead
+// ones. mem must hold the process's memory as of one instant, such as a
+// stopped process or a copy of one; a running program changes allgs
+// under a reader's feet.
+func (rt *GoRuntime) Goroutines(mem MemoryReader) ([]Goroutine, error) {
+	hdr := make([]byte, 16) // slice pointer and length
+	if _, err := mem.ReadAt(hdr, rt.AllGs); err != nil {
+		return nil, fmt.Errorf("failed to read runtime.allgs: %w", err)
+	}
+	ptr := uintptr(binary.LittleEndian.Uint64(hdr))
+	n := binary.LittleEndian.Uint64(hdr[8:])
+	if n > maxGoroutines {
+		return nil, fmt.Errorf("runtime.allgs has implausible length %d", n)
+	}
+	ptrs := make([]byte, 8*n)
+	if _, err := mem.ReadAt(ptrs, ptr); err != nil {
+		return nil, fmt.Errorf("failed to read runtime.allgs contents: %w", err)
+	}
+
+	l := rt.G
+	g := make([]byte, l.Size)
+	u64 := func(off uint64) uint64 { return binary.LittleEndian.Uint64(g[off:]) }
+	var gs []Goroutine
+	for i := range n {
+		addr := uintptr(binary.LittleEndian.Uint64(ptrs[8*i:]))
+		if _, err := mem.ReadAt(g, addr); err != nil {
+			return nil, fmt.Errorf("failed to read g at %x: %w", addr, err)
+		}
+		status := binary.LittleEndian.Uint32(g[l.Status:])
+		if status == GoroutineDead {
+			continue
+		}
+		gs = append(gs, Goroutine{
+			Addr:       addr,
+			ID:         u64(l.Goid),
+			Status:     status,
+			WaitReason: g[l.WaitReason],
+			StackLo:    uintptr(u64(l.StackLo)),
+			StackHi:    uintptr(u64(l.StackHi)),
+			SP:         uintptr(u64(l.SchedSP)),
+			PC:         uintptr(u64(l.SchedPC)),
+		})
+	}
+	return gs, nil
+}
@@ -0,0 +1,180 @@
+package proc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// LinkMap is the dynamic linker's view of a process's loaded objects, as
+// debuggers find it: the executable's DT_DEBUG entry points to r_debug,
+// whose r_map heads a list of link_map structs, one per object.
+type LinkMap struct {
+	Phdr   uintptr // AT_PHDR
+	Phnum  uint64  // AT_PHNUM
+	Base   uintptr // AT_BASE, the dynamic linker's load address
+	RDebug uintptr // address of the first r_debug
+	Maps   []LinkMapEntry
+
+	// Ranges holds the memory the above was read from: program headers,
+	// dynamic section, r_debug, link_map structs, and name strings.
+	Ranges []MemRange
+}
+
+// LinkMapEntry is one link_map struct.
+type LinkMapEntry struct {
+	Addr  uintptr // address of the link_map struct itself
+	LAddr uintptr // l_addr, the object's load bias
+	LD    uintptr // l_ld, its dynamic section
+	Name  string  // l_name
+}
+
+// MemRange is a half-open range [Start, End) of target addresses.
+type MemRange struct {
+	Start, End uintptr
+}
+
+// ELF constants for x86-64 used to find r_debug.
+const (
+	ptDynamic = 2
+	ptPhdr    = 6
+	dtNull    = 0
+	dtDebug   = 21
+
+	phdrSize      = 56
+	rDebugSize    = 48 // r_debug_extended, which adds r_next to r_debug
+	linkMapSize   = 40 // the public part of struct link_map
+	maxLinkMaps   = 1 << 16
+	maxNamespaces = 256
+)
+
+// ReadLinkMap reads the dynamic linker's list of loaded objects from a
+// stopped process. It returns nil and no error for processes without a
+// dynamic linker, or whose dynamic linker hasn't set up r_debug yet.
+func (fs FS) ReadLinkMap(pid int) (*LinkMap, error) {
+	auxvData, err := fs.GetAuxv(pid)
+	if err != nil {
+		return nil, err
+	}
+	auxv := ParseAuxv(auxvData)
+	lm := &LinkMap{
+		Phdr:  uintptr(auxv[AT_PHDR]),
+		Phnum: auxv[AT_PHNUM],
+		Base:  uintptr(auxv[AT_BASE]),
+	}
+	if lm.Phdr == 0 || lm.Phnum == 0 || lm.Phnum > 0xffff {
+		return nil, nil
+	}
+	r := &memReader{mem: NewMemory(pid), lm: lm}
+
+	// Find the load bias (via PT_PHDR) and the dynamic section.
+	phdrs := make([]byte, lm.Phnum*phdrSize)
+	if err := r.read(lm.Phdr, phdrs); err != nil {
+		return nil, fmt.Errorf("failed to read program headers: %w", err)
+	}
+	var bias, dynVaddr, dynSize uintptr
+	var havePhdr bool
+	for i := 0; i < len(phdrs); i += phdrSize {
+		ph := phdrs[i : i+phdrSize]
+		vaddr := uintptr(binary.LittleEndian.Uint64(ph[16:]))
+		switch binary.LittleEndian.Uint32(ph) {
+		case ptPhdr:
+			bias = lm.Phdr - vaddr
+			havePhdr = true
+		case ptDynamic:
+			dynVaddr = vaddr
+			dynSize = uintptr(binary.LittleEndian.Uint64(ph[40:])) // p_memsz
+		}
+	}
+	if !havePhdr || dynSize == 0 {
+		return nil, nil // static executable
+	}
+
+	// DT_DEBUG in the executable's dynamic section points to r_debug.
+	dyn := make([]byte, dynSize&^15)
+	if err := r.read(bias+dynVaddr, dyn); err != nil {
+		return nil, fmt.Errorf("failed to read dynamic section: %w", err)
+	}
+	for i := 0; i < len(dyn); i += 16 {
+		tag := binary.LittleEndian.Uint64(dyn[i:])
+		if tag == dtNull {
+			break
+		}
+		if tag == dtDebug {
+			lm.RDebug = uintptr(binary.LittleEndian.Uint64(dyn[i+8:]))
+		}
+	}
+	if lm.RDebug == 0 {
+		return nil, nil
+	}
+
+	// Walk each namespace's r_debug (r_next in r_debug_extended, for
+	// dlmopen) and its link_map list.
+	rd := make([]byte, rDebugSize)
+	ent := make([]byte, linkMapSize)
+	rdAddr := lm.RDebug
+	for ns := 0; rdAddr != 0 && ns < maxNamespaces; ns++ {
+		if err := r.read(rdAddr, rd); err != nil {
+			return nil, fmt.Errorf("failed to read r_debug at %x: %w", rdAddr, err)
+		}
+		version := binary.LittleEndian.Uint32(rd)
+		mapAddr := uintptr(binary.LittleEndian.Uint64(rd[8:]))
+		for mapAddr != 0 && len(lm.Maps) < maxLinkMaps {
+			if err := r.read(mapAddr, ent); err != nil {
+				return nil, fmt.Errorf("failed to read link_map at %x: %w", mapAddr, err)
+			}
+			e := LinkMapEntry{
+				Addr:  mapAddr,
+				LAddr: uintptr(binary.LittleEndian.Uint64(ent[0:])),
+				LD:    uintptr(binary.LittleEndian.Uint64(ent[16:])),
+			}
+			e.Name = r.readString(uintptr(binary.LittleEndian.Uint64(ent[8:])))
+			lm.Maps = append(lm.Maps, e)
+			mapAddr = uintptr(binary.LittleEndian.Uint64(ent[24:]))
+		}
+		if version < 2 {
+			break
+		}
+		rdAddr = uintptr(binary.LittleEndian.Uint64(rd[40:]))
+	}
+	return lm, nil
+}
+
+// memReader reads target memory, recording what it read in lm.Ranges.
+type memReader struct {
+	mem *Memory
+	lm  *LinkMap
+}
+
+func (r *memReader) read(addr uintptr, buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := r.mem.ReadAt(buf, addr); err != nil {
+		return err
+	}
+	r.lm.Ranges = append(r.lm.Ranges, MemRange{Start: addr, End: addr + uintptr(len(buf))})
+	return nil
+}
+
+// readString reads a NUL-terminated string of up to a page, a chunk at a
+// time so it doesn't run off the end of a mapping. It returns what it
+// could read.
+func (r *memReader) readString(addr uintptr) string {
+	const chunk = 256
+	var s []byte
+	buf := make([]byte, chunk)
+	for addr != 0 && len(s) < 4096 {
+		// Don't cross a page boundary in one read.
+		n := min(chunk, int(4096-addr%4096))
+		if r.read(addr, buf[:n]) != nil {
+			break
+		}
+		if i := bytes.IndexByte(buf[:n], 0); i >= 0 {
+			return string(append(s, buf[:i]...))
+		}
+		s = append(s, buf[:n]...)
+		addr += uintptr(n)
+	}
+	return string(s)
+}
@@ -21,7 +21,12 @@ const (
 )
 
 // VMFlag constants
-var vmFlagDD = VMFlag{'d', 'd'} // MADV_DONTDUMP flag
+var (
+	vmFlagDD = VMFlag{'d', 'd'} // MADV_DONTDUMP flag
+	vmFlagSD = VMFlag{'s', 'd'} // VMA-wide soft-dirty flag
+	vmFlagSH = VMFlag{'s', 'h'} // shared mapping
+	vmFlagHT = VMFlag{'h', 't'} // hugetlb mapping
+)
 
 // Perm represents memory permissions.
 type Perm uint8
@@ -47,14 +52,21 @@ type VMA struct {
 	Kind    VMAKind
 	VmFlags []VMFlag // Memory advice flags from smaps
 	IsZero  bool     // True if this VMA should be zero-filled (no permissions)
+	// PageSize is the size of the VMA's pages: the base page size, or for
+	// a hugetlb mapping, its huge page size, such as 2MB or 1GB.
+	PageSize uint64
+	// ELFHeader is set on the first page of a mapped ELF file that
+	// SplitELFHeaders split off, which is dumped whatever the filter says
+	// of file mappings.
+	ELFHeader bool
 	// Internal fields for tracking
 	FileOffset uint64 // Offset in core file
 	MemSize    uint64 // Size in core file
 }
 
-// ParseMaps parses /proc/<pid>/maps.
-func ParseMaps(pid int) ([]VMA, error) {
-	mapsPath := fmt.Sprintf("/proc/%d/maps", pid)
+// ParseMaps parses /proc/<pid>/maps, merging in VmFlags from smaps.
+func (fs FS) ParseMaps(pid int) ([]VMA, error) {
+	mapsPath := fs.path(pid, "maps")
 	file, err := os.Open(mapsPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open maps: %w", err)
@@ -78,15 +90,19 @@ func ParseMaps(pid int) ([]VMA, error) {
 	}
 
 	// Parse smaps to get VmFlags for each VMA
-	smapsInfo, err := ParseSMaps(pid)
+	smapsInfo, err := fs.ParseSMaps(pid)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse smaps: %w", err)
 	}
 
-	// Merge VmFlags into VMAs
+	// Merge VmFlags and page sizes into VMAs
 	for i := range vmas {
+		vmas[i].PageSize = uint64(os.Getpagesize())
 		if info, ok := smapsInfo[vmas[i].Start]; ok {
 			vmas[i].VmFlags = info.VmFlags
+			if info.KernelPageSize != 0 {
+				vmas[i].PageSize = info.KernelPageSize * 1024
+			}
 		}
 	}
 
@@ -168,15 +184,16 @@ func parseMapsLine(line string) (VMA, error) {
 	}
 
 	// Determine VMA kind
-	kind := determineVMAKind(path, uintptr(start), uintptr(end))
+	kind := determineVMAKind(path, len(perms) == 4 && perms[3] == 's')
 
 	// Check if this VMA should be zero-filled:
 	// 1. No permissions (---p)
 	// 2. Special kernel regions that can't be read via process_vm_readv
+	//    or /proc/<pid>/mem. [vdso] can, and debuggers unwind through its
+	//    signal trampolines, so it's copied like any other mapping.
 	isZero := perms == "---p" ||
 		strings.Contains(path, "[vvar]") ||
 		strings.Contains(path, "[vvar_vclock]") ||
-		strings.Contains(path, "[vdso]") ||
 		strings.Contains(path, "[vsyscall]")
 
 	return VMA{
@@ -193,8 +210,12 @@ func parseMapsLine(line string) (VMA, error) {
 	}, nil
 }
 
-// determineVMAKind determines the type of VMA based on its properties
-func determineVMAKind(path string, start, end uintptr) VMAKind {
+// determineVMAKind determines the type of VMA based on its properties:
+// its path, and whether it's shared (MAP_SHARED) rather than private.
+func determineVMAKind(path string, shared bool) VMAKind {
+	if shared {
+		return VMAShared
+	}
 	if path == "" {
 		return VMAAnonymous
 	}
@@ -215,8 +236,8 @@ func determineVMAKind(path string, start, end uintptr) VMAKind {
 }
 
 // ParseSMaps parses /proc/<pid>/smaps for additional VMA information.
-func ParseSMaps(pid int) (map[uintptr]SMapsInfo, error) {
-	smapsPath := fmt.Sprintf("/proc/%d/smaps", pid)
+func (fs FS) ParseSMaps(pid int) (map[uintptr]SMapsInfo, error) {
+	smapsPath := fs.path(pid, "smaps")
 	file, err := os.Open(smapsPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open smaps: %w", err)
@@ -279,7 +300,17 @@ type SMapsInfo struct {
 	Referenced uint64
 	Anonymous  uint64
 	Swap       uint64
-	VmFlags    []VMFlag
+	// KernelPageSize is the size of the VMA's pages, larger than the base
+	// page size only for hugetlb mappings (transparent huge pages don't
+	// count).
+	KernelPageSize uint64
+	VmFlags        []VMFlag
+}
+
+// AllSoftDirty reports whether the kernel considers every page of the VMA
+// soft-dirty, as it does for VMAs created since the last clear_refs.
+func (info *SMapsInfo) AllSoftDirty() bool {
+	return slices.Contains(info.VmFlags, vmFlagSD)
 }
 
 // parseSMapsProperty parses a single property line from smaps.
@@ -325,6 +356,10 @@ func parseSMapsProperty(line string, info *SMapsInfo) {
 		if swap, err := strconv.ParseUint(value, 10, 64); err == nil {
 			info.Swap = swap
 		}
+	case "KernelPageSize:":
+		if ps, err := strconv.ParseUint(value, 10, 64); err == nil {
+			info.KernelPageSize = ps
+		}
 	case "VmFlags:":
 		// Parse space-separated 2-character flags
 		info.VmFlags = parseVmFlags(strings.Join(parts[1:], " "))
@@ -344,26 +379,156 @@ func parseVmFlags(flagsStr string) []VMFlag {
 	return flags
 }
 
+// DumpFilter selects which VMAs IsDumpable accepts. Its zero value
+// leaves out file-backed mappings; DefaultDumpFilter is what livecore uses
+// unless told otherwise.
+type DumpFilter struct {
+	IncludeFileMaps bool // include file-backed mappings
+	OnlyAnon        bool // include only the heap, stacks, and anonymous mappings
+	RespectDontdump bool // exclude MADV_DONTDUMP mappings
+
+	// ELFHeaders includes the first page of each mapping of an ELF file
+	// from its start, even where the rest of the mapping is left out, as
+	// bit 4 of the kernel's coredump_filter does; see SplitELFHeaders.
+	ELFHeaders bool
+
+	// Shared says which shared (MAP_SHARED) mappings to include.
+	Shared SharedPolicy
+
+	// Ranges, if set, limits the dump to these addresses. VMAs that
+	// straddle their edges must first be split with SplitAtRanges.
+	Ranges []AddrRange
+
+	// Match, if set, limits the dump to VMAs that match any of these.
+	Match []VMAExpr
+
+	// Exclude leaves out the VMAs that match any of these, even if Match
+	// selects them, such as a huge mapped database file.
+	Exclude []VMAExpr
+}
+
+// DefaultDumpFilter includes everything but MADV_DONTDUMP mappings, as the
+// kernel does.
+var DefaultDumpFilter = DumpFilter{IncludeFileMaps: true, RespectDontdump: true, ELFHeaders: true}
+
 // IsDumpable checks if a VMA should be included in the core dump.
-func (vma *VMA) IsDumpable(includeFileMaps, onlyAnon, respectDontdump bool) bool {
-	// Check if it's anonymous and we only want anonymous
-	if onlyAnon && vma.Kind != VMAAnonymous {
-		return false
+func (vma *VMA) IsDumpable(f DumpFilter) bool {
+	return vma.ExcludeReason(f) == ""
+}
+
+// ExcludeReason returns why f leaves the VMA out of the core dump, or ""
+// if it doesn't.
+func (vma *VMA) ExcludeReason(f DumpFilter) string {
+	// Check if it's anonymous and we only want anonymous. The kernel's
+	// special mappings, like [vdso], count as anonymous but aren't
+	// the program's memory. An ELF header is kept from any mapping.
+	if f.OnlyAnon && !vma.ELFHeader {
+		switch {
+		case vma.Kind == VMAHeap, vma.Kind == VMAStack:
+		case vma.Kind != VMAAnonymous, vma.Path != "":
+			return "not anonymous memory"
+		}
 	}
 
 	// Check if it's file-backed and we don't want file maps
-	if !includeFileMaps && vma.Kind == VMAFile {
-		return false
+	if !f.IncludeFileMaps && !vma.ELFHeader && (vma.Kind == VMAFile || vma.Kind == VMAShared && !vma.SharedMemory()) {
+		return "file-backed mapping"
+	}
+
+	if vma.Kind == VMAShared && !vma.ELFHeader {
+		switch {
+		case f.Shared == SharedExclude:
+			return "shared mapping"
+		case f.Shared == SharedAnonOnly && !vma.SharedMemory():
+			return "shared file mapping"
+		}
 	}
 
-	// Check MADV_DONTDUMP if respectDontdump is true
-	if respectDontdump {
+	// Check MADV_DONTDUMP if RespectDontdump is set
+	if f.RespectDontdump {
 		if slices.Contains(vma.VmFlags, vmFlagDD) {
-			return false
+			return "MADV_DONTDUMP"
 		}
 	}
 
-	return true
+	if len(f.Ranges) > 0 && !vma.inRanges(f.Ranges) {
+		return "outside the selected address ranges"
+	}
+	if len(f.Match) > 0 && !slices.ContainsFunc(f.Match, func(e VMAExpr) bool { return e.Match(vma) }) {
+		return "not selected by the VMA filter"
+	}
+	if i := slices.IndexFunc(f.Exclude, func(e VMAExpr) bool { return e.Match(vma) }); i >= 0 {
+		return "excluded by " + f.Exclude[i].String()
+	}
+
+	return ""
+}
+
+// Shared reports whether the VMA is a shared mapping, whose pages other
+// processes can change without the change showing up in this process's
+// soft-dirty bits.
+func (vma *VMA) Shared() bool {
+	return slices.Contains(vma.VmFlags, vmFlagSH)
+}
+
+// Hugetlb reports whether the VMA is backed by huge pages from hugetlbfs,
+// as MAP_HUGETLB and SHM_HUGETLB mappings are. The kernel tracks no
+// soft-dirty bits for them, so their writes can't be found that way.
+func (vma *VMA) Hugetlb() bool {
+	return slices.Contains(vma.VmFlags, vmFlagHT) || vma.PageSize > uint64(os.Getpagesize())
+}
+
+// VDSO reports whether the VMA is the kernel's vDSO. It counts as
+// anonymous, having no file, but its pages read back its code whether or
+// not the target ever touched them.
+func (vma *VMA) VDSO() bool {
+	return vma.Path == "[vdso]"
+}
+
+// SharedMemory reports whether the VMA is a shared mapping of memory
+// rather than of a file: one of MAP_SHARED|MAP_ANONYMOUS, memfd, System V,
+// or /dev/shm memory, or of a deleted file, whose contents can't be read
+// back from it. The kernel's core dumps count them as anonymous.
+func (vma *VMA) SharedMemory() bool {
+	if vma.Kind != VMAShared {
+		return false
+	}
+	for _, prefix := range []string{"/dev/zero", "/SYSV", "/memfd:", "/dev/shm/"} {
+		if strings.HasPrefix(vma.Path, prefix) {
+			return true
+		}
+	}
+	return vma.Path == "" || strings.HasSuffix(vma.Path, " (deleted)")
+}
+
+// SharedPolicy says which shared (MAP_SHARED) mappings a DumpFilter
+// includes, as bits 1 and 3 of /proc/<pid>/coredump_filter do for the
+// kernel's core dumps.
+type SharedPolicy int
+
+const (
+	// SharedInclude includes every shared mapping.
+	SharedInclude SharedPolicy = iota
+	// SharedExclude leaves them all out.
+	SharedExclude
+	// SharedAnonOnly includes only shared memory, as VMA.SharedMemory
+	// reports it, and leaves out shared mappings of files, whose contents
+	// are in the files; it's what the kernel does by default.
+	SharedAnonOnly
+)
+
+// ParseSharedPolicy parses a SharedPolicy name: "include", "exclude", or
+// "anon-only".
+func ParseSharedPolicy(s string) (SharedPolicy, error) {
+	switch s {
+	case "include":
+		return SharedInclude, nil
+	case "exclude":
+		return SharedExclude, nil
+	case "anon-only":
+		return SharedAnonOnly, nil
+	}
+	return 0, fmt.Errorf("unknown shared mapping policy %q (want include, exclude, or anon-only)", s)
 }
 
 // Size returns the size of the VMA.
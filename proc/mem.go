@@ -0,0 +1,42 @@
+package proc
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Memory reads a live process's memory with process_vm_readv, which needs
+// the same permission as attaching with ptrace. The process keeps running
+// unless the caller has stopped it, so reads aren't consistent with each
+// other.
+type Memory struct {
+	pid int
+}
+
+// NewMemory returns a Memory for pid.
+func NewMemory(pid int) *Memory {
+	return &Memory{pid: pid}
+}
+
+// ReadAt reads len(p) bytes of memory at addr. As with io.ReaderAt, it
+// returns a non-nil error if it reads fewer, such as when part of the
+// range isn't mapped.
+func (m *Memory) ReadAt(p []byte, addr uintptr) (int, error) {
+	n := 0
+	for n < len(p) {
+		// process_vm_readv stops at the first page it can't read, so
+		// retry from there to get the error for that page.
+		local := []unix.Iovec{{Base: &p[n], Len: uint64(len(p) - n)}}
+		remote := []unix.RemoteIovec{{Base: addr + uintptr(n), Len: len(p) - n}}
+		got, err := unix.ProcessVMReadv(m.pid, local, remote, 0)
+		if err != nil {
+			return n, fmt.Errorf("failed to read memory at %x: %w", addr+uintptr(n), err)
+		}
+		if got == 0 {
+			return n, fmt.Errorf("failed to read memory at %x: %w", addr+uintptr(n), unix.EFAULT)
+		}
+		n += got
+	}
+	return n, nil
+}
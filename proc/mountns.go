@@ -0,0 +1,159 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountInfo is a line of a mountinfo file.
+type mountInfo struct {
+	dev       string // major:minor
+	root      string // the directory of the filesystem mounted
+	point     string
+	fsType    string
+	superOpts string
+}
+
+// readMountInfo parses a mountinfo file.
+func readMountInfo(path string) ([]mountInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %w", err)
+	}
+	var mounts []mountInfo
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 1<<20) // overlay options can be long
+	for s.Scan() {
+		// ID parent major:minor root mount-point options [optional...] - type source super-options
+		pre, post, ok := strings.Cut(s.Text(), " - ")
+		f, g := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(f) < 5 || len(g) < 3 {
+			continue
+		}
+		mounts = append(mounts, mountInfo{
+			dev:       f[2],
+			root:      unescapeMountinfo(f[3]),
+			point:     unescapeMountinfo(f[4]),
+			fsType:    g[0],
+			superOpts: g[2],
+		})
+	}
+	return mounts, s.Err()
+}
+
+// mountOf returns the mount that path is under: the last one mounted
+// at its longest mount point prefix, as later mounts hide earlier ones.
+func mountOf(mounts []mountInfo, path string) (mountInfo, bool) {
+	var best mountInfo
+	found := false
+	for _, m := range mounts {
+		if under(path, m.point) && (!found || len(m.point) >= len(best.point)) {
+			best, found = m, true
+		}
+	}
+	return best, found
+}
+
+// under reports whether path is dir or in it.
+func under(path, dir string) bool {
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// HostPaths finds, for the files pid maps that are in a different mount
+// namespace from the caller's, where the caller can open them, so they can
+// still be found after pid, and its namespace, are gone. It returns a map
+// from the path pid sees, as in vmas, to the caller's, leaving out paths
+// that already name the same file for the caller. If pid shares the
+// caller's mount namespace, it returns nil.
+//
+// It looks where pid's mount of each file comes from: the same filesystem
+// mounted elsewhere for the caller, or, for an overlay, as containers'
+// root filesystems usually are, its upper and lower directories. A path is
+// only returned if the file there has the device and inode pid maps.
+func (fs FS) HostPaths(pid int, vmas []VMA) (map[string]string, error) {
+	theirs, err := os.Readlink(fs.path(pid, "ns", "mnt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount namespace: %w", err)
+	}
+	if ours, err := os.Readlink("/proc/self/ns/mnt"); err == nil && ours == theirs {
+		return nil, nil
+	}
+	targetMounts, err := readMountInfo(fs.path(pid, "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	hostMounts, err := readMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, vma := range vmas {
+		p := vma.Path
+		if vma.Inode == 0 || !filepath.IsAbs(p) || strings.HasSuffix(p, " (deleted)") || seen[p] {
+			continue
+		}
+		seen[p] = true
+		if sameFile(p, vma) {
+			continue
+		}
+		m, ok := mountOf(targetMounts, p)
+		if !ok {
+			continue
+		}
+		rel := strings.TrimPrefix(p, m.point)
+		if m.point == "/" {
+			rel = p
+		}
+		for _, c := range hostCandidates(m, rel, hostMounts) {
+			if sameFile(c, vma) {
+				paths[p] = c
+				break
+			}
+		}
+	}
+	return paths, nil
+}
+
+// hostCandidates returns the caller's paths that might be rel within the
+// mount m of another namespace.
+func hostCandidates(m mountInfo, rel string, hostMounts []mountInfo) []string {
+	var cs []string
+	if m.fsType == "overlay" {
+		for _, opt := range strings.Split(m.superOpts, ",") {
+			k, v, _ := strings.Cut(opt, "=")
+			switch k {
+			case "upperdir":
+				cs = append(cs, v+rel)
+			case "lowerdir":
+				for _, dir := range strings.Split(v, ":") {
+					cs = append(cs, dir+rel)
+				}
+			}
+		}
+	}
+	inFS := filepath.Join(m.root, rel)
+	for _, hm := range hostMounts {
+		if hm.dev == m.dev && under(inFS, hm.root) {
+			cs = append(cs, filepath.Join(hm.point, strings.TrimPrefix(inFS, hm.root)))
+		}
+	}
+	return cs
+}
+
+// sameFile reports whether path, for the caller, is the file vma maps.
+func sameFile(path string, vma VMA) bool {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return false
+	}
+	// VMA.Dev is encoded as ParseMaps does.
+	return st.Ino == vma.Inode && uint64(unix.Major(st.Dev))<<8|uint64(unix.Minor(st.Dev)) == vma.Dev
+}
@@ -0,0 +1,48 @@
+package proc
+
+import (
+	"fmt"
+	"os"
+)
+
+// A PidNamespace translates process and thread IDs, as the caller sees
+// them, to the ones a PID namespace, such as a container's, uses.
+type PidNamespace struct {
+	fs   FS
+	link string // its ns/pid link, which identifies it
+	own  bool   // the caller's
+}
+
+// PidNamespaceOf returns the PID namespace pid is in.
+func (fs FS) PidNamespaceOf(pid int) (*PidNamespace, error) {
+	link, err := os.Readlink(fs.path(pid, "ns", "pid"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PID namespace: %w", err)
+	}
+	self, err := os.Readlink("/proc/self/ns/pid")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PID namespace: %w", err)
+	}
+	return &PidNamespace{fs: fs, link: link, own: link == self}, nil
+}
+
+// Own reports whether ns is the caller's, whose IDs need no translating.
+func (ns *PidNamespace) Own() bool { return ns.own }
+
+// ID returns the ID the process or thread the caller knows as id has in
+// ns, or 0 if it's not in ns, as the kernel reports a parent or session
+// leader outside a process's namespace, or it's gone.
+func (ns *PidNamespace) ID(id int) int {
+	if ns.own || id <= 0 {
+		return id
+	}
+	link, err := os.Readlink(ns.fs.path(id, "ns", "pid"))
+	if err != nil || link != ns.link {
+		return 0
+	}
+	st, err := ns.fs.ReadStatus(id)
+	if err != nil || len(st.NSpid) == 0 {
+		return 0
+	}
+	return st.NSpid[len(st.NSpid)-1]
+}
@@ -0,0 +1,155 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Status holds the fields of /proc/<pid>/status that livecore uses.
+type Status struct {
+	Name    string
+	PPid    int
+	Uids    [4]int // real, effective, saved, and filesystem
+	Gids    [4]int
+	Threads int
+	VmRSS   uint64 // bytes
+	CapEff  uint64 // effective capability set
+	SigPnd  uint64 // signals pending for the thread itself, as a mask
+	SigBlk  uint64 // blocked signals
+	Seccomp int    // 0 off, 1 strict, 2 filtered
+
+	// NSpid is the process's ID in each PID namespace it's in, from the
+	// caller's, usually, to its own.
+	NSpid []int
+
+	// NoMemory is set for kernel threads and zombies, which have no
+	// address space to dump.
+	NoMemory bool
+
+	// Owner is the uid owning the /proc/<pid> directory: normally the
+	// effective uid, but root for non-dumpable processes.
+	Owner int
+}
+
+// capSysPtrace is CAP_SYS_PTRACE's bit in a capability set.
+const capSysPtrace = 1 << 19
+
+// HasPtraceCap reports whether the process has CAP_SYS_PTRACE in effect.
+func (s *Status) HasPtraceCap() bool {
+	return s.CapEff&capSysPtrace != 0
+}
+
+// Dumpable reports whether the process looks dumpable (see PR_SET_DUMPABLE).
+// It can only tell for processes whose effective uid isn't root.
+func (s *Status) Dumpable() bool {
+	return s.Owner == s.Uids[1] || s.Uids[1] == 0
+}
+
+// ReadStatus parses /proc/<pid>/status. pid can be any thread's ID, to
+// read that thread's signal state.
+func (fs FS) ReadStatus(pid int) (Status, error) {
+	var st Status
+	dir := fs.path(pid)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return st, fmt.Errorf("failed to stat %s: %w", dir, err)
+	}
+	st.Owner = int(fi.Sys().(*syscall.Stat_t).Uid)
+
+	data, err := os.ReadFile(fs.path(pid, "status"))
+	if err != nil {
+		return st, fmt.Errorf("failed to read status: %w", err)
+	}
+	st.NoMemory = true // until we see a Vm line
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		key, val, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		if strings.HasPrefix(key, "Vm") {
+			st.NoMemory = false
+		}
+		switch key {
+		case "Name":
+			st.Name = val
+		case "PPid":
+			st.PPid, err = strconv.Atoi(val)
+		case "Uid":
+			err = parseIDs(val, &st.Uids)
+		case "Gid":
+			err = parseIDs(val, &st.Gids)
+		case "Threads":
+			st.Threads, err = strconv.Atoi(val)
+		case "VmRSS":
+			var kb uint64
+			kb, err = strconv.ParseUint(strings.TrimSuffix(val, " kB"), 10, 64)
+			st.VmRSS = kb * 1024
+		case "Kthread":
+			st.NoMemory = st.NoMemory || val == "1"
+		case "CapEff":
+			st.CapEff, err = strconv.ParseUint(val, 16, 64)
+		case "SigPnd":
+			st.SigPnd, err = strconv.ParseUint(val, 16, 64)
+		case "SigBlk":
+			st.SigBlk, err = strconv.ParseUint(val, 16, 64)
+		case "Seccomp":
+			st.Seccomp, err = strconv.Atoi(val)
+		case "NSpid":
+			for _, f := range strings.Fields(val) {
+				var id int
+				if id, err = strconv.Atoi(f); err != nil {
+					break
+				}
+				st.NSpid = append(st.NSpid, id)
+			}
+		}
+		if err != nil {
+			return st, fmt.Errorf("invalid status field %s: %w", key, err)
+		}
+	}
+	return st, nil
+}
+
+// parseIDs parses the four tab-separated ids of a Uid or Gid line.
+func parseIDs(val string, ids *[4]int) error {
+	f := strings.Fields(val)
+	if len(f) != len(ids) {
+		return fmt.Errorf("got %d ids, want %d", len(f), len(ids))
+	}
+	for i := range ids {
+		id, err := strconv.Atoi(f[i])
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+	return nil
+}
+
+// ListPids returns the IDs of the processes in fs, in increasing order.
+func (fs FS) ListPids() ([]int, error) {
+	root := fs.Root
+	if root == "" {
+		root = "/proc"
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+	var pids []int
+	for _, e := range entries {
+		if pid, err := strconv.Atoi(e.Name()); err == nil && e.IsDir() {
+			pids = append(pids, pid)
+		}
+	}
+	slices.Sort(pids)
+	return pids, nil
+}
@@ -0,0 +1,161 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FindByName returns the ID of the one process named name: by its
+// command name (comm, at most 15 bytes) or by the base name of its first
+// argument. Kernel threads and the calling process don't count. It fails
+// if no process or more than one matches.
+func (fs FS) FindByName(name string) (int, error) {
+	pids, err := fs.ListPids()
+	if err != nil {
+		return 0, err
+	}
+	var matches []int
+	for _, pid := range pids {
+		if pid == os.Getpid() {
+			continue
+		}
+		st, err := fs.ReadStatus(pid)
+		if err != nil || st.NoMemory {
+			continue // exited, or a kernel thread
+		}
+		if st.Name == name || fs.argv0(pid) == name {
+			matches = append(matches, pid)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("no process named %q", name)
+	case 1:
+		return matches[0], nil
+	}
+	var list []string
+	for _, pid := range matches {
+		list = append(list, strconv.Itoa(pid))
+	}
+	return 0, fmt.Errorf("%d processes are named %q (pids %s); pick one by pid", len(matches), name, strings.Join(list, ", "))
+}
+
+// argv0 returns the base name of pid's first argument, or "".
+func (fs FS) argv0(pid int) string {
+	data, err := os.ReadFile(fs.path(pid, "cmdline"))
+	if err != nil {
+		return ""
+	}
+	arg, _, _ := bytes.Cut(data, []byte{0})
+	if len(arg) == 0 {
+		return ""
+	}
+	return filepath.Base(string(arg))
+}
+
+// Descendants returns the IDs of pid's children, their children, and so
+// on, parents before children. It reads each thread's children file,
+// falling back to every process's parent pid on kernels built without
+// those. Zombies, which have no memory left, are left out, but not their
+// children. Processes forked after it looks are missed, of course.
+func (fs FS) Descendants(pid int) ([]int, error) {
+	children := fs.children
+	if _, err := os.Stat(fs.taskPath(pid, pid, "children")); errors.Is(err, os.ErrNotExist) {
+		byParent, err := fs.childrenByParent()
+		if err != nil {
+			return nil, err
+		}
+		children = func(pid int) []int { return byParent[pid] }
+	}
+
+	var pids []int
+	queue := []int{pid}
+	for len(queue) > 0 {
+		kids := children(queue[0])
+		queue = append(queue[1:], kids...)
+		for _, kid := range kids {
+			if st, err := fs.ReadStatus(kid); err == nil && !st.NoMemory {
+				pids = append(pids, kid)
+			}
+		}
+	}
+	return pids, nil
+}
+
+// children returns the IDs of the children of every thread of pid, from
+// /proc/<pid>/task/<tid>/children. A child whose parent exited is
+// reparented elsewhere, so it's not an error for threads to vanish.
+func (fs FS) children(pid int) []int {
+	threads, _ := fs.ParseThreads(pid)
+	var kids []int
+	for _, t := range threads {
+		data, err := os.ReadFile(fs.taskPath(pid, t.Tid, "children"))
+		if err != nil {
+			continue
+		}
+		for _, f := range strings.Fields(string(data)) {
+			if kid, err := strconv.Atoi(f); err == nil {
+				kids = append(kids, kid)
+			}
+		}
+	}
+	return kids
+}
+
+// childrenByParent maps each process's ID to its children's, from the
+// PPid of every process in fs.
+func (fs FS) childrenByParent() (map[int][]int, error) {
+	pids, err := fs.ListPids()
+	if err != nil {
+		return nil, err
+	}
+	byParent := make(map[int][]int)
+	for _, pid := range pids {
+		if st, err := fs.ReadStatus(pid); err == nil {
+			byParent[st.PPid] = append(byParent[st.PPid], pid)
+		}
+	}
+	return byParent, nil
+}
+
+// PidfdPid returns the ID of the process pidfd, an open pidfd of the
+// calling process, refers to. It fails if the process has exited.
+func PidfdPid(pidfd int) (int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/self/fdinfo/%d", pidfd))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read pidfd info: %w", err)
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		val, ok := strings.CutPrefix(s.Text(), "Pid:")
+		if !ok {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(val))
+		switch {
+		case err != nil:
+			return 0, fmt.Errorf("invalid pidfd info Pid %q", val)
+		case pid == -1:
+			return 0, fmt.Errorf("pidfd %d's process has exited", pidfd)
+		case pid == 0:
+			// The process is in a pid namespace we can't see into.
+			return 0, fmt.Errorf("pidfd %d's process isn't visible in this pid namespace", pidfd)
+		}
+		return pid, nil
+	}
+	return 0, fmt.Errorf("fd %d is not a pidfd", pidfd)
+}
+
+// PidfdAlive reports whether pidfd's process is still running, so that
+// its pid, looked up earlier with PidfdPid, still refers to it.
+func PidfdAlive(pidfd int) bool {
+	return unix.PidfdSendSignal(pidfd, 0, nil, 0) == nil
+}
@@ -0,0 +1,699 @@
+package proc
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Thread represents a thread in the target process
+type Thread struct {
+	Tid       int
+	Registers []byte // Raw register data
+	FPRegs    []byte // user_fpregs_struct (x87 and SSE), if read
+	XState    []byte // XSAVE area with AVX and later state, if the CPU has one
+	Name      string // comm, if read
+	Sched     *Sched // scheduling state, if read
+	Stopped   bool   // True once the thread has reported its ptrace-stop
+	Exited    bool   // True if the thread exited while being frozen
+
+	tracer *tracer // the OS thread that seized it, if not the caller's
+
+	// PendingSignal is a signal the thread had already dequeued for
+	// delivery when it stopped (a signal-delivery-stop rather than the
+	// PTRACE_EVENT_STOP we asked for). It's re-injected on detach so that
+	// freezing doesn't swallow it.
+	PendingSignal syscall.Signal
+
+	// SigInfo is the siginfo_t of PendingSignal, if any.
+	SigInfo []byte
+
+	// SigPending and SigBlocked are the masks of signals pending for the
+	// thread itself and blocked by it.
+	SigPending, SigBlocked uint64
+}
+
+// ParseThreads parses /proc/<pid>/task/* to enumerate threads
+func (fs FS) ParseThreads(pid int) ([]Thread, error) {
+	taskDir := fs.path(pid, "task")
+	entries, err := os.ReadDir(taskDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task directory: %w", err)
+	}
+
+	var threads []Thread
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue // Skip non-numeric entries
+		}
+
+		thread := Thread{
+			Tid: tid,
+		}
+		threads = append(threads, thread)
+	}
+
+	return threads, nil
+}
+
+// StackPointer returns the thread's stack pointer from its collected
+// registers, or 0 if they weren't collected.
+func (t *Thread) StackPointer() uintptr {
+	const espOffset = 15 * 4 // esp in i386's user_regs_struct
+	switch len(t.Registers) {
+	case gregsetSize:
+		return uintptr(binary.LittleEndian.Uint64(t.Registers[spOffset:]))
+	case gregsetSize32:
+		return uintptr(binary.LittleEndian.Uint32(t.Registers[espOffset:]))
+	}
+	return 0
+}
+
+// GetThreadRegisters collects a thread's general registers, in the
+// user_regs_struct layout of NT_PRSTATUS's pr_reg.
+func GetThreadRegisters(tid int) ([]byte, error) {
+	regs, err := getGeneralRegisters(tid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get general registers: %w", err)
+	}
+	return regs, nil
+}
+
+// getGeneralRegisters gets the general registers with
+// PTRACE_GETREGSET(NT_PRSTATUS). Unlike PTRACE_GETREGS, whose layout is
+// each architecture's own, the kernel fills in the register set exactly
+// as its own cores have it, fs_base and gs_base included, so TLS can be
+// found.
+//
+// For a 32-bit process, in compat mode, the kernel gives the i386
+// user_regs_struct instead, as a 32-bit debugger would see it.
+func getGeneralRegisters(tid int) ([]byte, error) {
+	regs, err := getRegSet(tid, ntPRStatus, gregsetSize)
+	switch {
+	case err == unix.ESRCH:
+		// Thread no longer exists - this can happen if the thread exits
+		return nil, err
+	case err == unix.EPERM:
+		return nil, fmt.Errorf("no permission to access thread %d", tid)
+	case err != nil:
+		return nil, fmt.Errorf("failed to get registers for thread %d: %w", tid, err)
+	case len(regs) != gregsetSize && len(regs) != gregsetSize32:
+		return nil, fmt.Errorf("got %d bytes of registers for thread %d, want %d", len(regs), tid, gregsetSize)
+	}
+	return regs, nil
+}
+
+// Register sets for PTRACE_GETREGSET, from linux/elf.h.
+const (
+	ntPRStatus    = 1      // user_regs_struct
+	gregsetSize32 = 17 * 4 // i386's
+	ntPRFPREG     = 2      // user_fpregs_struct
+	ntX86XState   = 0x202  // XSAVE area
+	maxXStateLen  = 16 << 10
+)
+
+// gregsetSize is the size of user_regs_struct, elf_gregset_t, on the
+// architecture livecore runs on, and spOffset is where the stack pointer
+// is in it.
+var gregsetSize, spOffset = func() (int, int) {
+	if runtime.GOARCH == "riscv64" {
+		return 32 * 8, 2 * 8 // pc, then x1 to x31; sp is x2
+	}
+	return 27 * 8, 19 * 8 // x86-64; rsp
+}()
+
+// getFloatingPointRegisters gets the floating-point registers in the
+// layout of NT_FPREGSET: on x86-64, the x87 and SSE registers, in the
+// 512-byte FXSAVE layout, and on RISC-V, f0 to f31 and fcsr.
+func getFloatingPointRegisters(tid int) ([]byte, error) {
+	return getRegSet(tid, ntPRFPREG, 512)
+}
+
+// getXState gets an x86 thread's XSAVE area, which holds the FXSAVE
+// registers followed by the AVX, AVX-512, and other extended state the
+// CPU has. Its size depends on the CPU; the kernel says how much it
+// filled in.
+func getXState(tid int) ([]byte, error) {
+	return getRegSet(tid, ntX86XState, maxXStateLen)
+}
+
+// siginfoSize is the size of siginfo_t.
+const siginfoSize = 128
+
+// getSigInfo gets the siginfo_t of the signal a thread in
+// signal-delivery-stop is about to receive.
+func getSigInfo(tid int) ([]byte, error) {
+	buf := make([]byte, siginfoSize)
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_GETSIGINFO, uintptr(tid), 0, uintptr(unsafe.Pointer(&buf[0])), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return buf, nil
+}
+
+// getRegSet reads a register set with PTRACE_GETREGSET into a buffer of
+// up to size bytes, returning the part the kernel filled in.
+func getRegSet(tid int, typ uintptr, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	iov := unix.Iovec{Base: &buf[0]}
+	iov.SetLen(size)
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_GETREGSET, uintptr(tid), typ, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return buf[:iov.Len], nil
+}
+
+// FreezeThread freezes a thread using ptrace
+func FreezeThread(tid int) error {
+	// PTRACE_SEIZE to attach without stopping
+	if err := unix.PtraceSeize(tid); err != nil {
+		return fmt.Errorf("failed to seize thread %d: %w", tid, err)
+	}
+
+	// PTRACE_INTERRUPT to stop the thread
+	if err := unix.PtraceInterrupt(tid); err != nil {
+		return fmt.Errorf("failed to interrupt thread %d: %w", tid, err)
+	}
+
+	return nil
+}
+
+// UnfreezeThread unfreezes a thread using ptrace, delivering sig to it
+// (if non-zero) as it resumes.
+//
+// Threads that were in a job-control stop when seized report it as a
+// PTRACE_EVENT_STOP; on detach the kernel reinstates the group-stop, so a
+// deliberately SIGSTOPped target stays stopped. We never resume a thread
+// between its stop and detach, so PTRACE_LISTEN isn't needed to keep it there.
+func UnfreezeThread(tid int, sig syscall.Signal) error {
+	// For seized threads, we can detach directly without resuming
+	// PTRACE_DETACH will automatically resume the thread and detach
+	if err := ptraceDetach(tid, sig); err != nil {
+		// If thread no longer exists, that's okay - it already exited
+		if err == unix.ESRCH {
+			return nil
+		}
+		return fmt.Errorf("failed to detach from thread %d: %w", tid, err)
+	}
+
+	return nil
+}
+
+// ptraceDetach is unix.PtraceDetach with a signal to deliver.
+func ptraceDetach(tid int, sig syscall.Signal) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_DETACH, uintptr(tid), 0, uintptr(sig), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// FreezeOptions configures FreezeAllThreads.
+type FreezeOptions struct {
+	// StopTimeout is how long to wait for the threads to report their
+	// ptrace-stop. Zero means forever.
+	StopTimeout time.Duration
+
+	// Workers is how many OS threads to seize threads from in parallel
+	// when the target has at least parallelFreezeMin of them. Zero means
+	// one per CPU, up to 16; one seizes everything from the calling thread.
+	Workers int
+
+	// Cgroup, if set, is frozen while the threads are seized, so none can
+	// run or start new threads meanwhile, and thawed once they all are.
+	// Everything else in the cgroup is frozen for that long too.
+	Cgroup *CgroupFreezer
+}
+
+// parallelFreezeMin is the fewest threads FreezeAllThreads seizes in
+// parallel. Below it, starting tracers costs more than it saves.
+const parallelFreezeMin = 256
+
+// FreezeAllThreads freezes all threads in a process and returns them sorted by tid.
+//
+// It waits up to opts.StopTimeout for the threads to report their
+// ptrace-stop. Threads that don't stop in time, typically ones in
+// uninterruptible sleep, are returned with Stopped false; their registers
+// can't be read. The caller must be locked to its OS thread, as all later
+// ptrace calls on the threads have to come from the same thread.
+//
+// Targets with many threads are seized by several OS threads at once, so
+// the first threads stopped aren't kept waiting on the last. Later calls
+// on the returned threads (CollectThreadRegisters, UnfreezeAllThreads)
+// run on whichever OS thread seized each one, and UnfreezeAllThreads shuts
+// those down.
+//
+// With opts.Cgroup, the threads are seized all while the cgroup is frozen.
+// Once thawed, each goes straight into ptrace-stop, since its interrupt
+// is already pending, without running any more of its own code.
+func (fs FS) FreezeAllThreads(pid int, opts FreezeOptions) ([]Thread, error) {
+	var deadline time.Time
+	if opts.StopTimeout > 0 {
+		deadline = time.Now().Add(opts.StopTimeout)
+	}
+
+	var tracers []*tracer
+	frozen := make(map[int]*Thread) // by tid
+	cgroup := opts.Cgroup           // nil once thawed
+	abandon := func(err error) ([]Thread, error) {
+		if cgroup != nil {
+			cgroup.Thaw()
+		}
+		// If we can't freeze a thread, we should unfreeze the ones we did freeze
+		ts := slices.Collect(maps.Values(frozen))
+		forEachByTracer(ts, func(t *Thread) error {
+			UnfreezeThread(t.Tid, t.PendingSignal)
+			return nil
+		})
+		for _, tr := range tracers {
+			tr.stop()
+		}
+		return nil, err
+	}
+
+	if cgroup != nil {
+		if err := cgroup.Freeze(deadline); err != nil {
+			return nil, fmt.Errorf("failed to freeze cgroup: %w", err)
+		}
+	}
+
+	for {
+		threads, err := fs.ParseThreads(pid)
+		if err != nil {
+			return abandon(fmt.Errorf("failed to parse threads: %w", err))
+		}
+		var seize []*Thread
+		for _, thread := range threads {
+			if _, ok := frozen[thread.Tid]; !ok {
+				seize = append(seize, &thread)
+			}
+		}
+
+		if tracers == nil && len(seize) >= parallelFreezeMin {
+			tracers = startTracers(opts.Workers)
+		}
+		for i, t := range seize {
+			if len(tracers) > 0 {
+				t.tracer = tracers[i%len(tracers)]
+			}
+		}
+		var (
+			mu   sync.Mutex
+			errs = make(map[*Thread]error)
+		)
+		forEachByTracer(seize, func(t *Thread) error {
+			if err := FreezeThread(t.Tid); err != nil {
+				mu.Lock()
+				errs[t] = err
+				mu.Unlock()
+			}
+			return nil
+		})
+
+		newCount := 0
+		var freezeErr error
+		for _, t := range seize {
+			switch err := errs[t]; {
+			case errors.Is(err, unix.ESRCH):
+				// Exited since we listed it; nothing to freeze.
+			case err != nil:
+				if freezeErr == nil {
+					freezeErr = fmt.Errorf("failed to freeze thread %d: %w", t.Tid, err)
+				}
+			default:
+				frozen[t.Tid] = t
+				newCount++
+			}
+		}
+		if freezeErr != nil {
+			return abandon(freezeErr)
+		}
+		if cgroup != nil {
+			// Threads in a v1 freezer don't report their ptrace-stop
+			// until thawed, so thaw before waiting.
+			if err := cgroup.Thaw(); err != nil {
+				return abandon(fmt.Errorf("failed to thaw cgroup: %w", err))
+			}
+			cgroup = nil
+		}
+
+		// Threads that were still running could have created new
+		// threads before stopping, so rescan until nothing new shows up.
+		if err := waitForStops(frozen, deadline); err != nil {
+			return abandon(err)
+		}
+		if newCount == 0 {
+			var ts []Thread
+			used := make(map[*tracer]bool)
+			for _, t := range frozen {
+				ts = append(ts, *t)
+				used[t.tracer] = true
+			}
+			for _, tr := range tracers {
+				if !used[tr] {
+					tr.stop()
+				}
+			}
+			slices.SortFunc(ts, func(a, b Thread) int {
+				return cmp.Compare(a.Tid, b.Tid)
+			})
+			return ts, nil
+		}
+	}
+}
+
+// startTracers starts the tracers to seize threads with, given
+// FreezeOptions.Workers. It returns none if they'd all be seized from the
+// calling thread.
+func startTracers(workers int) []*tracer {
+	if workers == 0 {
+		workers = min(runtime.NumCPU(), 16)
+	}
+	if workers <= 1 {
+		return nil
+	}
+	tracers := make([]*tracer, workers)
+	for i := range tracers {
+		tracers[i] = newTracer()
+	}
+	return tracers
+}
+
+// waitForStops waits for each seized thread to report its ptrace-stop,
+// marking it Stopped. It gives up at deadline (unless zero), leaving the
+// remaining threads unstopped.
+func waitForStops(threads map[int]*Thread, deadline time.Time) error {
+	for sleep := 50 * time.Microsecond; ; sleep = min(sleep*2, 10*time.Millisecond) {
+		pending := 0
+		for _, t := range threads {
+			if t.Stopped {
+				continue
+			}
+			var ws unix.WaitStatus
+			wpid, err := unix.Wait4(t.Tid, &ws, unix.WALL|unix.WNOHANG, nil)
+			switch {
+			case err == unix.EINTR:
+				pending++
+			case err == unix.ECHILD:
+				// Already exited and reaped; it won't run again.
+				t.Stopped, t.Exited = true, true
+			case err != nil:
+				return fmt.Errorf("failed to wait for thread %d: %w", t.Tid, err)
+			case wpid == t.Tid:
+				// Stopped, or exited; either way it won't run again.
+				t.Stopped = true
+				t.Exited = ws.Exited() || ws.Signaled()
+				// Our PTRACE_INTERRUPT (or a group-stop) reports as
+				// PTRACE_EVENT_STOP. Without an event, it's a
+				// signal-delivery-stop and the signal must be passed
+				// back on detach.
+				if ws.Stopped() && uint32(ws)>>16 == 0 {
+					t.PendingSignal = ws.StopSignal()
+				}
+			default:
+				pending++
+			}
+		}
+		if pending == 0 {
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(sleep)
+	}
+}
+
+// ThreadState returns the scheduler state letter of a thread from
+// /proc/<pid>/task/<tid>/stat, such as 'R', 'S', or 'D'.
+func (fs FS) ThreadState(pid, tid int) (byte, error) {
+	data, err := os.ReadFile(fs.taskPath(pid, tid, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	fields := StatFields(data)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid stat format")
+	}
+	return fields[0][0], nil
+}
+
+// ThreadName returns the name of a thread from
+// /proc/<pid>/task/<tid>/comm: what it was last named with
+// prctl(PR_SET_NAME) or pthread_setname_np, or else its process's name.
+func (fs FS) ThreadName(pid, tid int) (string, error) {
+	data, err := os.ReadFile(fs.taskPath(pid, tid, "comm"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// Sched is a thread's scheduling state.
+type Sched struct {
+	Policy     int      // SCHED_OTHER (0), SCHED_FIFO, SCHED_RR, and so on
+	RTPriority int      // 1 to 99 under a real-time policy, else 0
+	Priority   int      // the kernel's priority, as /proc/<tid>/stat has it
+	Nice       int      // -20 to 19
+	CPU        int      // the CPU it last ran on
+	Affinity   []uint64 // the CPUs it may run on, as a bitmask, CPU 0 in bit 0 of the first word
+}
+
+// ThreadSched returns the scheduling state of a thread, from
+// /proc/<pid>/task/<tid>/stat and sched_getaffinity.
+func (fs FS) ThreadSched(pid, tid int) (*Sched, error) {
+	data, err := os.ReadFile(fs.taskPath(pid, tid, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// Fields from state (field 3 in proc(5)) on.
+	fields := StatFields(data)
+	if len(fields) < 39 {
+		return nil, fmt.Errorf("invalid stat format")
+	}
+	s := new(Sched)
+	for _, f := range []struct {
+		p     *int
+		field int
+	}{
+		{&s.Priority, 18},
+		{&s.Nice, 19},
+		{&s.CPU, 39},
+		{&s.RTPriority, 40},
+		{&s.Policy, 41},
+	} {
+		if *f.p, err = strconv.Atoi(fields[f.field-3]); err != nil {
+			return nil, fmt.Errorf("invalid stat field %d: %w", f.field, err)
+		}
+	}
+
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(tid, &set); err != nil {
+		return nil, fmt.Errorf("failed to get CPU affinity: %w", err)
+	}
+	n := len(set)
+	for n > 0 && set[n-1] == 0 {
+		n--
+	}
+	for _, w := range set[:n] {
+		s.Affinity = append(s.Affinity, uint64(w))
+	}
+	return s, nil
+}
+
+// UnfreezeAllThreads unfreezes all threads in a process
+func UnfreezeAllThreads(threads []Thread) error {
+	ts := pointers(threads)
+	err := forEachByTracer(ts, func(thread *Thread) error {
+		if thread.Exited {
+			return nil
+		}
+		if !thread.Stopped {
+			// A seized thread can't be detached until it stops. Check
+			// once more; otherwise the kernel detaches it when its
+			// tracer exits.
+			var ws unix.WaitStatus
+			if wpid, _ := unix.Wait4(thread.Tid, &ws, unix.WALL|unix.WNOHANG, nil); wpid != thread.Tid {
+				return nil
+			}
+		}
+		return UnfreezeThread(thread.Tid, thread.PendingSignal)
+	})
+	stopTracers(ts)
+	return err
+}
+
+// CollectThreadRegisters collects register state for all stopped threads,
+// along with their signal state.
+func CollectThreadRegisters(threads []Thread) error {
+	return forEachByTracer(pointers(threads), func(thread *Thread) error {
+		if !thread.Stopped || thread.Exited {
+			// Registers can only be read in ptrace-stop.
+			return nil
+		}
+		registers, err := GetThreadRegisters(thread.Tid)
+		if err != nil {
+			// If thread no longer exists, skip it but continue with others
+			if errors.Is(err, unix.ESRCH) {
+				thread.Exited = true
+				return nil
+			}
+			return fmt.Errorf("failed to get registers for thread %d: %w", thread.Tid, err)
+		}
+		thread.Registers = registers
+
+		// Only general registers can hold pointers, so FP and vector
+		// state is nice to have, for debuggers, but not worth failing
+		// over: kernels and CPUs without XSAVE don't have it.
+		if fpregs, err := getFloatingPointRegisters(thread.Tid); err == nil {
+			thread.FPRegs = fpregs
+		}
+		if xstate, err := getXState(thread.Tid); err == nil {
+			thread.XState = xstate
+		}
+
+		// Signal state is just as optional.
+		if st, err := ReadStatus(thread.Tid); err == nil {
+			thread.SigPending, thread.SigBlocked = st.SigPnd, st.SigBlk
+		}
+		if thread.PendingSignal != 0 {
+			if si, err := getSigInfo(thread.Tid); err == nil {
+				thread.SigInfo = si
+			}
+		}
+		return nil
+	})
+}
+
+// pointers returns pointers to the elements of threads.
+func pointers(threads []Thread) []*Thread {
+	ts := make([]*Thread, len(threads))
+	for i := range threads {
+		ts[i] = &threads[i]
+	}
+	return ts
+}
+
+// GetProcessInfo reads basic process information
+func (fs FS) GetProcessInfo(pid int) (ProcessInfo, error) {
+	var info ProcessInfo
+
+	// Read comm from /proc/<pid>/comm
+	commPath := fs.path(pid, "comm")
+	commData, err := os.ReadFile(commPath)
+	if err != nil {
+		return info, fmt.Errorf("failed to read comm: %w", err)
+	}
+	info.Comm = string(commData[:len(commData)-1]) // Remove newline
+
+	// Read stat from /proc/<pid>/stat
+	statPath := fs.path(pid, "stat")
+	statData, err := os.ReadFile(statPath)
+	if err != nil {
+		return info, fmt.Errorf("failed to read stat: %w", err)
+	}
+
+	// Parse stat data (simplified)
+	info.Stat = string(statData)
+
+	return info, nil
+}
+
+// ProcessInfo contains basic process information
+type ProcessInfo struct {
+	Comm string
+	Stat string
+}
+
+// StringAreas holds the address ranges of a process's argument and
+// environment strings, normally at the top of the main thread's stack.
+type StringAreas struct {
+	ArgStart, ArgEnd uintptr
+	EnvStart, EnvEnd uintptr
+}
+
+// GetStringAreas reads the argument and environment string ranges from
+// fields 48 through 51 of /proc/<pid>/stat.
+func (fs FS) GetStringAreas(pid int) (StringAreas, error) {
+	data, err := os.ReadFile(fs.path(pid, "stat"))
+	if err != nil {
+		return StringAreas{}, fmt.Errorf("failed to read stat: %w", err)
+	}
+	fields := StatFields(data)
+	if len(fields) < 49 {
+		return StringAreas{}, fmt.Errorf("stat has %d fields, want at least 51", len(fields)+2)
+	}
+	var vals [4]uintptr
+	for i := range vals {
+		v, err := strconv.ParseUint(fields[45+i], 10, 64)
+		if err != nil {
+			return StringAreas{}, fmt.Errorf("invalid stat field %d: %w", 48+i, err)
+		}
+		vals[i] = uintptr(v)
+	}
+	return StringAreas{ArgStart: vals[0], ArgEnd: vals[1], EnvStart: vals[2], EnvEnd: vals[3]}, nil
+}
+
+// clockTicks is the kernel's USER_HZ, the unit of the times in
+// /proc/<pid>/stat. It's 100 on every Linux architecture Go supports.
+const clockTicks = 100
+
+// StartTime returns when a process started, as time since boot, from
+// field 22 of /proc/<pid>/stat. It tells a process apart from a later one
+// that reuses its pid.
+func (fs FS) StartTime(pid int) (time.Duration, error) {
+	data, err := os.ReadFile(fs.path(pid, "stat"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read stat: %w", err)
+	}
+	fields := StatFields(data)
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("stat has %d fields, want at least 22", len(fields)+2)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stat field 22: %w", err)
+	}
+	return time.Duration(ticks) * time.Second / clockTicks, nil
+}
+
+// StatFields returns the fields of a /proc/<pid>/stat line that follow the
+// parenthesized comm, which may itself contain spaces. The first returned
+// field is the state, field 3 in proc(5) numbering.
+func StatFields(stat []byte) []string {
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return nil
+	}
+	return strings.Fields(string(stat[i+1:]))
+}
+
+// GetAuxv reads the auxiliary vector from /proc/<pid>/auxv
+func (fs FS) GetAuxv(pid int) ([]byte, error) {
+	auxvPath := fs.path(pid, "auxv")
+	auxvData, err := os.ReadFile(auxvPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auxv: %w", err)
+	}
+	return auxvData, nil
+}
@@ -0,0 +1,97 @@
+package proc
+
+import (
+	"runtime"
+	"sync"
+)
+
+// A tracer is an OS thread dedicated to ptrace calls. The kernel makes the
+// thread that seized a tracee its tracer, and only that thread may make
+// further ptrace requests of it, so each tracee has to stay with the
+// tracer that seized it until it's detached.
+type tracer struct {
+	work chan func()
+}
+
+// newTracer starts a tracer.
+func newTracer() *tracer {
+	t := &tracer{work: make(chan func())}
+	go func() {
+		// Never unlocked: when the goroutine returns, the thread exits,
+		// and the kernel detaches anything it was still tracing.
+		runtime.LockOSThread()
+		for f := range t.work {
+			f()
+		}
+	}()
+	return t
+}
+
+// do runs f on the tracer's thread and waits for it.
+func (t *tracer) do(f func()) {
+	done := make(chan struct{})
+	t.work <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// stop shuts down the tracer's thread.
+func (t *tracer) stop() {
+	close(t.work)
+}
+
+// forEachByTracer calls f on each of threads, from the thread that seized
+// it. Threads seized by different tracers are handled concurrently; those
+// seized by the calling thread are handled on it. It returns the first
+// error f returns, after handling every thread.
+func forEachByTracer(threads []*Thread, f func(*Thread) error) error {
+	batches := make(map[*tracer][]*Thread)
+	for _, t := range threads {
+		batches[t.tracer] = append(batches[t.tracer], t)
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	run := func(batch []*Thread) {
+		for _, t := range batch {
+			if err := f(t); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}
+	}
+	for tr, batch := range batches {
+		if tr == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr.do(func() { run(batch) })
+		}()
+	}
+	run(batches[nil])
+	wg.Wait()
+	return firstErr
+}
+
+// stopTracers shuts down the tracers of threads, which must all have been
+// detached or be past caring, and forgets them.
+func stopTracers(threads []*Thread) {
+	seen := make(map[*tracer]bool)
+	for _, t := range threads {
+		if t.tracer != nil && !seen[t.tracer] {
+			seen[t.tracer] = true
+			t.tracer.stop()
+		}
+		t.tracer = nil
+	}
+}
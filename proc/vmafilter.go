@@ -0,0 +1,302 @@
+package proc
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// AddrRange is a half-open range [Start, End) of addresses.
+type AddrRange struct {
+	Start, End uintptr
+}
+
+// ParseAddrRange parses a range written as "start-end", in hex with or
+// without a leading 0x, as in /proc/<pid>/maps. It's widened to whole
+// pages.
+func ParseAddrRange(s string) (AddrRange, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return AddrRange{}, fmt.Errorf("invalid address range %q: want start-end", s)
+	}
+	parse := func(s string) (uintptr, error) {
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+		v, err := strconv.ParseUint(s, 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid address in range: %w", err)
+		}
+		return uintptr(v), nil
+	}
+	start, err := parse(startStr)
+	if err != nil {
+		return AddrRange{}, err
+	}
+	end, err := parse(endStr)
+	if err != nil {
+		return AddrRange{}, err
+	}
+	if start >= end {
+		return AddrRange{}, fmt.Errorf("invalid address range %q: start isn't below end", s)
+	}
+	pageSize := uintptr(os.Getpagesize())
+	return AddrRange{Start: start &^ (pageSize - 1), End: (end + pageSize - 1) &^ (pageSize - 1)}, nil
+}
+
+// VMAExpr is a parsed VMA filter expression: comma-separated terms that a
+// VMA must all match. The terms are
+//
+//	kind=anon|file|heap|stack|shared
+//	path=GLOB    the mapped file's path, or a name like [heap], matched
+//	             with path.Match, or, for a GLOB without a /, its base
+//	             name; path= matches unnamed mappings
+//	perms=rwx    has at least these permissions (any of r, w, and x)
+//	size>N       bigger than N bytes; also size<N, size>=N, and size<=N.
+//	             N may end in K, M, G, or T
+//
+// and any term may start with ! to negate it, as in "!path=*.so*".
+type VMAExpr struct {
+	s     string
+	terms []vmaTerm
+}
+
+type vmaTerm struct {
+	not   bool
+	match func(*VMA) bool
+}
+
+// ParseVMAExpr parses a VMA filter expression; see VMAExpr.
+func ParseVMAExpr(s string) (VMAExpr, error) {
+	e := VMAExpr{s: s}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		var term vmaTerm
+		if rest, ok := strings.CutPrefix(t, "!"); ok {
+			term.not, t = true, rest
+		}
+		var err error
+		term.match, err = parseVMATerm(t)
+		if err != nil {
+			return VMAExpr{}, fmt.Errorf("invalid VMA filter %q: %w", s, err)
+		}
+		e.terms = append(e.terms, term)
+	}
+	return e, nil
+}
+
+func parseVMATerm(t string) (func(*VMA) bool, error) {
+	if rest, ok := strings.CutPrefix(t, "size"); ok {
+		return parseSizeTerm(rest)
+	}
+	key, val, ok := strings.Cut(t, "=")
+	if !ok {
+		return nil, fmt.Errorf("term %q isn't key=value or a size comparison", t)
+	}
+	switch key {
+	case "kind":
+		kinds := map[string]VMAKind{
+			"anon":   VMAAnonymous,
+			"file":   VMAFile,
+			"heap":   VMAHeap,
+			"stack":  VMAStack,
+			"shared": VMAShared,
+		}
+		kind, ok := kinds[val]
+		if !ok {
+			return nil, fmt.Errorf("unknown kind %q", val)
+		}
+		return func(vma *VMA) bool { return vma.Kind == kind }, nil
+	case "path":
+		if _, err := path.Match(val, ""); err != nil {
+			return nil, fmt.Errorf("bad path pattern %q: %w", val, err)
+		}
+		base := !strings.Contains(val, "/")
+		return func(vma *VMA) bool {
+			ok, _ := path.Match(val, vma.Path)
+			if !ok && base && strings.HasPrefix(vma.Path, "/") {
+				ok, _ = path.Match(val, path.Base(vma.Path))
+			}
+			return ok
+		}, nil
+	case "perms":
+		var want Perm
+		for _, c := range val {
+			switch c {
+			case 'r':
+				want |= PermRead
+			case 'w':
+				want |= PermWrite
+			case 'x':
+				want |= PermExec
+			default:
+				return nil, fmt.Errorf("unknown permission %q", c)
+			}
+		}
+		return func(vma *VMA) bool { return vma.Perms&want == want }, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", key)
+}
+
+// parseSizeTerm parses what follows "size" in a size comparison.
+func parseSizeTerm(t string) (func(*VMA) bool, error) {
+	var op string
+	for _, o := range []string{">=", "<=", ">", "<"} {
+		if rest, ok := strings.CutPrefix(t, o); ok {
+			op, t = o, rest
+			break
+		}
+	}
+	if op == "" {
+		return nil, fmt.Errorf("size term needs one of >, <, >=, or <=")
+	}
+	n, err := ParseSize(t)
+	if err != nil {
+		return nil, err
+	}
+	return func(vma *VMA) bool {
+		size := uint64(vma.End - vma.Start)
+		switch op {
+		case ">=":
+			return size >= n
+		case "<=":
+			return size <= n
+		case ">":
+			return size > n
+		}
+		return size < n
+	}, nil
+}
+
+// ParseSize parses a byte count, with an optional K, M, G, or T suffix
+// for binary multiples.
+func ParseSize(s string) (uint64, error) {
+	shift := 0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		case 'T', 't':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v << shift, nil
+}
+
+// String returns the expression as it was written.
+func (e VMAExpr) String() string { return e.s }
+
+// Match reports whether vma matches every term of e.
+func (e VMAExpr) Match(vma *VMA) bool {
+	for _, t := range e.terms {
+		if t.match(vma) == t.not {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitAtRanges splits the VMAs that straddle an edge of f.Ranges, so the
+// parts inside and outside them can be dumped or left out separately. It
+// returns vmas unchanged if f has no Ranges.
+func (f DumpFilter) SplitAtRanges(vmas []VMA) []VMA {
+	if len(f.Ranges) == 0 {
+		return vmas
+	}
+	var result []VMA
+	for _, vma := range vmas {
+		for {
+			cut := vma.End
+			for _, r := range f.Ranges {
+				for _, edge := range []uintptr{r.Start, r.End} {
+					if edge > vma.Start && edge < cut {
+						cut = edge
+					}
+				}
+			}
+			if cut == vma.End {
+				result = append(result, vma)
+				break
+			}
+			head := vma
+			head.End, head.MemSize = cut, uint64(cut-vma.Start)
+			result = append(result, head)
+			if vma.Inode != 0 {
+				vma.Offset += uint64(cut - vma.Start)
+			}
+			vma.Start, vma.MemSize = cut, uint64(vma.End-cut)
+		}
+	}
+	return result
+}
+
+// SplitELFHeaders splits the first page off each VMA that maps an ELF file
+// from its start, reading the ELF magic number from process pid's memory,
+// and marks it ELFHeader, so that it's dumped even where f leaves the rest
+// of the mapping out as a file mapping. Debuggers find build IDs there
+// without the file. It returns vmas unchanged unless f.ELFHeaders is set,
+// and leaves VMAs f dumps anyway whole.
+func (f DumpFilter) SplitELFHeaders(pid int, vmas []VMA) ([]VMA, error) {
+	if !f.ELFHeaders {
+		return vmas, nil
+	}
+	var mem *os.File
+	defer func() {
+		if mem != nil {
+			mem.Close()
+		}
+	}()
+	pageSize := uintptr(os.Getpagesize())
+	var result []VMA
+	for _, vma := range vmas {
+		head := vma
+		head.ELFHeader = true
+		if vma.Inode == 0 || vma.Offset != 0 || vma.Perms&PermRead == 0 || vma.IsZero || vma.Hugetlb() ||
+			vma.IsDumpable(f) || !head.IsDumpable(f) {
+			result = append(result, vma)
+			continue
+		}
+		if mem == nil {
+			var err error
+			if mem, err = os.Open(DefaultFS.path(pid, "mem")); err != nil {
+				return nil, fmt.Errorf("failed to open memory: %w", err)
+			}
+		}
+		var magic [4]byte
+		if _, err := mem.ReadAt(magic[:], int64(vma.Start)); err != nil || string(magic[:]) != "\x7fELF" {
+			result = append(result, vma)
+			continue
+		}
+		if vma.End-vma.Start <= pageSize {
+			result = append(result, head)
+			continue
+		}
+		head.End, head.MemSize = vma.Start+pageSize, uint64(pageSize)
+		vma.Start, vma.MemSize = head.End, uint64(vma.End-head.End)
+		vma.Offset += uint64(pageSize)
+		result = append(result, head, vma)
+	}
+	return result, nil
+}
+
+// inRanges reports whether vma, which mustn't straddle an edge of ranges,
+// is inside them.
+func (vma *VMA) inRanges(ranges []AddrRange) bool {
+	for _, r := range ranges {
+		if vma.Start >= r.Start && vma.End <= r.End {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package livecore
+
+import (
+	"os"
+	"time"
+)
+
+// Progress says how far a dump has got; see WithProgress.
+type Progress struct {
+	// Phase is the phase running, as named in Stats.Phase.
+	Phase string
+
+	// Pass is the pre-copy pass running, from 1, or 0 outside pre-copy.
+	Pass int
+
+	// Done is how many bytes of memory the phase, or pass, has copied
+	// or, in the "write" phase, written to the core. Total is how many
+	// it's expected to in all, an estimate until the target is stopped,
+	// or 0 if the phase doesn't move memory or can't tell.
+	Done, Total uint64
+
+	// Elapsed is how long the phase, or pass, has run.
+	Elapsed time.Duration
+}
+
+// PagesRemaining returns how many pages the phase, or pass, is expected
+// still to copy or write.
+func (p Progress) PagesRemaining() uint64 {
+	if p.Done >= p.Total {
+		return 0
+	}
+	return (p.Total - p.Done) / uint64(os.Getpagesize())
+}
+
+// ETA estimates how much longer the phase, or pass, will take, at the
+// rate it has gone so far, or returns 0 if it can't tell.
+func (p Progress) ETA() time.Duration {
+	if p.Done == 0 || p.Done >= p.Total {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * float64(p.Total-p.Done) / float64(p.Done))
+}
+
+// progressInterval is the least time between reports of a phase's
+// progress, but for its start and end.
+const progressInterval = 100 * time.Millisecond
+
+// progress is the Progress a Dumper last reported, and when.
+type progress struct {
+	Progress
+	start, last time.Time
+}
+
+// startProgress reports the start of phase, or of one of its passes,
+// which is expected to move total bytes.
+func (d *Dumper) startProgress(phase string, pass int, total uint64) {
+	if d.onProgress == nil {
+		return
+	}
+	now := time.Now()
+	d.progress = progress{Progress: Progress{Phase: phase, Pass: pass, Total: total}, start: now, last: now}
+	d.onProgress(d.progress.Progress)
+}
+
+// progressTo records that the current phase has moved done bytes,
+// reporting it if it has been a while since the last report, or if that's
+// all it was expected to.
+func (d *Dumper) progressTo(done uint64) {
+	if d.onProgress == nil {
+		return
+	}
+	p := &d.progress
+	p.Done = done
+	now := time.Now()
+	if now.Sub(p.last) < progressInterval && done < p.Total {
+		return
+	}
+	p.last = now
+	p.Elapsed = now.Sub(p.start)
+	d.onProgress(p.Progress)
+}
+
+// finishProgress reports that the current phase has moved all it will,
+// which may be less than it was expected to.
+func (d *Dumper) finishProgress() {
+	if d.onProgress == nil {
+		return
+	}
+	d.progress.Total = d.progress.Done
+	d.progress.last = time.Time{}
+	d.progressTo(d.progress.Done)
+}
@@ -0,0 +1,276 @@
+// Package quiesce lets a process cooperate with livecore: before freezing
+// the process, livecore asks it to reach a clean point (flush buffers,
+// release locks, finish in-flight writes), and tells it when the dump has
+// let it run again.
+//
+// A program opts in by calling Listen once at startup. livecore only asks
+// when run with -quiesce-timeout, and freezes the process anyway if it
+// isn't ready in time.
+//
+// # Protocol
+//
+// The target listens on the abstract Unix socket named by SocketName for
+// its pid as it knows it, which in a container is its pid in the
+// container's PID namespace. Abstract sockets belong to a network
+// namespace, so livecore connects from the target's, and hangs up unless
+// the listener is the target itself. For each dump, it sends "quiesce\n". The target prepares
+// and replies "ready\n". When the dump has resumed the target, livecore
+// sends "resume\n"; the target also resumes if the connection closes
+// first, so a crashed livecore can't wedge it. Only root and the target's
+// own user may connect.
+package quiesce
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Protocol messages, each sent as a single line.
+const (
+	msgQuiesce = "quiesce"
+	msgReady   = "ready"
+	msgResume  = "resume"
+)
+
+// SocketName returns the name of the abstract Unix socket on which process
+// pid listens for quiesce requests, in its network namespace. pid is as
+// the process knows itself, by os.Getpid.
+func SocketName(pid int) string {
+	return fmt.Sprintf("@livecore-quiesce.%d", pid)
+}
+
+// Listen starts serving quiesce requests for the current process in the
+// background and returns a Closer that stops it.
+//
+// prepare is called when a dump is about to freeze the process. It should
+// bring the program to a clean point and return a function that undoes
+// that, which is called once the dump has resumed the process. prepare
+// may return nil if there's nothing to undo. Requests are handled one at
+// a time.
+func Listen(prepare func() (resume func())) (io.Closer, error) {
+	ln, err := net.Listen("unix", SocketName(os.Getpid()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for quiesce requests: %w", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serve(c.(*net.UnixConn), prepare)
+		}
+	}()
+	return ln, nil
+}
+
+// serve handles a single quiesce request on c.
+func serve(c *net.UnixConn, prepare func() func()) {
+	defer c.Close()
+	if !peerAllowed(c) {
+		return
+	}
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if line, err := br.ReadString('\n'); err != nil || line != msgQuiesce+"\n" {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	resume := prepare()
+	if resume != nil {
+		defer resume()
+	}
+	if _, err := io.WriteString(c, msgReady+"\n"); err != nil {
+		return
+	}
+	// Wait for "resume", or for livecore to hang up.
+	br.ReadString('\n')
+}
+
+// peerAllowed reports whether the process on the other end of c is root
+// or runs as our user.
+func peerAllowed(c *net.UnixConn) bool {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return false
+	}
+	return cred.Uid == 0 || int(cred.Uid) == os.Getuid()
+}
+
+// peerPid returns the pid, as the caller knows it, of the process on the
+// other end of c, or 0 if it can't tell, such as when that process isn't
+// in the caller's PID namespace. For a connection to a listening socket,
+// it's the process that listened.
+func peerPid(c *net.UnixConn) int {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return 0
+	}
+	return int(cred.Pid)
+}
+
+// nsPid returns the pid process pid, as the caller knows it, has in its
+// own PID namespace: the last of the NSpid line in its status, or pid if
+// the kernel doesn't report one.
+func nsPid(pid int) (int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read process status: %w", err)
+	}
+	for line := range strings.Lines(string(data)) {
+		if ids, ok := strings.CutPrefix(line, "NSpid:"); ok {
+			f := strings.Fields(ids)
+			if len(f) == 0 {
+				break
+			}
+			return strconv.Atoi(f[len(f)-1])
+		}
+	}
+	return pid, nil
+}
+
+// dial connects to the abstract Unix socket name in process pid's network
+// namespace. A socket stays in the namespace it was made in, so when that
+// isn't the caller's, it's made on a thread that enters pid's namespace
+// and then returns to its own.
+func dial(pid int, name string, timeout time.Duration) (net.Conn, error) {
+	target, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network namespace: %w", err)
+	}
+	self, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network namespace: %w", err)
+	}
+	if target == self {
+		return net.DialTimeout("unix", name, timeout)
+	}
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		c, restored, err := dialIn(pid, name, timeout)
+		if restored {
+			runtime.UnlockOSThread()
+		} // else the thread, still in pid's namespace, exits with us
+		done <- result{c, err}
+	}()
+	r := <-done
+	return r.c, r.err
+}
+
+// dialIn does dial's work on a locked thread: it enters pid's network
+// namespace, connects, and goes back to the thread's own namespace,
+// reporting whether it managed to.
+func dialIn(pid int, name string, timeout time.Duration) (c net.Conn, restored bool, err error) {
+	own, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to open network namespace: %w", err)
+	}
+	defer own.Close()
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to open target's network namespace: %w", err)
+	}
+	defer ns.Close()
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return nil, true, fmt.Errorf("failed to enter target's network namespace: %w", err)
+	}
+	c, err = net.DialTimeout("unix", name, timeout)
+	restored = unix.Setns(int(own.Fd()), unix.CLONE_NEWNET) == nil
+	return c, restored, err
+}
+
+// ErrNotSupported is returned, possibly wrapped, by Request when the
+// target isn't listening for quiesce requests, or another process holds
+// its socket.
+var ErrNotSupported = errors.New("target does not listen for quiesce requests")
+
+// Session is an outstanding quiesce request, as seen by the dumper.
+type Session struct {
+	c    net.Conn
+	once sync.Once
+}
+
+// Request asks process pid, as the caller knows it, to quiesce and waits
+// up to timeout for it to report that it's ready. Entering the network
+// namespace of a target in another one takes CAP_SYS_ADMIN.
+//
+// On timeout it returns both the Session and an error: the target may
+// still get ready later, and must be told to resume either way.
+func Request(pid int, timeout time.Duration) (*Session, error) {
+	ownPid, err := nsPid(pid)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dial(pid, SocketName(ownPid), timeout)
+	if err != nil {
+		if errors.Is(err, unix.ECONNREFUSED) || errors.Is(err, unix.ENOENT) {
+			return nil, ErrNotSupported
+		}
+		return nil, fmt.Errorf("failed to connect to quiesce socket: %w", err)
+	}
+	if peer := peerPid(c.(*net.UnixConn)); peer != pid {
+		c.Close()
+		return nil, fmt.Errorf("%w: its socket is held by process %d instead", ErrNotSupported, peer)
+	}
+	s := &Session{c: c}
+	c.SetDeadline(time.Now().Add(timeout))
+	defer c.SetDeadline(time.Time{})
+	if _, err := io.WriteString(c, msgQuiesce+"\n"); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to send quiesce request: %w", err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return s, fmt.Errorf("target did not quiesce: %w", err)
+	}
+	if line != msgReady+"\n" {
+		return s, fmt.Errorf("unexpected quiesce reply %q", line)
+	}
+	return s, nil
+}
+
+// Resume tells the target that it's running again, and ends the session.
+// It's safe to call more than once.
+func (s *Session) Resume() error {
+	var err error
+	s.once.Do(func() {
+		s.c.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err = io.WriteString(s.c, msgResume+"\n")
+		if cerr := s.c.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package livecore
+
+import (
+	"github.com/bradfitz/livecore/internal/buffer"
+	"github.com/bradfitz/livecore/internal/copy"
+	"github.com/bradfitz/livecore/internal/vmaindex"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// reconcileVMAs brings the scratch buffer, filled by pre-copy from vmas,
+// up to date with finalVMAs, the mappings once the target is frozen.
+// Mappings may have appeared, gone, grown, shrunk, or been split or merged
+// in between. The buffer finds what was copied of a final VMA where it
+// overlaps VMAs pre-copy saw of the same mapping, moving it where need be;
+// see buffer.Manager.GetOffsetForVMA. What was copied of VMAs that are
+// gone, or that another mapping has replaced, is discarded. The ranges of
+// final VMAs pre-copy didn't see, such as where one grew, are returned, to
+// copy in full while the target's stopped, since their pages needn't be
+// soft-dirty.
+func (d *Dumper) reconcileVMAs(vmas, finalVMAs []proc.VMA, bm *buffer.Manager) ([]copy.PageRange, error) {
+	index := vmaindex.New(len(vmas), func(i int) (uintptr, uintptr) { return vmas[i].Start, vmas[i].End })
+	var uncopied, mapped []copy.PageRange
+	var changedVMAs int
+	for _, vma := range finalVMAs {
+		whole := copy.PageRange{Start: vma.Start, End: vma.End}
+		mapped = append(mapped, whole)
+		if vma.IsZero {
+			continue
+		}
+		overlapping := index.Overlapping(vma.Start, vma.End)
+		if len(overlapping) == 1 {
+			if p := vmas[overlapping[0]]; p.Start == vma.Start && p.End == vma.End && sameMapping(p, vma) {
+				continue
+			}
+		}
+		changedVMAs++
+		rest := []copy.PageRange{whole}
+		for _, i := range overlapping {
+			p := vmas[i]
+			start, end := max(p.Start, vma.Start), min(p.End, vma.End)
+			if !sameMapping(p, vma) {
+				// Its pages are another mapping's.
+				if err := bm.Discard(uint64(start), uint64(end-start)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			rest = copy.SubtractRanges(rest, []copy.PageRange{{Start: start, End: end}})
+		}
+		uncopied = append(uncopied, rest...)
+	}
+
+	var seen []copy.PageRange
+	for _, vma := range vmas {
+		seen = append(seen, copy.PageRange{Start: vma.Start, End: vma.End})
+	}
+	for _, r := range copy.SubtractRanges(seen, mapped) {
+		if err := bm.Discard(uint64(r.Start), uint64(r.End-r.Start)); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.verbose && changedVMAs > 0 {
+		var size uint64
+		for _, r := range uncopied {
+			size += uint64(r.End - r.Start)
+		}
+		d.logf("[STW] %d VMAs changed since pre-copy; copying %d MB of them in full", changedVMAs, size>>20)
+	}
+	return uncopied, nil
+}
+
+// sameMapping reports whether a and b, which overlap, map the same thing,
+// so that what was copied of one holds for the other where they overlap:
+// the same file, or anonymous memory, at the same offsets.
+func sameMapping(a, b proc.VMA) bool {
+	return a.Inode == b.Inode && a.Dev == b.Dev && a.Path == b.Path &&
+		a.Shared() == b.Shared() && a.Hugetlb() == b.Hugetlb() &&
+		a.Offset-uint64(a.Start) == b.Offset-uint64(b.Start)
+}
@@ -0,0 +1,72 @@
+package livecore
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/internal/buffer"
+)
+
+// recordsTrailer is what ends a record stream (see WithRecords), after
+// the pages: what Replay needs to write the core around them.
+type recordsTrailer struct {
+	Class elf.Class
+	VMAs  []elfcore.VMA
+	Notes []elfcore.Note
+}
+
+// finishRecords ends the record stream bm writes with info's layout and
+// notes.
+func (d *Dumper) finishRecords(bm *buffer.Manager, info *elfcore.CoreInfo) error {
+	payload, err := json.Marshal(recordsTrailer{Class: info.Class, VMAs: info.VMAs, Notes: info.Notes})
+	if err != nil {
+		return fmt.Errorf("failed to encode the records' trailer: %w", err)
+	}
+	if err := bm.FinishRecords(payload); err != nil {
+		return err
+	}
+	if d.verbose {
+		d.logf("Wrote %d MB of records; livecore replay turns them into the core", bm.RecordsWritten()>>20)
+	}
+	return nil
+}
+
+// Replay reads from r the record stream of a dump made WithRecords, and
+// writes the core it describes to w: straight into it if it's a regular
+// file, or else streamed, holes and all. The pages are replayed into a
+// scratch buffer in dir, or os.TempDir if it's "", which takes up as much
+// as the pages the core holds; only the last copy of each is kept.
+func Replay(r io.Reader, w io.Writer, dir string) error {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	bm, payload, err := buffer.ReplayRecords(r, dir, 0)
+	if err != nil {
+		return err
+	}
+	defer bm.Close()
+	var t recordsTrailer
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return fmt.Errorf("failed to decode the records' trailer: %w", err)
+	}
+
+	info := &elfcore.CoreInfo{Class: t.Class, VMAs: t.VMAs, Notes: t.Notes}
+	mem := newBufferMemory(bm, info.VMAs)
+	var elfWriter *elfcore.ELFWriter
+	if f := regularFile(w); f != nil {
+		if elfWriter, err = elfcore.NewFileWriter(f, info, mem); err != nil {
+			return fmt.Errorf("failed to create ELF writer: %w", err)
+		}
+	} else {
+		elfWriter = elfcore.NewStreamWriter(w, info, mem)
+	}
+	defer elfWriter.Close()
+	if err := elfWriter.WriteCore(); err != nil {
+		return fmt.Errorf("failed to write core file: %w", err)
+	}
+	return nil
+}
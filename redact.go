@@ -0,0 +1,147 @@
+package livecore
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+
+	"github.com/bradfitz/livecore/elfcore"
+	"github.com/bradfitz/livecore/internal/buffer"
+	"github.com/bradfitz/livecore/internal/copy"
+	"github.com/bradfitz/livecore/internal/vmaindex"
+	"github.com/bradfitz/livecore/proc"
+)
+
+// SecretPatterns match common credentials, for WithRedactPatterns: AWS
+// access key IDs, PEM private keys, and GitHub and Slack tokens.
+var SecretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`),
+	regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`),
+}
+
+// redactMask is what WithRedactPatterns' matches are overwritten with.
+const redactMask = '*'
+
+// redactScanChunk is how much buffered memory is searched for patterns at
+// a time, and redactOverlap how much more is read past each chunk, so
+// that a match of up to that length across chunks is still found.
+const (
+	redactScanChunk = 1 << 20
+	redactOverlap   = 16 << 10
+)
+
+// redact zeroes or masks what's to be kept out of the core in the
+// buffered memory of vmas: the argument and environment strings, as
+// requested by -cmdline and -environ, WithRedactRanges' ranges, and
+// WithRedactPatterns' matches. It returns what it redacted, for the
+// NT_LIVECORE_REDACTED note.
+func (d *Dumper) redact(vmas []proc.VMA, bufferManager *buffer.Manager) ([]elfcore.RedactedRange, error) {
+	type zeroRange struct {
+		copy.PageRange
+		rule string
+	}
+	var zero []zeroRange
+	if d.cmdline != elfcore.RedactNone || d.omitEnviron {
+		areas, err := proc.GetStringAreas(d.pid)
+		if err != nil {
+			return nil, err
+		}
+		if d.cmdline != elfcore.RedactNone {
+			zero = append(zero, zeroRange{copy.PageRange{Start: areas.ArgStart, End: areas.ArgEnd}, "cmdline"})
+		}
+		if d.omitEnviron {
+			zero = append(zero, zeroRange{copy.PageRange{Start: areas.EnvStart, End: areas.EnvEnd}, "environ"})
+		}
+	}
+	for _, r := range d.redactRanges {
+		zero = append(zero, zeroRange{copy.PageRange{Start: r.Start, End: r.End}, "range"})
+	}
+
+	var redacted []elfcore.RedactedRange
+	index := vmaindex.New(len(vmas), func(i int) (uintptr, uintptr) {
+		return vmas[i].Start, vmas[i].End
+	})
+	for _, r := range zero {
+		for _, i := range index.Overlapping(r.Start, r.End) {
+			vma := vmas[i]
+			tmpOffset, ok := bufferManager.GetExistingOffsetForVMA(uint64(vma.Start), vma.MemSize)
+			if vma.IsZero || !ok {
+				continue
+			}
+			start, end := max(r.Start, vma.Start), min(r.End, vma.End)
+			if err := bufferManager.Zero(tmpOffset+buffer.TmpOffset(start-vma.Start), uint64(end-start)); err != nil {
+				return nil, err
+			}
+			redacted = append(redacted, elfcore.RedactedRange{Start: start, End: end, Rule: r.rule})
+		}
+	}
+
+	if len(d.redactPatterns) > 0 {
+		for _, vma := range vmas {
+			masked, err := d.maskPatterns(vma, bufferManager)
+			if err != nil {
+				return nil, err
+			}
+			redacted = append(redacted, masked...)
+		}
+	}
+	slices.SortStableFunc(redacted, func(a, b elfcore.RedactedRange) int { return cmp.Compare(a.Start, b.Start) })
+	if d.verbose && len(redacted) > 0 {
+		d.logf("Redacted %d ranges", len(redacted))
+	}
+	return redacted, nil
+}
+
+// maskPatterns overwrites the matches of WithRedactPatterns' patterns in
+// the buffered memory of vma with redactMask, returning where they were.
+// Only the pages that were copied are searched; the rest are holes.
+func (d *Dumper) maskPatterns(vma proc.VMA, bufferManager *buffer.Manager) ([]elfcore.RedactedRange, error) {
+	tmpOffset, ok := bufferManager.GetExistingOffsetForVMA(uint64(vma.Start), vma.MemSize)
+	if vma.IsZero || !ok {
+		return nil, nil
+	}
+	extents, err := bufferManager.DataExtents(tmpOffset, vma.MemSize)
+	if err != nil {
+		return nil, err
+	}
+	var masked []elfcore.RedactedRange
+	buf := make([]byte, redactScanChunk+redactOverlap)
+	for _, e := range extents {
+		for off := e.Offset; off < e.Offset+e.Length; off += redactScanChunk {
+			// The chunk and the overlap are whole pages, as extents are,
+			// so they can be written back to a compressed buffer.
+			b := buf[:min(redactScanChunk+redactOverlap, e.Offset+e.Length-off)]
+			chunkEnd := min(redactScanChunk, len(b))
+			at := tmpOffset + buffer.TmpOffset(off)
+			if err := bufferManager.WriteDataTo(sliceWriter(b), 0, at, uint64(len(b))); err != nil {
+				return nil, err
+			}
+			changed := false
+			for _, re := range d.redactPatterns {
+				for _, m := range re.FindAllIndex(b, -1) {
+					if m[0] >= chunkEnd {
+						break // the next chunk finds it
+					}
+					for i := m[0]; i < m[1]; i++ {
+						b[i] = redactMask
+					}
+					changed = true
+					addr := vma.Start + uintptr(off)
+					masked = append(masked, elfcore.RedactedRange{
+						Start: addr + uintptr(m[0]),
+						End:   addr + uintptr(m[1]),
+						Rule:  "pattern " + re.String(),
+					})
+				}
+			}
+			if changed {
+				if err := bufferManager.WriteData(at, b); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return masked, nil
+}
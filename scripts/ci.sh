@@ -61,7 +61,7 @@ fi
 
 # Build
 echo "Building livecore..."
-go build -o livecore .
+go build -o livecore ./cmd/livecore
 
 # Check if binary was created
 if [ ! -f "livecore" ]; then
@@ -230,6 +230,10 @@ else
     exit 1
 fi
 
+# Check that debuggers can read livecore's cores
+echo "Testing cores with gdb..."
+./test/gdb_test.sh
+
 # Clean up
 echo "Cleaning up test processes..."
 kill $SERVER_PID 2>/dev/null || true
@@ -0,0 +1,180 @@
+package livecore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/livecore/internal/buffer"
+	"github.com/bradfitz/livecore/proc"
+	"golang.org/x/sys/unix"
+)
+
+// minFreeSpace is how much space to leave free on the output filesystem.
+// Copying stops with an error rather than eat into it.
+const minFreeSpace = 64 << 20
+
+// defaultMemoryMax is the most page data BufferAuto buffers in memory,
+// unless WithBuffer says otherwise.
+const defaultMemoryMax = 4 << 30
+
+// estimateDumpSize estimates how many bytes of page data dumping vmas
+// copies, and the largest amount from any single VMA. It's an estimate:
+// the target keeps running and faulting pages in while we work.
+func (d *Dumper) estimateDumpSize(vmas []proc.VMA) (total, largest uint64) {
+	// Without smaps, assume every page gets copied.
+	smaps, _ := proc.ParseSMaps(d.pid)
+	for _, vma := range vmas {
+		if vma.IsZero {
+			continue
+		}
+		size := uint64(vma.End - vma.Start)
+		if info, ok := smaps[vma.Start]; ok {
+			switch {
+			case d.residentOnly:
+				size = info.RSS * 1024
+			case vma.Inode == 0:
+				// Only faulted-in anonymous pages are copied.
+				size = (info.RSS + info.Swap) * 1024
+			}
+		}
+		size = uint64(float64(size) * d.sample / 100)
+		total += size
+		largest = max(largest, size)
+	}
+	return total, largest
+}
+
+// checkWindow checks that vmas fit in the scratch buffer's window, which
+// holds each VMA whole, holes and all.
+func (d *Dumper) checkWindow(vmas []proc.VMA) error {
+	window := uint64(d.bufferWindow)
+	if window == 0 {
+		window = buffer.DefaultWindow
+	}
+	var need uint64
+	for _, vma := range vmas {
+		need += uint64(vma.End-vma.Start) + 64<<10 // and block alignment
+	}
+	if need > window {
+		return fmt.Errorf("the mappings to dump span %d MB, more than the %d MB scratch buffer window; make it bigger", need>>20, window>>20)
+	}
+	return nil
+}
+
+// checkFreeSpace checks that dir, where the scratch buffer goes, has room
+// for the dump. By default the scratch buffer lives next to the output,
+// and the writer frees each VMA's scratch space after writing it out, so
+// at peak it needs room for the page data plus one more copy of the
+// largest VMA. coreToo says whether the core is written there too, rather
+// than streamed, and direct whether the core is the scratch buffer.
+func (d *Dumper) checkFreeSpace(dir string, vmas []proc.VMA, coreToo, direct bool) error {
+	total, largest := d.estimateDumpSize(vmas)
+	need := total + largest + minFreeSpace
+	switch {
+	case direct:
+		need = total + minFreeSpace
+	case !coreToo:
+		// The core is streamed elsewhere; only the scratch buffer is here.
+		need = total + minFreeSpace
+	case d.compressBuffer:
+		// The compressed scratch space isn't freed until the end; guess
+		// that pages compress 2:1.
+		need = total + total/2 + minFreeSpace
+	case d.verify != VerifyOff:
+		// Nor is the scratch space kept to verify the core against.
+		need = 2*total + minFreeSpace
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("failed to statfs %s: %w", dir, err)
+	}
+	avail := st.Bavail * uint64(st.Bsize)
+
+	if d.verbose {
+		d.logf("Estimated %d MB of page data; need about %d MB free in %s, have %d MB", total>>20, need>>20, dir, avail>>20)
+	}
+	if avail < need {
+		return fmt.Errorf("not enough space in %s: need about %d MB, have %d MB (skip the space check to try anyway)", dir, need>>20, avail>>20)
+	}
+	return nil
+}
+
+// bufferInMemory reports whether the scratch buffer of a dump that has one
+// goes in memory, as WithBuffer says. For BufferAuto, that's if the page
+// data is estimated at most d.memoryMax bytes and half the memory
+// available, before the VMAs to copy are found.
+func (d *Dumper) bufferInMemory() bool {
+	switch d.bufferMode {
+	case BufferMemory:
+		return true
+	case BufferDisk:
+		return false
+	}
+	if d.journal != "" {
+		return false
+	}
+	total, err := d.EstimateSize()
+	if err != nil {
+		return false
+	}
+	avail, err := memAvailable()
+	if err != nil {
+		return false
+	}
+	limit := uint64(d.memoryMax)
+	if limit == 0 {
+		limit = defaultMemoryMax
+	}
+	return total <= limit && total <= avail/2
+}
+
+// checkFreeMemory is checkFreeSpace for a scratch buffer in memory, which
+// the memory the system has available must hold.
+func (d *Dumper) checkFreeMemory(vmas []proc.VMA) error {
+	total, _ := d.estimateDumpSize(vmas)
+	need := total + minFreeSpace
+	if d.compressBuffer {
+		need = total/2 + minFreeSpace
+	}
+	avail, err := memAvailable()
+	if err != nil {
+		return err
+	}
+	if d.verbose {
+		d.logf("Estimated %d MB of page data; need about %d MB of memory, have %d MB available", total>>20, need>>20, avail>>20)
+	}
+	if avail < need {
+		return fmt.Errorf("not enough memory for the scratch buffer: need about %d MB, have %d MB available (buffer on disk, or skip the space check to try anyway)", need>>20, avail>>20)
+	}
+	return nil
+}
+
+// memAvailable returns how much memory the system has available for new
+// allocations without swapping, as MemAvailable in /proc/meminfo.
+func memAvailable() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		rest, ok := strings.CutPrefix(sc.Text(), "MemAvailable:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(rest), " kB"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse MemAvailable: %w", err)
+		}
+		return kb << 10, nil
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemAvailable in /proc/meminfo")
+}
@@ -0,0 +1,147 @@
+package livecore
+
+import (
+	"slices"
+	"time"
+)
+
+// Stats describes a dump, as it runs and once it's done; see
+// Dumper.Stats.
+type Stats struct {
+	// Phase is the phase running, as named in PhaseError, or "done"
+	// once the dump has succeeded. After a failure, it's the phase that
+	// failed.
+	Phase  string
+	Failed bool
+
+	// Phases lists how long each phase took, in order, including the
+	// one running so far.
+	Phases []PhaseTime
+
+	// PreCopyPasses describes each pre-copy pass.
+	PreCopyPasses []PassStats
+
+	// PreCopyStopReason says why pre-copy stopped when it did: "threshold"
+	// (the dirty ratio fell below WithDirtyThreshold's), "converged" (a
+	// pass didn't shrink the dirty set by at least a tenth), "time budget"
+	// (another pass would have run past WithMaxPreCopyTime's), or "max
+	// passes". It's empty until pre-copy is done, or if there was none.
+	PreCopyStopReason string
+
+	Threads          int
+	UnstoppedThreads int           // threads that didn't stop in time
+	FreezeTime       time.Duration // to seize and stop the threads
+	StopTime         time.Duration // from starting the freeze to resuming the target
+
+	// FinalDirtyPages is how many pages were dirty when the target was
+	// frozen, and had to be copied while it was stopped.
+	FinalDirtyPages int
+
+	// BytesCopied is how much memory pre-copy and the final copy read.
+	BytesCopied uint64
+
+	// SwappedInBytes is how much swapped-out, dirty memory was faulted
+	// in before the freeze, so the final copy didn't wait on swap.
+	SwappedInBytes uint64
+
+	// ChangedBytes is, for an incremental dump, how much memory the core
+	// holds: what changed since the base, plus anonymous pages that
+	// aren't present, which are holes.
+	ChangedBytes uint64
+
+	// ReadFailures and ReadFailureBytes count the ranges the final copy
+	// couldn't read (with process_vm_readv), and their total size.
+	ReadFailures     int
+	ReadFailureBytes uint64
+
+	// UncopiedBytes is how much dirty memory WithMaxStopTime's budget ran
+	// out before copying while the target was stopped.
+	UncopiedBytes uint64
+
+	// ScratchBytes is how much disk space the scratch buffer took up
+	// once everything was copied, before writing the core freed it.
+	ScratchBytes uint64
+
+	// ScratchDir is the directory the scratch buffer was in; see
+	// WithTempDir. It's empty if ScratchInMemory.
+	ScratchDir string
+
+	// ScratchInMemory is set if the scratch buffer was in memory; see
+	// WithBuffer.
+	ScratchInMemory bool
+}
+
+// PhaseTime is how long a dump phase took.
+type PhaseTime struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// PassStats describes one pre-copy pass.
+type PassStats struct {
+	Duration    time.Duration
+	DirtyRatio  float64 // fraction of pages dirtied during the pass
+	DirtyPages  int     // pages dirtied during the pass
+	DirtyRate   float64 // DirtyPages a second
+	BytesCopied uint64
+	// ZeroPageBytes is how much memory mapped the shared zero page, and
+	// was left as holes rather than copied.
+	ZeroPageBytes uint64
+}
+
+// Stats returns statistics about the dump d is running, or last ran. It
+// may be called while Dump runs, such as to serve metrics.
+func (d *Dumper) Stats() Stats {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	s := d.stats
+	s.Phases = slices.Clone(s.Phases)
+	s.PreCopyPasses = slices.Clone(s.PreCopyPasses)
+	if n := len(s.Phases); n > 0 && s.Phase != "done" && !s.Failed {
+		s.Phases[n-1].Duration = time.Since(d.phaseStart)
+	}
+	return s
+}
+
+// updateStats calls f to update d's statistics.
+func (d *Dumper) updateStats(f func(*Stats)) {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	f(&d.stats)
+}
+
+// enterPhase records the end of the current phase and the start of the
+// next one, and reports it to WithProgress's function.
+func (d *Dumper) enterPhase(phase string) {
+	d.statsMu.Lock()
+	d.endPhaseLocked()
+	d.stats.Phase = phase
+	if phase != "done" {
+		d.stats.Phases = append(d.stats.Phases, PhaseTime{Phase: phase})
+	}
+	d.phaseStart = time.Now()
+	d.statsMu.Unlock()
+	d.startProgress(phase, 0, 0)
+}
+
+// endPhaseLocked records how long the current phase took.
+func (d *Dumper) endPhaseLocked() {
+	if n := len(d.stats.Phases); n > 0 {
+		d.stats.Phases[n-1].Duration = time.Since(d.phaseStart)
+	}
+}
+
+// phase returns the phase the dump is in.
+func (d *Dumper) phase() string {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	return d.stats.Phase
+}
+
+// failed records that the dump failed in its current phase.
+func (d *Dumper) failed() {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	d.endPhaseLocked()
+	d.stats.Failed = true
+}
@@ -0,0 +1,118 @@
+#!/bin/bash
+
+# Checks that debuggers can use livecore's cores: dumps test/testprog with
+# several sets of flags, then has gdb list the threads, backtrace each, and
+# read the program's code and a string it put on the heap, and has delve,
+# if it's installed, list the goroutines. Run it from the project root;
+# it needs gdb, and ptrace permission (see scripts/enable-ptrace.sh).
+
+set -e
+
+if ! command -v gdb >/dev/null 2>&1; then
+    echo "gdb not found; skipping gdb round-trip tests"
+    exit 0
+fi
+
+WORK=$(mktemp -d)
+TEST_PID=
+cleanup() {
+    [ -n "$TEST_PID" ] && kill $TEST_PID 2>/dev/null || true
+    rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+echo "Building livecore and test program..."
+go build -o "$WORK/livecore" ./cmd/livecore
+go build -o "$WORK/testprog" ./test/testprog.go
+
+"$WORK/testprog" >"$WORK/testprog.out" &
+TEST_PID=$!
+for i in {1..50}; do
+    grep -q "^Marker:" "$WORK/testprog.out" 2>/dev/null && break
+    sleep 0.1
+done
+MARKER="livecore-testprog-$TEST_PID"
+sleep 1 # let the goroutines start
+
+FAILED=0
+fail() {
+    echo "❌ $1"
+    FAILED=1
+}
+
+# gdb_core runs gdb in batch mode on core $1 with the remaining arguments.
+gdb_core() {
+    local core=$1
+    shift
+    gdb --batch -nx -q "$@" "$WORK/testprog" "$core" 2>&1
+}
+
+# The code gdb reads from the executable alone, to compare with the core's.
+WANT_CODE=$(gdb --batch -nx -q -ex "x/32xb 'main.main'" "$WORK/testprog" 2>&1 | grep '^0x' || true)
+
+check_core() {
+    local name=$1
+    shift
+    local core="$WORK/$name.core"
+    echo "Testing $name core ($*)..."
+    if ! "$WORK/livecore" "$@" $TEST_PID "$core" >"$WORK/$name.log" 2>&1; then
+        cat "$WORK/$name.log"
+        fail "$name: livecore failed"
+        return
+    fi
+    if ! "$WORK/livecore" verify "$core"; then
+        fail "$name: livecore verify failed"
+    fi
+
+    # Threads: gdb should find every thread the core has notes for.
+    local want got
+    want=$("$WORK/livecore" info -vmas=false "$core" | sed -n 's/^Threads: *\([0-9]*\):.*/\1/p')
+    got=$(gdb_core "$core" -ex "info threads" | grep -cE '^\*? +[0-9]+ +(Thread|LWP) ' || true)
+    if [ "$got" != "$want" ]; then
+        fail "$name: gdb lists $got threads; want $want"
+    fi
+
+    # Backtraces: every thread is somewhere in the Go runtime, and gdb
+    # shouldn't trip over memory missing from the core.
+    local bt
+    bt=$(gdb_core "$core" -ex "thread apply all bt" || true)
+    if echo "$bt" | grep -q "Cannot access memory"; then
+        echo "$bt"
+        fail "$name: gdb couldn't read memory for backtraces"
+    fi
+    if [ "$(echo "$bt" | grep -c '^#1 .* runtime\.')" -lt "$want" ]; then
+        echo "$bt"
+        fail "$name: a thread's backtrace doesn't reach the Go runtime"
+    fi
+
+    # Memory: the code should match the executable's, and the heap should
+    # hold the marker string.
+    local code
+    code=$(gdb_core "$core" -ex "x/32xb 'main.main'" | grep '^0x' || true)
+    if [ -z "$code" ] || [ "$code" != "$WANT_CODE" ]; then
+        fail "$name: main.main's code in the core doesn't match the executable's"
+    fi
+    if ! gdb_core "$core" -ex "set language c" -ex "x/s *(char **)&'main.marker'" | grep -q "$MARKER"; then
+        fail "$name: gdb can't read main.marker from the core's heap"
+    fi
+
+    # Goroutines: delve should find main's four workers.
+    if command -v dlv >/dev/null 2>&1; then
+        printf 'goroutines\nexit\n' >"$WORK/dlv.init"
+        local workers
+        workers=$(dlv core "$WORK/testprog" "$core" --init "$WORK/dlv.init" </dev/null 2>&1 | grep -c 'main\.main\.func1' || true)
+        if [ "$workers" -lt 4 ]; then
+            fail "$name: delve finds $workers worker goroutines; want 4"
+        fi
+    fi
+}
+
+check_core basic
+check_core precopy -passes 2 -dirty-thresh 10
+check_core minimal -notes minimal
+
+if [ $FAILED -ne 0 ]; then
+    echo "❌ gdb round-trip tests failed"
+    exit 1
+fi
+echo "✅ gdb round-trip tests passed"
@@ -7,8 +7,14 @@ import (
 	"time"
 )
 
+// marker is a string on the heap that gdb_test.sh reads back from cores
+// of this program.
+var marker string
+
 func main() {
 	fmt.Printf("Test program PID: %d\n", os.Getpid())
+	marker = fmt.Sprintf("livecore-testprog-%d", os.Getpid())
+	fmt.Printf("Marker: %s\n", marker)
 
 	// Allocate some memory
 	mem := make([]byte, 1024*1024) // 1MB
@@ -0,0 +1,113 @@
+package livecore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bradfitz/livecore/elfcore"
+)
+
+const (
+	// verifyChunk is how much memory verifyWrite compares at a time.
+	verifyChunk = 1 << 20
+
+	// verifySampleEvery is how many pages apart the pages are that
+	// "-verify-write sample" compares.
+	verifySampleEvery = 64
+)
+
+// verifyWrite reads the core just written into out back and checks it
+// against what went into it: that it parses as a core, has the notes in
+// info and a segment for each VMA, isn't truncated, and holds the same
+// memory as mem, the scratch buffer it was written from (over the base,
+// for a reflinked dump). With VerifySample, only the first and last pages
+// of each segment and every verifySampleEvery'th page between are
+// compared.
+//
+// mem must not have released its pages; see bufferMemory.keep.
+func (d *Dumper) verifyWrite(out *os.File, info *elfcore.CoreInfo, mem elfcore.MemorySource) error {
+	start := time.Now()
+	cr, err := elfcore.NewCoreReader(out)
+	if err != nil {
+		return err
+	}
+
+	got := cr.Info().Notes
+	if len(got) != len(info.Notes) {
+		return fmt.Errorf("core has %d notes, want %d", len(got), len(info.Notes))
+	}
+	for i, n := range info.Notes {
+		if got[i].Name != n.Name || got[i].Type != n.Type || !bytes.Equal(got[i].Data, n.Data) {
+			return fmt.Errorf("note %d (%s %s) doesn't match what was written", i, n.Name, n.TypeName())
+		}
+	}
+
+	fi, err := out.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat core file: %w", err)
+	}
+	vmas := make(map[uintptr]elfcore.VMA)
+	for _, vma := range info.VMAs {
+		vmas[vma.Start] = vma
+	}
+	segs := cr.Segments()
+	for _, seg := range segs {
+		vma, ok := vmas[seg.Start]
+		if !ok || vma.End != seg.End {
+			return fmt.Errorf("segment %x-%x doesn't match a VMA", seg.Start, seg.End)
+		}
+		if end := seg.FileOffset + seg.FileSize; end > uint64(fi.Size()) {
+			return fmt.Errorf("core file is truncated: segment %x-%x ends at offset %d, file is %d bytes", seg.Start, seg.End, end, fi.Size())
+		}
+	}
+
+	pageSize := uint64(os.Getpagesize())
+	want, have := make([]byte, verifyChunk), make([]byte, verifyChunk)
+	var checked uint64
+	check := func(vma elfcore.VMA, addr uintptr, n uint64) error {
+		if vma.IsZero {
+			// Written as a hole, without reading the buffer.
+			clear(want[:n])
+		} else if _, err := mem.ReadAt(want[:n], addr); err != nil {
+			return fmt.Errorf("failed to read scratch buffer at %x: %w", addr, err)
+		}
+		if _, err := cr.ReadAt(have[:n], addr); err != nil {
+			return fmt.Errorf("failed to read core file at %x: %w", addr, err)
+		}
+		if !bytes.Equal(want[:n], have[:n]) {
+			return fmt.Errorf("core file memory at %x-%x doesn't match what was written", addr, addr+uintptr(n))
+		}
+		checked += n
+		return nil
+	}
+	for _, seg := range segs {
+		vma := vmas[seg.Start]
+		size := uint64(seg.End - seg.Start)
+		if d.verify == VerifySample {
+			for off := uint64(0); off < size; off += verifySampleEvery * pageSize {
+				if err := check(vma, seg.Start+uintptr(off), pageSize); err != nil {
+					return err
+				}
+			}
+			if size > pageSize {
+				if err := check(vma, seg.End-uintptr(pageSize), pageSize); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for off := uint64(0); off < size; off += verifyChunk {
+			if err := check(vma, seg.Start+uintptr(off), min(verifyChunk, size-off)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if d.verbose {
+		d.logf("Verified core file: %d notes, %d segments, %d MB of memory compared (took %v)",
+			len(got), len(segs), checked>>20, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
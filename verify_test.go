@@ -0,0 +1,63 @@
+package livecore
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bradfitz/livecore/elfcore"
+)
+
+// patternMemory is an elfcore.MemorySource whose bytes are derived from
+// their addresses.
+type patternMemory struct{}
+
+func (patternMemory) ReadAt(p []byte, addr uintptr) (int, error) {
+	for i := range p {
+		a := addr + uintptr(i)
+		p[i] = byte(a>>12) ^ byte(a) ^ 0x5a
+	}
+	return len(p), nil
+}
+
+func TestVerifyWriteOddNotes(t *testing.T) {
+	page := uint64(os.Getpagesize())
+	info := &elfcore.CoreInfo{
+		Pid:   1234,
+		Class: elf.ELFCLASS64,
+		VMAs: []elfcore.VMA{
+			{Start: 0x1000_0000, End: 0x1000_0000 + uintptr(4*page), Perms: elfcore.PermRead, MemSize: 4 * page, Path: "/x", Inode: 1},
+		},
+		Threads: []elfcore.Thread{{Tid: 1234, Name: "test"}},
+		PSInfo:  &elfcore.PSInfo{State: 'S', Pid: 1234, PPid: 1, Fname: "test", Args: []byte("test")},
+		Auxv:    make([]byte, 32),
+		// NT_FILE's length is that of the paths, which here isn't a
+		// multiple of 4.
+		FileTable: []elfcore.FileEntry{{Start: 0x1000_0000, End: 0x1000_0000 + uintptr(4*page), Inode: 1, Path: "/x"}},
+	}
+	notes, err := elfcore.CreateCoreNotes(info, elfcore.NoteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Notes = append(notes, elfcore.Note{Name: "TEST", Type: 0x7e57, Data: []byte("odd")})
+
+	for _, mode := range []VerifyMode{VerifySample, VerifyAll} {
+		f, err := os.Create(filepath.Join(t.TempDir(), "core"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		w, err := elfcore.NewFileWriter(f, info, patternMemory{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteCore(); err != nil {
+			t.Fatal(err)
+		}
+		d := New(1234, WithVerifyWrite(mode))
+		if err := d.verifyWrite(f, info, patternMemory{}); err != nil {
+			t.Errorf("verifyWrite(%v): %v", mode, err)
+		}
+	}
+}